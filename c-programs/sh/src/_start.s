@@ -0,0 +1,13 @@
+.section .text
+.globl _start
+.type _strt, @function
+
+# The system leaves argc at sp, followed by argv and envp, both ending in NULL.
+_start:
+	lw    a0, 0(sp)   # argc
+	addi  a1, sp, 4   # argv
+	slli  t0, a0, 2
+	add   a2, a1, t0
+	addi  a2, a2, 4   # envp starts after the NULL that ends argv
+	call  main
+	call  sys_exit
@@ -0,0 +1,400 @@
+// A small shell.
+//
+// Each line is a command and its arguments separated by spaces, optionally
+// followed by redirections and a `&`:
+//
+//   fib
+//   echo hello > out.txt
+//   count < in.txt >> log.txt &
+//
+// A command without a `/` is looked up in the directories listed in PATH,
+// first as `dir/command/main.text`, which is where the programs in c-programs
+// end up, and then as `dir/command`.
+//
+// The built-in commands are `cd [dir]` and `exit [status]`.
+
+#include "sys.h"
+
+#define MAX_LINE 256
+#define MAX_ARGS 32
+#define MAX_PATH 256
+
+struct command {
+    char *argv[MAX_ARGS + 1];
+    char *in;       // file to read standard input from, or 0
+    char *out;      // file to write standard output to, or 0
+    int append;     // append to `out` instead of truncating it
+    int background; // don't wait for the command to finish
+};
+
+static char **environ;
+
+static int length(const char *s) {
+    int n = 0;
+    while (s[n]) {
+        n++;
+    }
+    return n;
+}
+
+static int equal(const char *a, const char *b) {
+    while (*a && *a == *b) {
+        a++;
+        b++;
+    }
+    return *a == *b;
+}
+
+static void print(int fd, const char *s) { write(fd, s, length(s)); }
+
+static void print_int(int fd, int n) {
+    char buf[12];
+    int i = sizeof(buf);
+    unsigned int u = n < 0 ? -n : n;
+
+    buf[--i] = 0;
+    do {
+        buf[--i] = '0' + u % 10;
+        u /= 10;
+    } while (u);
+    if (n < 0) {
+        buf[--i] = '-';
+    }
+
+    print(fd, &buf[i]);
+}
+
+static int parse_int(const char *s) {
+    int n = 0;
+    while (*s >= '0' && *s <= '9') {
+        n = n * 10 + (*s++ - '0');
+    }
+    return n;
+}
+
+static const char *error_string(int err) {
+    switch (-err) {
+    case ENOENT:
+        return "no such file or directory";
+    case E2BIG:
+        return "argument list too long";
+    case ENOEXEC:
+        return "exec format error";
+    case ENOMEM:
+        return "out of memory";
+    case EACCES:
+        return "permission denied";
+    case ENOTDIR:
+        return "not a directory";
+    case EISDIR:
+        return "is a directory";
+    }
+    return "error";
+}
+
+static void error(const char *what, int err) {
+    print(2, "sh: ");
+    print(2, what);
+    print(2, ": ");
+    print(2, error_string(err));
+    print(2, "\n");
+}
+
+static char *getenv(const char *name) {
+    int n = length(name);
+    for (char **env = environ; *env; env++) {
+        char *e = *env;
+        int i = 0;
+        while (i < n && e[i] == name[i]) {
+            i++;
+        }
+        if (i == n && e[i] == '=') {
+            return &e[i + 1];
+        }
+    }
+    return 0;
+}
+
+// read_line reads a line from standard input without the newline.
+// Returns -1 at the end of the input.
+static int read_line(char *line, int max) {
+    int n = 0;
+    char c;
+
+    for (;;) {
+        if (read(0, &c, 1) <= 0) {
+            if (n == 0) {
+                return -1;
+            }
+            break;
+        }
+        if (c == '\n') {
+            break;
+        }
+        if (n < max - 1) {
+            line[n++] = c;
+        }
+    }
+
+    line[n] = 0;
+    return n;
+}
+
+// next_token cuts the next word off the front of `*s`.
+static char *next_token(char **s) {
+    char *p = *s;
+    while (*p == ' ' || *p == '\t') {
+        p++;
+    }
+    if (*p == 0) {
+        *s = p;
+        return 0;
+    }
+
+    char *token = p;
+    while (*p && *p != ' ' && *p != '\t') {
+        p++;
+    }
+    if (*p) {
+        *p++ = 0;
+    }
+
+    *s = p;
+    return token;
+}
+
+// parse splits `line` into `cmd` and returns the number of arguments, or -1 if
+// the line makes no sense.
+static int parse(char *line, struct command *cmd) {
+    int argc = 0;
+    char *token;
+
+    cmd->in = 0;
+    cmd->out = 0;
+    cmd->append = 0;
+    cmd->background = 0;
+
+    while ((token = next_token(&line))) {
+        if (cmd->background) {
+            return -1; // `&` has to come last
+        }
+
+        if (equal(token, "&")) {
+            cmd->background = 1;
+            continue;
+        }
+
+        if (token[0] == '<' || token[0] == '>') {
+            char **file = token[0] == '<' ? &cmd->in : &cmd->out;
+            if (token[0] == '>') {
+                cmd->append = token[1] == '>';
+                token += cmd->append;
+            }
+            token++;
+
+            // both `> file` and `>file` work
+            if (*token == 0) {
+                token = next_token(&line);
+            }
+            if (!token) {
+                return -1;
+            }
+            *file = token;
+            continue;
+        }
+
+        if (argc == MAX_ARGS) {
+            return -1;
+        }
+        cmd->argv[argc++] = token;
+    }
+
+    cmd->argv[argc] = 0;
+    return argc;
+}
+
+// join places `dir`, `/`, `name` and `suffix` in `path`.
+static int join(char *path, const char *dir, int n, const char *name, const char *suffix) {
+    int len = 0;
+    if (n + length(name) + length(suffix) + 2 > MAX_PATH) {
+        return 0;
+    }
+
+    for (int i = 0; i < n; i++) {
+        path[len++] = dir[i];
+    }
+    path[len++] = '/';
+    for (const char *p = name; *p; p++) {
+        path[len++] = *p;
+    }
+    for (const char *p = suffix; *p; p++) {
+        path[len++] = *p;
+    }
+    path[len] = 0;
+    return 1;
+}
+
+// run spawns the program `cmd` names and returns its pid, or a negative error
+// number.
+static int run(struct command *cmd) {
+    char *name = cmd->argv[0];
+    for (char *p = name; *p; p++) {
+        if (*p == '/') {
+            return spawn(name, cmd->argv, environ);
+        }
+    }
+
+    char *dirs = getenv("PATH");
+    if (!dirs) {
+        return spawn(name, cmd->argv, environ);
+    }
+
+    int err = -ENOENT;
+    while (*dirs) {
+        int n = 0;
+        while (dirs[n] && dirs[n] != ':') {
+            n++;
+        }
+
+        char path[MAX_PATH];
+        const char *suffixes[] = {"/main.text", ""};
+        for (int i = 0; i < 2; i++) {
+            if (!join(path, dirs, n, name, suffixes[i])) {
+                continue;
+            }
+            int pid = spawn(path, cmd->argv, environ);
+            if (pid >= 0) {
+                return pid;
+            }
+            if (err == -ENOENT) {
+                err = pid;
+            }
+        }
+
+        dirs += n;
+        if (*dirs == ':') {
+            dirs++;
+        }
+    }
+
+    return err;
+}
+
+// redirect makes the file descriptor `fd` refer to `file`.
+static int redirect(int fd, const char *file, int flags) {
+    int f = open(file, flags, 0644);
+    if (f < 0) {
+        return f;
+    }
+    if (f != fd) {
+        dup2(f, fd);
+        close(f);
+    }
+    return 0;
+}
+
+// execute runs `cmd` with its redirections, and waits for it unless it runs in
+// the background.
+//   The shell redirects its own descriptors, which the child inherits, and
+// puts them back afterwards.
+static int execute(struct command *cmd) {
+    int saved_in = -1, saved_out = -1;
+    int pid = 0, status = 0;
+
+    if (cmd->in) {
+        saved_in = dup(0);
+        if ((pid = redirect(0, cmd->in, O_RDONLY)) < 0) {
+            error(cmd->in, pid);
+        }
+    }
+    if (pid >= 0 && cmd->out) {
+        saved_out = dup(1);
+        if ((pid = redirect(1, cmd->out, O_WRONLY | O_CREAT | (cmd->append ? O_APPEND : O_TRUNC))) < 0) {
+            error(cmd->out, pid);
+        }
+    }
+
+    if (pid >= 0) {
+        pid = run(cmd);
+        if (pid < 0) {
+            error(cmd->argv[0], pid);
+        }
+    }
+
+    if (saved_in >= 0) {
+        dup2(saved_in, 0);
+        close(saved_in);
+    }
+    if (saved_out >= 0) {
+        dup2(saved_out, 1);
+        close(saved_out);
+    }
+
+    if (pid < 0) {
+        return 127;
+    }
+
+    if (cmd->background) {
+        print(1, "[");
+        print_int(1, pid);
+        print(1, "]\n");
+        return 0;
+    }
+
+    wait(pid, &status, 0);
+    return status;
+}
+
+// reap collects background commands that have finished.
+static void reap(void) {
+    int pid, status;
+    while ((pid = wait(-1, &status, WNOHANG)) > 0) {
+        print(1, "[");
+        print_int(1, pid);
+        print(1, "] done, status ");
+        print_int(1, status);
+        print(1, "\n");
+    }
+}
+
+int main(int argc, char *argv[], char *envp[]) {
+    char line[MAX_LINE];
+    struct command cmd;
+    int status = 0;
+
+    environ = envp;
+
+    for (;;) {
+        reap();
+        print(1, "$ ");
+        if (read_line(line, sizeof(line)) < 0) {
+            print(1, "\n");
+            return status;
+        }
+
+        int n = parse(line, &cmd);
+        if (n < 0) {
+            print(2, "sh: syntax error\n");
+            continue;
+        }
+        if (n == 0) {
+            continue;
+        }
+
+        if (equal(cmd.argv[0], "exit")) {
+            return n > 1 ? parse_int(cmd.argv[1]) : status;
+        }
+
+        if (equal(cmd.argv[0], "cd")) {
+            char *dir = n > 1 ? cmd.argv[1] : getenv("HOME");
+            int err = chdir(dir ? dir : "/");
+            if (err < 0) {
+                error(dir ? dir : "/", err);
+            }
+            status = err < 0;
+            continue;
+        }
+
+        status = execute(&cmd);
+    }
+}
@@ -0,0 +1,29 @@
+#include "sys.h"
+
+#define SYS_OPEN  13
+#define SYS_CLOSE 14
+#define SYS_READ  15
+#define SYS_WRITE 16
+#define SYS_SPAWN 21
+#define SYS_WAIT  22
+#define SYS_CHDIR 23
+#define SYS_DUP   24
+#define SYS_DUP2  25
+
+int open(const char *path, int flags, int mode) { return syscall(SYS_OPEN, path, flags, mode); }
+
+int close(int fd) { return syscall(SYS_CLOSE, fd); }
+
+int read(int fd, void *buf, unsigned int n) { return syscall(SYS_READ, fd, buf, n); }
+
+int write(int fd, const void *buf, unsigned int n) { return syscall(SYS_WRITE, fd, buf, n); }
+
+int spawn(const char *path, char *const argv[], char *const envp[]) { return syscall(SYS_SPAWN, path, argv, envp); }
+
+int wait(int pid, int *status, int options) { return syscall(SYS_WAIT, pid, status, options); }
+
+int chdir(const char *path) { return syscall(SYS_CHDIR, path); }
+
+int dup(int fd) { return syscall(SYS_DUP, fd); }
+
+int dup2(int oldfd, int newfd) { return syscall(SYS_DUP2, oldfd, newfd); }
@@ -0,0 +1,40 @@
+#ifndef SYS_H
+#define SYS_H
+
+extern int syscall(int, ...);
+
+extern void _Noreturn sys_exit(int);
+
+// flags for open
+#define O_RDONLY 0x000
+#define O_WRONLY 0x001
+#define O_RDWR   0x002
+#define O_CREAT  0x040
+#define O_TRUNC  0x200
+#define O_APPEND 0x400
+
+// options for wait
+#define WNOHANG 1
+
+// error numbers, syscalls return them negated
+#define ENOENT  2
+#define E2BIG   7
+#define ENOEXEC 8
+#define ECHILD  10
+#define ENOMEM  12
+#define EACCES  13
+#define ENOTDIR 20
+#define EISDIR  21
+
+// system calls
+int open(const char *path, int flags, int mode);
+int close(int fd);
+int read(int fd, void *buf, unsigned int n);
+int write(int fd, const void *buf, unsigned int n);
+int spawn(const char *path, char *const argv[], char *const envp[]);
+int wait(int pid, int *status, int options);
+int chdir(const char *path);
+int dup(int fd);
+int dup2(int oldfd, int newfd);
+
+#endif
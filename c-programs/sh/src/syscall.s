@@ -0,0 +1,7 @@
+.section .text
+.globl syscall
+.type syscall, @function
+
+syscall:
+	ecall
+	ret
@@ -0,0 +1,232 @@
+// This file contains the block cache, which keeps instructions decoded so
+// that they don't have to be fetched and decoded every time they execute.
+//   Instructions are decoded a basic block at a time: from an address until
+// the first instruction that may jump, the end of the page, or
+// `blockMaxLength` instructions, whichever comes first. Instructions of the
+// SYSTEM and MISC-MEM opcodes end a block as well, since they may change how
+// the instructions after them are fetched.
+//   Blocks are kept by the physical address of their first instruction, so
+// they are shared between all address spaces that map the same code, and the
+// address of a block only has to be translated once for all of its
+// instructions.
+//   A block is stale once the code it was decoded from is written. Pages that
+// blocks are decoded from are marked as code in memory, and writing to one
+// moves the code generation of memory on; when a core sees that the
+// generation has moved, it drops all of its blocks. `FENCE_I` drops them as
+// well.
+//   Blocks are decoded from memory, not through the instruction cache, and
+// executing them doesn't touch it either; with the block cache, the
+// instruction cache only sees the fetches of instructions that no block could
+// be decoded for, so it no longer models how a real core would fetch. That is
+// why the block cache is off by default, and has to be asked for with
+// `Config.BlockCache`.
+
+package cpu
+
+import "encoding/binary"
+
+const (
+	blockCacheSize = 4096 // how many blocks a core keeps; must be a power of 2
+	blockMaxLength = 64   // how many instructions a block may hold
+	stepMaxLength  = 256  // how many instructions a step may go on to execute
+)
+
+// Opcodes that matter to blocks, besides those in rv32c.go.
+const (
+	opMiscMem uint32 = 0b0001111
+	opAmo     uint32 = 0b0101111
+)
+
+// blockOp is a decoded instruction of a block.
+type blockOp struct {
+	op    operation // the implementation of the instruction
+	inst  uint32    // the encoding to call `op` with, expanded if compressed
+	ilen  uint32    // the length of the instruction in bytes
+	store bool      // the instruction may write memory, and so code
+}
+
+// block is a basic block of decoded instructions.
+type block struct {
+	pAddr uint64 // physical address of the first instruction
+	ops   []blockOp
+	chain bool // the block may be followed by another without translating
+}
+
+// blockCache holds the blocks of a core, direct mapped by their physical
+// address.
+type blockCache struct {
+	blocks     []*block
+	generation uint32 // the code generation of memory the blocks are from
+}
+
+// newBlockCache returns a new, empty block cache.
+func newBlockCache() blockCache {
+	return blockCache{blocks: make([]*block, blockCacheSize)}
+}
+
+// find returns the block that starts at the physical address `pAddr`, or nil
+// if there is none.
+func (bc *blockCache) find(pAddr uint64) *block {
+	b := bc.blocks[(pAddr>>1)&(blockCacheSize-1)]
+	if b == nil || b.pAddr != pAddr {
+		return nil
+	}
+	return b
+}
+
+// insert keeps the block `b`, replacing the one in its slot.
+func (bc *blockCache) insert(b *block) {
+	bc.blocks[(b.pAddr>>1)&(blockCacheSize-1)] = b
+}
+
+// invalidateAll drops all blocks.
+func (bc *blockCache) invalidateAll() {
+	for i := range bc.blocks {
+		bc.blocks[i] = nil
+	}
+}
+
+// stepBlock executes the block at the program counter, decoding it first if
+// it isn't in the block cache, and goes on with the blocks that follow it in
+// the same page, until it has executed `max` instructions.
+//   Before each instruction but the first, the counters and interrupts are
+// checked, just like `Step` does, and stepBlock returns early if the core
+// traps. It returns early as well if an instruction may have written to
+// code, or the program counter leaves the page, since the next address must
+// then be translated again.
+//   Returns the number of instructions executed, counting one that trapped
+// or that the core trapped before, like `step` does.
+//   Returns 0, having done nothing, if there is no block to execute; the
+// instruction at the program counter must then be fetched as usual, which
+// raises the exception that prevented the block from being decoded.
+func (c *Core) stepBlock(max int) int {
+	if c.misalignedInstruction(c.pc) {
+		return 0
+	}
+
+	success, pAddr := c.translate(c.pc, accessTypeInstructionFetch)
+	if !success {
+		return 1 // the page fault has been taken
+	}
+
+	// the page stays mapped to the same frame until the core traps or
+	// executes a SYSTEM instruction, neither of which a chain of blocks
+	// goes past
+	vPage := c.pc &^ (pagesize - 1)
+	pPage := pAddr &^ (pagesize - 1)
+
+	m := c.system.Memory()
+	executed := 0
+	for {
+		if g := m.generation(); g != c.blocks.generation {
+			c.blocks.invalidateAll()
+			c.blocks.generation = g
+		}
+
+		b := c.blocks.find(pAddr)
+		if b == nil {
+			if b = c.decodeBlock(m, pAddr); b == nil {
+				return executed
+			}
+			c.blocks.insert(b)
+		}
+
+		for i := range b.ops {
+			if executed > 0 {
+				if executed >= max {
+					return executed
+				}
+				if c.tick() {
+					return executed + 1
+				}
+			}
+			executed++
+
+			op := &b.ops[i]
+			c.jumped = false
+			c.excepted = false
+			c.ilen = op.ilen
+
+			// see `execute`
+			c.reg[Reg_ZERO] = 0
+			c.csr[Csr_MTVAL] = 0
+			op.op(c, op.inst)
+
+			if c.excepted {
+				return executed
+			}
+			c.instret++
+			if c.jumped {
+				break
+			}
+			c.pc += op.ilen
+
+			if op.store && m.generation() != c.blocks.generation {
+				return executed
+			}
+		}
+
+		if !b.chain || executed >= max ||
+			c.pc&^(pagesize-1) != vPage || c.misalignedInstruction(c.pc) {
+			return executed
+		}
+		pAddr = pPage | uint64(c.pc&(pagesize-1))
+	}
+}
+
+// decodeBlock decodes the block that starts at the physical address `pAddr`,
+// and marks its page as code.
+//   Returns nil if no instruction can be decoded, as when `pAddr` is not in
+// RAM, or the first instruction crosses into the next page.
+func (c *Core) decodeBlock(m *Memory, pAddr uint64) *block {
+	if !m.isRAM(pAddr) {
+		return nil
+	}
+
+	var buf [blockMaxLength * 4]uint8
+	n := pagesize - pAddr%pagesize
+	if n > uint64(len(buf)) {
+		n = uint64(len(buf))
+	}
+
+	m.Lock()
+	m.markCode(pAddr)
+	m.read(pAddr, buf[:n])
+	m.Unlock()
+
+	b := &block{pAddr: pAddr, chain: true}
+	for offset := uint64(0); offset+2 <= n && len(b.ops) < blockMaxLength; {
+		inst := uint32(binary.LittleEndian.Uint16(buf[offset:]))
+		ilen := uint32(2)
+		if inst&0x3 == 0x3 {
+			if offset+4 > n {
+				break // the rest of the instruction is in the next page
+			}
+			inst = binary.LittleEndian.Uint32(buf[offset:])
+			ilen = 4
+		}
+
+		op, expanded := c.decode(inst)
+		opcode := expanded & 0x7f
+		b.ops = append(b.ops, blockOp{
+			op:    op,
+			inst:  expanded,
+			ilen:  ilen,
+			store: opcode == opStore || opcode == opStoreFP || opcode == opAmo,
+		})
+		offset += uint64(ilen)
+
+		if opcode == opSystem || opcode == opMiscMem {
+			b.chain = false
+			break
+		}
+		if opcode == opBranch || opcode == opJal || opcode == opJalr {
+			break
+		}
+	}
+
+	if len(b.ops) == 0 {
+		return nil
+	}
+	return b
+}
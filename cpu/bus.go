@@ -0,0 +1,147 @@
+// This file contains the memory-mapped I/O bus.
+//   Devices are mapped at ranges of the MMIO regions of the physical address
+// space.
+// Loads and stores to such a range are never cached; they go straight to the
+// device, which decides what reading and writing its registers means.
+//   Physical addresses that are neither RAM nor a device, including all of
+// the holes of the memory map, cause access faults.
+
+package cpu
+
+import (
+	"errors"
+	"sync"
+)
+
+// Device is a memory-mapped device.
+//   Offsets are relative to the start of the range the device is mapped at,
+// and `width` is 1, 2, 4, or 8 bytes.
+//   Accesses may come from several cores at once, so a device has to do its
+// own locking.
+type Device interface {
+	// Read returns `true, v` with the value of the `width` bytes at `offset`
+	// right-aligned in `v`, or `false, 0` if that can't be read, which causes
+	// an access fault.
+	Read(offset, width uint32) (bool, uint64)
+	// Write writes the `width` lowest bytes of `v` at `offset`, or returns
+	// `false` if that can't be written, which causes an access fault.
+	Write(offset, width uint32, v uint64) bool
+}
+
+// ErrBadMapping is returned when a device is mapped outside the MMIO regions,
+// or where it overlaps another device.
+var ErrBadMapping = errors.New("device range is outside MMIO or overlaps another device")
+
+// mapping is a device mapped at a range of physical addresses.
+type mapping struct {
+	base uint64
+	size uint64
+	dev  Device
+}
+
+// bus keeps track of the devices mapped into the physical address space.
+type bus struct {
+	sync.RWMutex
+	mappings []mapping
+}
+
+// Map maps `dev` at the `size` bytes starting at the physical address `base`.
+//   The range must lie in an MMIO region and must not overlap any other
+// device.
+func (m *Memory) Map(base uint64, size uint32, dev Device) error {
+	if size == 0 || !m.inMMIO(base, uint64(size)) {
+		return ErrBadMapping
+	}
+
+	m.bus.Lock()
+	defer m.bus.Unlock()
+	for _, mp := range m.bus.mappings {
+		if base <= mp.base+mp.size-1 && mp.base <= base+uint64(size)-1 {
+			return ErrBadMapping
+		}
+	}
+	m.bus.mappings = append(m.bus.mappings, mapping{base: base, size: uint64(size), dev: dev})
+	return nil
+}
+
+// inMMIO returns whether all of the `n` bytes from `pAddr` are in a single
+// MMIO region.
+func (m *Memory) inMMIO(pAddr, n uint64) bool {
+	for _, r := range m.regions {
+		if r.Kind == RegionMMIO && pAddr >= r.Base && pAddr+n <= r.Base+r.Size && pAddr+n > pAddr {
+			return true
+		}
+	}
+	return false
+}
+
+// Unmap removes the device mapped at `base`.
+func (m *Memory) Unmap(base uint64) {
+	m.bus.Lock()
+	defer m.bus.Unlock()
+	for i, mp := range m.bus.mappings {
+		if mp.base == base {
+			m.bus.mappings = append(m.bus.mappings[:i], m.bus.mappings[i+1:]...)
+			return
+		}
+	}
+}
+
+// device returns the device mapped at the physical address `pAddr`, and the
+// offset of `pAddr` into its range.
+//   Returns `nil, 0` for addresses in RAM.
+//   Addresses outside RAM where nothing is mapped get a device that faults on
+// every access.
+func (m *Memory) device(pAddr uint64) (Device, uint32) {
+	switch m.kind(pAddr) {
+	case RegionRAM:
+		return nil, 0
+	case RegionHole:
+		return unmapped{}, 0
+	}
+
+	m.bus.RLock()
+	defer m.bus.RUnlock()
+	for _, mp := range m.bus.mappings {
+		if pAddr >= mp.base && pAddr-mp.base < mp.size {
+			return mp.dev, uint32(pAddr - mp.base)
+		}
+	}
+	return unmapped{}, 0
+}
+
+// unmapped stands in for a device where nothing is mapped, so that every
+// access to it faults.
+type unmapped struct{}
+
+func (unmapped) Read(offset, width uint32) (bool, uint64) {
+	return false, 0
+}
+
+func (unmapped) Write(offset, width uint32, v uint64) bool {
+	return false
+}
+
+// ReadIO reads the register of `width` bytes at the physical address `pAddr`
+// of a device, like a load from a core would.
+//   This lets code outside the emulated cores, such as the drivers of the
+// system, program devices through the bus.
+//   Returns `false, 0` if nothing is mapped there or the device refuses.
+func (m *Memory) ReadIO(pAddr uint64, width uint32) (bool, uint64) {
+	dev, offset := m.device(pAddr)
+	if dev == nil {
+		return false, 0
+	}
+	return dev.Read(offset, width)
+}
+
+// WriteIO writes the register of `width` bytes at the physical address `pAddr`
+// of a device, like a store from a core would.
+//   Returns `false` if nothing is mapped there or the device refuses.
+func (m *Memory) WriteIO(pAddr uint64, width uint32, v uint64) bool {
+	dev, offset := m.device(pAddr)
+	if dev == nil {
+		return false
+	}
+	return dev.Write(offset, width, v)
+}
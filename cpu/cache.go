@@ -6,6 +6,7 @@ package cpu
 
 import (
 	"encoding/binary"
+	"math/bits"
 )
 
 // Cache flags, cache lines can be dirty or stale
@@ -17,11 +18,11 @@ const (
 	cacheFlagStale          = 0x02 // stale flag - triggers/or should trigger a refresh when a stale line is accessed
 )
 
-// cacheLine consists of a number, some flags, and the data
+// cacheLine consists of a number and some flags; the data of the line in
+// slot `i` is kept at `i << cache.offsetBits` in `cache.data`
 type cacheLine struct {
 	number uint32
 	flags  uint8
-	data   [cacheLineLength]uint8
 }
 
 // cache is implemented as a hash-map with quadratic probing.
@@ -29,39 +30,51 @@ type cacheLine struct {
 //   When it gives up, the candidate slots should be flushed/set stale
 // and the new line should be brought in from main memory at the first
 // position.
+//   The geometry of the cache comes from the `Config` it is made with; as
+// the line length and the line count are powers of 2, addresses are split and
+// slots are found with masks rather than divisions.
+//   Shifts by `offsetBits` on the paths of loads and stores are masked with
+// 31, which tells Go that they are shorter than 32 bits and saves a check.
 type cache struct {
-	lines [cacheLineCount]cacheLine
+	lines      []cacheLine
+	data       []uint8 // the data of all lines, one after the other
+	lineLength uint32  // bytes in a line
+	offsetBits uint32  // how many bits of the address are used for the offset
+	offsetMask uint32  // used to extract the offset in a cache line from an address
+	indexMask  uint32  // used to turn a line number into a slot, len(lines) - 1
+	probeDepth uint32  // how many slots a line may be placed in
 }
 
 // load will load a value from cache with a given width.
 //   It will fail/miss if the correct line is not in cache.
 //   Panics if address is not aligned to `width` bytes
-func (c *cache) load(address, width uint32) (bool, uint64) {
+func (c *cache) load(address uint64, width uint32) (bool, uint64) {
 	// Misaligned load from cache will always fail
-	if address&(width-1) != 0 {
+	if uint32(address)&(width-1) != 0 {
 		panic("misaligned access to cache")
 	}
 
-	lineNumber := address >> cacheLineOffsetBits
-	offset := address & cacheLineOffsetMask
+	lineNumber := uint32(address >> (c.offsetBits & 31))
+	offset := uint32(address) & c.offsetMask
 
-	for i := uint32(0); i < cacheProbeDepth; i++ {
-		try := (lineNumber + i*i) % cacheLineCount
-		if c.lines[try].number == lineNumber {
-			if c.lines[try].flags&cacheFlagStale != 0 {
+	for i := uint32(0); i < c.probeDepth; i++ {
+		try := (lineNumber + i*i) & c.indexMask
+		line := &c.lines[try]
+		if line.number == lineNumber {
+			if line.flags&cacheFlagStale != 0 {
 				return false, 0
 			}
 
+			data := c.data[try<<(c.offsetBits&31)+offset:]
 			switch width {
 			case 1:
-				return true, uint64(c.lines[try].data[offset])
+				return true, uint64(data[0])
 			case 2:
-				return true, uint64(binary.LittleEndian.Uint16(c.lines[try].data[offset : offset+2]))
+				return true, uint64(binary.LittleEndian.Uint16(data))
 			case 4:
-				return true, uint64(
-					binary.LittleEndian.Uint32(c.lines[try].data[offset : offset+4]))
+				return true, uint64(binary.LittleEndian.Uint32(data))
 			case 8:
-				return true, binary.LittleEndian.Uint64(c.lines[try].data[offset : offset+8])
+				return true, binary.LittleEndian.Uint64(data)
 			default:
 				panic("Invalid load width")
 			}
@@ -71,22 +84,35 @@ func (c *cache) load(address, width uint32) (bool, uint64) {
 	return false, 0
 }
 
+// find returns the slot holding the line `lineNumber`, and whether it is
+// there and not stale.
+func (c *cache) find(lineNumber uint32) (uint32, bool) {
+	for i := uint32(0); i < c.probeDepth; i++ {
+		try := (lineNumber + i*i) & c.indexMask
+		if c.lines[try].number == lineNumber {
+			return try, c.lines[try].flags&cacheFlagStale == 0
+		}
+	}
+	return 0, false
+}
+
 // store will store a value into cache with a given width.
 //   It will fail/miss if the correct line is not in cache.
 //   Panics if address is not aligned to `width` bytes
-func (c *cache) store(address, width uint32, v uint64) bool {
+func (c *cache) store(address uint64, width uint32, v uint64) bool {
 	// misaligned store will always miss
-	if address&(width-1) != 0 {
+	if uint32(address)&(width-1) != 0 {
 		panic("misaligned access to cache")
 	}
 
-	lineNumber := address >> cacheLineOffsetBits
-	offset := address & cacheLineOffsetMask
+	lineNumber := uint32(address >> (c.offsetBits & 31))
+	offset := uint32(address) & c.offsetMask
 
-	for i := uint32(0); i < cacheProbeDepth; i++ {
-		try := (lineNumber + i*i) % cacheLineCount
-		if c.lines[try].number == lineNumber {
-			if c.lines[try].flags&cacheFlagStale != 0 {
+	for i := uint32(0); i < c.probeDepth; i++ {
+		try := (lineNumber + i*i) & c.indexMask
+		line := &c.lines[try]
+		if line.number == lineNumber {
+			if line.flags&cacheFlagStale != 0 {
 				return false
 			}
 
@@ -105,8 +131,8 @@ func (c *cache) store(address, width uint32, v uint64) bool {
 				panic("Invalid store width")
 			}
 
-			copy(c.lines[try].data[offset:], bytes[0:width])
-			c.lines[try].flags |= cacheFlagDirty
+			copy(c.data[try<<(c.offsetBits&31)+offset:], bytes[0:width])
+			line.flags |= cacheFlagDirty
 			return true
 		}
 	}
@@ -114,70 +140,77 @@ func (c *cache) store(address, width uint32, v uint64) bool {
 	return false
 }
 
-// replace brings a line into cache at one of the candidate slots.
+// replace brings a line into cache from `m` at one of the candidate slots.
 //   Candidate slots are all slots that might hold the given line; e.g if the
 // probe depth is 2, there are 2 slots that any cache line might fit into.
 //   If all candidate slots are filled, they will be flushed and the line will
 // be placed in the first slot.
 //   If the line is already in cache, it will be refreshed by this.
-func (c *cache) replace(lineNumber uint32, flags uint8, src []uint8) bool {
-	for i := uint32(0); i < cacheProbeDepth; i++ {
-		try := (lineNumber + i*i) % cacheLineCount
+//   The lock of `m` must be held.
+func (c *cache) replace(lineNumber uint32, flags uint8, m *Memory) bool {
+	for i := uint32(0); i < c.probeDepth; i++ {
+		try := (lineNumber + i*i) & c.indexMask
 		if c.lines[try].number == lineNumber {
 			if c.lines[try].flags&cacheFlagStale == 0 {
 				return false
 			}
 
-			address := lineNumber << cacheLineOffsetBits
-			copy(c.lines[try].data[:], src[address:address+cacheLineLength])
+			m.read(c.address(lineNumber), c.line(try))
 			c.lines[try].flags &= (cacheFlagDirty ^ cacheFlagStale ^ cacheFlagAll) // remove stale and dirty bits
 			return true
 		}
 	}
 
 	// line was not present, try to find a place for it
-	for i := uint32(0); i < cacheProbeDepth; i++ {
-		try := (lineNumber + i*i) % cacheLineCount
+	for i := uint32(0); i < c.probeDepth; i++ {
+		try := (lineNumber + i*i) & c.indexMask
 		if c.lines[try].number == cacheInvalidEntry {
-			address := lineNumber << cacheLineOffsetBits
 			c.lines[try].number = lineNumber
-			copy(c.lines[try].data[:], src[address:address+cacheLineLength])
+			m.read(c.address(lineNumber), c.line(try))
 			c.lines[try].flags &= (cacheFlagDirty ^ cacheFlagStale ^ cacheFlagAll) // remove stale and dirty bits
 			return true
 		}
 	}
 
 	// no vacant slots, invalidate all candidate slots
-	for i := uint32(0); i < cacheProbeDepth; i++ {
-		try := (lineNumber + i*i) % cacheLineCount
+	for i := uint32(0); i < c.probeDepth; i++ {
+		try := (lineNumber + i*i) & c.indexMask
 		if c.lines[try].flags&cacheFlagDirty == 1 {
-			address := c.lines[try].number << cacheLineOffsetBits
-			copy(src[address:], c.lines[try].data[:])
+			m.write(c.address(c.lines[try].number), c.line(try))
 		}
 		c.lines[try].number = cacheInvalidEntry
 		c.lines[try].flags = 0
 	}
 
 	// finally, a vacant space is guaranteed
-	try := lineNumber % cacheLineCount
-	address := lineNumber << cacheLineOffsetBits
+	try := lineNumber & c.indexMask
 	c.lines[try].number = lineNumber
-	copy(c.lines[try].data[:], src[address:address+cacheLineLength])
+	m.read(c.address(lineNumber), c.line(try))
 	c.lines[try].flags &= (cacheFlagDirty ^ cacheFlagStale ^ cacheFlagAll) // remove stale and dirty bits
 	return true
 }
 
-// writebackAll writes all cache-lines back to `dst`.
+// address returns the physical address of the line `lineNumber`.
+func (c *cache) address(lineNumber uint32) uint64 {
+	return uint64(lineNumber) << c.offsetBits
+}
+
+// line returns the data of the line in slot `slot`.
+func (c *cache) line(slot uint32) []uint8 {
+	start := slot << c.offsetBits
+	return c.data[start : start+c.lineLength]
+}
+
+// writebackAll writes all cache-lines back to `m`, whose lock must be held.
 // Helpful if you want all other cores to see changes made by this core.
-func (c *cache) writebackAll(dst []uint8) int {
+func (c *cache) writebackAll(m *Memory) int {
 	written := 0
 	for i := range c.lines {
 		line := &c.lines[i]
 
 		// check if it's dirty, if so, flush
 		if line.flags&cacheFlagDirty != 0 {
-			address := line.number << cacheLineOffsetBits
-			copy(dst[address:], line.data[:])
+			m.write(c.address(line.number), c.line(uint32(i)))
 			written += 1
 			// clear the dirty bit
 			line.flags &= (cacheFlagDirty ^ cacheFlagAll)
@@ -195,9 +228,19 @@ func (c *cache) invalidateAll() {
 	}
 }
 
-// newCache returns a new cache filled with invalid (open) entries.
-func newCache() cache {
-	c := cache{}
+// newCache returns a new cache with the geometry given by `cfg`, filled with
+// invalid (open) entries.
+func newCache(cfg Config) cache {
+	c := cache{
+		lines:      make([]cacheLine, cfg.CacheLineCount),
+		lineLength: cfg.CacheLineLength,
+		offsetBits: uint32(bits.TrailingZeros32(cfg.CacheLineLength)),
+		offsetMask: cfg.CacheLineLength - 1,
+		indexMask:  cfg.CacheLineCount - 1,
+		probeDepth: cfg.CacheProbeDepth,
+	}
+
+	c.data = make([]uint8, cfg.CacheLineCount*cfg.CacheLineLength)
 	for i := range c.lines {
 		c.lines[i].number = cacheInvalidEntry
 		c.lines[i].flags = 0
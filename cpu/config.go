@@ -1,34 +1,118 @@
+// This file contains the configuration of a machine: the extensions its cores
+// implement, the geometry of their caches and TLBs, and the size of memory.
+//   A Config is given to `NewCore` when the machine is made, and the system
+// lays out `MemorySize` bytes of RAM in the memory map it gives `NewMemory`,
+// so that one binary can run, and compare, machines that are configured
+// differently.
+
 package cpu
 
-// enable the F extension
-const xFEnable = false
-
-// enable the D extension
-const xDEnable = false
-
-// enable the Zicsr extension
-const xZicsrEnable = false
-
-// enable interprocessor interrupts for normal operation; if set to false,
-// interrupts are only received from the system and can not be raised on, or
-// received from other cores
-const ipiEnable = false
-
-// CoresMax is the maximum number of cores we support
-// This just simplifies the interrupt implementation
-const CoresMax = 4
-
-// Cache constants, cache size, line count, etc.
-const (
-	cacheEnable         = true
-	cacheLineLength     = 64   // must be equal to exp(2, CACHE_LINE_OFFSET_BITS)
-	cacheLineOffsetBits = 6    // how many bits of the address are used for the offset
-	cacheLineOffsetMask = 0x3F // used to extract the offset in a cache line from an address
-	cacheLineCount      = 256  // how many cache lines the cache contains by default
-	cacheProbeDepth     = 2
-)
-
-const (
-	tlbSize       = 256
-	tlbProbeDepth = 3
-)
+import "fmt"
+
+// Config configures the cores and the memory of a machine.
+type Config struct {
+	F bool // enable the F extension
+	D bool // enable the D extension
+
+	// use the IEEE 754 compliant implementation of the F and D extensions in
+	// softfloat.go, rather than the much faster one built on the floats of Go
+	SoftFloat bool
+
+	C      bool // enable the C extension
+	Zicsr  bool // enable the Zicsr extension
+	Zicntr bool // enable the Zicntr extension, the counters programs read through CSRs
+
+	// enable the Zba, Zbb, Zbc and Zbs bit-manipulation extensions
+	Zba, Zbb, Zbc, Zbs bool
+
+	// enable interprocessor interrupts for normal operation; if set to false,
+	// interrupts are only received from the system and can not be raised on,
+	// or received from other cores
+	IPI bool
+
+	// Cache geometry; the line length and the line count must be powers of 2
+	Cache           bool   // enable the instruction and data caches
+	CacheLineLength uint32 // bytes in a cache line
+	CacheLineCount  uint32 // how many cache lines each cache contains
+	CacheProbeDepth uint32 // how many slots a line may be placed in
+
+	// decode basic blocks once and keep them, rather than fetching and
+	// decoding every instruction as it executes; faster, but blocks bypass
+	// the instruction cache, so it is off unless asked for, see block.go
+	BlockCache bool
+
+	// TLB geometry; the size must be a power of 2
+	TLBSize       uint32 // how many translations the TLB holds
+	TLBProbeDepth uint32 // how many slots a translation may be placed in
+
+	// MemorySize is the number of bytes of RAM, a multiple of the page size;
+	// where it goes in the physical address space is up to the memory map of
+	// the system, see `NewMemory`
+	MemorySize uint64
+}
+
+// DefaultConfig returns the configuration main runs with unless told
+// otherwise: 4 MiB of memory, and cores implementing RV32IMAC with Zicsr,
+// Zicntr and the bit-manipulation extensions, but not F and D.
+//   The caches, the TLB and the memory keep the sizes the constants used to
+// give them. The extensions don't: the constants had Zicsr disabled, and there
+// was no C, Zicntr or Zb* at all.
+func DefaultConfig() Config {
+	return Config{
+		F:         false,
+		D:         false,
+		SoftFloat: true,
+		C:         true,
+		Zicsr:     true,
+		Zicntr:    true,
+		Zba:       true,
+		Zbb:       true,
+		Zbc:       true,
+		Zbs:       true,
+		IPI:       false,
+
+		Cache:           true,
+		CacheLineLength: 64,
+		CacheLineCount:  256,
+		CacheProbeDepth: 2,
+
+		BlockCache: false,
+
+		TLBSize:       256,
+		TLBProbeDepth: 3,
+
+		// 4 MiB of memory ought to be enough
+		MemorySize: 1024 * 1024 * 4,
+	}
+}
+
+// Validate returns an error if the configuration describes a machine that
+// can't be made.
+func (cfg Config) Validate() error {
+	powerOf2 := func(v uint32) bool { return v != 0 && v&(v-1) == 0 }
+
+	switch {
+	case cfg.D && !cfg.F:
+		return fmt.Errorf("the D extension requires the F extension")
+	case !powerOf2(cfg.CacheLineLength) || cfg.CacheLineLength < 8 || cfg.CacheLineLength > pagesize:
+		return fmt.Errorf("bad cache line length %d", cfg.CacheLineLength)
+	case !powerOf2(cfg.CacheLineCount):
+		return fmt.Errorf("bad cache line count %d", cfg.CacheLineCount)
+	case cfg.CacheProbeDepth < 1 || cfg.CacheProbeDepth > cfg.CacheLineCount:
+		return fmt.Errorf("bad cache probe depth %d", cfg.CacheProbeDepth)
+	case !powerOf2(cfg.TLBSize):
+		return fmt.Errorf("bad TLB size %d", cfg.TLBSize)
+	case cfg.TLBProbeDepth < 1 || cfg.TLBProbeDepth > cfg.TLBSize:
+		return fmt.Errorf("bad TLB probe depth %d", cfg.TLBProbeDepth)
+	case cfg.MemorySize == 0 || cfg.MemorySize%pagesize != 0:
+		return fmt.Errorf("bad memory size %d", cfg.MemorySize)
+	}
+	return nil
+}
+
+// mustValidate panics if the configuration is not valid.
+func (cfg Config) mustValidate() {
+	if err := cfg.Validate(); err != nil {
+		panic(err)
+	}
+}
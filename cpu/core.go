@@ -2,12 +2,14 @@ package cpu
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type coreState int
 
 const (
+	coreStateWaiting  coreState = 4 // Core is waiting for an interrupt, but is still considered running
 	coreStateNopLoop  coreState = 3
 	coreStateRunning            = 2 // Core is running and executing instructions
 	coreStateStopping           = 1 // Core is running and executing instructions, but will turn off in the next cycle
@@ -21,6 +23,13 @@ type Core struct {
 	bcm    sync.Mutex
 	system System
 
+	// cfg is the configuration of the machine, see config.go
+	cfg Config
+
+	// ialignMask has the bits set that must be clear in the address of an
+	// instruction, worked out from `cfg` once so that fetching doesn't test it
+	ialignMask uint32
+
 	// state tracks the state of the core at any given time
 	state coreState
 
@@ -28,6 +37,10 @@ type Core struct {
 	// caused a jump
 	jumped bool
 
+	// ilen is the length in bytes of the instruction being executed, 2 for a
+	// compressed instruction and 4 otherwise
+	ilen uint32
+
 	// normal registers (save on context switch)
 	reg  [32]uint32 // normal registers
 	freg [32]uint64 // fp registers
@@ -45,9 +58,29 @@ type Core struct {
 	// counter can be set to interrupt the core in N cycles
 	counter counter
 
+	// pending interrupt lines, see `SetPending`
+	pending uint32
+
+	// cycles spent executing instructions or waiting, updated together with
+	// the interrupt checks
+	cycles uint64
+
+	// instret counts the instructions retired, see zicntr.go
+	instret uint64
+
+	// excepted is set if the instruction being executed raised an exception,
+	// and so did not retire
+	excepted bool
+
+	// trapDepth counts the trap handlers that are running, see `trap`
+	trapDepth int
+
 	// mc controls access to memory and manages caches
 	mc memoryController
 
+	// blocks holds decoded instructions, see block.go
+	blocks blockCache
+
 	// Control Status Registers, see chapter 2 in the RISC-V privileged specification.
 	csr [4096]uint32
 }
@@ -60,6 +93,8 @@ func (c *Core) Boot() {
 
 // Step will check counters and interrupts and, if it does not trap,
 // it will attempt to fetch the next instruction and execute it.
+//   With the block cache, it executes a chain of decoded basic blocks from
+// the program counter instead, see block.go.
 func (c *Core) Step() {
 	// When a core halts, we can't just stop it or it might miss
 	// interrupts.
@@ -73,41 +108,103 @@ func (c *Core) Step() {
 		return
 	}
 
-	// check timer
-	if c.counter.enable {
-		if c.counter.value == 0 {
-			c.counter.enable = false
-			c.trap(TrapMachineTimerInterrupt)
-			return
+	if c.state == coreStateWaiting {
+		if !c.wait(waitCycles) {
+			time.Sleep(time.Millisecond)
 		}
-		c.counter.value -= 1
+		return
 	}
 
-	c.interruptCounter++
-	// check IPIs every 100 cycles
-	if c.interruptCounter >= 100 {
-		c.interruptCounter = 0 // reset the counter
-		if c.checkInterrupts() {
-			return
+	c.step(stepMaxLength)
+}
+
+// wait checks whether a waiting core should go back to executing
+// instructions, and lets `cycles` cycles pass if it shouldn't.
+//   A waiting core behaves like a halted one, except that it goes back to
+// executing instructions as soon as it takes an interrupt.
+//   The handler is free to make it wait again.
+//   Like WFI, an interrupt enabled in mie also ends the wait when
+// mstatus.MIE is clear, only without being taken.
+//   Every round of waiting counts as a number of cycles, so that time goes on
+// for devices that follow the cycles even when every core waits.
+//   Returns true if the wait has ended.
+func (c *Core) wait(cycles uint64) bool {
+	c.state = coreStateRunning
+	if c.checkPending() || c.checkInterrupts() || c.enabledPending() != 0 {
+		return true
+	}
+	c.state = coreStateWaiting
+	atomic.AddUint64(&c.cycles, cycles)
+	return false
+}
+
+// step executes the next instruction, or with the block cache up to `max`
+// instructions, unless the counters or interrupts make the core trap first.
+//   Returns the number of instructions executed, counting one that trapped
+// or that the core trapped before.
+func (c *Core) step(max int) int {
+	if c.tick() {
+		return 1
+	}
+
+	if c.cfg.BlockCache {
+		if n := c.stepBlock(max); n > 0 {
+			return n
 		}
 	}
 
 	// --- normal instruction flow ---
 
 	c.jumped = false
+	c.excepted = false
 
 	// load and execute instruction
 	success, inst := c.loadInstruction(c.pc)
 	if !success {
-		return
+		return 1
 	}
 
+	c.ilen = 4
+	if inst&0x3 != 0x3 {
+		c.ilen = 2
+	}
 	c.execute(inst)
+	if !c.excepted {
+		c.instret++
+	}
 
 	// increment program counter if previous instruction didn't jump
 	if !c.jumped {
-		c.pc += 4
+		c.pc += c.ilen
+	}
+	return 1
+}
+
+// tick counts down the timer of the core, and checks interrupt lines and
+// IPIs every 100 cycles, before an instruction is executed.
+//   Returns true if the core trapped, in which case the instruction must not
+// be executed.
+func (c *Core) tick() bool {
+	// check timer
+	if c.counter.enable {
+		if c.counter.value == 0 {
+			c.counter.enable = false
+			c.trap(TrapMachineTimerInterrupt)
+			return true
+		}
+		c.counter.value -= 1
+	}
+
+	c.interruptCounter++
+	// check interrupt lines and IPIs every 100 cycles
+	if c.interruptCounter >= 100 {
+		c.interruptCounter = 0 // reset the counter
+		atomic.AddUint64(&c.cycles, 100)
+		if c.checkPending() || c.checkInterrupts() {
+			return true
+		}
 	}
+	return false
 }
 
 // run will place the core into a run loop.
@@ -144,6 +241,54 @@ func (c *Core) Start() {
 	go c.run()
 }
 
+// StartTurns boots the core so that it can be run in turns with `Turn`, in
+// the goroutine of the caller, rather than in a goroutine of its own like
+// `Start` does.
+func (c *Core) StartTurns() {
+	c.system.WgAwake().Add(1)
+	c.system.WgRunning().Add(1)
+	c.state = coreStateRunning
+	c.Boot()
+}
+
+// Turn runs a core started with `StartTurns` for `n` instructions, or less if
+// it stops executing instructions.
+//   A waiting core checks for interrupts and lets `n` cycles pass, and a
+// halted core checks for interrupts, instead of sleeping like `Step` does;
+// either ends its turn.
+//   Returns false once the core has stopped, which it does at the start of
+// the first turn after `Stop`.
+func (c *Core) Turn(n int) bool {
+	c.bcm.Lock()
+	defer c.bcm.Unlock()
+
+	for n > 0 {
+		switch c.state {
+		case coreStateStopped:
+			return false
+		case coreStateStopping:
+			c.state = coreStateStopped
+			c.system.WgAwake().Done()
+			return false
+		case coreStateNopLoop:
+			c.checkInterrupts()
+			return true
+		case coreStateWaiting:
+			c.wait(uint64(n))
+			return true
+		}
+		n -= c.step(n)
+	}
+	return true
+}
+
+// Running returns whether the core is running, which it is while it executes
+// instructions or waits for an interrupt, but not once it is halted or
+// stopped.
+func (c *Core) Running() bool {
+	return c.state == coreStateRunning || c.state == coreStateWaiting
+}
+
 // Stop will eventually transition the core into the stopped state.
 //   This causes the goroutine to exit and the core will no longer check
 // interrupts.
@@ -171,14 +316,43 @@ func (c *Core) Halt() bool {
 	return false
 }
 
-// NewCore creates a new core with a given id and system.
+// WaitForInterrupt will put the core into the waiting state, much like the
+// WFI instruction.
+//   In this state, the core does not execute instructions, but unlike a halted
+// core it resumes execution after the next interrupt has been handled.
+//   A waiting core still counts as running, so a system that waits on
+// `WgRunning` will not see it as done.
+func (c *Core) WaitForInterrupt() {
+	if c.state == coreStateRunning {
+		c.state = coreStateWaiting
+	}
+}
+
+// NewCore creates a new core with a given id and system, configured by
+// `cfg`.
 //   `sys` must be a System with at least `id + 1` cores and `id` must
 // be unique among all cores that reference `sys`.
-//   `id` must be less than `CoresMax`.
-func NewCore(id uint32, sys System) (c Core) {
+//   The memory of `sys` must be made with the same `cfg`, and its reservation
+// sets and interrupt matrix for all of its cores.
+//   Panics if `cfg` is not valid, or if `id` is out of range for the
+// interrupt matrix of `sys`.
+func NewCore(id uint32, sys System, cfg Config) (c Core) {
+	cfg.mustValidate()
+	if id >= uint32(sys.InterruptMatrix().Cores()) {
+		panic("core id out of range")
+	}
+
 	c = Core{
-		mc:     newMemoryController(),
-		system: sys,
+		mc:         newMemoryController(cfg),
+		system:     sys,
+		cfg:        cfg,
+		ialignMask: 0x3,
+	}
+	if cfg.C {
+		c.ialignMask = 0x1
+	}
+	if cfg.BlockCache {
+		c.blocks = newBlockCache()
 	}
 
 	c.csr[Csr_MHARTID] = id
@@ -191,17 +365,54 @@ func NewCore(id uint32, sys System) (c Core) {
 
 // GetCSR will give the value of a named CSR.
 //   `name` must be one of the constants defined in `zicsr.go`.
+//   `mip` reads the interrupt lines, see `Pending`.
+//   `fflags` and `frm` are fields of `fcsr`, and read as such.
+//   The counters of Zicntr are read from the core and the system, see
+// zicntr.go.
 func (c *Core) GetCSR(name Csr) uint32 {
+	switch name {
+	case Csr_MIP:
+		return c.Pending()
+	case csr_FFLAGS:
+		return c.csr[csr_FCSR] & fcsrFlagsMask
+	case csr_FRM:
+		return c.csr[csr_FCSR] >> fcsrFrmShift
+	case Csr_CYCLE, Csr_TIME, Csr_INSTRET, Csr_CYCLEH, Csr_TIMEH, Csr_INSTRETH:
+		return c.readCounter(name)
+	}
 	return c.csr[name]
 }
 
 // SetCSR will set the value of a named CSR.
 //   `name` must be one of the constants defined in `zicsr.go`.
 //   `val` is a 32-bit unsigned integer
+//   Writes to `mip` are ignored, since all of its bits follow interrupt
+// lines.
+//   `fflags` and `frm` are fields of `fcsr`, and writing them changes it.
 func (c *Core) SetCSR(name Csr, val uint32) {
+	switch name {
+	case Csr_MIP:
+		return
+	case csr_FFLAGS:
+		val = c.csr[csr_FCSR]&^fcsrFlagsMask | val&fcsrFlagsMask
+		name = csr_FCSR
+	case csr_FRM:
+		val = c.csr[csr_FCSR]&fcsrFlagsMask | val<<fcsrFrmShift
+		name = csr_FCSR
+	}
+	if name == csr_FCSR {
+		val &= fcsrMask
+	}
 	c.csr[name] = val
 }
 
+// InstructionLength gives the length in bytes of the instruction that is
+// executing, or that caused the trap being handled: 2 for a compressed
+// instruction and 4 otherwise.
+func (c *Core) InstructionLength() uint32 {
+	return c.ilen
+}
+
 // GetIRegister gets the value of a named integer register.
 //   `name` must be one of the constants defined in `register.go`.
 func (c *Core) GetIRegister(name Reg) uint32 {
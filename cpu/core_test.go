@@ -0,0 +1,115 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+// testRAMSize is the size of the RAM of a `testSystem`, from address 0.
+const testRAMSize = 1 << 20
+
+// testSystem is a System of a single core, which records the traps the core
+// takes rather than handling them.
+type testSystem struct {
+	memory     Memory
+	rsets      ReservationSets
+	interrupts InterruptMatrix
+	wgAwake    sync.WaitGroup
+	wgRunning  sync.WaitGroup
+
+	traps []uint32 // mcause of every trap taken, in order
+}
+
+func (s *testSystem) HandleTrap(c *Core) {
+	s.traps = append(s.traps, c.csr[Csr_MCAUSE])
+}
+
+func (s *testSystem) HandleBoot(c *Core) {}
+
+func (s *testSystem) Memory() *Memory                   { return &s.memory }
+func (s *testSystem) ReservationSets() *ReservationSets { return &s.rsets }
+func (s *testSystem) InterruptMatrix() *InterruptMatrix { return &s.interrupts }
+func (s *testSystem) Time() uint64                      { return 0 }
+func (s *testSystem) WgAwake() *sync.WaitGroup          { return &s.wgAwake }
+func (s *testSystem) WgRunning() *sync.WaitGroup        { return &s.wgRunning }
+
+// newTestCore returns a core configured by `cfg`, in a system with
+// `testRAMSize` bytes of RAM.
+func newTestCore(cfg Config) (*Core, *testSystem) {
+	s := &testSystem{
+		memory:     NewMemory([]Region{{Base: 0, Size: testRAMSize, Kind: RegionRAM}}),
+		rsets:      NewReservationSets(1),
+		interrupts: NewInterruptMatrix(1),
+	}
+	c := NewCore(0, s, cfg)
+	return &c, s
+}
+
+// exec executes the instruction `inst` at the program counter, as `step`
+// would had it fetched it, and returns the causes of the traps it took.
+func (c *Core) exec(inst uint32) []uint32 {
+	s := c.system.(*testSystem)
+	s.traps = nil
+
+	c.jumped = false
+	c.excepted = false
+	c.ilen = 4
+	if inst&0x3 != 0x3 {
+		c.ilen = 2
+	}
+	c.execute(inst)
+	if !c.jumped {
+		c.pc += c.ilen
+	}
+	return s.traps
+}
+
+// writeWord writes the word `v` to the physical address `pAddr`.
+func writeWord(t *testing.T, m *Memory, pAddr uint64, v uint32) {
+	t.Helper()
+	b := make([]uint8, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	if err, _ := m.WriteRaw(pAddr, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// registerVector is a test vector of an instruction that computes a0 from a1
+// and a2.
+type registerVector struct {
+	name     string
+	inst     uint32
+	rs1, rs2 uint32 // a1 and a2
+	want     uint32 // a0
+}
+
+// testRegisterVectors executes every vector on a core configured by `cfg`.
+func testRegisterVectors(t *testing.T, cfg Config, vectors []registerVector) {
+	t.Helper()
+	c, _ := newTestCore(cfg)
+	for _, v := range vectors {
+		c.reg[Reg_A0], c.reg[Reg_A1], c.reg[Reg_A2] = 0, v.rs1, v.rs2
+		if traps := c.exec(v.inst); len(traps) != 0 {
+			t.Errorf("%s (%#08x) took traps %v", v.name, v.inst, traps)
+			continue
+		}
+		if c.reg[Reg_A0] != v.want {
+			t.Errorf("%s %#08x, %#08x is %#08x, want %#08x", v.name, v.rs1, v.rs2, c.reg[Reg_A0], v.want)
+		}
+	}
+}
+
+// testIllegal checks that every instruction of `insts` is illegal on a core
+// configured by `cfg`, and leaves a0 alone.
+func testIllegal(t *testing.T, cfg Config, insts map[string]uint32) {
+	t.Helper()
+	c, _ := newTestCore(cfg)
+	for name, inst := range insts {
+		c.reg[Reg_A0] = 0x5A5A5A5A
+		traps := c.exec(inst)
+		if len(traps) != 1 || traps[0] != TrapIllegalInstruction || c.reg[Reg_A0] != 0x5A5A5A5A {
+			t.Errorf("%s (%#08x) took traps %v and wrote %#08x, want an illegal instruction", name, inst, traps, c.reg[Reg_A0])
+		}
+	}
+}
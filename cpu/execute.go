@@ -1,12 +1,50 @@
 // This file contains logic for decoding 32 bit RISC-V instructions.
-// Decoding is implemented for the I, M, A, F, D, Zicsr, and Zifencei extensions.
+// Decoding is implemented for the I, M, A, F, D, Zicsr, Zifencei, Zba, Zbb,
+// Zbc, and Zbs extensions; compressed instructions of the C extension are
+// expanded first (see rv32c.go).
+//   Decoding an instruction gives the method that implements it, so that the
+// work of decoding can be saved and the method called again, see block.go.
 
 package cpu
 
+// operation is the implementation of an instruction, a method of `Core` that
+// is called with the encoding of the instruction.
+type operation func(c *Core, inst uint32)
+
 // execute takes an instruction encoded as an unsigned 32-bit integer,
 // decodes it, and executes it.
 //   This function returns nothing, but potentially has several side-effects.
 func (c *Core) execute(inst uint32) {
+	// Register 0 is hardwired with all 0s,
+	// have to reset to 0 for every cycle because some instructions
+	// may use this as their /dev/null
+	c.reg[Reg_ZERO] = 0
+	c.csr[Csr_MTVAL] = 0
+
+	op, inst := c.decode(inst)
+	op(c, inst)
+}
+
+// decode returns the operation that implements the instruction `inst`, and
+// the encoding to call it with.
+//   The encoding is `inst` itself, unless `inst` is a compressed instruction,
+// which is expanded into the 32-bit instruction it stands for.
+func (c *Core) decode(inst uint32) (operation, uint32) {
+	if inst&0x3 != 0x3 {
+		return c.decodeCompressed(inst)
+	}
+	return c.decode32(inst), inst
+}
+
+// illegal traps the instruction `inst` as illegal.
+func (c *Core) illegal(inst uint32) {
+	c.csr[Csr_MTVAL] = inst
+	c.trap(TrapIllegalInstruction)
+}
+
+// decode32 returns the operation that implements the 32-bit instruction
+// `inst`.
+func (c *Core) decode32(inst uint32) operation {
 	const (
 		OP_IMM   uint32 = 0b0010011
 		LUI             = 0b0110111
@@ -29,13 +67,11 @@ func (c *Core) execute(inst uint32) {
 		FNMADD          = 0b1001111
 	)
 
-	// Register 0 is hardwired with all 0s,
-	// have to reset to 0 for every cycle because some instructions
-	// may use this as their /dev/null
-	c.reg[Reg_ZERO] = 0
-	c.csr[Csr_MTVAL] = 0
-
 	opcode := inst & 0x7f
+	if c.cfg.SoftFloat && (opcode == OP_FP || opcode&^0b0001100 == FMADD) {
+		return (*Core).executeSoftFloat // see execute_softfloat.go
+	}
+
 	switch opcode {
 	case OP:
 		// OP funct7
@@ -43,6 +79,14 @@ func (c *Core) execute(inst uint32) {
 			OP_A   uint32 = 0b0000000
 			OP_B          = 0b0100000
 			MULDIV        = 0b0000001
+			// bit-manipulation extensions
+			SHADD        = 0b0010000 // SH1ADD, SH2ADD, SH3ADD
+			MINMAX_CLMUL = 0b0000101 // MIN, MINU, MAX, MAXU, CLMUL, CLMULH, CLMULR
+			ROT          = 0b0110000 // ROL, ROR
+			ZEXT         = 0b0000100 // ZEXT_H
+			BCLR_BEXT    = 0b0100100 // BCLR, BEXT
+			BINV         = 0b0110100
+			BSET         = 0b0010100
 		)
 		funct7 := (inst >> 25) & 0x7f
 		switch funct7 {
@@ -61,39 +105,46 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case ADD:
-				c.add(inst)
+				return (*Core).add
 			case SLL:
-				c.sll(inst)
+				return (*Core).sll
 			case SLT:
-				c.slt(inst)
+				return (*Core).slt
 			case SLTU:
-				c.sltu(inst)
+				return (*Core).sltu
 			case XOR:
-				c.xor(inst)
+				return (*Core).xor
 			case SRL:
-				c.srl(inst)
+				return (*Core).srl
 			case OR:
-				c.or(inst)
+				return (*Core).or
 			case AND:
-				c.and(inst)
+				return (*Core).and
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case OP_B:
 			const (
-				SUB uint32 = 0b000
-				SRA        = 0b101
+				SUB  uint32 = 0b000
+				SRA         = 0b101
+				XNOR        = 0b100
+				ORN         = 0b110
+				ANDN        = 0b111
 			)
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case SUB:
-				c.sub(inst)
+				return (*Core).sub
 			case SRA:
-				c.sra(inst)
+				return (*Core).sra
+			case XNOR:
+				return (*Core).xnor
+			case ORN:
+				return (*Core).orn
+			case ANDN:
+				return (*Core).andn
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case MULDIV:
 			const (
@@ -110,28 +161,117 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case MUL:
-				c.mul(inst)
+				return (*Core).mul
 			case MULH:
-				c.mulh(inst)
+				return (*Core).mulh
 			case MULHSU:
-				c.mulhsu(inst)
+				return (*Core).mulhsu
 			case MULHU:
-				c.mulhu(inst)
+				return (*Core).mulhu
 			case DIV:
-				c.div(inst)
+				return (*Core).div
 			case DIVU:
-				c.divu(inst)
+				return (*Core).divu
 			case REM:
-				c.rem(inst)
+				return (*Core).rem
 			case REMU:
-				c.rem(inst)
+				return (*Core).remu
+			default:
+				return (*Core).illegal
+			}
+		case SHADD:
+			const (
+				SH1ADD uint32 = 0b010
+				SH2ADD        = 0b100
+				SH3ADD        = 0b110
+			)
+			funct3 := (inst >> 12) & 0x7
+			switch funct3 {
+			case SH1ADD:
+				return (*Core).sh1add
+			case SH2ADD:
+				return (*Core).sh2add
+			case SH3ADD:
+				return (*Core).sh3add
+			default:
+				return (*Core).illegal
+			}
+		case MINMAX_CLMUL:
+			const (
+				CLMUL  uint32 = 0b001
+				CLMULR        = 0b010
+				CLMULH        = 0b011
+				MIN           = 0b100
+				MINU          = 0b101
+				MAX           = 0b110
+				MAXU          = 0b111
+			)
+			funct3 := (inst >> 12) & 0x7
+			switch funct3 {
+			case CLMUL:
+				return (*Core).clmul
+			case CLMULR:
+				return (*Core).clmulr
+			case CLMULH:
+				return (*Core).clmulh
+			case MIN:
+				return (*Core).min
+			case MINU:
+				return (*Core).minu
+			case MAX:
+				return (*Core).max
+			case MAXU:
+				return (*Core).maxu
+			default:
+				return (*Core).illegal
+			}
+		case ROT:
+			const (
+				ROL uint32 = 0b001
+				ROR        = 0b101
+			)
+			funct3 := (inst >> 12) & 0x7
+			switch funct3 {
+			case ROL:
+				return (*Core).rol
+			case ROR:
+				return (*Core).ror
+			default:
+				return (*Core).illegal
+			}
+		case ZEXT:
+			funct3 := (inst >> 12) & 0x7
+			rs2 := (inst >> 20) & 0x1f
+			if funct3 == 0b100 && rs2 == 0 {
+				return (*Core).zext_h
+			}
+			return (*Core).illegal
+		case BCLR_BEXT:
+			const (
+				BCLR uint32 = 0b001
+				BEXT        = 0b101
+			)
+			funct3 := (inst >> 12) & 0x7
+			switch funct3 {
+			case BCLR:
+				return (*Core).bclr
+			case BEXT:
+				return (*Core).bext
+			default:
+				return (*Core).illegal
+			}
+		case BINV, BSET:
+			funct3 := (inst >> 12) & 0x7
+			switch {
+			case funct3 == 0b001 && funct7 == BINV:
+				return (*Core).binv
+			case funct3 == 0b001 && funct7 == BSET:
+				return (*Core).bset
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case OP_IMM:
 		// op-imm funct3
@@ -149,33 +289,101 @@ func (c *Core) execute(inst uint32) {
 		funct3 := (inst >> 12) & 0x7
 		switch funct3 {
 		case ADDI:
-			c.addi(inst)
+			return (*Core).addi
 		case SLTI:
-			c.slti(inst)
+			return (*Core).slti
 		case SLTIU:
-			c.sltiu(inst)
+			return (*Core).sltiu
 		case XORI:
-			c.xori(inst)
+			return (*Core).xori
 		case ORI:
-			c.ori(inst)
+			return (*Core).ori
 		case ANDI:
-			c.andi(inst)
+			return (*Core).andi
 		case SLLI:
-			c.slli(inst)
+			// the upper bits of the immediate select the instruction
+			const (
+				SHIFT uint32 = 0b0000000 // SLLI
+				COUNT        = 0b0110000 // CLZ, CTZ, CPOP, SEXT_B, SEXT_H
+				BCLRI        = 0b0100100
+				BINVI        = 0b0110100
+				BSETI        = 0b0010100
+			)
+			funct7 := (inst >> 25) & 0x7f
+			switch funct7 {
+			case SHIFT:
+				return (*Core).slli
+			case COUNT:
+				const (
+					CLZ    uint32 = 0b00000
+					CTZ           = 0b00001
+					CPOP          = 0b00010
+					SEXT_B        = 0b00100
+					SEXT_H        = 0b00101
+				)
+				funct5 := (inst >> 20) & 0x1f
+				switch funct5 {
+				case CLZ:
+					return (*Core).clz
+				case CTZ:
+					return (*Core).ctz
+				case CPOP:
+					return (*Core).cpop
+				case SEXT_B:
+					return (*Core).sext_b
+				case SEXT_H:
+					return (*Core).sext_h
+				default:
+					return (*Core).illegal
+				}
+			case BCLRI:
+				return (*Core).bclri
+			case BINVI:
+				return (*Core).binvi
+			case BSETI:
+				return (*Core).bseti
+			default:
+				return (*Core).illegal
+			}
 		case SRLI:
-			c.srli(inst)
+			// the upper bits of the immediate select the instruction
+			const (
+				SRL   uint32 = 0b0000000 // SRLI
+				SRA          = 0b0100000 // SRAI
+				RORI         = 0b0110000
+				BEXTI        = 0b0100100
+				REV8         = 0b0110100
+				ORC_B        = 0b0010100
+			)
+			funct7 := (inst >> 25) & 0x7f
+			funct5 := (inst >> 20) & 0x1f
+			switch {
+			case funct7 == SRL:
+				return (*Core).srli
+			case funct7 == SRA:
+				return (*Core).srai
+			case funct7 == RORI:
+				return (*Core).rori
+			case funct7 == BEXTI:
+				return (*Core).bexti
+			case funct7 == REV8 && funct5 == 0b11000:
+				return (*Core).rev8
+			case funct7 == ORC_B && funct5 == 0b00111:
+				return (*Core).orc_b
+			default:
+				return (*Core).illegal
+			}
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case LUI:
-		c.lui(inst)
+		return (*Core).lui
 	case AUIPC:
-		c.auipc(inst)
+		return (*Core).auipc
 	case JAL:
-		c.jal(inst)
+		return (*Core).jal
 	case JALR:
-		c.jalr(inst)
+		return (*Core).jalr
 	case BRANCH:
 		// branch funct3
 		const (
@@ -190,20 +398,19 @@ func (c *Core) execute(inst uint32) {
 		funct3 := (inst >> 12) & 0x7
 		switch funct3 {
 		case BEQ:
-			c.beq(inst)
+			return (*Core).beq
 		case BNE:
-			c.bne(inst)
+			return (*Core).bne
 		case BLT:
-			c.blt(inst)
+			return (*Core).blt
 		case BGE:
-			c.bge(inst)
+			return (*Core).bge
 		case BLTU:
-			c.bltu(inst)
+			return (*Core).bltu
 		case BGEU:
-			c.bgeu(inst)
+			return (*Core).bgeu
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case LOAD:
 		// load funct3
@@ -218,18 +425,17 @@ func (c *Core) execute(inst uint32) {
 		funct3 := (inst >> 12) & 0x7
 		switch funct3 {
 		case LB:
-			c.lb(inst)
+			return (*Core).lb
 		case LH:
-			c.lh(inst)
+			return (*Core).lh
 		case LW:
-			c.lw(inst)
+			return (*Core).lw
 		case LBU:
-			c.lbu(inst)
+			return (*Core).lbu
 		case LHU:
-			c.lhu(inst)
+			return (*Core).lhu
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case STORE:
 		// store funct3
@@ -242,14 +448,13 @@ func (c *Core) execute(inst uint32) {
 		funct3 := (inst >> 12) & 0x7
 		switch funct3 {
 		case SB:
-			c.sb(inst)
+			return (*Core).sb
 		case SH:
-			c.sh(inst)
+			return (*Core).sh
 		case SW:
-			c.sw(inst)
+			return (*Core).sw
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case MISC_MEM:
 		// misc-mem funct3
@@ -261,12 +466,11 @@ func (c *Core) execute(inst uint32) {
 		funct3 := (inst >> 12) & 0x7
 		switch funct3 {
 		case FENCE:
-			c.fence(inst)
+			return (*Core).fence
 		case FENCE_I:
-			c.fence_i(inst)
+			return (*Core).fence_i
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case SYSTEM:
 		// system funct3
@@ -292,28 +496,26 @@ func (c *Core) execute(inst uint32) {
 			funct12 := (inst >> 20) & 0xfff
 			switch funct12 {
 			case ECALL:
-				c.ecall(inst)
+				return (*Core).ecall
 			case EBREAK:
-				c.ebreak(inst)
+				return (*Core).ebreak
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case CSRRW:
-			c.csrrw(inst)
+			return (*Core).csrrw
 		case CSRRS:
-			c.csrrs(inst)
+			return (*Core).csrrs
 		case CSRRC:
-			c.csrrc(inst)
+			return (*Core).csrrc
 		case CSRRWI:
-			c.csrrwi(inst)
+			return (*Core).csrrwi
 		case CSRRSI:
-			c.csrrsi(inst)
+			return (*Core).csrrsi
 		case CSRRCI:
-			c.csrrci(inst)
+			return (*Core).csrrci
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case AMO:
 		// AMO funct5
@@ -334,30 +536,29 @@ func (c *Core) execute(inst uint32) {
 		funct5 := inst >> 27
 		switch funct5 {
 		case LR:
-			c.lr_w(inst)
+			return (*Core).lr_w
 		case SC:
-			c.sc_w(inst)
+			return (*Core).sc_w
 		case AMOSWAP:
-			c.amoswap_w(inst)
+			return (*Core).amoswap_w
 		case AMOADD:
-			c.amoadd_w(inst)
+			return (*Core).amoadd_w
 		case AMOXOR:
-			c.amoxor_w(inst)
+			return (*Core).amoxor_w
 		case AMOAND:
-			c.amoand_w(inst)
+			return (*Core).amoand_w
 		case AMOOR:
-			c.amoor_w(inst)
+			return (*Core).amoor_w
 		case AMOMIN:
-			c.amomin_w(inst)
+			return (*Core).amomin_w
 		case AMOMAX:
-			c.amomax_w(inst)
+			return (*Core).amomax_w
 		case AMOMINU:
-			c.amominu_w(inst)
+			return (*Core).amominu_w
 		case AMOMAXU:
-			c.amomaxu_w(inst)
+			return (*Core).amomaxu_w
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case LOAD_FP:
 		const (
@@ -368,12 +569,11 @@ func (c *Core) execute(inst uint32) {
 		funct3 := (inst >> 12) & 0x7
 		switch funct3 {
 		case W:
-			c.flw(inst)
+			return (*Core).flw
 		case D:
-			c.fld(inst)
+			return (*Core).fld
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case STORE_FP:
 		const (
@@ -384,12 +584,11 @@ func (c *Core) execute(inst uint32) {
 		funct3 := (inst >> 12) & 0x7
 		switch funct3 {
 		case W:
-			c.fsw(inst)
+			return (*Core).fsw
 		case D:
-			c.fsd(inst)
+			return (*Core).fsd
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case OP_FP:
 		const (
@@ -427,15 +626,15 @@ func (c *Core) execute(inst uint32) {
 		switch funct7 {
 		// F extension
 		case FADD_S:
-			c.fadd_s(inst)
+			return (*Core).fadd_s
 		case FSUB_S:
-			c.fsub_s(inst)
+			return (*Core).fsub_s
 		case FMUL_S:
-			c.fmul_s(inst)
+			return (*Core).fmul_s
 		case FDIV_S:
-			c.fdiv_s(inst)
+			return (*Core).fdiv_s
 		case FSQRT_S:
-			c.fsqrt_s(inst)
+			return (*Core).fsqrt_s
 		case FSGNJZ_S:
 			const (
 				FSGNJ_S  uint32 = 0b000
@@ -445,14 +644,13 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case FSGNJ_S:
-				c.fsgnj_s(inst)
+				return (*Core).fsgnj_s
 			case FSGNJN_S:
-				c.fsgnjn_s(inst)
+				return (*Core).fsgnjn_s
 			case FSGNJX_S:
-				c.fsgnjx_s(inst)
+				return (*Core).fsgnjx_s
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FMNX_S:
 			const (
@@ -462,12 +660,11 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case FMIN_S:
-				c.fmin_s(inst)
+				return (*Core).fmin_s
 			case FMAX_S:
-				c.fmax_s(inst)
+				return (*Core).fmax_s
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FCVT_WX_S:
 			const (
@@ -477,12 +674,11 @@ func (c *Core) execute(inst uint32) {
 			funct5 := (inst >> 20) & 0x1f
 			switch funct5 {
 			case FCVT_W_S:
-				c.fcvt_w_s(inst)
+				return (*Core).fcvt_w_s
 			case FCVT_WU_S:
-				c.fcvt_wu_s(inst)
+				return (*Core).fcvt_wu_s
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FMV_X_W_OR_FCLASS_S:
 			const (
@@ -492,12 +688,11 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case FMV_X_W:
-				c.fmv_x_w(inst)
+				return (*Core).fmv_x_w
 			case FCLASS_S:
-				c.fclass_s(inst)
+				return (*Core).fclass_s
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FCMP_S:
 			const (
@@ -508,14 +703,13 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case FEQ_S:
-				c.feq_s(inst)
+				return (*Core).feq_s
 			case FLT_S:
-				c.flt_s(inst)
+				return (*Core).flt_s
 			case FLE_S:
-				c.fle_s(inst)
+				return (*Core).fle_s
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FCVT_S_WX:
 			const (
@@ -525,26 +719,25 @@ func (c *Core) execute(inst uint32) {
 			funct5 := (inst >> 20) & 0x1f
 			switch funct5 {
 			case FCVT_S_W:
-				c.fcvt_s_w(inst)
+				return (*Core).fcvt_s_w
 			case FCVT_S_WU:
-				c.fcvt_s_wu(inst)
+				return (*Core).fcvt_s_wu
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FMV_W_X:
-			c.fmv_w_x(inst)
+			return (*Core).fmv_w_x
 		// D extension
 		case FADD_D:
-			c.fadd_d(inst)
+			return (*Core).fadd_d
 		case FSUB_D:
-			c.fsub_d(inst)
+			return (*Core).fsub_d
 		case FMUL_D:
-			c.fmul_d(inst)
+			return (*Core).fmul_d
 		case FDIV_D:
-			c.fdiv_d(inst)
+			return (*Core).fdiv_d
 		case FSQRT_D:
-			c.fsqrt_d(inst)
+			return (*Core).fsqrt_d
 		case FSGNJZ_D:
 			const (
 				FSGNJ_D  uint32 = 0b000
@@ -554,14 +747,13 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case FSGNJ_D:
-				c.fsgnj_d(inst)
+				return (*Core).fsgnj_d
 			case FSGNJN_D:
-				c.fsgnjn_d(inst)
+				return (*Core).fsgnjn_d
 			case FSGNJX_D:
-				c.fsgnjn_d(inst)
+				return (*Core).fsgnjx_d
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FMNX_D:
 			const (
@@ -571,17 +763,16 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case FMIN_D:
-				c.fmin_d(inst)
+				return (*Core).fmin_d
 			case FMAX_D:
-				c.fmax_d(inst)
+				return (*Core).fmax_d
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FCVT_S_D:
-			c.fcvt_s_d(inst)
+			return (*Core).fcvt_s_d
 		case FCVT_D_S:
-			c.fcvt_d_s(inst)
+			return (*Core).fcvt_d_s
 		case FCMP_D:
 			const (
 				FEQ_D uint32 = 0b010
@@ -591,17 +782,16 @@ func (c *Core) execute(inst uint32) {
 			funct3 := (inst >> 12) & 0x7
 			switch funct3 {
 			case FEQ_D:
-				c.feq_d(inst)
+				return (*Core).feq_d
 			case FLT_D:
-				c.flt_d(inst)
+				return (*Core).flt_d
 			case FLE_D:
-				c.fle_d(inst)
+				return (*Core).fle_d
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FCLASS_D:
-			c.fclass_d(inst)
+			return (*Core).fclass_d
 		case FCVT_WX_D:
 			const (
 				FCVT_W_D  uint32 = 0b00000
@@ -610,12 +800,11 @@ func (c *Core) execute(inst uint32) {
 			funct5 := (inst >> 20) & 0x1f
 			switch funct5 {
 			case FCVT_W_D:
-				c.fcvt_w_d(inst)
+				return (*Core).fcvt_w_d
 			case FCVT_WU_D:
-				c.fcvt_wu_d(inst)
+				return (*Core).fcvt_wu_d
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		case FCVT_D_WX:
 			const (
@@ -625,16 +814,14 @@ func (c *Core) execute(inst uint32) {
 			funct5 := (inst >> 20) & 0x1f
 			switch funct5 {
 			case FCVT_D_W:
-				c.fcvt_d_w(inst)
+				return (*Core).fcvt_d_w
 			case FCVT_D_WU:
-				c.fcvt_d_wu(inst)
+				return (*Core).fcvt_d_wu
 			default:
-				c.csr[Csr_MTVAL] = inst
-				c.trap(TrapIllegalInstruction)
+				return (*Core).illegal
 			}
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case FMADD:
 		const (
@@ -644,12 +831,11 @@ func (c *Core) execute(inst uint32) {
 		format2 := (inst >> 25) & 0x3
 		switch format2 {
 		case S:
-			c.fmadd_s(inst)
+			return (*Core).fmadd_s
 		case D:
-			c.fmadd_d(inst)
+			return (*Core).fmadd_d
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case FMSUB:
 		const (
@@ -659,12 +845,11 @@ func (c *Core) execute(inst uint32) {
 		format2 := (inst >> 25) & 0x3
 		switch format2 {
 		case S:
-			c.fmsub_s(inst)
+			return (*Core).fmsub_s
 		case D:
-			c.fmsub_d(inst)
+			return (*Core).fmsub_d
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case FNMSUB:
 		const (
@@ -674,12 +859,11 @@ func (c *Core) execute(inst uint32) {
 		format2 := (inst >> 25) & 0x3
 		switch format2 {
 		case S:
-			c.fnmadd_s(inst)
+			return (*Core).fnmsub_s
 		case D:
-			c.fnmadd_d(inst)
+			return (*Core).fnmsub_d
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	case FNMADD:
 		const (
@@ -689,15 +873,13 @@ func (c *Core) execute(inst uint32) {
 		format2 := (inst >> 25) & 0x3
 		switch format2 {
 		case S:
-			c.fnmsub_s(inst)
+			return (*Core).fnmadd_s
 		case D:
-			c.fnmsub_d(inst)
+			return (*Core).fnmadd_d
 		default:
-			c.csr[Csr_MTVAL] = inst
-			c.trap(TrapIllegalInstruction)
+			return (*Core).illegal
 		}
 	default:
-		c.csr[Csr_MTVAL] = inst
-		c.trap(TrapIllegalInstruction)
+		return (*Core).illegal
 	}
 }
@@ -0,0 +1,249 @@
+// This file contains the decoder for the compliant implementation of the F
+// and D extensions, which does its arithmetic with the functions in
+// `softfloat.go`.
+//   It replaces the arithmetic instructions of rv32f.go and rv32d.go when
+// `Config.SoftFloat` is set. Those use the floats of Go, which is much faster,
+// but ignores the rounding mode, never raises exception flags and lets NaN
+// payloads through. Loads, stores and moves are the same either way, and are
+// left to them.
+
+package cpu
+
+// executeSoftFloat decodes and executes an instruction of the OP-FP, MADD,
+// MSUB, NMSUB or NMADD major opcodes.
+func (c *Core) executeSoftFloat(inst uint32) {
+	const (
+		OP_FP  uint32 = 0b1010011
+		FMADD         = 0b1000011
+		FMSUB         = 0b1000111
+		FNMSUB        = 0b1001011
+		FNMADD        = 0b1001111
+	)
+
+	// the format of the operation
+	const (
+		S uint32 = 0b00
+		D        = 0b01
+	)
+
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	rs3 := (inst >> 27) & 0x1f
+	funct3 := (inst >> 12) & 0x7
+
+	var f floatFormat
+	switch inst >> 25 & 0x3 {
+	case S:
+		if !c.cfg.F {
+			c.illegalFloat(inst)
+			return
+		}
+		f = binary32
+	case D:
+		if !c.cfg.D {
+			c.illegalFloat(inst)
+			return
+		}
+		f = binary64
+	default:
+		c.illegalFloat(inst)
+		return
+	}
+
+	opcode := inst & 0x7f
+	if opcode != OP_FP {
+		rm, ok := c.roundingMode(inst)
+		if !ok {
+			c.illegalFloat(inst)
+			return
+		}
+
+		a, b, addend := c.getF(f, rs1), c.getF(f, rs2), c.getF(f, rs3)
+		switch opcode {
+		case FMSUB: // a*b - c
+			addend ^= f.signBit()
+		case FNMSUB: // -(a*b) + c
+			a ^= f.signBit()
+		case FNMADD: // -(a*b) - c
+			a ^= f.signBit()
+			addend ^= f.signBit()
+		}
+		c.setF(f, rd, c.raise(f.fma(a, b, addend, rm)))
+		return
+	}
+
+	const (
+		FADD    uint32 = 0b00000
+		FSUB           = 0b00001
+		FMUL           = 0b00010
+		FDIV           = 0b00011
+		FSGNJ          = 0b00100 // FSGNJ, FSGNJN, FSGNJX
+		FMINMAX        = 0b00101 // FMIN, FMAX
+		FCVT_FF        = 0b01000 // FCVT_S_D, FCVT_D_S
+		FSQRT          = 0b01011
+		FCMP           = 0b10100 // FEQ, FLT, FLE
+		FCVT_W         = 0b11000 // FCVT_W, FCVT_WU
+		FCVT_FW        = 0b11010 // FCVT_S_W, FCVT_S_WU, FCVT_D_W, FCVT_D_WU
+		FMV_X_W        = 0b11100 // FMV_X_W, FCLASS
+		FMV_W_X        = 0b11110
+	)
+
+	a, b := c.getF(f, rs1), c.getF(f, rs2)
+
+	funct5 := inst >> 27
+	switch funct5 {
+	case FADD, FSUB, FMUL, FDIV, FSQRT:
+		rm, ok := c.roundingMode(inst)
+		if !ok || funct5 == FSQRT && rs2 != 0 {
+			c.illegalFloat(inst)
+			return
+		}
+		switch funct5 {
+		case FADD:
+			c.setF(f, rd, c.raise(f.add(a, b, rm)))
+		case FSUB:
+			c.setF(f, rd, c.raise(f.sub(a, b, rm)))
+		case FMUL:
+			c.setF(f, rd, c.raise(f.mul(a, b, rm)))
+		case FDIV:
+			c.setF(f, rd, c.raise(f.div(a, b, rm)))
+		case FSQRT:
+			c.setF(f, rd, c.raise(f.sqrt(a, rm)))
+		}
+	case FSGNJ:
+		sign := b & f.signBit()
+		switch funct3 {
+		case 0b000: // FSGNJ
+		case 0b001: // FSGNJN
+			sign ^= f.signBit()
+		case 0b010: // FSGNJX
+			sign ^= a & f.signBit()
+		default:
+			c.illegalFloat(inst)
+			return
+		}
+		c.setF(f, rd, a&^f.signBit()|sign)
+	case FMINMAX:
+		if funct3 > 0b001 {
+			c.illegalFloat(inst)
+			return
+		}
+		c.setF(f, rd, c.raise(f.minMax(a, b, funct3 == 0b001)))
+	case FCVT_FF:
+		rm, ok := c.roundingMode(inst)
+		if !ok || !c.cfg.F || !c.cfg.D {
+			c.illegalFloat(inst)
+			return
+		}
+		switch {
+		case f == binary32 && rs2 == D: // FCVT_S_D
+			c.setF(f, rd, c.raise(f.convert(c.getF(binary64, rs1), binary64, rm)))
+		case f == binary64 && rs2 == S: // FCVT_D_S
+			c.setF(f, rd, c.raise(f.convert(c.getF(binary32, rs1), binary32, rm)))
+		default:
+			c.illegalFloat(inst)
+		}
+	case FCMP:
+		var res bool
+		var flags uint32
+		switch funct3 {
+		case 0b010:
+			res, flags = f.eq(a, b)
+		case 0b001:
+			res, flags = f.lt(a, b)
+		case 0b000:
+			res, flags = f.le(a, b)
+		default:
+			c.illegalFloat(inst)
+			return
+		}
+		c.csr[csr_FCSR] |= flags
+		c.reg[rd] = 0
+		if res {
+			c.reg[rd] = 1
+		}
+	case FCVT_W:
+		rm, ok := c.roundingMode(inst)
+		if !ok || rs2 > 0b00001 {
+			c.illegalFloat(inst)
+			return
+		}
+		res, flags := f.toInt(a, rs2 == 0b00000, rm)
+		c.csr[csr_FCSR] |= flags
+		c.reg[rd] = res
+	case FCVT_FW:
+		rm, ok := c.roundingMode(inst)
+		if !ok || rs2 > 0b00001 {
+			c.illegalFloat(inst)
+			return
+		}
+		c.setF(f, rd, c.raise(f.fromInt(c.reg[rs1], rs2 == 0b00000, rm)))
+	case FMV_X_W:
+		switch {
+		case rs2 != 0:
+			c.illegalFloat(inst)
+		case funct3 == 0b001:
+			c.reg[rd] = f.class(a)
+		case funct3 == 0b000 && f == binary32:
+			c.reg[rd] = uint32(c.freg[rs1]) // moves the bits as they are, boxed or not
+		default:
+			c.illegalFloat(inst) // FMV_X_D only exists on RV64
+		}
+	case FMV_W_X:
+		if rs2 != 0 || funct3 != 0 || f != binary32 {
+			c.illegalFloat(inst)
+			return
+		}
+		c.setF(f, rd, uint64(c.reg[rs1]))
+	default:
+		c.illegalFloat(inst)
+	}
+}
+
+// illegalFloat traps the floating-point instruction `inst` as illegal.
+func (c *Core) illegalFloat(inst uint32) {
+	c.csr[Csr_MTVAL] = inst
+	c.trap(TrapIllegalInstruction)
+}
+
+// roundingMode returns the rounding mode of `inst`, which is frm if the
+// instruction asks for the dynamic mode.
+//   It returns false if the mode is not a valid one.
+func (c *Core) roundingMode(inst uint32) (uint32, bool) {
+	rm := (inst >> 12) & 0x7
+	if rm == rmDYN {
+		rm = c.csr[csr_FCSR] >> fcsrFrmShift & 0x7
+	}
+	return rm, rm <= rmRMM
+}
+
+// getF returns the value of the floating-point register `r` in the format
+// `f`.
+//   A single precision value that isn't NaN-boxed, which is to say the upper
+// half of the register isn't all ones, reads as the canonical NaN.
+func (c *Core) getF(f floatFormat, r uint32) uint64 {
+	v := c.freg[r]
+	if f == binary32 {
+		if v>>32 != 0xFFFFFFFF {
+			return binary32.canonicalNaN()
+		}
+		return v & 0xFFFFFFFF
+	}
+	return v
+}
+
+// setF sets the floating-point register `r` to `v`, a value in the format
+// `f`, NaN-boxing it if it is single precision.
+func (c *Core) setF(f floatFormat, r uint32, v uint64) {
+	if f == binary32 {
+		v |= 0xFFFFFFFF00000000
+	}
+	c.freg[r] = v
+}
+
+// raise accumulates the exception flags `flags` in fcsr, and returns `v`.
+func (c *Core) raise(v uint64, flags uint32) uint64 {
+	c.csr[csr_FCSR] |= flags
+	return v
+}
@@ -17,6 +17,9 @@ type System interface {
 	ReservationSets() *ReservationSets
 	InterruptMatrix() *InterruptMatrix
 
+	// Time returns the value of `mtime`, which the time CSR reads
+	Time() uint64
+
 	// Tracking resources
 	WgAwake() *sync.WaitGroup
 	WgRunning() *sync.WaitGroup
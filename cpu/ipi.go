@@ -9,34 +9,111 @@ import (
 	"sync/atomic"
 )
 
-// InterruptMatrix is an (N+1)×(N+1) matrix.
+// InterruptMatrix is an (N+1)×(N+1) matrix, where N is the number of cores.
+//   Row `i` holds the interrupts raised on core `i`, with the code raised by
+// core `j` in column `j`.
 //   The last column is used by the system to interrupt a core
-type InterruptMatrix [CoresMax + 1][CoresMax + 1]uint32
+//   Each row also counts the interrupts raised in it, so that a core finds
+// that nothing is pending with a single load rather than a scan of N+1
+// columns, however many cores there are.
+type InterruptMatrix struct {
+	rows []interruptRow
+}
+
+// interruptRow is a row of the `InterruptMatrix`.
+//   `pending` is the number of codes raised in the row and not yet taken,
+// leaving out the response on the diagonal.
+//   Rows are padded to 64 bytes, a cache line on most hosts, so that cores
+// checking their own rows don't contend with each other.
+type interruptRow struct {
+	codes   []uint32
+	pending uint32
+	_       [64 - 24 - 4]uint8
+}
+
+// NewInterruptMatrix creates a new instance of `InterruptMatrix` for `n`
+// cores.
+func NewInterruptMatrix(n int) InterruptMatrix {
+	if n < 1 {
+		panic("an interrupt matrix needs at least one core")
+	}
+	m := InterruptMatrix{rows: make([]interruptRow, n+1)}
+	for i := range m.rows {
+		m.rows[i].codes = make([]uint32, n+1)
+	}
+	return m
+}
+
+// Cores returns the number of cores the matrix is made for.
+func (m *InterruptMatrix) Cores() int {
+	return len(m.rows) - 1
+}
+
+// raise raises an interrupt with `code` on core `coreID` from `by`.
+//   It returns false if `by` already has an interrupt raised on the core.
+func (m *InterruptMatrix) raise(coreID, by, code uint32) bool {
+	row := &m.rows[coreID]
+	if !atomic.CompareAndSwapUint32(&row.codes[by], 0, code) {
+		return false
+	}
+	atomic.AddUint32(&row.pending, 1)
+	return true
+}
+
+// take clears the interrupt raised on core `coreID` by `by`.
+func (m *InterruptMatrix) take(coreID, by uint32) {
+	row := &m.rows[coreID]
+	atomic.StoreUint32(&row.codes[by], 0)
+	atomic.AddUint32(&row.pending, ^uint32(0))
+}
+
+// RaiseSystemInterrupt raises an interrupt with `code` on core `coreID` from
+// the system, in the last column.
+//   This spins until the core has taken the previous interrupt from the
+// system, if there is one.
+func (m *InterruptMatrix) RaiseSystemInterrupt(coreID, code uint32) {
+	for !m.raise(coreID, uint32(m.Cores()), code) {
+	}
+}
 
 // checkInterrupts will scan through interrupts from other cores
+//   The count of pending interrupts is checked first, so that the scan is
+// only done when something has been raised.
+//   A core may take an interrupt before the core that raised it has counted
+// it, which makes the count wrap around for a moment; the count is only
+// compared with 0 so that this causes at most an extra scan.
 func (c *Core) checkInterrupts() bool {
 	thisCoreID := c.csr[Csr_MHARTID]
-	codes := &c.system.InterruptMatrix()[thisCoreID]
+	matrix := c.system.InterruptMatrix()
+	row := &matrix.rows[thisCoreID]
+	if atomic.LoadUint32(&row.pending) == 0 {
+		return false
+	}
+
+	codes := row.codes
 	interrupted := false
 
 	// if ipi is disabled, only check system interrupt
-	if !ipiEnable {
-		if code := atomic.LoadUint32(&codes[CoresMax]); code != 0 {
-			c.interruptedBy = uint32(CoresMax)
+	if !c.cfg.IPI {
+		systemID := matrix.Cores()
+		if code := atomic.LoadUint32(&codes[systemID]); code != 0 {
+			c.interruptedBy = uint32(systemID)
 			c.interruptCode = code
 			c.trap(TrapMachineExternalInterrupt)
-			atomic.StoreUint32(&codes[CoresMax], 0)
+			c.interruptCode = 0
+			matrix.take(thisCoreID, uint32(systemID))
 			interrupted = true
 		}
 		return interrupted
 	}
 
-	for i := 0; i < CoresMax+1; i++ {
+	for i := range codes {
 		if code := atomic.LoadUint32(&codes[i]); uint32(i) != thisCoreID && code != 0 {
 			c.interruptedBy = uint32(i)
 			c.interruptCode = code
 			c.trap(TrapMachineExternalInterrupt)
-			atomic.StoreUint32(&codes[i], 0)
+			c.interruptCode = 0
+			matrix.take(thisCoreID, uint32(i))
 			interrupted = true
 		}
 	}
@@ -53,11 +130,12 @@ func (c *Core) checkInterrupts() bool {
 //   An interrupt is considered active from when CAS returns true,
 // until a response is received, if a response is expected.
 func (c *Core) RaiseInterrupt(coreID, code uint32) {
-	if !ipiEnable {
-		panic("Tried to perform IPI with ipiEnable set to false")
+	if !c.cfg.IPI {
+		panic("Tried to perform IPI with Config.IPI set to false")
 	}
 
-	if coreID >= CoresMax {
+	matrix := c.system.InterruptMatrix()
+	if coreID >= uint32(matrix.Cores()) {
 		panic("Invalid interrupt target")
 	}
 
@@ -65,10 +143,9 @@ func (c *Core) RaiseInterrupt(coreID, code uint32) {
 	if coreID == thisCoreID {
 		panic("A core can't raise an interrupt on itself!")
 	}
-	ptr := &c.system.InterruptMatrix()[coreID][thisCoreID]
 	// use CAS here so that core cannot accidentally raise two interrupts on
 	// the same core this ensures that interrupts don't get lost
-	for !atomic.CompareAndSwapUint32(ptr, 0, code) {
+	for !matrix.raise(coreID, thisCoreID, code) {
 		c.checkInterrupts()
 	}
 }
@@ -77,6 +154,8 @@ func (c *Core) RaiseInterrupt(coreID, code uint32) {
 // latest received interrupt.
 //   `by` is the ID of the core that sent the interrupt
 //   `code` is an interrupt code
+//   `code` is only set while the interrupt is being handled, so an external
+// interrupt with a `code` of 0 comes from an interrupt line instead.
 func (c *Core) InterruptInfo() (by, code uint32) {
 	return c.interruptedBy, c.interruptCode
 }
@@ -86,12 +165,12 @@ func (c *Core) InterruptInfo() (by, code uint32) {
 //   It is an error to not await a response when one is expected.
 //   It is an error to await a response when one is not expected.
 func (c *Core) AwaitInterruptResponse() uint32 {
-	if !ipiEnable {
-		panic("Tried to wait for IPI response with ipiEnable set to false")
+	if !c.cfg.IPI {
+		panic("Tried to wait for IPI response with Config.IPI set to false")
 	}
 
 	thisID := c.csr[Csr_MHARTID]
-	ptr := &c.system.InterruptMatrix()[thisID][thisID]
+	ptr := &c.system.InterruptMatrix().rows[thisID].codes[thisID]
 	for atomic.LoadUint32(ptr) == 0 {
 		c.checkInterrupts()
 	}
@@ -105,7 +184,7 @@ func (c *Core) AwaitInterruptResponse() uint32 {
 //   It is an error to respond when a response is not expected.
 func (c *Core) RespondInterrupt(code uint32) {
 	by, _ := c.InterruptInfo()
-	ptr := &c.system.InterruptMatrix()[by][by]
+	ptr := &c.system.InterruptMatrix().rows[by].codes[by]
 	atomic.StoreUint32(ptr, code)
 }
 
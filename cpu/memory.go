@@ -1,58 +1,291 @@
+// This file contains the physical memory of a machine.
+//   Physical addresses are 34 bits wide, as in Sv32, where the PPN[1] field of
+// a page table entry has 12 bits; the 2 bits above the 32 of a virtual address
+// let a page table map pages above 4 GiB.
+//   The physical address space is divided into regions by a memory map: RAM,
+// MMIO where devices may be mapped, and holes where nothing is. Addresses the
+// map leaves out are holes as well.
+//   RAM is sparse; the page backing an address is only allocated when the
+// address is first written, and reads from pages that have never been written
+// return zeros. A machine can have gigabytes of RAM without the host paying
+// for more than what is used.
+//   Pages that cores have decoded instructions from are marked as code. A
+// write to a code page moves the code generation on, which tells the cores
+// that their decoded blocks may be stale, see block.go.
+
 package cpu
 
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+)
+
+// PhysicalAddressLimit is the first address above the physical address space,
+// 16 GiB.
+const PhysicalAddressLimit = 1 << 34
+
+const (
+	superpageSize  = 1 << 22 // bytes of the physical address space each entry of the directory covers
+	superpagePages = superpageSize / pagesize
 )
 
+// RegionKind is what a region of the physical address space holds.
+type RegionKind uint8
+
 const (
-	// 4 MiB of memory ought to be enough
-	MemorySize = 1024 * 1024 * 4
+	RegionHole RegionKind = iota // nothing; every access faults
+	RegionRAM                    // memory
+	RegionMMIO                   // devices, see `Memory.Map`
 )
 
-// Memory is a structure that contains a mutex and a large array of bytes.
+// Region is a range of the physical address space in a memory map.
+//   `Base` and `Size` must be multiples of the page size.
+type Region struct {
+	Base uint64
+	Size uint64
+	Kind RegionKind
+}
+
+// page is the backing of a page of RAM.
+type page [pagesize]uint8
+
+// superpage is an entry of the directory of a `Memory`, covering 4 MiB of the
+// physical address space like a leaf of the first level of an Sv32 page
+// table.
+type superpage struct {
+	kind  RegionKind   // the kind of all of its pages, unless `kinds` is set
+	kinds []RegionKind // the kind of each of its pages, if regions split it
+	pages []*page      // backing of its RAM, allocated as it is first written
+	code  []uint64     // a bit for each of its pages that is marked as code
+}
+
+// Memory is a structure that contains a mutex and the sparse RAM of a
+// machine, laid out by a memory map.
+//   Devices can be mapped into MMIO regions of the physical address space,
+// see `Memory.Map`.
+//   The lock must be held while RAM is accessed; the memory map itself
+// never changes.
 type Memory struct {
 	sync.Mutex
-	data [MemorySize]uint8
+	codeGeneration uint32 // moves on when a code page is written, accessed atomically
+
+	regions []Region
+	dir     []superpage // one for each 4 MiB of the physical address space
+	size    uint64      // bytes of RAM in all regions
+
+	bus bus // devices mapped in MMIO regions
 }
 
-// WriteRaw will write len(data) number of bytes into m.data from offset
-// and out.
+// kind returns the kind of the region `pAddr` is in.
+func (m *Memory) kind(pAddr uint64) RegionKind {
+	if pAddr >= PhysicalAddressLimit {
+		return RegionHole
+	}
+	sp := &m.dir[pAddr/superpageSize]
+	if sp.kinds != nil {
+		return sp.kinds[pAddr/pagesize%superpagePages]
+	}
+	return sp.kind
+}
+
+// isRAM returns whether `pAddr` is in RAM.
+func (m *Memory) isRAM(pAddr uint64) bool {
+	return m.kind(pAddr) == RegionRAM
+}
+
+// page returns the backing of the page of RAM that `pAddr` is in, allocating
+// it if `alloc` is set.
+//   Returns nil for a page that has never been written, if `alloc` isn't set.
+//   The lock must be held.
+func (m *Memory) page(pAddr uint64, alloc bool) *page {
+	sp := &m.dir[pAddr/superpageSize]
+	i := pAddr / pagesize % superpagePages
+	if sp.pages == nil {
+		if !alloc {
+			return nil
+		}
+		sp.pages = make([]*page, superpagePages)
+	}
+	if sp.pages[i] == nil && alloc {
+		sp.pages[i] = new(page)
+	}
+	return sp.pages[i]
+}
+
+// read copies len(dst) bytes of RAM from `pAddr` into `dst`.
+//   The lock must be held, and all of the bytes must be in RAM.
+func (m *Memory) read(pAddr uint64, dst []uint8) {
+	for len(dst) > 0 {
+		offset := pAddr % pagesize
+		n := uint64(len(dst))
+		if n > pagesize-offset {
+			n = pagesize - offset
+		}
+		if p := m.page(pAddr, false); p != nil {
+			copy(dst[:n], p[offset:])
+		} else {
+			for i := range dst[:n] {
+				dst[i] = 0
+			}
+		}
+		dst = dst[n:]
+		pAddr += n
+	}
+}
+
+// write copies `src` into RAM at `pAddr`.
+//   The lock must be held, and all of the bytes must be in RAM.
+func (m *Memory) write(pAddr uint64, src []uint8) {
+	for len(src) > 0 {
+		m.unmarkCode(pAddr)
+		offset := pAddr % pagesize
+		n := copy(m.page(pAddr, true)[offset:], src)
+		src = src[n:]
+		pAddr += uint64(n)
+	}
+}
+
+// markCode marks the page of RAM that `pAddr` is in as code.
+//   The lock must be held.
+func (m *Memory) markCode(pAddr uint64) {
+	sp := &m.dir[pAddr/superpageSize]
+	if sp.code == nil {
+		sp.code = make([]uint64, superpagePages/64)
+	}
+	i := pAddr / pagesize % superpagePages
+	sp.code[i/64] |= 1 << (i % 64)
+}
+
+// unmarkCode clears the mark of the page of RAM that `pAddr` is in, and
+// moves the code generation on if the page was marked as code.
+//   The lock must be held.
+func (m *Memory) unmarkCode(pAddr uint64) {
+	sp := &m.dir[pAddr/superpageSize]
+	if sp.code == nil {
+		return
+	}
+	i := pAddr / pagesize % superpagePages
+	if sp.code[i/64]&(1<<(i%64)) != 0 {
+		sp.code[i/64] &^= 1 << (i % 64)
+		atomic.AddUint32(&m.codeGeneration, 1)
+	}
+}
+
+// generation returns the code generation, which moves on whenever a page
+// marked as code is written.
+//   The lock need not be held.
+func (m *Memory) generation() uint32 {
+	return atomic.LoadUint32(&m.codeGeneration)
+}
+
+// inRAM returns whether all of the `n` bytes from `pAddr` are in RAM.
+func (m *Memory) inRAM(pAddr, n uint64) bool {
+	if pAddr+n < pAddr || pAddr+n > PhysicalAddressLimit {
+		return false
+	}
+	for a := pAddr &^ (pagesize - 1); a < pAddr+n; a += pagesize {
+		if !m.isRAM(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteRaw will write len(data) number of bytes into RAM from the physical
+// address `address` and out.
 //   No address translation happens.
-//   Trying to write out of range will return an error and no data will
+//   Trying to write out of RAM will return an error and no data will
 // be written.
 //   Maybe this should panic?
-func (m *Memory) WriteRaw(address uint32, data []uint8) (error, int) {
-	m.Lock()
-	defer m.Unlock()
-	if address > uint32(len(m.data)-len(data)) {
+func (m *Memory) WriteRaw(address uint64, data []uint8) (error, int) {
+	if !m.inRAM(address, uint64(len(data))) {
 		return fmt.Errorf("Address out of range!"), 0
 	}
 
-	copy(m.data[address:], data)
+	m.Lock()
+	defer m.Unlock()
+	m.write(address, data)
 
 	return nil, len(data)
 }
 
-// ReadRaw n number of bytes from address and out
+// ReadRaw n number of bytes from the physical address `address` and out
 //   No address translation happens.
-//   Trying to read out of range will return an error and no data will
+//   Trying to read out of RAM will return an error and no data will
 // be read.
 //   Maybe this should panic?
-func (m *Memory) ReadRaw(address, n uint32) (error, []uint8) {
-	m.Lock()
-	defer m.Unlock()
-	if address > uint32(len(m.data))-n {
+func (m *Memory) ReadRaw(address uint64, n uint32) (error, []uint8) {
+	if !m.inRAM(address, uint64(n)) {
 		return fmt.Errorf("Address out of range!"), nil
 	}
 
+	m.Lock()
+	defer m.Unlock()
 	bytes := make([]uint8, n)
-	copy(bytes, m.data[address:address+n])
+	m.read(address, bytes)
 
 	return nil, bytes
 }
 
-// NewMemory creates a new instance of `Memory`
-func NewMemory() Memory {
-	return Memory{}
+// Size returns the number of bytes of RAM in all regions.
+func (m *Memory) Size() uint64 {
+	return m.size
+}
+
+// Regions returns the memory map, sorted by address.
+func (m *Memory) Regions() []Region {
+	return append([]Region(nil), m.regions...)
+}
+
+// NewMemory creates a new instance of `Memory` laid out by the memory map
+// `regions`.
+//   Panics if a region is empty, is not aligned to the page size, goes beyond
+// `PhysicalAddressLimit`, or overlaps another region.
+func NewMemory(regions []Region) Memory {
+	var sorted []Region
+	var size uint64
+	for _, r := range regions {
+		if r.Size == 0 || r.Base%pagesize != 0 || r.Size%pagesize != 0 ||
+			r.Base+r.Size < r.Base || r.Base+r.Size > PhysicalAddressLimit {
+			panic(fmt.Sprintf("bad region of %d bytes at 0x%09X", r.Size, r.Base))
+		}
+		for _, other := range sorted {
+			if r.Base < other.Base+other.Size && other.Base < r.Base+r.Size {
+				panic(fmt.Sprintf("region at 0x%09X overlaps region at 0x%09X", r.Base, other.Base))
+			}
+		}
+		sorted = append(sorted, r)
+		if r.Kind == RegionRAM {
+			size += r.Size
+		}
+	}
+
+	// insertion sort; there are only ever a few regions
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && sorted[j].Base < sorted[j-1].Base; j-- {
+			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+		}
+	}
+
+	dir := make([]superpage, PhysicalAddressLimit/superpageSize)
+	for _, r := range sorted {
+		for a := r.Base; a < r.Base+r.Size; {
+			sp := &dir[a/superpageSize]
+			if a%superpageSize == 0 && r.Base+r.Size-a >= superpageSize {
+				// the region covers the whole superpage
+				sp.kind = r.Kind
+				a += superpageSize
+				continue
+			}
+
+			if sp.kinds == nil {
+				sp.kinds = make([]RegionKind, superpagePages)
+			}
+			sp.kinds[a/pagesize%superpagePages] = r.Kind
+			a += pagesize
+		}
+	}
+
+	return Memory{regions: sorted, dir: dir, size: size}
 }
@@ -4,60 +4,126 @@ package cpu
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 )
 
 type memoryController struct {
 	iCache cache // instruction cache
 	dCache cache // data cache
 	tlb    tlb   // level 0 tlb - normal pages
+
+	// fetchLine is the number of the virtual line instructions were last
+	// fetched from, fetchSATP the satp it was translated with, and fetchData
+	// the data of the line in the instruction cache.
+	//   Most instructions come from the same line as the one before, which
+	// this lets `fetch` read without translating the address or looking the
+	// line up again. It is forgotten whenever lines of the instruction cache
+	// are replaced or invalidated, and whenever the TLB is.
+	fetchLine uint32
+	fetchSATP uint32
+	fetchData []uint8
 }
 
 // newMemoryController returns a new memory controller, complete with data
-// cache, instruction cache, and a tlb.
-func newMemoryController() memoryController {
-	return memoryController{
-		dCache: newCache(),
-		iCache: newCache(),
-		tlb:    newTLB(),
+// cache, instruction cache, and a tlb, configured by `cfg`.
+//   Without `cfg.Cache`, the caches are made so that every lookup misses; the
+// hot paths then don't need to test the configuration, and only the paths for
+// misses go straight to memory.
+func newMemoryController(cfg Config) memoryController {
+	mc := memoryController{
+		dCache:    newCache(cfg),
+		iCache:    newCache(cfg),
+		tlb:       newTLB(cfg),
+		fetchLine: cacheInvalidEntry,
+	}
+	if !cfg.Cache {
+		mc.dCache.probeDepth = 0
+		mc.iCache.probeDepth = 0
 	}
+	return mc
 }
 
-// loadInstruction attempts to load a 4 byte instruction stored at virtual
-// address `vAddr`.
-//   If successful, returns `true, instruction`, `false, 0` otherwise.
+// loadInstruction attempts to load the instruction stored at virtual address
+// `vAddr`, which is 2 or 4 bytes long.
+//   With the C extension, a 4 byte instruction only has to be aligned on a
+// 2 byte boundary, so it may straddle a cache line or a page; it is then
+// fetched in two halves.
+//   If successful, returns `true, instruction`, `false, 0` otherwise. A 2 byte
+// instruction is returned in the lower half.
 func (c *Core) loadInstruction(vAddr uint32) (bool, uint32) {
-	var inst uint32
-
-	if vAddr&0x3 != 0 { // address alignment
+	if c.misalignedInstruction(vAddr) {
 		c.csr[Csr_MTVAL] = vAddr
 		c.trap(TrapInstructionAddressMisaligned)
 		return false, 0
 	}
 
-	success, pAddr := c.translate(vAddr, accessTypeInstructionFetch)
+	if vAddr&0x3 == 0 {
+		// the instruction can't cross a line or a page, whatever its length
+		return c.fetch(vAddr, 4)
+	}
 
+	success, low := c.fetch(vAddr, 2)
+	if !success || low&0x3 != 0x3 {
+		return success, low
+	}
+	success, high := c.fetch(vAddr+2, 2)
 	if !success {
 		return false, 0
 	}
+	return true, high<<16 | low
+}
 
-	if !cacheEnable {
-		c.system.Memory().Lock()
-		defer c.system.Memory().Unlock()
-		return true, binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+// fetch loads `width` bytes of instructions from virtual address `vAddr`,
+// which must not cross a cache line.
+//   If successful, returns `true, v`, `false, 0` otherwise.
+func (c *Core) fetch(vAddr, width uint32) (bool, uint32) {
+	if vAddr>>(c.mc.iCache.offsetBits&31) != c.mc.fetchLine || c.csr[Csr_SATP] != c.mc.fetchSATP {
+		if success, v, done := c.fetchLineOf(vAddr, width); done {
+			return success, v
+		}
 	}
 
-	if hit, instruction := c.mc.iCache.load(pAddr, 4); !hit {
-		lineNumber := pAddr >> cacheLineOffsetBits
-		c.system.Memory().Lock()
-		c.mc.iCache.replace(lineNumber, cacheFlagNone, c.system.Memory().data[:])
-		c.system.Memory().Unlock()
-		_, instruction := c.mc.iCache.load(pAddr, 4)
-		inst = uint32(instruction)
-	} else {
-		inst = uint32(instruction)
+	data := c.mc.fetchData[vAddr&c.mc.iCache.offsetMask:]
+	if width == 2 {
+		return true, uint32(binary.LittleEndian.Uint16(data))
+	}
+	return true, binary.LittleEndian.Uint32(data)
+}
+
+// fetchLineOf translates `vAddr` and brings its line into the instruction
+// cache, to be remembered as the line `fetch` reads from.
+//   If the line can't be remembered, because the fetch failed or the caches
+// are disabled, the fetch is done here and `done` is set.
+func (c *Core) fetchLineOf(vAddr, width uint32) (success bool, v uint32, done bool) {
+	success, pAddr := c.translate(vAddr, accessTypeInstructionFetch)
+	if !success {
+		return false, 0, true
 	}
 
-	return true, inst
+	m := c.system.Memory()
+	if !m.isRAM(pAddr) { // instructions can't be fetched from devices
+		c.csr[Csr_MTVAL] = vAddr
+		c.trap(TrapInstructionAccessFault)
+		return false, 0, true
+	}
+
+	if !c.cfg.Cache {
+		return true, uint32(c.loadUncached(pAddr, width)), true
+	}
+
+	lineNumber := uint32(pAddr >> c.mc.iCache.offsetBits)
+	slot, hit := c.mc.iCache.find(lineNumber)
+	if !hit {
+		m.Lock()
+		c.mc.iCache.replace(lineNumber, cacheFlagNone, m)
+		m.Unlock()
+		slot, _ = c.mc.iCache.find(lineNumber)
+	}
+	c.mc.fetchLine = vAddr >> c.mc.iCache.offsetBits
+	c.mc.fetchSATP = c.csr[Csr_SATP]
+	c.mc.fetchData = c.mc.iCache.line(slot)
+	return true, 0, false
 }
 
 // load will attempt to load `width` bytes from the virtual address `vAddr`.
@@ -78,36 +144,36 @@ func (c *Core) load(vAddr, width uint32) (bool, uint64) {
 		return false, 0
 	}
 
-	if !cacheEnable {
-		c.system.Memory().Lock()
-		defer c.system.Memory().Unlock()
-
-		if width == 1 {
-			return true, uint64(c.system.Memory().data[pAddr])
-		}
-
-		switch width {
-		case 2:
-			return true, uint64(binary.LittleEndian.Uint16(c.system.Memory().data[pAddr : pAddr+4]))
-		case 4:
-			return true, uint64(binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4]))
-		case 8:
-			return true, binary.LittleEndian.Uint64(c.system.Memory().data[pAddr : pAddr+4])
-		default:
-			panic("Invalid load width")
+	if !c.system.Memory().isRAM(pAddr) {
+		dev, offset := c.system.Memory().device(pAddr)
+		success, v := dev.Read(offset, width)
+		if !success {
+			c.csr[Csr_MTVAL] = vAddr
+			c.trap(TrapLoadAccessFault)
 		}
+		return success, v
 	}
 
-	if hit, v := c.mc.dCache.load(pAddr, width); !hit {
-		lineNumber := pAddr >> cacheLineOffsetBits
-		c.system.Memory().Lock()
-		c.mc.dCache.replace(lineNumber, cacheFlagNone, c.system.Memory().data[:])
-		c.system.Memory().Unlock()
-		_, v := c.mc.dCache.load(pAddr, width)
-		return true, v
-	} else {
-		return true, v
+	return true, c.loadPhysical(pAddr, width)
+}
+
+// loadPhysical loads `width` bytes from the physical address `pAddr` through
+// the data cache.
+//   `pAddr` has to be aligned on a `width` byte boundary.
+func (c *Core) loadPhysical(pAddr uint64, width uint32) uint64 {
+	if hit, v := c.mc.dCache.load(pAddr, width); hit {
+		return v
 	}
+	if !c.cfg.Cache {
+		return c.loadUncached(pAddr, width)
+	}
+
+	lineNumber := uint32(pAddr >> c.mc.dCache.offsetBits)
+	c.system.Memory().Lock()
+	c.mc.dCache.replace(lineNumber, cacheFlagNone, c.system.Memory())
+	c.system.Memory().Unlock()
+	_, v := c.mc.dCache.load(pAddr, width)
+	return v
 }
 
 // store will attempt to store `width` bytes to the virtual address `vAddr`.
@@ -128,41 +194,84 @@ func (c *Core) store(vAddr, width uint32, v uint64) bool {
 		return false
 	}
 
-	if !cacheEnable {
-		c.system.Memory().Lock()
-		defer c.system.Memory().Unlock()
-
-		if width == 1 {
-			c.system.Memory().data[pAddr] = uint8(v)
-			return true
+	if !c.system.Memory().isRAM(pAddr) {
+		dev, offset := c.system.Memory().device(pAddr)
+		if !dev.Write(offset, width, v) {
+			c.csr[Csr_MTVAL] = vAddr
+			c.trap(TrapStoreAccessFault)
+			return false
 		}
-
-		var bytes [8]uint8
-
-		switch width {
-		case 2:
-			binary.LittleEndian.PutUint16(bytes[:], uint16(v))
-		case 4:
-			binary.LittleEndian.PutUint32(bytes[:], uint32(v))
-		case 8:
-			binary.LittleEndian.PutUint64(bytes[:], v)
-		default:
-			panic("Invalid store width")
-		}
-
-		copy(c.system.Memory().data[pAddr:], bytes[:width])
 		return true
 	}
 
+	c.storePhysical(pAddr, width, v)
+	return true
+}
+
+// storePhysical stores `width` bytes to the physical address `pAddr` through
+// the data cache.
+//   `pAddr` has to be aligned on a `width` byte boundary.
+func (c *Core) storePhysical(pAddr uint64, width uint32, v uint64) {
 	if hit := c.mc.dCache.store(pAddr, width, v); !hit {
-		lineNumber := pAddr >> cacheLineOffsetBits
+		if !c.cfg.Cache {
+			c.storeUncached(pAddr, width, v)
+			return
+		}
+
+		lineNumber := uint32(pAddr >> c.mc.dCache.offsetBits)
 		c.system.Memory().Lock()
-		c.mc.dCache.replace(lineNumber, cacheFlagNone, c.system.Memory().data[:])
+		c.mc.dCache.replace(lineNumber, cacheFlagNone, c.system.Memory())
 		c.system.Memory().Unlock()
 		c.mc.dCache.store(pAddr, width, v)
 	}
+}
 
-	return true
+// loadUncached loads `width` bytes from the physical address `pAddr` straight
+// from memory, for when the caches are disabled.
+//   It is kept out of `loadPhysical` and `fetch`, whose hit path is hot; the
+// defer alone would slow them down.
+func (c *Core) loadUncached(pAddr uint64, width uint32) uint64 {
+	var bytes [8]uint8
+
+	c.system.Memory().Lock()
+	c.system.Memory().read(pAddr, bytes[:width])
+	c.system.Memory().Unlock()
+
+	switch width {
+	case 1:
+		return uint64(bytes[0])
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(bytes[:]))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(bytes[:]))
+	case 8:
+		return binary.LittleEndian.Uint64(bytes[:])
+	default:
+		panic("Invalid load width")
+	}
+}
+
+// storeUncached stores `width` bytes to the physical address `pAddr` straight
+// to memory, for when the caches are disabled.
+func (c *Core) storeUncached(pAddr uint64, width uint32, v uint64) {
+	var bytes [8]uint8
+
+	switch width {
+	case 1:
+		bytes[0] = uint8(v)
+	case 2:
+		binary.LittleEndian.PutUint16(bytes[:], uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(bytes[:], uint32(v))
+	case 8:
+		binary.LittleEndian.PutUint64(bytes[:], v)
+	default:
+		panic("Invalid store width")
+	}
+
+	c.system.Memory().Lock()
+	c.system.Memory().write(pAddr, bytes[:width])
+	c.system.Memory().Unlock()
 }
 
 // loadByte attempts to load a single byte from the virtual address `vAddr`.
@@ -214,17 +323,20 @@ func (c *Core) SC_W() {
 // FENCE invalidates the data cache.
 func (c *Core) FENCE() {
 	c.system.Memory().Lock()
-	c.mc.dCache.writebackAll(c.system.Memory().data[:])
+	c.mc.dCache.writebackAll(c.system.Memory())
 	c.system.Memory().Unlock()
 	c.mc.dCache.invalidateAll()
 }
 
-// FENCE_I flushes written data and invalidates the instruction cache.
+// FENCE_I flushes written data and invalidates the instruction cache and the
+// block cache.
 func (c *Core) FENCE_I() {
 	c.system.Memory().Lock()
-	c.mc.dCache.writebackAll(c.system.Memory().data[:])
+	c.mc.dCache.writebackAll(c.system.Memory())
 	c.system.Memory().Unlock()
 	c.mc.iCache.invalidateAll()
+	c.mc.fetchLine = cacheInvalidEntry
+	c.blocks.invalidateAll()
 }
 
 const (
@@ -238,6 +350,7 @@ const (
 func (c *Core) SFENCE_VMA(asid, vAddr, flag uint32) {
 	// TODO discriminate on asid and vAddr depending on the flags
 	c.mc.tlb.invalidateAll()
+	c.mc.fetchLine = cacheInvalidEntry
 }
 
 // AtomicStoreWordPhysicalUncached will atomically store a single word `w` to
@@ -245,21 +358,27 @@ func (c *Core) SFENCE_VMA(asid, vAddr, flag uint32) {
 //   Misaligned access causes this function to fail with `false`.
 //   Otherwise, the memory is locked, the word is written, and this function
 // returns `true`.
+//   If a device is mapped at `pAddr`, the word is written to the device
+// instead.
 //
 //   This function, along with Core.AtomicLoadWordPhysicalUncached should only
 // be used by the system when atomic access is required and access should be
 // uncached (such as when modifying the page table).
 //   In all other instances, systems should use the Core.Read and Core.Write
 // functions to access the virtual address space currently in use.
-func (c *Core) AtomicStoreWordPhysicalUncached(pAddr, w uint32) bool {
+func (c *Core) AtomicStoreWordPhysicalUncached(pAddr uint64, w uint32) bool {
 	if pAddr&0x3 != 0 { // misaligned access
 		return false
 	}
 
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		return dev.Write(offset, 4, uint64(w))
+	}
+
 	var bytes [4]uint8
 	binary.LittleEndian.PutUint32(bytes[:], w)
 	c.system.Memory().Lock()
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+	c.system.Memory().write(pAddr, bytes[:])
 	c.system.Memory().Unlock()
 	return true
 }
@@ -269,30 +388,167 @@ func (c *Core) AtomicStoreWordPhysicalUncached(pAddr, w uint32) bool {
 //   Misaligned access causes this function to fail with `false, 0`.
 //   Otherwise, the memory is locked, the word is written, and this function
 // returns `true, w` where `w` is the word.
+//   If a device is mapped at `pAddr`, the word is read from the device
+// instead.
 //
 //   This function, along with Core.AtomicStoreWordPhysicalUncached should only
 // be used by the system when atomic access is required and access should be
 // uncached (such as when modifying the page table).
 //   In all other instances, systems should use the Core.Read and Core.Write
 // functions to access the virtual address space currently in use.
-func (c *Core) AtomicLoadWordPhysicalUncached(pAddr uint32) (bool, uint32) {
+func (c *Core) AtomicLoadWordPhysicalUncached(pAddr uint64) (bool, uint32) {
 	if pAddr&0x3 != 0 { // misaligned access
 		return false, 0
 	}
 
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		success, v := dev.Read(offset, 4)
+		return success, uint32(v)
+	}
+
+	var bytes [4]uint8
 	c.system.Memory().Lock()
-	defer c.system.Memory().Unlock()
-	return true, binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	c.system.Memory().read(pAddr, bytes[:])
+	c.system.Memory().Unlock()
+	return true, binary.LittleEndian.Uint32(bytes[:])
+}
+
+// FaultError is the error returned when the system accesses a virtual
+// address that the process running on the core could not access itself.
+type FaultError struct {
+	Addr  uint32 // first address that could not be accessed
+	Write bool   // the access was a write
+}
+
+func (e *FaultError) Error() string {
+	if e.Write {
+		return fmt.Sprintf("fault writing to 0x%08X", e.Addr)
+	}
+	return fmt.Sprintf("fault reading from 0x%08X", e.Addr)
+}
+
+// ErrStringTooLong is returned by Core.CopyInString when no terminator is
+// found within the allowed length.
+var ErrStringTooLong = errors.New("string too long")
+
+// userAddress translates `vAddr` the way a user mode access of type `aType`
+// would, including the permission checks, but fails with `false, 0` instead
+// of trapping.
+//   The TLB is neither used nor filled.
+func (c *Core) userAddress(vAddr uint32, aType accessType) (bool, uint64) {
+	pAddr := uint64(vAddr)
+
+	if satp := c.csr[Csr_SATP]; satp&0x80000000 != 0 {
+		i, pte := c.walkTable(vAddr>>12 | satp&0x7FC00000)
+		if i < 0 || pte == 0 || !pteAllows(pte, aType) {
+			return false, 0
+		}
+		pAddr = pteAddress(pte, vAddr, i)
+	}
+
+	if !c.system.Memory().isRAM(pAddr) {
+		return false, 0
+	}
+	return true, pAddr
 }
 
 // Read reads `n` bytes from the core's current address space (might be
 // virtual).
+//   Every page must be readable by the process running on the core, and the
+// data is read through the data cache, so writes the process has not yet
+// written back are seen.
+//   A bad address makes Read fail with a *FaultError instead of trapping.
 func (c *Core) Read(addr, n uint32) (error, []uint8) {
-	panic("Core.Read not implemented!")
+	if addr+n < addr {
+		return &FaultError{Addr: addr}, nil
+	}
+
+	data := make([]uint8, n)
+	for i := uint32(0); i < n; {
+		ok, pAddr := c.userAddress(addr+i, accessTypeLoad)
+		if !ok {
+			return &FaultError{Addr: addr + i}, nil
+		}
+
+		chunk := pagesize - (addr+i)%pagesize
+		if chunk > n-i {
+			chunk = n - i
+		}
+		for j := uint32(0); j < chunk; j++ {
+			data[i+j] = uint8(c.loadPhysical(pAddr+uint64(j), 1))
+		}
+		i += chunk
+	}
+
+	return nil, data
 }
 
 // Write writes len(data) bytes from the core's current address space
 // (might be virtual).
+//   Every page must be writable by the process running on the core, and the
+// data is written through the data cache, just like the stores of the process.
+//   A bad address makes Write fail with a *FaultError instead of trapping, in
+// which case nothing is written.
 func (c *Core) Write(addr uint32, data []uint8) (error, int) {
-	panic("Core.Write not implemented!")
+	n := uint32(len(data))
+	if addr+n < addr {
+		return &FaultError{Addr: addr, Write: true}, 0
+	}
+
+	// translate everything first so a bad page halfway leaves memory untouched
+	var pAddrs []uint64
+	for i := uint32(0); i < n; i += pagesize - (addr+i)%pagesize {
+		ok, pAddr := c.userAddress(addr+i, accessTypeStore)
+		if !ok {
+			return &FaultError{Addr: addr + i, Write: true}, 0
+		}
+		pAddrs = append(pAddrs, pAddr)
+	}
+
+	i := uint32(0)
+	for _, pAddr := range pAddrs {
+		chunk := uint32(pagesize - pAddr%pagesize)
+		if chunk > n-i {
+			chunk = n - i
+		}
+		for j := uint32(0); j < chunk; j++ {
+			c.storePhysical(pAddr+uint64(j), 1, uint64(data[i+j]))
+		}
+		i += chunk
+	}
+
+	return nil, len(data)
+}
+
+// CopyInString reads a NUL-terminated string of at most `max` bytes, the
+// terminator included, from the core's current address space.
+//   Fails with a *FaultError for a bad address, or ErrStringTooLong if there
+// is no terminator.
+func (c *Core) CopyInString(addr, max uint32) (error, string) {
+	var str []uint8
+	for uint32(len(str)) < max {
+		a := addr + uint32(len(str))
+		ok, pAddr := c.userAddress(a, accessTypeLoad)
+		if !ok {
+			return &FaultError{Addr: a}, ""
+		}
+
+		for chunk := pagesize - a%pagesize; chunk > 0 && uint32(len(str)) < max; chunk-- {
+			b := uint8(c.loadPhysical(pAddr, 1))
+			if b == 0 {
+				return nil, string(str)
+			}
+			str = append(str, b)
+			pAddr++
+		}
+	}
+
+	return ErrStringTooLong, ""
+}
+
+// CopyOut writes `data` to the core's current address space, all of it or
+// nothing.
+func (c *Core) CopyOut(addr uint32, data []uint8) error {
+	err, _ := c.Write(addr, data)
+	return err
 }
@@ -0,0 +1,61 @@
+package cpu
+
+import "testing"
+
+// TestLoadInstructionStraddlingPages fetches instructions that start in the
+// last halfword of a page, with and without the caches, when the next page is
+// mapped elsewhere in memory and when it isn't mapped at all.
+func TestLoadInstructionStraddlingPages(t *testing.T) {
+	const (
+		root   = 0x10000 // the first level of the page table
+		leaves = 0x11000 // the second level, for the first 4 MiB
+		flags  = pageFlagValid | pageFlagRead | pageFlagExec | pageFlagUser | pageFlagAccessed
+
+		addi = 0x00150513 // addi a0, a0, 1
+		cLI  = 0x4545     // c.li a0, 17
+	)
+
+	for _, cached := range []bool{true, false} {
+		cfg := DefaultConfig()
+		cfg.Cache = cached
+		c, s := newTestCore(cfg)
+		m := &s.memory
+
+		// virtual pages 0, 2 and 4 are mapped, 1 and 3 aren't, and 5 is mapped
+		// apart from 4 in memory
+		writeWord(t, m, root, leaves>>12<<10|pageFlagValid)
+		for vpn, ppn := range map[uint64]uint32{0: 0x20, 2: 0x22, 4: 0x24, 5: 0x30} {
+			writeWord(t, m, leaves+vpn*4, ppn<<10|flags)
+		}
+		c.csr[Csr_SATP] = 0x80000000 | root>>12
+
+		writeWord(t, m, 0x20ffc, addi<<16&0xffffffff)
+		writeWord(t, m, 0x22ffc, cLI<<16)
+		writeWord(t, m, 0x24ffc, addi<<16&0xffffffff)
+		writeWord(t, m, 0x30000, addi>>16)
+
+		// a 4 byte instruction faults on its second half
+		c.pc = 0x0ffe
+		if ok, inst := c.loadInstruction(c.pc); ok {
+			t.Errorf("cache %v: fetched %#08x across an unmapped page", cached, inst)
+		}
+		if len(s.traps) != 1 || s.traps[0] != TrapInstructionPageFault {
+			t.Errorf("cache %v: took traps %v, want an instruction page fault", cached, s.traps)
+		}
+		if c.csr[Csr_MTVAL] != 0x1000 || c.csr[Csr_MEPC] != 0x0ffe || c.pc != 0x0ffe {
+			t.Errorf("cache %v: faulted with mtval %#x and mepc %#x, going to %#x, want 0x1000, 0xffe and 0xffe",
+				cached, c.csr[Csr_MTVAL], c.csr[Csr_MEPC], c.pc)
+		}
+
+		// a 2 byte instruction doesn't get that far
+		s.traps = nil
+		if ok, inst := c.loadInstruction(0x2ffe); !ok || inst != cLI || len(s.traps) != 0 {
+			t.Errorf("cache %v: fetched %#04x, %v with traps %v, want %#04x", cached, inst, ok, s.traps, cLI)
+		}
+
+		// the halves of one that doesn't fault come from either page
+		if ok, inst := c.loadInstruction(0x4ffe); !ok || inst != addi || len(s.traps) != 0 {
+			t.Errorf("cache %v: fetched %#08x, %v with traps %v, want %#08x", cached, inst, ok, s.traps, addi)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testMemoryMap is a memory map with RAM below and above 4 GiB, a hole in
+// between, and nothing at all above 5 GiB.
+var testMemoryMap = []Region{
+	{Base: 0, Size: testRAMSize, Kind: RegionRAM},
+	{Base: testRAMSize, Size: 1<<32 - testRAMSize, Kind: RegionHole},
+	{Base: 1 << 32, Size: 1 << 30, Kind: RegionRAM},
+}
+
+// TestMemoryLazyPages checks that pages of RAM read as zero until they are
+// written, and that reading them doesn't allocate them.
+func TestMemoryLazyPages(t *testing.T) {
+	m := NewMemory(testMemoryMap)
+
+	for _, addr := range []uint64{0, testRAMSize - pagesize, 1 << 32, 1<<32 + 1<<30 - 8} {
+		err, b := m.ReadRaw(addr, 8)
+		if err != nil || !bytes.Equal(b, make([]uint8, 8)) {
+			t.Errorf("fresh RAM at %#x reads as %v, %v, want zeros", addr, b, err)
+		}
+		if m.page(addr, false) != nil {
+			t.Errorf("reading %#x allocated its page", addr)
+		}
+	}
+
+	// a write allocates the pages it touches, and no more; the rest of them
+	// still reads as zero
+	const addr = 1<<32 + 3*pagesize - 2
+	if err, _ := m.WriteRaw(addr, []uint8{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	want := []uint8{0, 0, 1, 2, 3, 4, 0, 0}
+	if err, b := m.ReadRaw(addr-2, 8); err != nil || !bytes.Equal(b, want) {
+		t.Errorf("RAM around a write reads as %v, %v, want %v", b, err, want)
+	}
+	for _, page := range []uint64{1<<32 + pagesize, 1<<32 + 4*pagesize} {
+		if m.page(page, false) != nil {
+			t.Errorf("a write to %#x allocated the page at %#x", uint64(addr), page)
+		}
+	}
+}
+
+// TestMemoryAbove4GiB stores through pages whose PPN[1] has the bits of the
+// physical address above 32 set, a normal page and a superpage, with and
+// without the caches, and checks that the values land above 4 GiB.
+func TestMemoryAbove4GiB(t *testing.T) {
+	const (
+		root   = 0x10000 // the first level of the page table
+		leaves = 0x11000 // the second level, for the first 4 MiB
+		flags  = pageFlagValid | pageFlagRead | pageFlagWrite | pageFlagUser | pageFlagAccessed | pageFlagDirty
+	)
+
+	for _, cached := range []bool{true, false} {
+		cfg := DefaultConfig()
+		cfg.Cache = cached
+		c, s := newTestCore(cfg)
+		s.memory = NewMemory(testMemoryMap)
+		m := &s.memory
+
+		// virtual page 2 is at 4 GiB + 8 KiB, and the superpage at 4 MiB at
+		// 4 GiB + 4 MiB
+		writeWord(t, m, root, leaves>>12<<10|pageFlagValid)
+		writeWord(t, m, root+4, 0x100400<<10|flags)
+		writeWord(t, m, leaves+2*4, 0x100002<<10|flags)
+		c.csr[Csr_SATP] = 0x80000000 | root>>12
+
+		for _, tc := range []struct {
+			vAddr uint32
+			pAddr uint64
+		}{
+			{0x2008, 0x100002008},
+			{0x4ABCD0, 0x1004ABCD0},
+		} {
+			if !c.store(tc.vAddr, 4, 0xDEADBEEF) {
+				t.Errorf("cache %v: store to %#x took traps %v", cached, tc.vAddr, s.traps)
+				continue
+			}
+			if ok, v := c.load(tc.vAddr, 4); !ok || v != 0xDEADBEEF {
+				t.Errorf("cache %v: %#x loads as %#x, %v, want 0xdeadbeef", cached, tc.vAddr, v, ok)
+			}
+
+			// through the cache, the store only reaches memory when its line
+			// is written back
+			c.FENCE()
+			err, b := m.ReadRaw(tc.pAddr, 4)
+			if err != nil || binary.LittleEndian.Uint32(b) != 0xDEADBEEF {
+				t.Errorf("cache %v: %#x holds %v, %v, want 0xdeadbeef", cached, tc.pAddr, b, err)
+			}
+			if err, b := m.ReadRaw(tc.pAddr&0xFFFFFFFF, 4); err == nil && binary.LittleEndian.Uint32(b) != 0 {
+				t.Errorf("cache %v: the store to %#x went to %#x as well", cached, tc.pAddr, tc.pAddr&0xFFFFFFFF)
+			}
+		}
+	}
+}
+
+// TestMemoryHoles checks that loads, stores and fetches fault in holes and
+// beyond the memory map, and that raw accesses there fail.
+func TestMemoryHoles(t *testing.T) {
+	for _, addr := range []uint32{testRAMSize, 0x80000000, 0xFFFFFFFC} {
+		c, s := newTestCore(DefaultConfig())
+		s.memory = NewMemory(testMemoryMap)
+
+		if ok, _ := c.load(addr, 4); ok || len(s.traps) != 1 || s.traps[0] != TrapLoadAccessFault {
+			t.Errorf("load from %#x took traps %v, want a load access fault", addr, s.traps)
+		}
+		s.traps = nil
+		if c.store(addr, 4, 1) || len(s.traps) != 1 || s.traps[0] != TrapStoreAccessFault {
+			t.Errorf("store to %#x took traps %v, want a store access fault", addr, s.traps)
+		}
+		s.traps = nil
+		if ok, _ := c.loadInstruction(addr); ok || len(s.traps) != 1 || s.traps[0] != TrapInstructionAccessFault {
+			t.Errorf("fetch from %#x took traps %v, want an instruction access fault", addr, s.traps)
+		}
+	}
+
+	m := NewMemory(testMemoryMap)
+	for _, addr := range []uint64{testRAMSize - 2, 1<<32 - 4, 1<<32 + 1<<30, PhysicalAddressLimit - 4} {
+		if err, _ := m.ReadRaw(addr, 4); err == nil {
+			t.Errorf("read of %#x succeeded", addr)
+		}
+		if err, _ := m.WriteRaw(addr, make([]uint8, 4)); err == nil {
+			t.Errorf("write to %#x succeeded", addr)
+		}
+	}
+}
+
+// TestNewMemoryBadRegions checks that NewMemory refuses memory maps with
+// regions that are empty, misaligned, too high, or overlap.
+func TestNewMemoryBadRegions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		regions []Region
+	}{
+		{"empty", []Region{{Base: 0, Size: 0, Kind: RegionRAM}}},
+		{"misaligned base", []Region{{Base: 0x800, Size: pagesize, Kind: RegionRAM}}},
+		{"misaligned size", []Region{{Base: 0, Size: pagesize + 1, Kind: RegionRAM}}},
+		{"beyond the limit", []Region{{Base: PhysicalAddressLimit - pagesize, Size: 2 * pagesize, Kind: RegionRAM}}},
+		{"wrapping around", []Region{{Base: pagesize, Size: 1<<64 - pagesize, Kind: RegionRAM}}},
+		{"overlapping", []Region{
+			{Base: 0, Size: 4 * pagesize, Kind: RegionRAM},
+			{Base: 3 * pagesize, Size: pagesize, Kind: RegionMMIO},
+		}},
+		{"overlapping, out of order", []Region{
+			{Base: 2 * pagesize, Size: 2 * pagesize, Kind: RegionMMIO},
+			{Base: 0, Size: 3 * pagesize, Kind: RegionRAM},
+		}},
+		{"the same twice", []Region{
+			{Base: 0, Size: pagesize, Kind: RegionRAM},
+			{Base: 0, Size: pagesize, Kind: RegionRAM},
+		}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: NewMemory accepted %v", tc.name, tc.regions)
+				}
+			}()
+			NewMemory(tc.regions)
+		}()
+	}
+
+	// regions that only touch are fine
+	m := NewMemory([]Region{
+		{Base: pagesize, Size: pagesize, Kind: RegionMMIO},
+		{Base: 0, Size: pagesize, Kind: RegionRAM},
+	})
+	if m.Size() != pagesize || !m.isRAM(0) || m.isRAM(pagesize) {
+		t.Errorf("adjacent regions give %d bytes of RAM, RAM at 0 %v and at %#x %v",
+			m.Size(), m.isRAM(0), pagesize, m.isRAM(pagesize))
+	}
+}
@@ -0,0 +1,97 @@
+// This file contains the interrupt lines of a core, and how they are masked.
+//   Devices such as timers do not interrupt a core directly; they raise a
+// line, which sets the matching bit in `mip`, as in the RISC-V privileged
+// specification.
+//   The core takes the interrupt the next time it checks for interrupts if
+// the matching bit in `mie` and the MIE bit in `mstatus` are set. Until then
+// the interrupt stays pending in `mip`, for as long as the line stays raised;
+// a handler has to deal with whatever raised the line, or it is taken again.
+//   Taking a trap clears MIE, after saving it in MPIE, and returning from the
+// handler restores it, like the `mret` instruction does.
+//   Interrupts raised through the `InterruptMatrix` can not be masked.
+
+package cpu
+
+import "sync/atomic"
+
+// Bits in mip.
+const (
+	MIP_MSIP uint32 = 1 << 3  // machine software interrupt
+	MIP_MTIP uint32 = 1 << 7  // machine timer interrupt
+	MIP_MEIP uint32 = 1 << 11 // machine external interrupt
+)
+
+// Bits in mie, in the same places as the interrupts they enable in mip.
+const (
+	MIE_MSIE uint32 = 1 << 3  // enable machine software interrupts
+	MIE_MTIE uint32 = 1 << 7  // enable machine timer interrupts
+	MIE_MEIE uint32 = 1 << 11 // enable machine external interrupts
+)
+
+// Bits in mstatus.
+const (
+	MSTATUS_MIE  uint32 = 1 << 3 // interrupts are enabled
+	MSTATUS_MPIE uint32 = 1 << 7 // MIE from before the current trap
+)
+
+// SetPending raises the interrupt lines in `bits` if `level` is true, or
+// lowers them otherwise.
+//   It may be called from any goroutine.
+func (c *Core) SetPending(bits uint32, level bool) {
+	for {
+		old := atomic.LoadUint32(&c.pending)
+		v := old &^ bits
+		if level {
+			v = old | bits
+		}
+		if atomic.CompareAndSwapUint32(&c.pending, old, v) {
+			return
+		}
+	}
+}
+
+// Pending returns the interrupt lines that are raised, which is the value of
+// mip.
+func (c *Core) Pending() uint32 {
+	return atomic.LoadUint32(&c.pending)
+}
+
+// enabledPending returns the interrupts that are pending and enabled in mie,
+// whether or not mstatus.MIE is set.
+func (c *Core) enabledPending() uint32 {
+	return atomic.LoadUint32(&c.pending) & c.csr[Csr_MIE]
+}
+
+// checkPending traps if an enabled interrupt is pending.
+//   External interrupts are taken before software interrupts, and those before
+// timer interrupts, as in the RISC-V privileged specification.
+func (c *Core) checkPending() bool {
+	if c.csr[Csr_MSTATUS]&MSTATUS_MIE == 0 {
+		return false
+	}
+
+	pending := c.enabledPending()
+	switch {
+	case pending&MIP_MEIP != 0:
+		c.trap(TrapMachineExternalInterrupt)
+	case pending&MIP_MSIP != 0:
+		c.trap(TrapMachineSoftwareInterrupt)
+	case pending&MIP_MTIP != 0:
+		c.trap(TrapMachineTimerInterrupt)
+	default:
+		return false
+	}
+	return true
+}
+
+// waitCycles is the number of cycles a waiting core counts for every
+// millisecond it waits.
+const waitCycles = 10000
+
+// Cycles returns the number of cycles the core has spent executing
+// instructions or waiting for an interrupt.
+//   The count is only brought up to date every few cycles, so it lags a little
+// behind when read from another goroutine.
+func (c *Core) Cycles() uint64 {
+	return atomic.LoadUint64(&c.cycles)
+}
@@ -18,7 +18,7 @@ type reservation struct {
 // valid or not.
 type ReservationSets struct {
 	sync.Mutex
-	reservations [CoresMax]reservation
+	reservations []reservation // one for each core
 }
 
 // unsafeInvalidate invalidates a matching reservation on all cores
@@ -50,7 +50,8 @@ func (rs *ReservationSets) unsafeInvalidateSingle(set int, addr uint32) bool {
 	return false
 }
 
-// NewReservationSets creates a new instance of `ReservationSets`
-func NewReservationSets() ReservationSets {
-	return ReservationSets{}
+// NewReservationSets creates a new instance of `ReservationSets` for `n`
+// cores.
+func NewReservationSets(n int) ReservationSets {
+	return ReservationSets{reservations: make([]reservation, n)}
 }
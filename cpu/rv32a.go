@@ -23,14 +23,27 @@ func (c *Core) lr_w(inst uint32) {
 		return // no side effects
 	}
 
-	pLine := pAddr >> cacheLineOffsetBits
-
-	// update rset
-	c.system.Memory().Lock()
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
-	// attempt to update value in cache, don't care about success
-	c.mc.dCache.store(pAddr, 4, uint64(w))
-	c.system.Memory().Unlock()
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
+
+	var w uint32
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		ok, v := dev.Read(offset, 4)
+		if !ok {
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapLoadAccessFault)
+			return
+		}
+		w = uint32(v)
+	} else {
+		// update rset
+		var bytes [4]uint8
+		c.system.Memory().Lock()
+		c.system.Memory().read(pAddr, bytes[:])
+		w = binary.LittleEndian.Uint32(bytes[:])
+		// attempt to update value in cache, don't care about success
+		c.mc.dCache.store(pAddr, 4, uint64(w))
+		c.system.Memory().Unlock()
+	}
 
 	if success {
 		c.system.ReservationSets().Lock()
@@ -61,19 +74,23 @@ func (c *Core) sc_w(inst uint32) {
 		return
 	}
 
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock()
 	// check rset
 	hid := int(c.csr[Csr_MHARTID])
 	if c.system.ReservationSets().unsafeInvalidateSingle(hid, pLine) {
-		var bytes [4]uint8
-		binary.LittleEndian.PutUint32(bytes[:], c.reg[rs2])
+		if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+			success = dev.Write(offset, 4, uint64(c.reg[rs2]))
+		} else {
+			var bytes [4]uint8
+			binary.LittleEndian.PutUint32(bytes[:], c.reg[rs2])
 
-		c.system.Memory().Lock()
-		copy(c.system.Memory().data[pAddr:], bytes[:])
-		c.mc.dCache.store(pAddr, 4, uint64(c.reg[rs2])) // attempt to update value in cache, don't care about success
-		c.system.Memory().Unlock()
+			c.system.Memory().Lock()
+			c.system.Memory().write(pAddr, bytes[:])
+			c.mc.dCache.store(pAddr, 4, uint64(c.reg[rs2])) // attempt to update value in cache, don't care about success
+			c.system.Memory().Unlock()
+		}
 
 		if success {
 			c.reg[rd] = 0
@@ -89,6 +106,11 @@ func (c *Core) sc_w(inst uint32) {
 	// invalidates any reservation held by this hart.
 	c.system.ReservationSets().unsafeInvalidateSingle(hid, pLine)
 	c.system.ReservationSets().Unlock()
+
+	if !success { // the device refused the write
+		c.csr[Csr_MTVAL] = addr
+		c.trap(TrapStoreAccessFault)
+	}
 }
 
 func (c *Core) amoswap_w(inst uint32) {
@@ -111,27 +133,45 @@ func (c *Core) amoswap_w(inst uint32) {
 		return
 	}
 
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := src
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := src
+		// calculate new value
+		res := src
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LRs
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -157,27 +197,45 @@ func (c *Core) amoadd_w(inst uint32) {
 	if !success {
 		return
 	}
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := w + src
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := w + src
+		// calculate new value
+		res := w + src
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LR in all cores
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -203,27 +261,45 @@ func (c *Core) amoand_w(inst uint32) {
 	if !success {
 		return
 	}
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := w & src
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := w & src
+		// calculate new value
+		res := w & src
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LRs
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -249,27 +325,45 @@ func (c *Core) amoor_w(inst uint32) {
 	if !success {
 		return
 	}
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := w | src
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := w | src
+		// calculate new value
+		res := w | src
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LRs
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -295,27 +389,45 @@ func (c *Core) amoxor_w(inst uint32) {
 	if !success {
 		return
 	}
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := w ^ src
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := w ^ src
+		// calculate new value
+		res := w ^ src
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LRs
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -349,27 +461,45 @@ func (c *Core) amomax_w(inst uint32) {
 	if !success {
 		return
 	}
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := uint32(max(int32(w), int32(src)))
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := uint32(max(int32(w), int32(src)))
+		// calculate new value
+		res := uint32(max(int32(w), int32(src)))
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LRs
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -403,27 +533,45 @@ func (c *Core) amomaxu_w(inst uint32) {
 	if !success {
 		return
 	}
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := maxu(w, src)
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := maxu(w, src)
+		// calculate new value
+		res := maxu(w, src)
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LRs
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -457,27 +605,45 @@ func (c *Core) amomin_w(inst uint32) {
 	if !success {
 		return
 	}
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := uint32(min(int32(w), int32(src)))
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := uint32(min(int32(w), int32(src)))
+		// calculate new value
+		res := uint32(min(int32(w), int32(src)))
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LRs
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -511,27 +677,45 @@ func (c *Core) amominu_w(inst uint32) {
 	if !success {
 		return
 	}
-	pLine := pAddr >> cacheLineOffsetBits
+	pLine := uint32(pAddr >> c.mc.dCache.offsetBits)
 
 	c.system.ReservationSets().Lock() // always lock rsets before system.Memory() to avoid deadlock
-	c.system.Memory().Lock()
-	// read bytes directly from memory
-	w := binary.LittleEndian.Uint32(c.system.Memory().data[pAddr : pAddr+4])
+	if dev, offset := c.system.Memory().device(pAddr); dev != nil {
+		// devices are never cached, the operation goes straight to the device
+		ok, v := dev.Read(offset, 4)
+		w := uint32(v)
+
+		// calculate new value
+		res := minu(w, src)
+
+		if !ok || !dev.Write(offset, 4, uint64(res)) {
+			c.system.ReservationSets().Unlock()
+			c.csr[Csr_MTVAL] = addr
+			c.trap(TrapStoreAccessFault)
+			return
+		}
+		c.reg[rd] = w
+	} else {
+		c.system.Memory().Lock()
+		// read bytes directly from memory
+		var bytes [4]uint8
+		c.system.Memory().read(pAddr, bytes[:])
+		w := binary.LittleEndian.Uint32(bytes[:])
 
-	// calculate new value
-	res := minu(w, src)
+		// calculate new value
+		res := minu(w, src)
 
-	// write value back to memory
-	var bytes [4]uint8
-	binary.LittleEndian.PutUint32(bytes[:], res)
-	copy(c.system.Memory().data[pAddr:], bytes[:])
+		// write value back to memory
+		binary.LittleEndian.PutUint32(bytes[:], res)
+		c.system.Memory().write(pAddr, bytes[:])
 
-	// update cache
-	c.mc.dCache.store(pAddr, 4, uint64(res))
+		// update cache
+		c.mc.dCache.store(pAddr, 4, uint64(res))
 
-	// store old value in rd
-	c.reg[rd] = w
-	c.system.Memory().Unlock()
+		// store old value in rd
+		c.reg[rd] = w
+		c.system.Memory().Unlock()
+	}
 
 	// Invalidate LRs
 	c.system.ReservationSets().unsafeInvalidate(pLine)
@@ -0,0 +1,247 @@
+// This file contains the C extension, which gives common instructions a
+// 16-bit encoding.
+//   Every compressed instruction is an abbreviation of a 32-bit instruction,
+// so instead of implementing each one again, it is expanded into the 32-bit
+// instruction it stands for, which is then executed as usual. The only
+// difference is that the instruction is 2 bytes long, which `c.ilen` tells
+// the instructions that care, such as `jal` when it computes the return
+// address.
+//   Encodings that are reserved, or only mean something on RV64 or RV128, are
+// illegal instructions.
+
+package cpu
+
+// Opcodes of the 32-bit instructions compressed instructions expand to.
+const (
+	opLoad    uint32 = 0b0000011
+	opLoadFP  uint32 = 0b0000111
+	opOpImm   uint32 = 0b0010011
+	opStore   uint32 = 0b0100011
+	opStoreFP uint32 = 0b0100111
+	opOp      uint32 = 0b0110011
+	opLui     uint32 = 0b0110111
+	opBranch  uint32 = 0b1100011
+	opJalr    uint32 = 0b1100111
+	opJal     uint32 = 0b1101111
+	opSystem  uint32 = 0b1110011
+)
+
+// Registers compressed instructions use implicitly.
+const (
+	cRegRA = 1
+	cRegSP = 2
+)
+
+// encodeR encodes an R-type instruction.
+func encodeR(funct7, rs2, rs1, funct3, rd, opcode uint32) uint32 {
+	return funct7<<25 | rs2<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+// encodeI encodes an I-type instruction.
+func encodeI(imm, rs1, funct3, rd, opcode uint32) uint32 {
+	return (imm&0xfff)<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+// encodeS encodes an S-type instruction.
+func encodeS(imm, rs2, rs1, funct3, opcode uint32) uint32 {
+	return (imm>>5&0x7f)<<25 | rs2<<20 | rs1<<15 | funct3<<12 | (imm&0x1f)<<7 | opcode
+}
+
+// encodeB encodes a B-type instruction.
+func encodeB(imm, rs2, rs1, funct3 uint32) uint32 {
+	return (imm>>12&1)<<31 | (imm>>5&0x3f)<<25 | rs2<<20 | rs1<<15 | funct3<<12 | (imm>>1&0xf)<<8 | (imm>>11&1)<<7 | opBranch
+}
+
+// encodeJ encodes a J-type instruction.
+func encodeJ(imm, rd uint32) uint32 {
+	return (imm>>20&1)<<31 | (imm>>1&0x3ff)<<21 | (imm>>11&1)<<20 | (imm>>12&0xff)<<12 | rd<<7 | opJal
+}
+
+// misalignedInstruction returns true if an instruction can't start at `addr`;
+// with the C extension instructions are aligned on 2 bytes, otherwise on 4.
+func (c *Core) misalignedInstruction(addr uint32) bool {
+	return addr&c.ialignMask != 0
+}
+
+// signExtend sign extends the lowest `bits` bits of `v`.
+func signExtend(v, bits uint32) uint32 {
+	shift := 32 - bits
+	return uint32(int32(v<<shift) >> shift)
+}
+
+// decodeCompressed returns the operation that implements the compressed
+// instruction `inst`, and the 32-bit instruction to call it with.
+func (c *Core) decodeCompressed(inst uint32) (operation, uint32) {
+	expanded, ok := expandCompressed(inst)
+	if !ok || !c.cfg.C {
+		return (*Core).illegal, inst
+	}
+	return c.decode32(expanded), expanded
+}
+
+// expandCompressed returns the 32-bit instruction the compressed instruction
+// `inst` stands for, or false if `inst` is not a legal instruction.
+func expandCompressed(inst uint32) (uint32, bool) {
+	// fields shared by many formats
+	rd := inst >> 7 & 0x1f          // rd and rs1 of CR and CI
+	rs2 := inst >> 2 & 0x1f         // rs2 of CR and CSS
+	rdp := inst>>2&0x7 + 8          // rd' of CIW and CL, rs2' of CS
+	rs1p := inst>>7&0x7 + 8         // rs1' of CL, CS and CB, and rd' of CA
+	funct3 := inst >> 13 & 0x7      // funct3 of every format
+	bit12 := inst >> 12 & 1         // often the top bit of an immediate
+	imm6 := bit12<<5 | inst>>2&0x1f // immediates of CI
+
+	// offsets of loads and stores of words and double words
+	lwImm := inst>>7&0x38 | inst>>4&0x4 | inst<<1&0x40
+	ldImm := inst>>7&0x38 | inst<<1&0xc0
+
+	switch inst & 0x3 {
+	case 0b00:
+		switch funct3 {
+		case 0b000: // C.ADDI4SPN
+			imm := inst>>7&0x30 | inst>>1&0x3c0 | inst>>4&0x4 | inst>>2&0x8
+			if imm == 0 {
+				return 0, false // includes the all-zero instruction
+			}
+			return encodeI(imm, cRegSP, 0b000, rdp, opOpImm), true
+		case 0b001: // C.FLD
+			return encodeI(ldImm, rs1p, 0b011, rdp, opLoadFP), true
+		case 0b010: // C.LW
+			return encodeI(lwImm, rs1p, 0b010, rdp, opLoad), true
+		case 0b011: // C.FLW
+			return encodeI(lwImm, rs1p, 0b010, rdp, opLoadFP), true
+		case 0b101: // C.FSD
+			return encodeS(ldImm, rdp, rs1p, 0b011, opStoreFP), true
+		case 0b110: // C.SW
+			return encodeS(lwImm, rdp, rs1p, 0b010, opStore), true
+		case 0b111: // C.FSW
+			return encodeS(lwImm, rdp, rs1p, 0b010, opStoreFP), true
+		}
+	case 0b01:
+		switch funct3 {
+		case 0b000: // C.ADDI, C.NOP
+			return encodeI(signExtend(imm6, 6), rd, 0b000, rd, opOpImm), true
+		case 0b001: // C.JAL
+			return encodeJ(cjOffset(inst), cRegRA), true
+		case 0b010: // C.LI
+			return encodeI(signExtend(imm6, 6), 0, 0b000, rd, opOpImm), true
+		case 0b011:
+			if rd == cRegSP { // C.ADDI16SP
+				imm := bit12<<9 | inst>>2&0x10 | inst<<1&0x40 | inst<<4&0x180 | inst<<3&0x20
+				if imm == 0 {
+					return 0, false
+				}
+				return encodeI(signExtend(imm, 10), cRegSP, 0b000, cRegSP, opOpImm), true
+			}
+			// C.LUI
+			if imm6 == 0 {
+				return 0, false
+			}
+			return signExtend(imm6, 6)<<12 | rd<<7 | opLui, true
+		case 0b100:
+			switch inst >> 10 & 0x3 {
+			case 0b00: // C.SRLI
+				if bit12 != 0 {
+					return 0, false
+				}
+				return encodeI(imm6, rs1p, 0b101, rs1p, opOpImm), true
+			case 0b01: // C.SRAI
+				if bit12 != 0 {
+					return 0, false
+				}
+				return encodeI(0b0100000<<5|imm6, rs1p, 0b101, rs1p, opOpImm), true
+			case 0b10: // C.ANDI
+				return encodeI(signExtend(imm6, 6), rs1p, 0b111, rs1p, opOpImm), true
+			case 0b11:
+				if bit12 != 0 {
+					return 0, false // C.SUBW and C.ADDW are RV64 only
+				}
+				switch inst >> 5 & 0x3 {
+				case 0b00: // C.SUB
+					return encodeR(0b0100000, rdp, rs1p, 0b000, rs1p, opOp), true
+				case 0b01: // C.XOR
+					return encodeR(0, rdp, rs1p, 0b100, rs1p, opOp), true
+				case 0b10: // C.OR
+					return encodeR(0, rdp, rs1p, 0b110, rs1p, opOp), true
+				case 0b11: // C.AND
+					return encodeR(0, rdp, rs1p, 0b111, rs1p, opOp), true
+				}
+			}
+		case 0b101: // C.J
+			return encodeJ(cjOffset(inst), 0), true
+		case 0b110: // C.BEQZ
+			return encodeB(cbOffset(inst), 0, rs1p, 0b000), true
+		case 0b111: // C.BNEZ
+			return encodeB(cbOffset(inst), 0, rs1p, 0b001), true
+		}
+	case 0b10:
+		switch funct3 {
+		case 0b000: // C.SLLI
+			if bit12 != 0 {
+				return 0, false
+			}
+			return encodeI(imm6, rd, 0b001, rd, opOpImm), true
+		case 0b001: // C.FLDSP
+			imm := bit12<<5 | inst>>2&0x18 | inst<<4&0x1c0
+			return encodeI(imm, cRegSP, 0b011, rd, opLoadFP), true
+		case 0b010: // C.LWSP
+			if rd == 0 {
+				return 0, false
+			}
+			imm := bit12<<5 | inst>>2&0x1c | inst<<4&0xc0
+			return encodeI(imm, cRegSP, 0b010, rd, opLoad), true
+		case 0b011: // C.FLWSP
+			imm := bit12<<5 | inst>>2&0x1c | inst<<4&0xc0
+			return encodeI(imm, cRegSP, 0b010, rd, opLoadFP), true
+		case 0b100:
+			switch {
+			case bit12 == 0 && rs2 == 0: // C.JR
+				if rd == 0 {
+					return 0, false
+				}
+				return encodeI(0, rd, 0b000, 0, opJalr), true
+			case bit12 == 0: // C.MV
+				return encodeR(0, rs2, 0, 0b000, rd, opOp), true
+			case rd == 0 && rs2 == 0: // C.EBREAK
+				return encodeI(1, 0, 0b000, 0, opSystem), true
+			case rs2 == 0: // C.JALR
+				return encodeI(0, rd, 0b000, cRegRA, opJalr), true
+			default: // C.ADD
+				return encodeR(0, rs2, rd, 0b000, rd, opOp), true
+			}
+		case 0b101: // C.FSDSP
+			imm := inst>>7&0x38 | inst>>1&0x1c0
+			return encodeS(imm, rs2, cRegSP, 0b011, opStoreFP), true
+		case 0b110: // C.SWSP
+			imm := inst>>7&0x3c | inst>>1&0xc0
+			return encodeS(imm, rs2, cRegSP, 0b010, opStore), true
+		case 0b111: // C.FSWSP
+			imm := inst>>7&0x3c | inst>>1&0xc0
+			return encodeS(imm, rs2, cRegSP, 0b010, opStoreFP), true
+		}
+	}
+	return 0, false
+}
+
+// cjOffset returns the sign extended jump offset of C.J and C.JAL.
+func cjOffset(inst uint32) uint32 {
+	offset := inst>>1&0x800 | // offset[11]  inst[12]
+		inst>>7&0x10 | // offset[4]   inst[11]
+		inst>>1&0x300 | // offset[9:8] inst[10:9]
+		inst<<2&0x400 | // offset[10]  inst[8]
+		inst>>1&0x40 | // offset[6]   inst[7]
+		inst<<1&0x80 | // offset[7]   inst[6]
+		inst>>2&0xe | // offset[3:1] inst[5:3]
+		inst<<3&0x20 // offset[5]   inst[2]
+	return signExtend(offset, 12)
+}
+
+// cbOffset returns the sign extended branch offset of C.BEQZ and C.BNEZ.
+func cbOffset(inst uint32) uint32 {
+	offset := inst>>4&0x100 | // offset[8]   inst[12]
+		inst>>7&0x18 | // offset[4:3] inst[11:10]
+		inst<<1&0xc0 | // offset[7:6] inst[6:5]
+		inst>>2&0x6 | // offset[2:1] inst[4:3]
+		inst<<3&0x20 // offset[5]   inst[2]
+	return signExtend(offset, 9)
+}
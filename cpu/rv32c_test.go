@@ -0,0 +1,115 @@
+package cpu
+
+import "testing"
+
+// TestExpandCompressed checks the expansion of every compressed instruction
+// of RV32FDC against the 32-bit instruction it stands for, both as encoded by
+// an assembler.
+func TestExpandCompressed(t *testing.T) {
+	for _, tc := range []struct {
+		asm      string
+		inst     uint32
+		expanded uint32
+	}{
+		{"c.addi4spn s0, sp, 1020", 0x1fe0, 0x3fc10413},
+		{"c.addi4spn a5, sp, 4", 0x005c, 0x00410793},
+		{"c.fld fs1, 248(a5)", 0x3fe4, 0x0f87b487},
+		{"c.lw a0, 124(s1)", 0x5ce8, 0x07c4a503},
+		{"c.lw s0, 4(a5)", 0x43c0, 0x0047a403},
+		{"c.flw fa2, 64(a3)", 0x62b0, 0x0406a607},
+		{"c.fsd fa5, 8(s0)", 0xa41c, 0x00f43427},
+		{"c.sw a4, 120(a2)", 0xde38, 0x06e62c23},
+		{"c.fsw fs0, 4(a1)", 0xe1c0, 0x0085a227},
+		{"c.nop", 0x0001, 0x00000013},
+		{"c.addi t0, -32", 0x1281, 0xfe028293},
+		{"c.addi a0, 31", 0x057d, 0x01f50513},
+		{"c.jal 2046", 0x2ffd, 0x7fe000ef},
+		{"c.jal -2048", 0x3001, 0x801ff0ef},
+		{"c.li s11, -1", 0x5dfd, 0xfff00d93},
+		{"c.li a0, 17", 0x4545, 0x01100513},
+		{"c.addi16sp sp, -512", 0x7101, 0xe0010113},
+		{"c.addi16sp sp, 496", 0x617d, 0x1f010113},
+		{"c.lui t1, 1", 0x6305, 0x00001337},
+		{"c.lui a4, 0xfffe0", 0x7701, 0xfffe0737},
+		{"c.lui ra, 31", 0x60fd, 0x0001f0b7},
+		{"c.srli s1, 31", 0x80fd, 0x01f4d493},
+		{"c.srai a3, 1", 0x8685, 0x4016d693},
+		{"c.andi a5, -3", 0x9bf5, 0xffd7f793},
+		{"c.andi s0, 21", 0x8855, 0x01547413},
+		{"c.sub a0, a1", 0x8d0d, 0x40b50533},
+		{"c.xor s1, a5", 0x8cbd, 0x00f4c4b3},
+		{"c.or a2, s0", 0x8e41, 0x00866633},
+		{"c.and a4, a3", 0x8f75, 0x00d77733},
+		{"c.j 1000", 0xa6e5, 0x3e80006f},
+		{"c.j -6", 0xbfed, 0xffbff06f},
+		{"c.beqz s0, 254", 0xcc7d, 0x0e040f63},
+		{"c.beqz a5, -256", 0xd381, 0xf00780e3},
+		{"c.bnez a1, -2", 0xfdfd, 0xfe059fe3},
+		{"c.slli t6, 31", 0x0ffe, 0x01ff9f93},
+		{"c.fldsp fs7, 504(sp)", 0x3bfe, 0x1f813b87},
+		{"c.lwsp ra, 252(sp)", 0x50fe, 0x0fc12083},
+		{"c.flwsp ft3, 4(sp)", 0x6192, 0x00412187},
+		{"c.jr t0", 0x8282, 0x00028067},
+		{"c.mv a0, s10", 0x856a, 0x01a00533},
+		{"c.ebreak", 0x9002, 0x00100073},
+		{"c.jalr a7", 0x9882, 0x000880e7},
+		{"c.add gp, tp", 0x9192, 0x004181b3},
+		{"c.fsdsp fa0, 504(sp)", 0xbfaa, 0x1ea13c27},
+		{"c.swsp s5, 252(sp)", 0xdfd6, 0x0f512e23},
+		{"c.fswsp ft11, 8(sp)", 0xe47e, 0x01f12427},
+	} {
+		expanded, ok := expandCompressed(tc.inst)
+		if !ok || expanded != tc.expanded {
+			t.Errorf("%s (%#04x) expands to %#08x, %v, want %#08x", tc.asm, tc.inst, expanded, ok, tc.expanded)
+		}
+	}
+}
+
+// TestExpandCompressedIllegal checks that reserved encodings, and those that
+// only mean something on RV64 or RV128, are illegal instructions.
+func TestExpandCompressedIllegal(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		inst uint32
+	}{
+		{"all zero", 0x0000},
+		{"c.addi4spn with a zero immediate", 0x0004},
+		{"reserved in quadrant 0", 0x8000},
+		{"c.addi16sp with a zero immediate", 0x6101},
+		{"c.lui with a zero immediate", 0x6501},
+		{"c.srli by 32 or more", 0x9005},
+		{"c.srai by 32 or more", 0x9405},
+		{"c.subw", 0x9c01},
+		{"c.addw", 0x9c21},
+		{"c.slli by 32 or more", 0x1086},
+		{"c.lwsp to zero", 0x4002},
+		{"c.jr to zero", 0x8002},
+	} {
+		if expanded, ok := expandCompressed(tc.inst); ok {
+			t.Errorf("%s (%#04x) expands to %#08x", tc.name, tc.inst, expanded)
+		}
+	}
+}
+
+// TestCompressedExecution checks that compressed instructions are illegal
+// without the C extension, and that the return address of c.jal is that of
+// the next instruction, 2 bytes on.
+func TestCompressedExecution(t *testing.T) {
+	const cJAL = 0x2ffd // c.jal 2046
+
+	cfg := DefaultConfig()
+	cfg.C = false
+	c, _ := newTestCore(cfg)
+	if traps := c.exec(cJAL); len(traps) != 1 || traps[0] != TrapIllegalInstruction {
+		t.Errorf("c.jal without C took traps %v, want an illegal instruction", traps)
+	}
+
+	c, _ = newTestCore(DefaultConfig())
+	c.pc = 0x1000
+	if traps := c.exec(cJAL); len(traps) != 0 {
+		t.Fatalf("c.jal took traps %v", traps)
+	}
+	if c.pc != 0x1000+2046 || c.reg[Reg_RA] != 0x1002 {
+		t.Errorf("c.jal went to %#x returning to %#x, want %#x returning to %#x", c.pc, c.reg[Reg_RA], 0x1000+2046, 0x1002)
+	}
+}
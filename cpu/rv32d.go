@@ -2,22 +2,19 @@
 // the D extension of the RISC-V unprivileged specification.
 //   Refer to the specification for instruction documentation.
 
-// WARNING This implementation is _NOT_ compliant with the RISC-V
+// WARNING The arithmetic in this file is _NOT_ compliant with the RISC-V
 // specification.
-//   A compliant implementation can likely be made, but it is not a
-// priority.
-//   User/application mode programs should not depend on IEEE compliant
-// floating point numbers.
-//   A compliant implementation would likely also be much, much slower.
-//   Programs should also not depend on the state of the FCSR containing
-// correct exception flags.
+//   It is the fast path, used when `Config.SoftFloat` is not set: it ignores
+// the rounding mode, and the FCSR does not contain correct exception flags.
+//   The compliant implementation, which is much, much slower, is in
+// softfloat.go.
 
 package cpu
 
 import "math"
 
 func (c *Core) fld(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -32,7 +29,7 @@ func (c *Core) fld(inst uint32) {
 }
 
 func (c *Core) fsd(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -48,7 +45,7 @@ func (c *Core) fsd(inst uint32) {
 }
 
 func (c *Core) fmadd_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -68,7 +65,7 @@ func (c *Core) fmadd_d(inst uint32) {
 }
 
 func (c *Core) fmsub_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -88,7 +85,7 @@ func (c *Core) fmsub_d(inst uint32) {
 }
 
 func (c *Core) fnmsub_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -102,13 +99,13 @@ func (c *Core) fnmsub_d(inst uint32) {
 	f2 := math.Float64frombits(c.freg[rs2])
 	f3 := math.Float64frombits(c.freg[rs3])
 
-	res := -f1*f2 - f3
+	res := -f1*f2 + f3
 
 	c.freg[rd] = math.Float64bits(res)
 }
 
 func (c *Core) fnmadd_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -122,13 +119,13 @@ func (c *Core) fnmadd_d(inst uint32) {
 	f2 := math.Float64frombits(c.freg[rs2])
 	f3 := math.Float64frombits(c.freg[rs3])
 
-	res := -f1*f2 + f3
+	res := -f1*f2 - f3
 
 	c.freg[rd] = math.Float64bits(res)
 }
 
 func (c *Core) fadd_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -146,7 +143,7 @@ func (c *Core) fadd_d(inst uint32) {
 }
 
 func (c *Core) fsub_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -164,7 +161,7 @@ func (c *Core) fsub_d(inst uint32) {
 }
 
 func (c *Core) fmul_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -182,7 +179,7 @@ func (c *Core) fmul_d(inst uint32) {
 }
 
 func (c *Core) fdiv_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -200,7 +197,7 @@ func (c *Core) fdiv_d(inst uint32) {
 }
 
 func (c *Core) fsqrt_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -223,7 +220,7 @@ func (c *Core) fsqrt_d(inst uint32) {
 }
 
 func (c *Core) fsgnj_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -241,7 +238,7 @@ func (c *Core) fsgnj_d(inst uint32) {
 }
 
 func (c *Core) fsgnjn_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -258,7 +255,7 @@ func (c *Core) fsgnjn_d(inst uint32) {
 }
 
 func (c *Core) fsgnjx_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -275,7 +272,7 @@ func (c *Core) fsgnjx_d(inst uint32) {
 }
 
 func (c *Core) fmin_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -293,7 +290,7 @@ func (c *Core) fmin_d(inst uint32) {
 }
 
 func (c *Core) fmax_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -311,7 +308,7 @@ func (c *Core) fmax_d(inst uint32) {
 }
 
 func (c *Core) fcvt_s_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -326,7 +323,7 @@ func (c *Core) fcvt_s_d(inst uint32) {
 }
 
 func (c *Core) fcvt_d_s(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -341,7 +338,7 @@ func (c *Core) fcvt_d_s(inst uint32) {
 }
 
 func (c *Core) feq_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -371,7 +368,7 @@ func (c *Core) feq_d(inst uint32) {
 }
 
 func (c *Core) flt_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -401,7 +398,7 @@ func (c *Core) flt_d(inst uint32) {
 }
 
 func (c *Core) fle_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -431,7 +428,7 @@ func (c *Core) fle_d(inst uint32) {
 }
 
 func (c *Core) fclass_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -468,7 +465,7 @@ func (c *Core) fclass_d(inst uint32) {
 }
 
 func (c *Core) fcvt_w_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -484,7 +481,7 @@ func (c *Core) fcvt_w_d(inst uint32) {
 }
 
 func (c *Core) fcvt_wu_d(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -500,7 +497,7 @@ func (c *Core) fcvt_wu_d(inst uint32) {
 }
 
 func (c *Core) fcvt_d_w(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -514,7 +511,7 @@ func (c *Core) fcvt_d_w(inst uint32) {
 }
 
 func (c *Core) fcvt_d_wu(inst uint32) {
-	if !xDEnable {
+	if !c.cfg.D {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
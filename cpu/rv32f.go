@@ -2,15 +2,12 @@
 // the F extension of the RISC-V unprivileged specification.
 //   Refer to the specification for instruction documentation.
 
-// WARNING This implementation is _NOT_ compliant with the RISC-V
+// WARNING The arithmetic in this file is _NOT_ compliant with the RISC-V
 // specification.
-//   A compliant implementation can likely be made, but it is not a
-// priority.
-//   User/application mode programs should not depend on IEEE compliant
-// floating point numbers.
-//   A compliant implementation would likely also be much, much slower.
-//   Programs should also not depend on the state of the FCSR containing
-// correct exception flags.
+//   It is the fast path, used when `Config.SoftFloat` is not set: it ignores
+// the rounding mode, and the FCSR does not contain correct exception flags.
+//   The compliant implementation, which is much, much slower, is in
+// softfloat.go.
 
 package cpu
 
@@ -97,10 +94,14 @@ const (
 	fcsrFlagOF        = 0b00100
 	fcsrFlagUF        = 0b00010
 	fcsrFlagNX        = 0b00001
+
+	fcsrFlagsMask = 0x1F // fflags, the accrued exceptions
+	fcsrFrmShift  = 5    // frm, the dynamic rounding mode, sits above fflags
+	fcsrMask      = 0xFF
 )
 
 func (c *Core) flw(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -117,7 +118,7 @@ func (c *Core) flw(inst uint32) {
 }
 
 func (c *Core) fsw(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -136,7 +137,7 @@ func (c *Core) fsw(inst uint32) {
 
 // float multiply and add
 func (c *Core) fmadd_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -156,7 +157,7 @@ func (c *Core) fmadd_s(inst uint32) {
 }
 
 func (c *Core) fmsub_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -176,7 +177,7 @@ func (c *Core) fmsub_s(inst uint32) {
 }
 
 func (c *Core) fnmsub_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -190,13 +191,13 @@ func (c *Core) fnmsub_s(inst uint32) {
 	f2 := math.Float32frombits(uint32(c.freg[rs2]))
 	f3 := math.Float32frombits(uint32(c.freg[rs3]))
 
-	res := -f1*f2 - f3
+	res := -f1*f2 + f3
 
 	c.freg[rd] = 0xFFFFFFFF00000000 | uint64(math.Float32bits(res))
 }
 
 func (c *Core) fnmadd_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -210,13 +211,13 @@ func (c *Core) fnmadd_s(inst uint32) {
 	f2 := math.Float32frombits(uint32(c.freg[rs2]))
 	f3 := math.Float32frombits(uint32(c.freg[rs3]))
 
-	res := -f1*f2 + f3
+	res := -f1*f2 - f3
 
 	c.freg[rd] = 0xFFFFFFFF00000000 | uint64(math.Float32bits(res))
 }
 
 func (c *Core) fadd_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -234,7 +235,7 @@ func (c *Core) fadd_s(inst uint32) {
 }
 
 func (c *Core) fsub_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -252,7 +253,7 @@ func (c *Core) fsub_s(inst uint32) {
 }
 
 func (c *Core) fmul_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -270,7 +271,7 @@ func (c *Core) fmul_s(inst uint32) {
 }
 
 func (c *Core) fdiv_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -288,7 +289,7 @@ func (c *Core) fdiv_s(inst uint32) {
 }
 
 func (c *Core) fsqrt_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -311,7 +312,7 @@ func (c *Core) fsqrt_s(inst uint32) {
 }
 
 func (c *Core) fsgnj_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -329,7 +330,7 @@ func (c *Core) fsgnj_s(inst uint32) {
 }
 
 func (c *Core) fsgnjn_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -346,7 +347,7 @@ func (c *Core) fsgnjn_s(inst uint32) {
 }
 
 func (c *Core) fsgnjx_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -363,7 +364,7 @@ func (c *Core) fsgnjx_s(inst uint32) {
 }
 
 func (c *Core) fmin_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -381,7 +382,7 @@ func (c *Core) fmin_s(inst uint32) {
 }
 
 func (c *Core) fmax_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -399,7 +400,7 @@ func (c *Core) fmax_s(inst uint32) {
 }
 
 func (c *Core) fcvt_w_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -415,7 +416,7 @@ func (c *Core) fcvt_w_s(inst uint32) {
 }
 
 func (c *Core) fcvt_wu_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -429,7 +430,7 @@ func (c *Core) fcvt_wu_s(inst uint32) {
 }
 
 func (c *Core) fmv_x_w(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -455,7 +456,7 @@ func (c *Core) fmv_x_w(inst uint32) {
 }
 
 func (c *Core) feq_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -492,7 +493,7 @@ func (c *Core) feq_s(inst uint32) {
 }
 
 func (c *Core) flt_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -524,7 +525,7 @@ func (c *Core) flt_s(inst uint32) {
 }
 
 func (c *Core) fle_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -556,7 +557,7 @@ func (c *Core) fle_s(inst uint32) {
 }
 
 func (c *Core) fclass_s(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -597,7 +598,7 @@ func (c *Core) fclass_s(inst uint32) {
 }
 
 func (c *Core) fcvt_s_w(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -611,7 +612,7 @@ func (c *Core) fcvt_s_w(inst uint32) {
 }
 
 func (c *Core) fcvt_s_wu(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -625,7 +626,7 @@ func (c *Core) fcvt_s_wu(inst uint32) {
 }
 
 func (c *Core) fmv_w_x(inst uint32) {
-	if !xFEnable {
+	if !c.cfg.F {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
@@ -203,12 +203,12 @@ func (c *Core) jal(inst uint32) {
 	offset := (imm10_1 << 1) | (imm11 << 11) | (imm19_12 << 12) | (imm20 << 20)
 
 	targetAddress := c.pc + offset
-	if targetAddress&0x3 != 0 {
+	if c.misalignedInstruction(targetAddress) {
 		c.csr[Csr_MTVAL] = targetAddress
 		c.trap(TrapInstructionAddressMisaligned)
 		return
 	} else {
-		c.reg[rd] = c.pc + 4
+		c.reg[rd] = c.pc + c.ilen
 		c.pc = targetAddress
 		c.jumped = true
 	}
@@ -223,12 +223,12 @@ func (c *Core) jalr(inst uint32) {
 
 	targetAddress := (imm11_0 + rs1_val) & 0xfffffffe
 
-	if targetAddress&0x3 != 0 {
+	if c.misalignedInstruction(targetAddress) {
 		c.csr[Csr_MTVAL] = targetAddress
 		c.trap(TrapInstructionAddressMisaligned)
 		return
 	} else {
-		c.reg[rd] = c.pc + 4
+		c.reg[rd] = c.pc + c.ilen
 		c.pc = targetAddress
 		c.jumped = true
 	}
@@ -247,7 +247,7 @@ func (c *Core) beq(inst uint32) {
 	targetAddress := c.pc + offset
 
 	if c.reg[rs1] == c.reg[rs2] {
-		if targetAddress&0x3 != 0 {
+		if c.misalignedInstruction(targetAddress) {
 			c.csr[Csr_MTVAL] = targetAddress
 			c.trap(TrapInstructionAddressMisaligned)
 			return
@@ -270,7 +270,7 @@ func (c *Core) bne(inst uint32) {
 	targetAddress := c.pc + offset
 
 	if c.reg[rs1] != c.reg[rs2] {
-		if targetAddress&0x3 != 0 {
+		if c.misalignedInstruction(targetAddress) {
 			c.csr[Csr_MTVAL] = targetAddress
 			c.trap(TrapInstructionAddressMisaligned)
 			return
@@ -294,7 +294,7 @@ func (c *Core) blt(inst uint32) {
 	targetAddress := c.pc + offset
 
 	if int32(c.reg[rs1]) < int32(c.reg[rs2]) {
-		if targetAddress&0x3 != 0 {
+		if c.misalignedInstruction(targetAddress) {
 			c.csr[Csr_MTVAL] = targetAddress
 			c.trap(TrapInstructionAddressMisaligned)
 			return
@@ -318,7 +318,7 @@ func (c *Core) bltu(inst uint32) {
 	targetAddress := c.pc + offset
 
 	if c.reg[rs1] < c.reg[rs2] {
-		if targetAddress&0x3 != 0 {
+		if c.misalignedInstruction(targetAddress) {
 			c.csr[Csr_MTVAL] = targetAddress
 			c.trap(TrapInstructionAddressMisaligned)
 			return
@@ -342,7 +342,7 @@ func (c *Core) bge(inst uint32) {
 	targetAddress := c.pc + offset
 
 	if int32(c.reg[rs1]) >= int32(c.reg[rs2]) {
-		if targetAddress&0x3 != 0 {
+		if c.misalignedInstruction(targetAddress) {
 			c.csr[Csr_MTVAL] = targetAddress
 			c.trap(TrapInstructionAddressMisaligned)
 			return
@@ -366,7 +366,7 @@ func (c *Core) bgeu(inst uint32) {
 	targetAddress := c.pc + offset
 
 	if c.reg[rs1] >= c.reg[rs2] {
-		if targetAddress&0x3 != 0 {
+		if c.misalignedInstruction(targetAddress) {
 			c.csr[Csr_MTVAL] = targetAddress
 			c.trap(TrapInstructionAddressMisaligned)
 			return
@@ -0,0 +1,591 @@
+// This file contains IEEE 754 arithmetic done in software, for the compliant
+// implementation of the F and D extensions.
+//   Every operation works out its result exactly, as an integer times a power
+// of two, and then rounds it once to the destination format with `round`, so
+// results are correctly rounded in all five rounding modes and the exception
+// flags come out as the standard says. The exact intermediate is a
+// `big.Int`, which is slow, but simple enough to be obviously right.
+//   Values are passed around as their encodings in a uint64, whatever the
+// format. NaN results are always the canonical NaN, as RISC-V requires, and
+// tininess is detected after rounding.
+
+package cpu
+
+import "math/big"
+
+// Rounding modes, as encoded in the rm field of instructions and in frm.
+const (
+	rmRNE uint32 = 0b000 // to nearest, ties to even
+	rmRTZ uint32 = 0b001 // towards zero
+	rmRDN uint32 = 0b010 // down, towards -infinity
+	rmRUP uint32 = 0b011 // up, towards +infinity
+	rmRMM uint32 = 0b100 // to nearest, ties to max magnitude
+	rmDYN uint32 = 0b111 // in an instruction, use frm
+)
+
+// floatFormat is an IEEE 754 binary interchange format.
+type floatFormat struct {
+	expBits  uint // width of the exponent field
+	fracBits uint // width of the fraction field, the precision minus one
+}
+
+var (
+	binary32 = floatFormat{expBits: 8, fracBits: 23}
+	binary64 = floatFormat{expBits: 11, fracBits: 52}
+)
+
+var bigOne = big.NewInt(1)
+
+// Classes of floating-point values.
+const (
+	classZero = iota
+	classFinite
+	classInf
+	classNaN
+)
+
+// floatValue is an unpacked floating-point value.
+//   A finite value is `mant * 2^exp`, with the sign apart.
+type floatValue struct {
+	sign      bool
+	class     int
+	signaling bool   // for NaNs
+	mant      uint64 // for finite values
+	exp       int    // for finite values
+}
+
+func (f floatFormat) bias() int {
+	return 1<<(f.expBits-1) - 1
+}
+
+func (f floatFormat) expMask() uint64 {
+	return 1<<f.expBits - 1
+}
+
+func (f floatFormat) fracMask() uint64 {
+	return 1<<f.fracBits - 1
+}
+
+func (f floatFormat) signBit() uint64 {
+	return 1 << (f.expBits + f.fracBits)
+}
+
+// canonicalNaN returns the NaN RISC-V produces for every NaN result.
+func (f floatFormat) canonicalNaN() uint64 {
+	return f.expMask()<<f.fracBits | 1<<(f.fracBits-1)
+}
+
+func (f floatFormat) zero(sign bool) uint64 {
+	if sign {
+		return f.signBit()
+	}
+	return 0
+}
+
+func (f floatFormat) inf(sign bool) uint64 {
+	return f.zero(sign) | f.expMask()<<f.fracBits
+}
+
+// maxFinite returns the finite value of the largest magnitude.
+func (f floatFormat) maxFinite(sign bool) uint64 {
+	return f.zero(sign) | (f.expMask()-1)<<f.fracBits | f.fracMask()
+}
+
+// unpack unpacks the encoding `x`.
+func (f floatFormat) unpack(x uint64) floatValue {
+	v := floatValue{sign: x&f.signBit() != 0}
+	exp := x >> f.fracBits & f.expMask()
+	frac := x & f.fracMask()
+
+	switch {
+	case exp == f.expMask() && frac == 0:
+		v.class = classInf
+	case exp == f.expMask():
+		v.class = classNaN
+		v.signaling = frac>>(f.fracBits-1) == 0
+	case exp == 0 && frac == 0:
+		v.class = classZero
+	case exp == 0: // subnormal
+		v.class = classFinite
+		v.mant = frac
+		v.exp = 1 - f.bias() - int(f.fracBits)
+	default:
+		v.class = classFinite
+		v.mant = frac | 1<<f.fracBits
+		v.exp = int(exp) - f.bias() - int(f.fracBits)
+	}
+	return v
+}
+
+// signedMant returns the mantissa of a finite or zero value with its sign.
+func (v floatValue) signedMant() *big.Int {
+	m := new(big.Int).SetUint64(v.mant)
+	if v.sign {
+		m.Neg(m)
+	}
+	return m
+}
+
+// nanResult returns the canonical NaN, raising NV if one of `vs` is a
+// signaling NaN.
+func (f floatFormat) nanResult(vs ...floatValue) (uint64, uint32) {
+	var flags uint32
+	for _, v := range vs {
+		if v.class == classNaN && v.signaling {
+			flags |= fcsrFlagNV
+		}
+	}
+	return f.canonicalNaN(), flags
+}
+
+// anyNaN returns true if one of `vs` is a NaN.
+func anyNaN(vs ...floatValue) bool {
+	for _, v := range vs {
+		if v.class == classNaN {
+			return true
+		}
+	}
+	return false
+}
+
+// roundBits rounds `m * 2^e`, which is not negative and has the sign `sign`
+// apart, to a multiple of `2^lsb` with the rounding mode `rm`.
+//   It returns the multiple, and whether rounding changed the value.
+func roundBits(sign bool, m *big.Int, e, lsb int, rm uint32) (*big.Int, bool) {
+	shift := lsb - e
+	if shift <= 0 {
+		return new(big.Int).Lsh(m, uint(-shift)), false
+	}
+
+	q := new(big.Int).Rsh(m, uint(shift))
+	rem := new(big.Int).Sub(m, new(big.Int).Lsh(q, uint(shift)))
+	if rem.Sign() == 0 {
+		return q, false
+	}
+
+	half := rem.Cmp(new(big.Int).Lsh(bigOne, uint(shift-1)))
+	up := false
+	switch rm {
+	case rmRNE:
+		up = half > 0 || half == 0 && q.Bit(0) == 1
+	case rmRDN:
+		up = sign
+	case rmRUP:
+		up = !sign
+	case rmRMM:
+		up = half >= 0
+	}
+	if up {
+		q.Add(q, bigOne)
+	}
+	return q, true
+}
+
+// round rounds the exact value `m * 2^e`, where `m` is positive and has the
+// sign `sign` apart, to the format.
+//   It returns the encoding of the result, and the flags rounding raised.
+func (f floatFormat) round(sign bool, m *big.Int, e int, rm uint32) (uint64, uint32) {
+	p := int(f.fracBits) + 1 // precision
+	emin := 1 - f.bias()
+	top := e + m.BitLen() - 1 // exponent of the leading bit
+
+	lsb := top - (p - 1)
+	tiny := false
+	if top < emin {
+		// subnormal, the exponent can't go lower
+		lsb = emin - (p - 1)
+		// tininess is detected after rounding, as though the exponent were
+		// unbounded, so a value just below the smallest normal is not tiny if
+		// it rounds up to it
+		q, _ := roundBits(sign, m, e, top-(p-1), rm)
+		tiny = q.BitLen() <= p || top+1 < emin
+	}
+
+	q, inexact := roundBits(sign, m, e, lsb, rm)
+	if q.BitLen() > p {
+		// rounding carried into a new bit, and q is now a power of two
+		q.Rsh(q, 1)
+		lsb++
+	}
+
+	var flags uint32
+	if inexact {
+		flags |= fcsrFlagNX
+		if tiny {
+			flags |= fcsrFlagUF
+		}
+	}
+
+	mant := q.Uint64()
+	if mant == 0 {
+		return f.zero(sign), flags
+	}
+	biased := 0
+	if mant>>f.fracBits != 0 {
+		biased = lsb + p - 1 + f.bias()
+	}
+	if biased >= int(f.expMask()) {
+		return f.overflow(sign, rm), fcsrFlagOF | fcsrFlagNX
+	}
+	return f.zero(sign) | uint64(biased)<<f.fracBits | mant&f.fracMask(), flags
+}
+
+// overflow returns the result of an overflow with the rounding mode `rm`,
+// which is infinity unless `rm` rounds towards zero.
+func (f floatFormat) overflow(sign bool, rm uint32) uint64 {
+	switch {
+	case rm == rmRTZ, rm == rmRDN && !sign, rm == rmRUP && sign:
+		return f.maxFinite(sign)
+	}
+	return f.inf(sign)
+}
+
+// exactZero returns the zero that results from adding values that cancel
+// out exactly, or from adding zeros of the signs `a` and `b`.
+func (f floatFormat) exactZero(a, b bool, rm uint32) uint64 {
+	if a == b {
+		return f.zero(a)
+	}
+	return f.zero(rm == rmRDN)
+}
+
+// sum rounds the exact sum `ma * 2^ea + mb * 2^eb`, where `ma` and `mb` carry
+// their signs.
+//   If it is zero, the result is `zero`.
+func (f floatFormat) sum(ma *big.Int, ea int, mb *big.Int, eb int, zero uint64, rm uint32) (uint64, uint32) {
+	e := ea
+	if eb < e {
+		e = eb
+	}
+	s := new(big.Int).Lsh(ma, uint(ea-e))
+	s.Add(s, new(big.Int).Lsh(mb, uint(eb-e)))
+
+	if s.Sign() == 0 {
+		return zero, 0
+	}
+	return f.round(s.Sign() < 0, s.Abs(s), e, rm)
+}
+
+// add returns `a + b`.
+func (f floatFormat) add(a, b uint64, rm uint32) (uint64, uint32) {
+	x, y := f.unpack(a), f.unpack(b)
+
+	switch {
+	case anyNaN(x, y):
+		return f.nanResult(x, y)
+	case x.class == classInf && y.class == classInf && x.sign != y.sign:
+		return f.canonicalNaN(), fcsrFlagNV
+	case x.class == classInf:
+		return f.inf(x.sign), 0
+	case y.class == classInf:
+		return f.inf(y.sign), 0
+	case x.class == classZero && y.class == classZero:
+		return f.exactZero(x.sign, y.sign, rm), 0
+	}
+	return f.sum(x.signedMant(), x.exp, y.signedMant(), y.exp, f.zero(rm == rmRDN), rm)
+}
+
+// sub returns `a - b`.
+func (f floatFormat) sub(a, b uint64, rm uint32) (uint64, uint32) {
+	return f.add(a, b^f.signBit(), rm)
+}
+
+// mul returns `a * b`.
+func (f floatFormat) mul(a, b uint64, rm uint32) (uint64, uint32) {
+	x, y := f.unpack(a), f.unpack(b)
+	sign := x.sign != y.sign
+
+	switch {
+	case anyNaN(x, y):
+		return f.nanResult(x, y)
+	case x.class == classInf && y.class == classZero, x.class == classZero && y.class == classInf:
+		return f.canonicalNaN(), fcsrFlagNV
+	case x.class == classInf || y.class == classInf:
+		return f.inf(sign), 0
+	case x.class == classZero || y.class == classZero:
+		return f.zero(sign), 0
+	}
+
+	m := new(big.Int).SetUint64(x.mant)
+	m.Mul(m, new(big.Int).SetUint64(y.mant))
+	return f.round(sign, m, x.exp+y.exp, rm)
+}
+
+// fma returns `a * b + c` with a single rounding.
+func (f floatFormat) fma(a, b, c uint64, rm uint32) (uint64, uint32) {
+	x, y, z := f.unpack(a), f.unpack(b), f.unpack(c)
+	sign := x.sign != y.sign
+	invalid := x.class == classInf && y.class == classZero || x.class == classZero && y.class == classInf
+
+	switch {
+	case anyNaN(x, y, z):
+		// the product of infinity and zero is invalid even when the addend is
+		// a quiet NaN
+		res, flags := f.nanResult(x, y, z)
+		if invalid {
+			flags |= fcsrFlagNV
+		}
+		return res, flags
+	case invalid:
+		return f.canonicalNaN(), fcsrFlagNV
+	case x.class == classInf || y.class == classInf:
+		if z.class == classInf && z.sign != sign {
+			return f.canonicalNaN(), fcsrFlagNV
+		}
+		return f.inf(sign), 0
+	case z.class == classInf:
+		return f.inf(z.sign), 0
+	}
+
+	product := new(big.Int).SetUint64(x.mant)
+	product.Mul(product, new(big.Int).SetUint64(y.mant))
+	if sign {
+		product.Neg(product)
+	}
+
+	zero := f.zero(rm == rmRDN)
+	if product.Sign() == 0 && z.class == classZero {
+		zero = f.exactZero(sign, z.sign, rm)
+	}
+	return f.sum(product, x.exp+y.exp, z.signedMant(), z.exp, zero, rm)
+}
+
+// div returns `a / b`.
+func (f floatFormat) div(a, b uint64, rm uint32) (uint64, uint32) {
+	x, y := f.unpack(a), f.unpack(b)
+	sign := x.sign != y.sign
+
+	switch {
+	case anyNaN(x, y):
+		return f.nanResult(x, y)
+	case x.class == classInf && y.class == classInf, x.class == classZero && y.class == classZero:
+		return f.canonicalNaN(), fcsrFlagNV
+	case x.class == classInf:
+		return f.inf(sign), 0
+	case y.class == classInf:
+		return f.zero(sign), 0
+	case y.class == classZero:
+		return f.inf(sign), fcsrFlagDZ
+	case x.class == classZero:
+		return f.zero(sign), 0
+	}
+
+	// Scale the dividend so the quotient has two bits more than the
+	// precision. The remainder only matters as far as whether it is zero,
+	// which a sticky bit below the quotient records.
+	mx := new(big.Int).SetUint64(x.mant)
+	my := new(big.Int).SetUint64(y.mant)
+	k := int(f.fracBits) + 3 + my.BitLen() - mx.BitLen()
+	if k < 0 {
+		k = 0
+	}
+	q, r := new(big.Int).QuoRem(mx.Lsh(mx, uint(k)), my, new(big.Int))
+	q.Lsh(q, 1)
+	if r.Sign() != 0 {
+		q.SetBit(q, 0, 1)
+	}
+	return f.round(sign, q, x.exp-y.exp-k-1, rm)
+}
+
+// sqrt returns the square root of `a`.
+func (f floatFormat) sqrt(a uint64, rm uint32) (uint64, uint32) {
+	x := f.unpack(a)
+
+	switch {
+	case x.class == classNaN:
+		return f.nanResult(x)
+	case x.class == classZero:
+		return a, 0 // the square root of -0 is -0
+	case x.sign:
+		return f.canonicalNaN(), fcsrFlagNV
+	case x.class == classInf:
+		return a, 0
+	}
+
+	// Make the exponent even so it can be halved, and scale the mantissa so
+	// the root has two bits more than the precision, with a sticky bit for a
+	// nonzero remainder like in `div`.
+	m := new(big.Int).SetUint64(x.mant)
+	e := x.exp
+	if e&1 != 0 {
+		m.Lsh(m, 1)
+		e--
+	}
+	k := int(f.fracBits) + 3
+	m.Lsh(m, uint(2*k))
+	root := new(big.Int).Sqrt(m)
+	exact := new(big.Int).Mul(root, root).Cmp(m) == 0
+	root.Lsh(root, 1)
+	if !exact {
+		root.SetBit(root, 0, 1)
+	}
+	return f.round(false, root, (e-2*k)/2-1, rm)
+}
+
+// orderKey returns a number that orders values that aren't NaNs like the
+// values do, and is the same for both zeros.
+func (f floatFormat) orderKey(x uint64) int64 {
+	magnitude := int64(x &^ f.signBit())
+	if x&f.signBit() != 0 {
+		return -magnitude
+	}
+	return magnitude
+}
+
+// eq returns whether `a == b`; it is a quiet comparison, which only raises NV
+// for signaling NaNs.
+func (f floatFormat) eq(a, b uint64) (bool, uint32) {
+	x, y := f.unpack(a), f.unpack(b)
+	if anyNaN(x, y) {
+		_, flags := f.nanResult(x, y)
+		return false, flags
+	}
+	return f.orderKey(a) == f.orderKey(b), 0
+}
+
+// lt returns whether `a < b`; it is a signaling comparison, which raises NV
+// for any NaN.
+func (f floatFormat) lt(a, b uint64) (bool, uint32) {
+	if anyNaN(f.unpack(a), f.unpack(b)) {
+		return false, fcsrFlagNV
+	}
+	return f.orderKey(a) < f.orderKey(b), 0
+}
+
+// le returns whether `a <= b`; it is a signaling comparison, which raises NV
+// for any NaN.
+func (f floatFormat) le(a, b uint64) (bool, uint32) {
+	if anyNaN(f.unpack(a), f.unpack(b)) {
+		return false, fcsrFlagNV
+	}
+	return f.orderKey(a) <= f.orderKey(b), 0
+}
+
+// minMax returns the smaller of `a` and `b`, or the larger if `max` is set.
+//   A NaN only results if both are NaNs, and -0 is smaller than +0.
+func (f floatFormat) minMax(a, b uint64, max bool) (uint64, uint32) {
+	x, y := f.unpack(a), f.unpack(b)
+	_, flags := f.nanResult(x, y)
+
+	switch {
+	case x.class == classNaN && y.class == classNaN:
+		return f.canonicalNaN(), flags
+	case x.class == classNaN:
+		return b, flags
+	case y.class == classNaN:
+		return a, flags
+	}
+
+	ka, kb := f.orderKey(a), f.orderKey(b)
+	if ka == kb {
+		// only the zeros compare equal with different encodings
+		if max {
+			return a & b, 0
+		}
+		return a | b, 0
+	}
+	if (ka < kb) != max {
+		return a, 0
+	}
+	return b, 0
+}
+
+// class returns the classification of `a` that `fclass` gives.
+func (f floatFormat) class(a uint64) uint32 {
+	x := f.unpack(a)
+	subnormal := a>>f.fracBits&f.expMask() == 0
+
+	var bit uint32
+	switch {
+	case x.class == classNaN && x.signaling:
+		return 1 << 8
+	case x.class == classNaN:
+		return 1 << 9
+	case x.class == classInf:
+		bit = 0
+	case x.class == classFinite && !subnormal:
+		bit = 1
+	case x.class == classFinite:
+		bit = 2
+	default:
+		bit = 3
+	}
+	if !x.sign {
+		bit = 7 - bit
+	}
+	return 1 << bit
+}
+
+// toInt converts `a` to a 32-bit integer, signed if `signed` is set.
+//   Values that are out of range, including NaNs and infinities, raise NV and
+// give the closest integer in range, where NaNs count as large and positive.
+func (f floatFormat) toInt(a uint64, signed bool, rm uint32) (uint32, uint32) {
+	x := f.unpack(a)
+
+	var min, max uint32 = 0, 0xFFFFFFFF
+	if signed {
+		min, max = 0x80000000, 0x7FFFFFFF
+	}
+
+	switch x.class {
+	case classNaN:
+		return max, fcsrFlagNV
+	case classInf:
+		if x.sign {
+			return min, fcsrFlagNV
+		}
+		return max, fcsrFlagNV
+	case classZero:
+		return 0, 0
+	}
+
+	q, inexact := roundBits(x.sign, new(big.Int).SetUint64(x.mant), x.exp, 0, rm)
+
+	limit := uint64(max)
+	if x.sign {
+		limit = uint64(-min) // as a magnitude
+	}
+	if q.BitLen() > 33 || q.Uint64() > limit {
+		if x.sign {
+			return min, fcsrFlagNV
+		}
+		return max, fcsrFlagNV
+	}
+
+	res := uint32(q.Uint64())
+	if x.sign {
+		res = -res
+	}
+	if inexact {
+		return res, fcsrFlagNX
+	}
+	return res, 0
+}
+
+// fromInt converts the 32-bit integer `v`, signed if `signed` is set, to the
+// format.
+func (f floatFormat) fromInt(v uint32, signed bool, rm uint32) (uint64, uint32) {
+	if v == 0 {
+		return f.zero(false), 0
+	}
+	sign := signed && int32(v) < 0
+	if sign {
+		v = -v
+	}
+	return f.round(sign, new(big.Int).SetUint64(uint64(v)), 0, rm)
+}
+
+// convert converts `a`, encoded in the format `from`, to the format.
+func (f floatFormat) convert(a uint64, from floatFormat, rm uint32) (uint64, uint32) {
+	x := from.unpack(a)
+
+	switch x.class {
+	case classNaN:
+		return f.nanResult(x)
+	case classInf:
+		return f.inf(x.sign), 0
+	case classZero:
+		return f.zero(x.sign), 0
+	}
+	return f.round(x.sign, new(big.Int).SetUint64(x.mant), x.exp, rm)
+}
@@ -0,0 +1,278 @@
+package cpu
+
+import "testing"
+
+// Formats of floating-point instructions.
+const (
+	fmtS uint32 = 0b00
+	fmtD uint32 = 0b01
+)
+
+// opFP encodes an instruction of the OP-FP major opcode.
+func opFP(funct5, fmt, rs2, rs1, rm, rd uint32) uint32 {
+	return encodeR(funct5<<2|fmt, rs2, rs1, rm, rd, 0b1010011)
+}
+
+// opFMA encodes a fused multiply-add of the major opcode `opcode`, which
+// computes `rd = ±(rs1*rs2) ± rs3`.
+func opFMA(opcode, fmt, rs3, rs2, rs1, rm, rd uint32) uint32 {
+	return rs3<<27 | fmt<<25 | rs2<<20 | rs1<<15 | rm<<12 | rd<<7 | opcode
+}
+
+// Instructions the tests below execute, on f1 and f2 into f3 or a0.
+const (
+	fFADD    = 0b00000
+	fFMUL    = 0b00010
+	fFDIV    = 0b00011
+	fFCVT_FF = 0b01000
+	fFSQRT   = 0b01011
+	fFCVT_W  = 0b11000
+)
+
+// box NaN-boxes the single `v`, as a D register holds it.
+func box(v uint32) uint64 {
+	return 0xFFFFFFFF00000000 | uint64(v)
+}
+
+// newSoftFloatCore returns a core implementing F and D with softfloat.go.
+func newSoftFloatCore() (*Core, *testSystem) {
+	cfg := DefaultConfig()
+	cfg.F, cfg.D, cfg.SoftFloat = true, true, true
+	return newTestCore(cfg)
+}
+
+// TestSoftFloatRoundingModes adds values that fall between two singles in
+// each of the rounding modes, given in the instruction or in frm.
+func TestSoftFloatRoundingModes(t *testing.T) {
+	// 1 + 0.75 ulp, -1 - 0.5 ulp and -1 - 0.75 ulp, which between them tell
+	// all five modes apart
+	operands := [][2]uint32{
+		{0x3F800000, 0x33C00000},
+		{0xBF800000, 0xB3800000},
+		{0xBF800000, 0xB3C00000},
+	}
+	for _, tc := range []struct {
+		name string
+		rm   uint32
+		want [3]uint32
+	}{
+		{"RNE", rmRNE, [3]uint32{0x3F800001, 0xBF800000, 0xBF800001}},
+		{"RTZ", rmRTZ, [3]uint32{0x3F800000, 0xBF800000, 0xBF800000}},
+		{"RDN", rmRDN, [3]uint32{0x3F800000, 0xBF800001, 0xBF800001}},
+		{"RUP", rmRUP, [3]uint32{0x3F800001, 0xBF800000, 0xBF800000}},
+		{"RMM", rmRMM, [3]uint32{0x3F800001, 0xBF800001, 0xBF800001}},
+	} {
+		for _, dynamic := range []bool{false, true} {
+			c, _ := newSoftFloatCore()
+			rm := tc.rm
+			if dynamic {
+				rm = rmDYN
+				c.SetCSR(csr_FRM, tc.rm)
+			}
+			for i, ops := range operands {
+				c.freg[1], c.freg[2] = box(ops[0]), box(ops[1])
+				if traps := c.exec(opFP(fFADD, fmtS, 2, 1, rm, 3)); len(traps) != 0 {
+					t.Fatalf("%s, dynamic %v: took traps %v", tc.name, dynamic, traps)
+				}
+				if c.freg[3] != box(tc.want[i]) || c.GetCSR(csr_FFLAGS) != fcsrFlagNX {
+					t.Errorf("%s, dynamic %v: %#08x + %#08x is %#016x with flags %05b, want %#08x with NX",
+						tc.name, dynamic, ops[0], ops[1], c.freg[3], c.GetCSR(csr_FFLAGS), tc.want[i])
+				}
+			}
+		}
+	}
+
+	// a tie in double precision
+	c, _ := newSoftFloatCore()
+	c.freg[1], c.freg[2] = 0x3FF0000000000000, 0x3CA0000000000000 // 1 and 0.5 ulp
+	for rm, want := range map[uint32]uint64{rmRNE: 0x3FF0000000000000, rmRUP: 0x3FF0000000000001} {
+		c.exec(opFP(fFADD, fmtD, 2, 1, rm, 3))
+		if c.freg[3] != want {
+			t.Errorf("fadd.d in mode %d is %#016x, want %#016x", rm, c.freg[3], want)
+		}
+	}
+}
+
+// TestSoftFloatIllegalRoundingModes checks that the reserved rounding modes
+// are illegal, in the instruction and in frm.
+func TestSoftFloatIllegalRoundingModes(t *testing.T) {
+	for _, tc := range []struct {
+		rm, frm uint32
+	}{
+		{0b101, rmRNE},
+		{0b110, rmRNE},
+		{rmDYN, 0b101},
+		{rmDYN, 0b111},
+	} {
+		c, _ := newSoftFloatCore()
+		c.SetCSR(csr_FRM, tc.frm)
+		c.freg[1], c.freg[2], c.freg[3] = box(0x3F800000), box(0x3F800000), 0
+		traps := c.exec(opFP(fFADD, fmtS, 2, 1, tc.rm, 3))
+		if len(traps) != 1 || traps[0] != TrapIllegalInstruction || c.freg[3] != 0 {
+			t.Errorf("rm %03b with frm %03b took traps %v and wrote %#016x, want an illegal instruction",
+				tc.rm, tc.frm, traps, c.freg[3])
+		}
+	}
+}
+
+// TestSoftFloatResults checks the results and exception flags of operations
+// that raise each of the flags, give NaNs, or read singles from registers that
+// don't hold them NaN-boxed.
+func TestSoftFloatResults(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		inst   uint32
+		f1, f2 uint64
+		want   uint64
+		flags  uint32
+	}{
+		// exceptions
+		{"sqrt(-1)", opFP(fFSQRT, fmtS, 0, 1, rmRNE, 3), box(0xBF800000), 0, box(0x7FC00000), fcsrFlagNV},
+		{"0 * inf", opFP(fFMUL, fmtS, 2, 1, rmRNE, 3), box(0x00000000), box(0x7F800000), box(0x7FC00000), fcsrFlagNV},
+		{"1 / 0", opFP(fFDIV, fmtS, 2, 1, rmRNE, 3), box(0x3F800000), box(0x00000000), box(0x7F800000), fcsrFlagDZ},
+		{"-1 / 0", opFP(fFDIV, fmtS, 2, 1, rmRNE, 3), box(0xBF800000), box(0x00000000), box(0xFF800000), fcsrFlagDZ},
+		{"1 / 0 in D", opFP(fFDIV, fmtD, 2, 1, rmRNE, 3), 0x3FF0000000000000, 0, 0x7FF0000000000000, fcsrFlagDZ},
+		{"max * 2", opFP(fFMUL, fmtS, 2, 1, rmRNE, 3), box(0x7F7FFFFF), box(0x40000000), box(0x7F800000), fcsrFlagOF | fcsrFlagNX},
+		{"max * 2 towards zero", opFP(fFMUL, fmtS, 2, 1, rmRTZ, 3), box(0x7F7FFFFF), box(0x40000000), box(0x7F7FFFFF), fcsrFlagOF | fcsrFlagNX},
+		{"min subnormal / 2", opFP(fFMUL, fmtS, 2, 1, rmRNE, 3), box(0x00000001), box(0x3F000000), box(0x00000000), fcsrFlagUF | fcsrFlagNX},
+		{"min normal / 2, exact", opFP(fFMUL, fmtS, 2, 1, rmRNE, 3), box(0x00800000), box(0x3F000000), box(0x00400000), 0},
+		{"1 / 3", opFP(fFDIV, fmtS, 2, 1, rmRNE, 3), box(0x3F800000), box(0x40400000), box(0x3EAAAAAB), fcsrFlagNX},
+
+		// NaNs come out canonical, whatever their payload
+		{"signaling NaN + 1", opFP(fFADD, fmtS, 2, 1, rmRNE, 3), box(0x7F800001), box(0x3F800000), box(0x7FC00000), fcsrFlagNV},
+		{"quiet NaN + 1", opFP(fFADD, fmtS, 2, 1, rmRNE, 3), box(0xFFC12345), box(0x3F800000), box(0x7FC00000), 0},
+		{"signaling NaN + 1 in D", opFP(fFADD, fmtD, 2, 1, rmRNE, 3), 0x7FF0000000000001, 0x3FF0000000000000, 0x7FF8000000000000, fcsrFlagNV},
+		{"quiet NaN to D", opFP(fFCVT_FF, fmtD, fmtS, 1, rmRNE, 3), box(0x7FC12345), 0, 0x7FF8000000000000, 0},
+		{"signaling NaN to S", opFP(fFCVT_FF, fmtS, fmtD, 1, rmRNE, 3), 0x7FF0000000000001, 0, box(0x7FC00000), fcsrFlagNV},
+
+		// singles that aren't NaN-boxed read as the canonical NaN
+		{"unboxed 1 + 1", opFP(fFADD, fmtS, 2, 1, rmRNE, 3), 0x000000003F800000, box(0x3F800000), box(0x7FC00000), 0},
+		{"half boxed 1 + 1", opFP(fFADD, fmtS, 2, 1, rmRNE, 3), 0xFFFFFFFE3F800000, box(0x3F800000), box(0x7FC00000), 0},
+		{"boxed 1 to D", opFP(fFCVT_FF, fmtD, fmtS, 1, rmRNE, 3), box(0x3F800000), 0, 0x3FF0000000000000, 0},
+		{"unboxed 1 to D", opFP(fFCVT_FF, fmtD, fmtS, 1, rmRNE, 3), 0x000000003F800000, 0, 0x7FF8000000000000, 0},
+	} {
+		c, _ := newSoftFloatCore()
+		c.freg[1], c.freg[2] = tc.f1, tc.f2
+		if traps := c.exec(tc.inst); len(traps) != 0 {
+			t.Errorf("%s: took traps %v", tc.name, traps)
+			continue
+		}
+		if c.freg[3] != tc.want || c.GetCSR(csr_FFLAGS) != tc.flags {
+			t.Errorf("%s: got %#016x with flags %05b, want %#016x with %05b",
+				tc.name, c.freg[3], c.GetCSR(csr_FFLAGS), tc.want, tc.flags)
+		}
+	}
+}
+
+// TestSoftFloatConvertToInt checks that conversions to integers saturate, and
+// raise NV rather than NX when they do.
+func TestSoftFloatConvertToInt(t *testing.T) {
+	const (
+		signed   = 0b00000
+		unsigned = 0b00001
+	)
+	for _, tc := range []struct {
+		name  string
+		inst  uint32
+		f1    uint64
+		want  uint32
+		flags uint32
+	}{
+		{"3e9", opFP(fFCVT_W, fmtS, signed, 1, rmRNE, 10), box(0x4F32D05E), 0x7FFFFFFF, fcsrFlagNV},
+		{"-3e9", opFP(fFCVT_W, fmtS, signed, 1, rmRNE, 10), box(0xCF32D05E), 0x80000000, fcsrFlagNV},
+		{"-2^31", opFP(fFCVT_W, fmtS, signed, 1, rmRNE, 10), box(0xCF000000), 0x80000000, 0},
+		{"NaN", opFP(fFCVT_W, fmtS, signed, 1, rmRNE, 10), box(0xFFC00000), 0x7FFFFFFF, fcsrFlagNV},
+		{"-inf", opFP(fFCVT_W, fmtS, signed, 1, rmRNE, 10), box(0xFF800000), 0x80000000, fcsrFlagNV},
+		{"2.5", opFP(fFCVT_W, fmtS, signed, 1, rmRNE, 10), box(0x40200000), 2, fcsrFlagNX},
+		{"2.5 to max magnitude", opFP(fFCVT_W, fmtS, signed, 1, rmRMM, 10), box(0x40200000), 3, fcsrFlagNX},
+		{"-2.5 down", opFP(fFCVT_W, fmtS, signed, 1, rmRDN, 10), box(0xC0200000), 0xFFFFFFFD, fcsrFlagNX},
+		{"2^31 from D", opFP(fFCVT_W, fmtD, signed, 1, rmRNE, 10), 0x41E0000000000000, 0x7FFFFFFF, fcsrFlagNV},
+		{"-2^31 - 0.5 from D, towards zero", opFP(fFCVT_W, fmtD, signed, 1, rmRTZ, 10), 0xC1E0000000100000, 0x80000000, fcsrFlagNX},
+		{"unsigned -1", opFP(fFCVT_W, fmtS, unsigned, 1, rmRNE, 10), box(0xBF800000), 0, fcsrFlagNV},
+		{"unsigned -0.4, towards zero", opFP(fFCVT_W, fmtS, unsigned, 1, rmRTZ, 10), box(0xBECCCCCD), 0, fcsrFlagNX},
+		{"unsigned 5e9", opFP(fFCVT_W, fmtS, unsigned, 1, rmRNE, 10), box(0x4F9502F9), 0xFFFFFFFF, fcsrFlagNV},
+		{"unsigned inf", opFP(fFCVT_W, fmtS, unsigned, 1, rmRNE, 10), box(0x7F800000), 0xFFFFFFFF, fcsrFlagNV},
+		{"unsigned NaN", opFP(fFCVT_W, fmtS, unsigned, 1, rmRNE, 10), box(0x7FC00000), 0xFFFFFFFF, fcsrFlagNV},
+	} {
+		c, _ := newSoftFloatCore()
+		c.freg[1] = tc.f1
+		if traps := c.exec(tc.inst); len(traps) != 0 {
+			t.Errorf("%s: took traps %v", tc.name, traps)
+			continue
+		}
+		if c.reg[Reg_A0] != tc.want || c.GetCSR(csr_FFLAGS) != tc.flags {
+			t.Errorf("%s: got %#08x with flags %05b, want %#08x with %05b",
+				tc.name, c.reg[Reg_A0], c.GetCSR(csr_FFLAGS), tc.want, tc.flags)
+		}
+	}
+}
+
+// TestSoftFloatFlagsAccumulate checks that flags accumulate in fcsr until
+// they are cleared, and leave frm alone.
+func TestSoftFloatFlagsAccumulate(t *testing.T) {
+	c, _ := newSoftFloatCore()
+	c.SetCSR(csr_FRM, rmRDN)
+
+	steps := []struct {
+		f1, f2 uint32
+		rm     uint32
+		want   uint32
+		flags  uint32 // accrued after the step
+	}{
+		{0x3F800000, 0x00000000, rmRNE, 0x7F800000, fcsrFlagDZ},                           // 1 / 0
+		{0x3F800000, 0x40400000, rmDYN, 0x3EAAAAAA, fcsrFlagDZ | fcsrFlagNX},              // 1 / 3, rounded down
+		{0x40000000, 0x3F800000, rmRNE, 0x40000000, fcsrFlagDZ | fcsrFlagNX},              // 2 / 1, exact
+		{0x00000000, 0x00000000, rmRNE, 0x7FC00000, fcsrFlagNV | fcsrFlagDZ | fcsrFlagNX}, // 0 / 0
+	}
+	for i, step := range steps {
+		c.freg[1], c.freg[2] = box(step.f1), box(step.f2)
+		c.exec(opFP(fFDIV, fmtS, 2, 1, step.rm, 3))
+		if c.freg[3] != box(step.want) || c.GetCSR(csr_FFLAGS) != step.flags {
+			t.Errorf("step %d: got %#016x with flags %05b, want %#08x with %05b",
+				i, c.freg[3], c.GetCSR(csr_FFLAGS), step.want, step.flags)
+		}
+	}
+	if frm := c.GetCSR(csr_FRM); frm != rmRDN {
+		t.Errorf("frm is %03b, want %03b", frm, rmRDN)
+	}
+
+	c.SetCSR(csr_FFLAGS, 0)
+	if fcsr := c.csr[csr_FCSR]; fcsr != rmRDN<<fcsrFrmShift {
+		t.Errorf("fcsr is %#x after clearing the flags, want %#x", fcsr, rmRDN<<fcsrFrmShift)
+	}
+}
+
+// TestFusedMultiplyAdd checks the signs of the four fused multiply-adds, with
+// softfloat.go and with the floats of Go, in both formats.
+func TestFusedMultiplyAdd(t *testing.T) {
+	const (
+		FMADD  = 0b1000011 // a*b + c
+		FMSUB  = 0b1000111 // a*b - c
+		FNMSUB = 0b1001011 // -(a*b) + c
+		FNMADD = 0b1001111 // -(a*b) - c
+	)
+	// 2 * 3 and 1, and what each gives
+	single := map[uint32]uint32{FMADD: 0x40E00000, FMSUB: 0x40A00000, FNMSUB: 0xC0A00000, FNMADD: 0xC0E00000}
+	double := map[uint32]uint64{FMADD: 0x401C000000000000, FMSUB: 0x4014000000000000, FNMSUB: 0xC014000000000000, FNMADD: 0xC01C000000000000}
+
+	for _, soft := range []bool{true, false} {
+		cfg := DefaultConfig()
+		cfg.F, cfg.D, cfg.SoftFloat = true, true, soft
+		c, _ := newTestCore(cfg)
+
+		for opcode, want := range single {
+			c.freg[1], c.freg[2], c.freg[4] = box(0x40000000), box(0x40400000), box(0x3F800000)
+			c.exec(opFMA(opcode, fmtS, 4, 2, 1, rmRNE, 3))
+			if c.freg[3] != box(want) {
+				t.Errorf("soft %v: opcode %07b in S gives %#016x, want %#016x", soft, opcode, c.freg[3], box(want))
+			}
+		}
+		for opcode, want := range double {
+			c.freg[1], c.freg[2], c.freg[4] = 0x4000000000000000, 0x4008000000000000, 0x3FF0000000000000
+			c.exec(opFMA(opcode, fmtD, 4, 2, 1, rmRNE, 3))
+			if c.freg[3] != want {
+				t.Errorf("soft %v: opcode %07b in D gives %#016x, want %#016x", soft, opcode, c.freg[3], want)
+			}
+		}
+	}
+}
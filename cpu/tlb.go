@@ -9,14 +9,19 @@ const (
 	tlbInvalidEntry = 0xFFFFFFFFFFFFFFFF
 )
 
+// tlb is a hash-map with quadratic probing, like `cache`.
+//   Its size comes from the `Config` it is made with; being a power of 2,
+// slots are found with a mask.
 type tlb struct {
-	entries [tlbSize]uint64
+	entries    []uint64
+	indexMask  uint32 // used to turn a vpi into a slot, len(entries) - 1
+	probeDepth uint32 // how many slots a translation may be placed in
 }
 
 // load will attempt to locate a given virtual page index
 func (t *tlb) load(vpi uint32) (bool, uint32) {
-	for i := uint32(0); i < tlbProbeDepth; i++ {
-		v := t.entries[(vpi+i*i)&0xFF]
+	for i := uint32(0); i < t.probeDepth; i++ {
+		v := t.entries[(vpi+i*i)&t.indexMask]
 		if uint32(v>>32) == vpi {
 			return true, uint32(v)
 		}
@@ -25,20 +30,20 @@ func (t *tlb) load(vpi uint32) (bool, uint32) {
 }
 
 func (t *tlb) store(vpi, pte uint32) bool {
-	for i := uint32(0); i < tlbProbeDepth; i++ {
-		v := t.entries[(vpi+i*i)&0xFF]
+	for i := uint32(0); i < t.probeDepth; i++ {
+		v := t.entries[(vpi+i*i)&t.indexMask]
 		if v == tlbInvalidEntry {
-			t.entries[(vpi+i*i)&0xFF] = (uint64(vpi) << 32) | uint64(pte)
+			t.entries[(vpi+i*i)&t.indexMask] = (uint64(vpi) << 32) | uint64(pte)
 			return true
 		}
 	}
 
 	// if all are filled, invalidate all entries
-	for i := uint32(0); i < tlbProbeDepth; i++ {
-		t.entries[(vpi+i*i)&0xFF] = tlbInvalidEntry
+	for i := uint32(0); i < t.probeDepth; i++ {
+		t.entries[(vpi+i*i)&t.indexMask] = tlbInvalidEntry
 	}
 
-	t.entries[vpi&0xFF] = (uint64(vpi) << 32) | uint64(pte)
+	t.entries[vpi&t.indexMask] = (uint64(vpi) << 32) | uint64(pte)
 	return true
 }
 
@@ -48,8 +53,14 @@ func (t *tlb) invalidateAll() {
 	}
 }
 
-func newTLB() tlb {
-	t := tlb{}
+// newTLB returns a new tlb with the size given by `cfg`, filled with invalid
+// entries.
+func newTLB(cfg Config) tlb {
+	t := tlb{
+		entries:    make([]uint64, cfg.TLBSize),
+		indexMask:  cfg.TLBSize - 1,
+		probeDepth: cfg.TLBProbeDepth,
+	}
 	for i := range t.entries {
 		t.entries[i] = tlbInvalidEntry
 	}
@@ -49,13 +49,14 @@ const (
 //   If the address is invalid, or insufficient flags are set for the
 // given accessType, a page fault is raised for that accessType and this
 // function returns `false, 0`.
-func (c *Core) translate(vAddr uint32, aType accessType) (success bool, pAddr uint32) {
+//   The physical address is 34 bits wide, see memory.go.
+func (c *Core) translate(vAddr uint32, aType accessType) (success bool, pAddr uint64) {
 	// get the satp register
 	satp := c.csr[Csr_SATP]
 
 	success = true
 	if satp&0x80000000 == 0 { // bare mode, no translation or protection
-		return true, vAddr
+		return true, uint64(vAddr)
 	}
 
 	// virtual page identifier
@@ -66,9 +67,9 @@ func (c *Core) translate(vAddr uint32, aType accessType) (success bool, pAddr ui
 	i := 0
 
 	if present, p := c.mc.tlb.load(vpi); present {
-		// normal page
-		pte = p
-		i = 0
+		// normal page; returning right away lets the shift in `pteAddress`
+		// be worked out at compile time on this hot path
+		return true, pteAddress(p, vAddr, 0)
 	} else {
 		// not in tlb, walk table
 		j, p := c.walkTable(vpi)
@@ -94,15 +95,7 @@ func (c *Core) translate(vAddr uint32, aType accessType) (success bool, pAddr ui
 		// 7. If pte.a = 0, or if the original memory access is a store and pte.d = 0,
 		// either raise a page-fault exception corresponding to the original access
 		// type...
-		success = success && pte&pageFlagUser != 0
-
-		if aType == accessTypeInstructionFetch && success {
-			success = pte&pageFlagExec != 0 && pte&pageFlagAccessed != 0
-		} else if aType == accessTypeLoad && success {
-			success = pte&pageFlagRead != 0 && pte&pageFlagAccessed != 0
-		} else if aType == accessTypeStore && success {
-			success = pte&pageFlagWrite != 0 && pte&pageFlagAccessed != 0 && pte&pageFlagDirty != 0
-		}
+		success = success && pteAllows(pte, aType)
 
 		// something, somewhere failed and now we have to trap
 		if !success {
@@ -130,8 +123,6 @@ func (c *Core) translate(vAddr uint32, aType accessType) (success bool, pAddr ui
 			pte |= (vAddr & 0x003FF000) >> 2 // edit the PTE
 			c.mc.tlb.store(vpi, pte)
 		}
-
-		pAddr = ((pte & 0xFFFFFC00) << 2) | (vAddr & 0x00000FFF)
 	}
 
 	// 8. The translation is successful. The translated physical address is given
@@ -139,9 +130,34 @@ func (c *Core) translate(vAddr uint32, aType accessType) (success bool, pAddr ui
 	// translation and
 	// pa.ppn[i − 1 : 0] = va.vpn[i − 1 : 0]. pa.ppn[LEVELS − 1 : i] = pte.ppn[LEVELS − 1 : i].
 
-	pAddr = ((pte & 0xFFFFFC00) << 2) | (vAddr & (0xFFFFFFFF >> (20 - 10*i)))
+	return true, pteAddress(pte, vAddr, i)
+}
 
-	return true, pAddr
+// pteAddress returns the physical address `vAddr` translates to through the
+// leaf `pte` found at depth `i`.
+//   The PPN of `pte` is 22 bits, so the address is 34 bits; PPN[1] holds the
+// bits above 32.
+func pteAddress(pte, vAddr uint32, i int) uint64 {
+	mask := uint32(0xFFFFFFFF) >> (20 - 10*i)
+	return uint64(pte&0xFFFFFC00)<<2 | uint64(vAddr&mask)
+}
+
+// pteAllows checks whether the leaf `pte` allows a user mode access of type
+// `aType`.
+func pteAllows(pte uint32, aType accessType) bool {
+	if pte&pageFlagUser == 0 || pte&pageFlagAccessed == 0 {
+		return false
+	}
+
+	switch aType {
+	case accessTypeInstructionFetch:
+		return pte&pageFlagExec != 0
+	case accessTypeLoad:
+		return pte&pageFlagRead != 0
+	case accessTypeStore:
+		return pte&pageFlagWrite != 0 && pte&pageFlagDirty != 0
+	}
+	return false
 }
 
 // walkTable walks the page table and returns the pte that corresponds
@@ -159,7 +175,7 @@ func (c *Core) walkTable(vpn uint32) (int, uint32) {
 	// 1. Let a be satp.ppn × PAGESIZE, and let i = LEVELS − 1. (For Sv32,
 	// PAGESIZE=2¹² and LEVELS=2.) The satp register must be active, i.e., the
 	// effective privilege mode must be S-mode or U-mode.
-	a := (satp & 0x003FFFFF) * pagesize
+	a := uint64(satp&0x003FFFFF) * pagesize
 	i := 1
 	for {
 		// 2. Let pte be the value of the PTE at address a+va.vpn[i]×PTESIZE.
@@ -167,7 +183,7 @@ func (c *Core) walkTable(vpn uint32) (int, uint32) {
 		// raise an access-fault exception corresponding to the original access
 		// type.
 		vpni := (vpn >> (10 * i)) & 0x3FF
-		success, pte := c.AtomicLoadWordPhysicalUncached(a + vpni*4)
+		success, pte := c.AtomicLoadWordPhysicalUncached(a + uint64(vpni)*4)
 		if !success {
 			return i, 0
 		}
@@ -192,7 +208,7 @@ func (c *Core) walkTable(vpn uint32) (int, uint32) {
 			if i < 0 {
 				return i, 0
 			}
-			a = (pte >> 10) * pagesize
+			a = uint64(pte>>10) * pagesize
 			// fmt.Println("Next level")
 			continue
 		}
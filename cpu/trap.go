@@ -17,6 +17,7 @@ const (
 	TrapStorePageFault                      = 0x0000000F
 
 	// --- Interrupt reasons ---
+	TrapMachineSoftwareInterrupt = 0x80000003
 	TrapMachineTimerInterrupt    = 0x80000007
 	TrapMachineExternalInterrupt = 0x8000000B
 )
@@ -24,10 +25,44 @@ const (
 // trap() sets up the parts of the trap that are common for every trap.
 //   Other setup has to be done independently depending on the trap
 // reason.
+//   Interrupts are disabled while the handler runs, and restored from
+// mstatus.MPIE afterwards, as `mret` would.
+//   A trap taken while a handler runs, which happens when a handler waits for
+// another core, leaves the trap CSRs as it found them, so the interrupted
+// handler carries on undisturbed.
 func (c *Core) trap(reason uint32) {
+	saved := c.csr[Csr_MSTATUS]
+	savedCause, savedEPC := c.csr[Csr_MCAUSE], c.csr[Csr_MEPC]
+
 	c.csr[Csr_MCAUSE] = reason
 	c.csr[Csr_MEPC] = c.pc
 	c.jumped = true
+	if reason&0x80000000 == 0 { // not an interrupt
+		c.excepted = true
+	}
+
+	mstatus := saved &^ (MSTATUS_MIE | MSTATUS_MPIE)
+	if saved&MSTATUS_MIE != 0 {
+		mstatus |= MSTATUS_MPIE
+	}
+	c.csr[Csr_MSTATUS] = mstatus
+
+	c.trapDepth++
 	c.system.HandleTrap(c)
+	c.trapDepth--
+
+	if c.trapDepth > 0 {
+		c.csr[Csr_MSTATUS] = saved
+		c.csr[Csr_MCAUSE], c.csr[Csr_MEPC] = savedCause, savedEPC
+		return
+	}
+
+	mstatus = c.csr[Csr_MSTATUS] | MSTATUS_MPIE
+	if c.csr[Csr_MSTATUS]&MSTATUS_MPIE != 0 {
+		mstatus |= MSTATUS_MIE
+	} else {
+		mstatus &^= MSTATUS_MIE
+	}
+	c.csr[Csr_MSTATUS] = mstatus
 	c.pc = c.csr[Csr_MEPC]
 }
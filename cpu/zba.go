@@ -0,0 +1,44 @@
+// This file contains implementations of the instructions specified in
+// the Zba extension of the RISC-V bit-manipulation specification.
+//   Refer to the specification for instruction documentation.
+
+package cpu
+
+// shift left by 1 and add
+func (c *Core) sh1add(inst uint32) {
+	if !c.cfg.Zba {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs2] + c.reg[rs1]<<1
+}
+
+// shift left by 2 and add
+func (c *Core) sh2add(inst uint32) {
+	if !c.cfg.Zba {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs2] + c.reg[rs1]<<2
+}
+
+// shift left by 3 and add
+func (c *Core) sh3add(inst uint32) {
+	if !c.cfg.Zba {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs2] + c.reg[rs1]<<3
+}
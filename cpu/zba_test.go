@@ -0,0 +1,29 @@
+package cpu
+
+import "testing"
+
+// TestZba checks the instructions of zba.go against test vectors.
+func TestZba(t *testing.T) {
+	testRegisterVectors(t, DefaultConfig(), []registerVector{
+		{"sh1add", 0x20c5a533, 0x00000001, 0x00000002, 0x00000004},
+		{"sh1add", 0x20c5a533, 0x80000001, 0x00000005, 0x00000007},
+		{"sh1add", 0x20c5a533, 0x40000000, 0xffffffff, 0x7fffffff},
+		{"sh2add", 0x20c5c533, 0x00000001, 0x00000002, 0x00000006},
+		{"sh2add", 0x20c5c533, 0x40000001, 0x00000000, 0x00000004},
+		{"sh2add", 0x20c5c533, 0xffffffff, 0x00000004, 0x00000000},
+		{"sh3add", 0x20c5e533, 0x00000001, 0x00000002, 0x0000000a},
+		{"sh3add", 0x20c5e533, 0x20000001, 0x00000010, 0x00000018},
+		{"sh3add", 0x20c5e533, 0xffffffff, 0x00000008, 0x00000000},
+	})
+}
+
+// TestZbaIllegal checks that nothing of Zba is left without it.
+func TestZbaIllegal(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zba = false
+	testIllegal(t, cfg, map[string]uint32{
+		"sh1add": 0x20c5a533,
+		"sh2add": 0x20c5c533,
+		"sh3add": 0x20c5e533,
+	})
+}
@@ -0,0 +1,251 @@
+// This file contains implementations of the instructions specified in
+// the Zbb extension of the RISC-V bit-manipulation specification.
+//   Refer to the specification for instruction documentation.
+
+package cpu
+
+import "math/bits"
+
+// and with inverted operand
+func (c *Core) andn(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] &^ c.reg[rs2]
+}
+
+// or with inverted operand
+func (c *Core) orn(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] | ^c.reg[rs2]
+}
+
+// exclusive nor
+func (c *Core) xnor(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = ^(c.reg[rs1] ^ c.reg[rs2])
+}
+
+// count leading zero bits
+func (c *Core) clz(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	c.reg[rd] = uint32(bits.LeadingZeros32(c.reg[rs1]))
+}
+
+// count trailing zero bits
+func (c *Core) ctz(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	c.reg[rd] = uint32(bits.TrailingZeros32(c.reg[rs1]))
+}
+
+// count set bits
+func (c *Core) cpop(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	c.reg[rd] = uint32(bits.OnesCount32(c.reg[rs1]))
+}
+
+// maximum (signed)
+func (c *Core) max(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1]
+	if int32(c.reg[rs2]) > int32(c.reg[rs1]) {
+		c.reg[rd] = c.reg[rs2]
+	}
+}
+
+// maximum (unsigned)
+func (c *Core) maxu(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1]
+	if c.reg[rs2] > c.reg[rs1] {
+		c.reg[rd] = c.reg[rs2]
+	}
+}
+
+// minimum (signed)
+func (c *Core) min(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1]
+	if int32(c.reg[rs2]) < int32(c.reg[rs1]) {
+		c.reg[rd] = c.reg[rs2]
+	}
+}
+
+// minimum (unsigned)
+func (c *Core) minu(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1]
+	if c.reg[rs2] < c.reg[rs1] {
+		c.reg[rd] = c.reg[rs2]
+	}
+}
+
+// sign extend byte
+func (c *Core) sext_b(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	c.reg[rd] = uint32(int32(int8(c.reg[rs1])))
+}
+
+// sign extend halfword
+func (c *Core) sext_h(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	c.reg[rd] = uint32(int32(int16(c.reg[rs1])))
+}
+
+// zero extend halfword
+func (c *Core) zext_h(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	c.reg[rd] = c.reg[rs1] & 0xffff
+}
+
+// rotate left
+func (c *Core) rol(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = bits.RotateLeft32(c.reg[rs1], int(c.reg[rs2]&0x1f))
+}
+
+// rotate right
+func (c *Core) ror(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = bits.RotateLeft32(c.reg[rs1], -int(c.reg[rs2]&0x1f))
+}
+
+// rotate right immediate
+func (c *Core) rori(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	shamt := (inst >> 20) & 0x1f
+	c.reg[rd] = bits.RotateLeft32(c.reg[rs1], -int(shamt))
+}
+
+// bitwise or combine, byte granule: every byte that isn't zero becomes 0xff
+func (c *Core) orc_b(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	res := uint32(0)
+	for i := 0; i < 32; i += 8 {
+		if c.reg[rs1]>>i&0xff != 0 {
+			res |= 0xff << i
+		}
+	}
+	c.reg[rd] = res
+}
+
+// byte reverse
+func (c *Core) rev8(inst uint32) {
+	if !c.cfg.Zbb {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	c.reg[rd] = bits.ReverseBytes32(c.reg[rs1])
+}
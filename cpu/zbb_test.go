@@ -0,0 +1,97 @@
+package cpu
+
+import "testing"
+
+// TestZbb checks the instructions of zbb.go against test vectors; for
+// rol and ror, only the low 5 bits of a2 count.
+func TestZbb(t *testing.T) {
+	testRegisterVectors(t, DefaultConfig(), []registerVector{
+		{"andn", 0x40c5f533, 0xff00ff00, 0x0ff00ff0, 0xf000f000},
+		{"andn", 0x40c5f533, 0xffffffff, 0x00000000, 0xffffffff},
+		{"orn", 0x40c5e533, 0xff00ff00, 0x0ff00ff0, 0xff0fff0f},
+		{"orn", 0x40c5e533, 0x00000000, 0xffffffff, 0x00000000},
+		{"xnor", 0x40c5c533, 0xff00ff00, 0x0ff00ff0, 0x0f0f0f0f},
+		{"xnor", 0x40c5c533, 0x12345678, 0x12345678, 0xffffffff},
+		{"max", 0x0ac5e533, 0xffffffff, 0x00000001, 0x00000001},
+		{"max", 0x0ac5e533, 0x80000000, 0x7fffffff, 0x7fffffff},
+		{"max", 0x0ac5e533, 0x00000005, 0x00000005, 0x00000005},
+		{"maxu", 0x0ac5f533, 0xffffffff, 0x00000001, 0xffffffff},
+		{"maxu", 0x0ac5f533, 0x80000000, 0x7fffffff, 0x80000000},
+		{"min", 0x0ac5c533, 0xffffffff, 0x00000001, 0xffffffff},
+		{"min", 0x0ac5c533, 0x80000000, 0x7fffffff, 0x80000000},
+		{"minu", 0x0ac5d533, 0xffffffff, 0x00000001, 0x00000001},
+		{"minu", 0x0ac5d533, 0x80000000, 0x7fffffff, 0x7fffffff},
+		{"rol", 0x60c59533, 0x80000001, 0x00000001, 0x00000003},
+		{"rol", 0x60c59533, 0x12345678, 0x00000008, 0x34567812},
+		{"rol", 0x60c59533, 0x12345678, 0x00000024, 0x23456781},
+		{"rol", 0x60c59533, 0x12345678, 0x00000000, 0x12345678},
+		{"ror", 0x60c5d533, 0x80000001, 0x00000001, 0xc0000000},
+		{"ror", 0x60c5d533, 0x12345678, 0x00000008, 0x78123456},
+		{"ror", 0x60c5d533, 0x12345678, 0xffffffe8, 0x78123456},
+		{"ror", 0x60c5d533, 0x12345678, 0x00000020, 0x12345678},
+		{"clz", 0x60059513, 0x00000000, 0, 0x00000020},
+		{"clz", 0x60059513, 0x00000001, 0, 0x0000001f},
+		{"clz", 0x60059513, 0x80000000, 0, 0x00000000},
+		{"clz", 0x60059513, 0x0000ffff, 0, 0x00000010},
+		{"ctz", 0x60159513, 0x00000000, 0, 0x00000020},
+		{"ctz", 0x60159513, 0x00000001, 0, 0x00000000},
+		{"ctz", 0x60159513, 0x80000000, 0, 0x0000001f},
+		{"ctz", 0x60159513, 0xffff0000, 0, 0x00000010},
+		{"cpop", 0x60259513, 0x00000000, 0, 0x00000000},
+		{"cpop", 0x60259513, 0xffffffff, 0, 0x00000020},
+		{"cpop", 0x60259513, 0x12345678, 0, 0x0000000d},
+		{"sext.b", 0x60459513, 0x0000007f, 0, 0x0000007f},
+		{"sext.b", 0x60459513, 0x00000080, 0, 0xffffff80},
+		{"sext.b", 0x60459513, 0x123456ff, 0, 0xffffffff},
+		{"sext.h", 0x60559513, 0x00007fff, 0, 0x00007fff},
+		{"sext.h", 0x60559513, 0x00008000, 0, 0xffff8000},
+		{"sext.h", 0x60559513, 0x1234ffff, 0, 0xffffffff},
+		{"zext.h", 0x0805c533, 0xffffffff, 0, 0x0000ffff},
+		{"zext.h", 0x0805c533, 0x12345678, 0, 0x00005678},
+		{"rev8", 0x6985d513, 0x12345678, 0, 0x78563412},
+		{"rev8", 0x6985d513, 0xff000000, 0, 0x000000ff},
+		{"rev8", 0x6985d513, 0x00000000, 0, 0x00000000},
+		{"orc.b", 0x2875d513, 0x00000000, 0, 0x00000000},
+		{"orc.b", 0x2875d513, 0x00010000, 0, 0x00ff0000},
+		{"orc.b", 0x2875d513, 0x80000001, 0, 0xff0000ff},
+		{"orc.b", 0x2875d513, 0x01020304, 0, 0xffffffff},
+		{"rori 1", 0x6015d513, 0x80000001, 0, 0xc0000000},
+		{"rori 31", 0x61f5d513, 0x12345678, 0, 0x2468acf0},
+		{"rori 0", 0x6005d513, 0x12345678, 0, 0x12345678},
+	})
+}
+
+// TestZbbIllegal checks that rori can't rotate by 32 or more, that rev8 and
+// orc.b only exist with their own immediates, and that nothing of Zbb is left
+// without it.
+func TestZbbIllegal(t *testing.T) {
+	const shamt5 = 1 << 25 // the bit of the immediate that would mean 32
+	testIllegal(t, DefaultConfig(), map[string]uint32{
+		"rori 63":                0x61f5d513 | shamt5,
+		"rev8 with immediate 0":  0x6985d513 &^ (0x1f << 20),
+		"orc.b with immediate 0": 0x2875d513 &^ (0x1f << 20),
+	})
+
+	cfg := DefaultConfig()
+	cfg.Zbb = false
+	testIllegal(t, cfg, map[string]uint32{
+		"andn":    0x40c5f533,
+		"orn":     0x40c5e533,
+		"xnor":    0x40c5c533,
+		"clz":     0x60059513,
+		"ctz":     0x60159513,
+		"cpop":    0x60259513,
+		"max":     0x0ac5e533,
+		"maxu":    0x0ac5f533,
+		"min":     0x0ac5c533,
+		"minu":    0x0ac5d533,
+		"sext.b":  0x60459513,
+		"sext.h":  0x60559513,
+		"zext.h":  0x0805c533,
+		"rol":     0x60c59533,
+		"ror":     0x60c5d533,
+		"rori 31": 0x61f5d513,
+		"rev8":    0x6985d513,
+		"orc.b":   0x2875d513,
+	})
+}
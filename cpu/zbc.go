@@ -0,0 +1,55 @@
+// This file contains implementations of the instructions specified in
+// the Zbc extension of the RISC-V bit-manipulation specification.
+//   Refer to the specification for instruction documentation.
+
+package cpu
+
+// clmul64 returns the 64-bit carry-less product of `a` and `b`.
+func clmul64(a, b uint32) uint64 {
+	var res uint64
+	for i := 0; i < 32; i++ {
+		if b>>i&1 != 0 {
+			res ^= uint64(a) << i
+		}
+	}
+	return res
+}
+
+// carry-less multiply, low half
+func (c *Core) clmul(inst uint32) {
+	if !c.cfg.Zbc {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = uint32(clmul64(c.reg[rs1], c.reg[rs2]))
+}
+
+// carry-less multiply, high half
+func (c *Core) clmulh(inst uint32) {
+	if !c.cfg.Zbc {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = uint32(clmul64(c.reg[rs1], c.reg[rs2]) >> 32)
+}
+
+// carry-less multiply, reversed: bits 62 to 31 of the product
+func (c *Core) clmulr(inst uint32) {
+	if !c.cfg.Zbc {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = uint32(clmul64(c.reg[rs1], c.reg[rs2]) >> 31)
+}
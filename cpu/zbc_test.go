@@ -0,0 +1,37 @@
+package cpu
+
+import "testing"
+
+// TestZbc checks the carry-less multiplications of zbc.go against test
+// vectors worked out from the definitions in the specification.
+func TestZbc(t *testing.T) {
+	testRegisterVectors(t, DefaultConfig(), []registerVector{
+		{"clmul", 0x0ac59533, 0x00000003, 0x00000003, 0x00000005},
+		{"clmul", 0x0ac59533, 0xffffffff, 0xffffffff, 0x55555555},
+		{"clmul", 0x0ac59533, 0x80000000, 0x00000002, 0x00000000},
+		{"clmul", 0x0ac59533, 0x12345678, 0x9abcdef0, 0x5cd25a80},
+		{"clmul", 0x0ac59533, 0x00000000, 0xdeadbeef, 0x00000000},
+		{"clmulh", 0x0ac5b533, 0x00000003, 0x00000003, 0x00000000},
+		{"clmulh", 0x0ac5b533, 0xffffffff, 0xffffffff, 0x55555555},
+		{"clmulh", 0x0ac5b533, 0x80000000, 0x00000002, 0x00000001},
+		{"clmulh", 0x0ac5b533, 0x12345678, 0x9abcdef0, 0x08860e94},
+		{"clmulh", 0x0ac5b533, 0x80000000, 0x80000000, 0x40000000},
+		{"clmulr", 0x0ac5a533, 0x00000003, 0x00000003, 0x00000000},
+		{"clmulr", 0x0ac5a533, 0xffffffff, 0xffffffff, 0xaaaaaaaa},
+		{"clmulr", 0x0ac5a533, 0x80000000, 0x00000002, 0x00000002},
+		{"clmulr", 0x0ac5a533, 0x12345678, 0x9abcdef0, 0x110c1d28},
+		{"clmulr", 0x0ac5a533, 0x80000000, 0x80000000, 0x80000000},
+		{"clmulr", 0x0ac5a533, 0x00000001, 0x00000001, 0x00000000},
+	})
+}
+
+// TestZbcIllegal checks that nothing of Zbc is left without it.
+func TestZbcIllegal(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zbc = false
+	testIllegal(t, cfg, map[string]uint32{
+		"clmul":  0x0ac59533,
+		"clmulh": 0x0ac5b533,
+		"clmulr": 0x0ac5a533,
+	})
+}
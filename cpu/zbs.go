@@ -0,0 +1,109 @@
+// This file contains implementations of the instructions specified in
+// the Zbs extension of the RISC-V bit-manipulation specification.
+//   Refer to the specification for instruction documentation.
+
+package cpu
+
+// clear bit
+func (c *Core) bclr(inst uint32) {
+	if !c.cfg.Zbs {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] &^ (1 << (c.reg[rs2] & 0x1f))
+}
+
+// clear bit immediate
+func (c *Core) bclri(inst uint32) {
+	if !c.cfg.Zbs {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	shamt := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] &^ (1 << shamt)
+}
+
+// extract bit
+func (c *Core) bext(inst uint32) {
+	if !c.cfg.Zbs {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] >> (c.reg[rs2] & 0x1f) & 1
+}
+
+// extract bit immediate
+func (c *Core) bexti(inst uint32) {
+	if !c.cfg.Zbs {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	shamt := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] >> shamt & 1
+}
+
+// invert bit
+func (c *Core) binv(inst uint32) {
+	if !c.cfg.Zbs {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] ^ 1<<(c.reg[rs2]&0x1f)
+}
+
+// invert bit immediate
+func (c *Core) binvi(inst uint32) {
+	if !c.cfg.Zbs {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	shamt := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] ^ 1<<shamt
+}
+
+// set bit
+func (c *Core) bset(inst uint32) {
+	if !c.cfg.Zbs {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] | 1<<(c.reg[rs2]&0x1f)
+}
+
+// set bit immediate
+func (c *Core) bseti(inst uint32) {
+	if !c.cfg.Zbs {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
+	}
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	shamt := (inst >> 20) & 0x1f
+	c.reg[rd] = c.reg[rs1] | 1<<shamt
+}
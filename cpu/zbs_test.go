@@ -0,0 +1,56 @@
+package cpu
+
+import "testing"
+
+// TestZbs checks the instructions of zbs.go against test vectors; for the
+// register forms, only the low 5 bits of a2 count.
+func TestZbs(t *testing.T) {
+	testRegisterVectors(t, DefaultConfig(), []registerVector{
+		{"bclr", 0x48c59533, 0xffffffff, 0x0000001f, 0x7fffffff},
+		{"bclr", 0x48c59533, 0xffffffff, 0x00000024, 0xffffffef},
+		{"bclr", 0x48c59533, 0x00000010, 0x00000004, 0x00000000},
+		{"bext", 0x48c5d533, 0x80000000, 0x0000001f, 0x00000001},
+		{"bext", 0x48c5d533, 0x00000010, 0x00000024, 0x00000001},
+		{"bext", 0x48c5d533, 0x00000010, 0x00000003, 0x00000000},
+		{"binv", 0x68c59533, 0x00000000, 0x0000001f, 0x80000000},
+		{"binv", 0x68c59533, 0x00000010, 0x00000024, 0x00000000},
+		{"binv", 0x68c59533, 0xffffffff, 0x00000000, 0xfffffffe},
+		{"bset", 0x28c59533, 0x00000000, 0x0000001f, 0x80000000},
+		{"bset", 0x28c59533, 0x00000000, 0x00000024, 0x00000010},
+		{"bset", 0x28c59533, 0x00000001, 0x00000000, 0x00000001},
+		{"bclri 31", 0x49f59513, 0xffffffff, 0, 0x7fffffff},
+		{"bclri 0", 0x48059513, 0xffffffff, 0, 0xfffffffe},
+		{"bexti 31", 0x49f5d513, 0x80000000, 0, 0x00000001},
+		{"bexti 4", 0x4845d513, 0x00000010, 0, 0x00000001},
+		{"bexti 3", 0x4835d513, 0x00000010, 0, 0x00000000},
+		{"binvi 31", 0x69f59513, 0x00000000, 0, 0x80000000},
+		{"binvi 4", 0x68459513, 0x00000010, 0, 0x00000000},
+		{"bseti 31", 0x29f59513, 0x00000000, 0, 0x80000000},
+		{"bseti 0", 0x28059513, 0x00000000, 0, 0x00000001},
+	})
+}
+
+// TestZbsIllegal checks that the immediate forms can't shift by 32 or more,
+// and that nothing of Zbs is left without it.
+func TestZbsIllegal(t *testing.T) {
+	const shamt5 = 1 << 25 // the bit of the immediate that would mean 32
+	testIllegal(t, DefaultConfig(), map[string]uint32{
+		"bclri 63": 0x49f59513 | shamt5,
+		"bexti 63": 0x49f5d513 | shamt5,
+		"binvi 63": 0x69f59513 | shamt5,
+		"bseti 63": 0x29f59513 | shamt5,
+	})
+
+	cfg := DefaultConfig()
+	cfg.Zbs = false
+	testIllegal(t, cfg, map[string]uint32{
+		"bclr":     0x48c59533,
+		"bext":     0x48c5d533,
+		"binv":     0x68c59533,
+		"bset":     0x28c59533,
+		"bclri 31": 0x49f59513,
+		"bexti 31": 0x49f5d513,
+		"binvi 31": 0x69f59513,
+		"bseti 31": 0x29f59513,
+	})
+}
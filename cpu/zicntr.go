@@ -0,0 +1,28 @@
+// This file contains the counters of the Zicntr extension, which programs
+// read through the cycle, time and instret CSRs and their upper halves.
+//   `cycle` counts the cycles of the core like `Cycles` does, only without
+// lagging behind, and `instret` counts the instructions the core retired,
+// which leaves out those that raised an exception. `time` is `mtime`, which
+// the system provides, so that it agrees with the timer interrupts.
+//   The counters are per core, and keep counting across context switches.
+
+package cpu
+
+// readCounter returns the value of the counter CSR `csr`.
+func (c *Core) readCounter(csr Csr) uint32 {
+	var v uint64
+	switch csr {
+	case Csr_CYCLE, Csr_CYCLEH:
+		// `cycles` is only brought up to date every few cycles
+		v = c.Cycles() + uint64(c.interruptCounter)
+	case Csr_TIME, Csr_TIMEH:
+		v = c.system.Time()
+	case Csr_INSTRET, Csr_INSTRETH:
+		v = c.instret
+	}
+
+	if csr&0x080 != 0 { // the upper half
+		return uint32(v >> 32)
+	}
+	return uint32(v)
+}
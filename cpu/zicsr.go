@@ -1,6 +1,11 @@
 // This file contains implementations of the instructions specified in
 // the Zicsr extension of the RISC-V unprivileged specification.
 //   Refer to the specification for instruction documentation.
+//   Programs run in user mode, since the system itself plays the part of
+// machine mode, so only the unprivileged CSRs can be accessed by
+// instructions. Accesses go through `GetCSR` and `SetCSR`, so that CSRs that
+// are fields of another one, or are computed when read, behave the same for
+// the system and for programs.
 
 package cpu
 
@@ -13,6 +18,14 @@ const (
 	csr_FRM        = 0x002
 	csr_FCSR       = 0x003
 
+	// --- Unprivileged Counter/Timers, see zicntr.go ---
+	Csr_CYCLE    = 0xC00
+	Csr_TIME     = 0xC01
+	Csr_INSTRET  = 0xC02
+	Csr_CYCLEH   = 0xC80
+	Csr_TIMEH    = 0xC81
+	Csr_INSTRETH = 0xC82
+
 	// --- Machine information registers ---
 	// Csr_MVENDORID  = 0xF11
 	// Csr_MARCHID    = 0xF12
@@ -20,12 +33,16 @@ const (
 	Csr_MHARTID = 0xF14
 	// Csr_MCONFIGPTR = 0xF15
 
+	// --- Machine trap setup ---
+	Csr_MSTATUS = 0x300
+	Csr_MIE     = 0x304
+
 	// --- Machine trap handling ---
 	// Csr_MSCRATCH = 0x340
 	Csr_MEPC   = 0x341
 	Csr_MCAUSE = 0x342
 	Csr_MTVAL  = 0x343
-	// Csr_MIP      = 0x344
+	Csr_MIP    = 0x344
 	// Csr_MTINST   = 0x34A
 	// Csr_MTVAL2   = 0x34B
 
@@ -33,167 +50,121 @@ const (
 	Csr_SATP = 0x180
 )
 
-func (c *Core) csrrw(inst uint32) {
-	if !xZicsrEnable {
-		c.csr[Csr_MTVAL] = inst
-		c.trap(TrapIllegalInstruction)
-		return
-	}
-	rd := (inst >> 7) & 0x1f
-	rs1 := (inst >> 15) & 0x1f
-	csr := (inst >> 20) & 0xfff
+// Kinds of accesses the Zicsr instructions make.
+const (
+	csrWrite = iota // CSRRW, CSRRWI: replace the value
+	csrSet          // CSRRS, CSRRSI: set the bits set in the operand
+	csrClear        // CSRRC, CSRRCI: clear the bits set in the operand
+)
 
-	// Don't need to check rd for 0
-	// We just reset the zero register to 0 in the next instruction anyway
+// csrAccessible returns true if the CSR `csr` exists and may be accessed by
+// a program, and also written if `write` is set.
+func (c *Core) csrAccessible(csr Csr, write bool) bool {
+	if csr>>8&0x3 != 0 { // the lowest privilege level that may access it
+		return false
+	}
+	if write && csr>>10 == 0x3 { // read-only
+		return false
+	}
 
-	// Check permissions
-	if (csr&0xC00 != 0) && (csr&0xC00 != 0xC00) { // verify read and write permissions
-		old := c.csr[csr]
-		c.csr[csr] = c.reg[rs1]
-		c.reg[rd] = old
-	} else {
-		c.trap(TrapIllegalInstruction)
-		return
+	switch csr {
+	case csr_FFLAGS, csr_FRM, csr_FCSR:
+		return c.cfg.F
+	case Csr_CYCLE, Csr_TIME, Csr_INSTRET, Csr_CYCLEH, Csr_TIMEH, Csr_INSTRETH:
+		return c.cfg.Zicntr
 	}
+	return false
 }
 
-func (c *Core) csrrs(inst uint32) {
-	if !xZicsrEnable {
-		c.csr[Csr_MTVAL] = inst
-		c.trap(TrapIllegalInstruction)
-		return
-	}
+// csrAccess makes the access of kind `kind` with the operand `v` to the CSR
+// that `inst` names, and places the old value of the CSR in rd.
+//   As the specification asks, CSRRW does not read the CSR if rd is x0, and
+// CSRRS and CSRRC do not write it if rs1 is x0 or the immediate is 0, which
+// makes them usable on read-only CSRs.
+func (c *Core) csrAccess(inst uint32, kind int, v uint32) {
 	rd := (inst >> 7) & 0x1f
-	rs1 := (inst >> 15) & 0x1f
-	csr := (inst >> 20) & 0xfff
+	src := (inst >> 15) & 0x1f // rs1 or the immediate
+	csr := Csr((inst >> 20) & 0xfff)
 
-	if csr&0xC00 != 0 { // check if user mode register
+	write := kind == csrWrite || src != 0
+	if !c.csrAccessible(csr, write) {
+		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
 	}
 
-	if rs1 != 0 {
-		if csr&0xC00 != 0xC00 { // verify read and write permissions
-			old := c.csr[csr]
-			c.csr[csr] |= c.reg[rs1]
-			c.reg[rd] = old
-		} else {
-			c.trap(TrapIllegalInstruction)
-			return
+	var old uint32
+	if kind != csrWrite || rd != 0 {
+		old = c.GetCSR(csr)
+	}
+	if write {
+		switch kind {
+		case csrSet:
+			v = old | v
+		case csrClear:
+			v = old &^ v
 		}
-	} else { // don't write csr, just read
-		c.reg[rd] = c.csr[csr]
+		c.SetCSR(csr, v)
 	}
+	c.reg[rd] = old
 }
 
-func (c *Core) csrrc(inst uint32) {
-	if !xZicsrEnable {
+func (c *Core) csrrw(inst uint32) {
+	if !c.cfg.Zicsr {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
 	}
-	rd := (inst >> 7) & 0x1f
 	rs1 := (inst >> 15) & 0x1f
-	csr := (inst >> 20) & 0xfff
+	c.csrAccess(inst, csrWrite, c.reg[rs1])
+}
 
-	if csr&0xC00 != 0 { // check if user mode register
+func (c *Core) csrrs(inst uint32) {
+	if !c.cfg.Zicsr {
+		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
 	}
+	rs1 := (inst >> 15) & 0x1f
+	c.csrAccess(inst, csrSet, c.reg[rs1])
+}
 
-	if rs1 != 0 {
-		if csr&0xC00 != 0xC00 { // verify read and write permissions
-			old := c.csr[csr]
-			c.csr[csr] &= (c.reg[rs1] ^ 0xFFFFFFFF) // AND with inverse of bit-pattern to unset select bits
-			c.reg[rd] = old
-		} else {
-			c.trap(TrapIllegalInstruction)
-			return
-		}
-	} else { // don't write csr, just read
-		c.reg[rd] = c.csr[csr]
+func (c *Core) csrrc(inst uint32) {
+	if !c.cfg.Zicsr {
+		c.csr[Csr_MTVAL] = inst
+		c.trap(TrapIllegalInstruction)
+		return
 	}
+	rs1 := (inst >> 15) & 0x1f
+	c.csrAccess(inst, csrClear, c.reg[rs1])
 }
 
 func (c *Core) csrrwi(inst uint32) {
-	if !xZicsrEnable {
+	if !c.cfg.Zicsr {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
 	}
-	rd := (inst >> 7) & 0x1f
 	imm4_0 := (inst >> 15) & 0x1f
-	csr := (inst >> 20) & 0xfff
-
-	// Don't need to check rd for 0
-	// We just reset the zero register to 0 in the next instruction anyway
-
-	// Check permissions
-	if (csr&0xC00 != 0) && (csr&0xC00 != 0xC00) { // verify read and write permissions
-		old := c.csr[csr]
-		c.csr[csr] = imm4_0
-		c.reg[rd] = old
-	} else {
-		// illegal instruction?
-		c.trap(TrapIllegalInstruction)
-		return
-	}
+	c.csrAccess(inst, csrWrite, imm4_0)
 }
 
 func (c *Core) csrrsi(inst uint32) {
-	if !xZicsrEnable {
+	if !c.cfg.Zicsr {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
 	}
-	rd := (inst >> 7) & 0x1f
 	imm4_0 := (inst >> 15) & 0x1f
-	csr := (inst >> 20) & 0xfff
-
-	if csr&0xC00 != 0 { // check if user mode register
-		c.trap(TrapIllegalInstruction)
-		return
-	}
-
-	if imm4_0 != 0 {
-		if csr&0xC00 != 0xC00 { // verify read and write permissions
-			old := c.csr[csr]
-			c.csr[csr] |= imm4_0
-			c.reg[rd] = old
-		} else {
-			c.trap(TrapIllegalInstruction)
-			return
-		}
-	} else { // don't write csr, just read
-		c.reg[rd] = c.csr[csr]
-	}
+	c.csrAccess(inst, csrSet, imm4_0)
 }
 
 func (c *Core) csrrci(inst uint32) {
-	if !xZicsrEnable {
+	if !c.cfg.Zicsr {
 		c.csr[Csr_MTVAL] = inst
 		c.trap(TrapIllegalInstruction)
 		return
 	}
-	rd := (inst >> 7) & 0x1f
 	imm4_0 := (inst >> 15) & 0x1f
-	csr := (inst >> 20) & 0xfff
-
-	if csr&0xC00 != 0 { // check if user mode register
-		c.trap(TrapIllegalInstruction)
-		return
-	}
-
-	if imm4_0 != 0 {
-		if csr&0xC00 != 0xC00 { // verify read and write permissions
-			old := c.csr[csr]
-			c.csr[csr] &= (imm4_0 ^ 0xFFFFFFFF) // AND with inverse of bit-pattern to unset select bits
-			c.reg[rd] = old
-		} else {
-			c.trap(TrapIllegalInstruction)
-			return
-		}
-	} else { // don't write csr, just read
-		c.reg[rd] = c.csr[csr]
-	}
+	c.csrAccess(inst, csrClear, imm4_0)
 }
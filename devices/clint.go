@@ -0,0 +1,238 @@
+// This file contains a core-local interruptor (CLINT) like the one found in
+// many RISC-V systems.
+//   It holds the machine timer `mtime`, which is shared by all harts, and for
+// every hart a compare register `mtimecmp` and a software interrupt register
+// `msip`.
+//   A hart has a timer interrupt pending for as long as `mtime` is at or past
+// its `mtimecmp`, and a software interrupt pending for as long as its `msip`
+// is 1, which is how one hart interrupts another.
+
+package devices
+
+import (
+	"sync"
+	"time"
+)
+
+// CLINTSize is the size of the register range of the CLINT.
+const CLINTSize = 0x10000
+
+// CLINT registers, given as offsets.
+const (
+	CLINT_MSIP     uint32 = 0x0000 // 4 bytes per hart
+	CLINT_MTIMECMP uint32 = 0x4000 // 8 bytes per hart
+	CLINT_MTIME    uint32 = 0xBFF8 // 8 bytes
+)
+
+// clintPollInterval is how often the CLINT looks at the clock to see whether a
+// timer has gone off.
+const clintPollInterval = 100 * time.Microsecond
+
+// CLINT is a core-local interruptor.
+type CLINT struct {
+	mu    sync.Mutex
+	clock Clock
+	delta uint64 // added to the clock, so `mtime` can be written
+
+	msip     []uint32
+	mtimecmp []uint64
+	timer    []Line
+	soft     []Line
+	levels   []bool // levels of the timer lines
+
+	stop chan struct{}  // closed to stop polling the clock
+	done sync.WaitGroup // tracks the polling goroutine
+}
+
+// NewCLINT creates a CLINT whose `mtime` follows `clock`, for as many harts as
+// there are lines in `timer` and `soft`, which are the timer and software
+// interrupt lines of the harts.
+//   Every `mtimecmp` starts out at its largest value, so no timer goes off
+// until it is set.
+func NewCLINT(clock Clock, timer, soft []Line) *CLINT {
+	clint := &CLINT{
+		clock:    clock,
+		msip:     make([]uint32, len(timer)),
+		mtimecmp: make([]uint64, len(timer)),
+		timer:    timer,
+		soft:     soft,
+		levels:   make([]bool, len(timer)),
+	}
+	for i := range clint.mtimecmp {
+		clint.mtimecmp[i] = ^uint64(0)
+	}
+	return clint
+}
+
+// SetClock makes `mtime` follow `clock` from now on, without changing its
+// value.
+func (clint *CLINT) SetClock(clock Clock) {
+	clint.mu.Lock()
+	defer clint.mu.Unlock()
+	mtime := clint.mtime()
+	clint.clock = clock
+	clint.delta = mtime - clock.Now()
+}
+
+// mtime returns the current value of `mtime`.
+//   The caller must hold `clint.mu`.
+func (clint *CLINT) mtime() uint64 {
+	return clint.clock.Now() + clint.delta
+}
+
+// Now returns the current value of `mtime`, so that other devices can keep
+// time with the harts.
+func (clint *CLINT) Now() uint64 {
+	clint.mu.Lock()
+	defer clint.mu.Unlock()
+	return clint.mtime()
+}
+
+// Read reads the register at `offset`.
+//   `msip` can be read with a width of 4, the 64-bit registers with a width
+// of 8 or as two halves with a width of 4.
+func (clint *CLINT) Read(offset, width uint32) (bool, uint64) {
+	clint.mu.Lock()
+	defer clint.mu.Unlock()
+
+	if hart, ok := clint.msipHart(offset, width); ok {
+		return true, uint64(clint.msip[hart])
+	}
+
+	var v uint64
+	var reg uint32
+	if hart, ok := clint.mtimecmpHart(offset, width); ok {
+		v, reg = clint.mtimecmp[hart], CLINT_MTIMECMP+hart*8
+	} else if clint.isMtime(offset, width) {
+		v, reg = clint.mtime(), CLINT_MTIME
+	} else {
+		return false, 0
+	}
+
+	if width == 4 && offset != reg {
+		v >>= 32 // the upper half
+	} else if width == 4 {
+		v &= 0xFFFFFFFF
+	}
+	return true, v
+}
+
+// Write writes the register at `offset`.
+//   The same widths are allowed as for `Read`.
+func (clint *CLINT) Write(offset, width uint32, v uint64) bool {
+	clint.mu.Lock()
+	defer clint.mu.Unlock()
+
+	if hart, ok := clint.msipHart(offset, width); ok {
+		clint.msip[hart] = uint32(v) & 1
+		clint.soft[hart].Set(clint.msip[hart] != 0)
+		return true
+	}
+
+	if hart, ok := clint.mtimecmpHart(offset, width); ok {
+		reg := CLINT_MTIMECMP + hart*8
+		clint.mtimecmp[hart] = mergeHalf(clint.mtimecmp[hart], offset-reg, width, v)
+	} else if clint.isMtime(offset, width) {
+		mtime := mergeHalf(clint.mtime(), offset-CLINT_MTIME, width, v)
+		clint.delta = mtime - clint.clock.Now()
+	} else {
+		return false
+	}
+
+	clint.update()
+	return true
+}
+
+// msipHart returns the hart whose `msip` is at `offset`.
+func (clint *CLINT) msipHart(offset, width uint32) (uint32, bool) {
+	hart := (offset - CLINT_MSIP) / 4
+	ok := offset < CLINT_MTIMECMP && width == 4 && offset%4 == 0 && hart < uint32(len(clint.msip))
+	return hart, ok
+}
+
+// mtimecmpHart returns the hart whose `mtimecmp` is at `offset`.
+func (clint *CLINT) mtimecmpHart(offset, width uint32) (uint32, bool) {
+	if offset < CLINT_MTIMECMP || offset%width != 0 || (width != 4 && width != 8) {
+		return 0, false
+	}
+	hart := (offset - CLINT_MTIMECMP) / 8
+	return hart, hart < uint32(len(clint.mtimecmp))
+}
+
+// isMtime reports whether `offset` is in `mtime`.
+func (clint *CLINT) isMtime(offset, width uint32) bool {
+	return offset >= CLINT_MTIME && offset%width == 0 && (width == 4 || width == 8) && offset+width <= CLINT_MTIME+8
+}
+
+// mergeHalf writes `v` into `old`, either whole or into the half at `at`
+// bytes into it.
+func mergeHalf(old uint64, at, width uint32, v uint64) uint64 {
+	if width == 8 {
+		return v
+	}
+	shift := at * 8
+	return old&^(0xFFFFFFFF<<shift) | (v&0xFFFFFFFF)<<shift
+}
+
+// update sets the timer lines to match `mtime` and the compare registers.
+//   The caller must hold `clint.mu`.
+func (clint *CLINT) update() {
+	mtime := clint.mtime()
+	for hart, cmp := range clint.mtimecmp {
+		level := mtime >= cmp
+		if level != clint.levels[hart] {
+			clint.levels[hart] = level
+			clint.timer[hart].Set(level)
+		}
+	}
+}
+
+// Poll brings the timer lines up to date with the clock, which the goroutine
+// started by `Start` does every `clintPollInterval`.
+//   It is for a machine that runs without that goroutine, so that the lines
+// change at points of its run that don't depend on the host.
+func (clint *CLINT) Poll() {
+	clint.mu.Lock()
+	defer clint.mu.Unlock()
+	clint.update()
+}
+
+// Start starts a goroutine that keeps the timer lines up to date as the clock
+// advances.
+//   Calling it while the CLINT is already running does nothing.
+func (clint *CLINT) Start() {
+	clint.mu.Lock()
+	defer clint.mu.Unlock()
+	if clint.stop != nil {
+		return
+	}
+
+	clint.stop = make(chan struct{})
+	clint.done.Add(1)
+	go func(stop chan struct{}) {
+		defer clint.done.Done()
+		ticker := time.NewTicker(clintPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				clint.Poll()
+			case <-stop:
+				return
+			}
+		}
+	}(clint.stop)
+}
+
+// Stop stops the goroutine started by `Start` and waits for it to finish.
+func (clint *CLINT) Stop() {
+	clint.mu.Lock()
+	stop := clint.stop
+	clint.stop = nil
+	clint.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		clint.done.Wait()
+	}
+}
@@ -0,0 +1,69 @@
+// This file contains the clocks that drive timers such as the CLINT.
+//   A clock either counts cycles, which makes time stand still while the
+// emulator is paused and keeps runs comparable on hosts of different speed,
+// or follows the wall clock of the host, which is what timeouts and anything
+// interactive want.
+
+package devices
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of time for a timer.
+//   `Now` must never decrease.
+type Clock interface {
+	Now() uint64
+}
+
+// CycleCounter is anything that counts the cycles it has executed, such as a
+// `cpu.Core`.
+type CycleCounter interface {
+	Cycles() uint64
+}
+
+// CycleClock is a clock that ticks once per cycle of the fastest of a number
+// of cores.
+type CycleClock struct {
+	counters []CycleCounter
+
+	mu   sync.Mutex
+	last uint64 // keeps `Now` from decreasing
+}
+
+// NewCycleClock creates a clock that follows the cycles of `counters`.
+func NewCycleClock(counters ...CycleCounter) *CycleClock {
+	return &CycleClock{counters: counters}
+}
+
+// Now returns the largest number of cycles executed by any of the cores.
+func (clk *CycleClock) Now() uint64 {
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+	for _, counter := range clk.counters {
+		if cycles := counter.Cycles(); cycles > clk.last {
+			clk.last = cycles
+		}
+	}
+	return clk.last
+}
+
+// WallClock is a clock that follows the time of the host.
+type WallClock struct {
+	start     time.Time
+	frequency uint64
+}
+
+// NewWallClock creates a clock that ticks `frequency` times per second of
+// host time, starting now.
+func NewWallClock(frequency uint64) *WallClock {
+	return &WallClock{start: time.Now(), frequency: frequency}
+}
+
+// Now returns the number of ticks since the clock was created.
+func (clk *WallClock) Now() uint64 {
+	elapsed := uint64(time.Since(clk.start))
+	second := uint64(time.Second)
+	return elapsed/second*clk.frequency + elapsed%second*clk.frequency/second
+}
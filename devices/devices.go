@@ -0,0 +1,21 @@
+// Package devices contains emulated hardware that is mapped into the physical
+// address space of a system through the MMIO bus of the `cpu` package.
+//   Every device implements `cpu.Device`, and is programmed through its
+// registers just like real hardware, so that drivers written against it
+// teach the same things a driver for the real device would.
+
+package devices
+
+// Line is an interrupt line a device uses to ask for attention.
+//   Lines are level-triggered: the device keeps the line raised for as long as
+// the condition that caused it holds.
+//   Devices call `Set` while holding their own lock, so an implementation
+// must not access the device from within `Set`.
+type Line interface {
+	Set(level bool)
+}
+
+// noLine is used by devices that are not connected to an interrupt line.
+type noLine struct{}
+
+func (noLine) Set(level bool) {}
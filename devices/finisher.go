@@ -0,0 +1,63 @@
+// This file contains a test finisher like the SiFive test device, through
+// which a program ends the whole run and reports whether it passed.
+//   Writing FINISHER_PASS to it ends the run successfully, and writing
+// FINISHER_FAIL with an exit code in the upper 16 bits ends it as a failure.
+// Only the first such write counts; any other value is ignored.
+
+package devices
+
+import "sync"
+
+// FinisherSize is the size of the register range of the finisher.
+const FinisherSize = 0x1000
+
+// Values written to the finisher, in the lower 16 bits.
+const (
+	FINISHER_FAIL  uint32 = 0x3333 // failed, with the exit code in the upper 16 bits
+	FINISHER_PASS  uint32 = 0x5555 // passed
+	FINISHER_RESET uint32 = 0x7777 // reset the system, which is not supported and ignored
+)
+
+// Finisher is a device that ends the run.
+type Finisher struct {
+	mu     sync.Mutex
+	done   bool
+	finish func(pass bool, code uint32)
+}
+
+// NewFinisher creates a finisher that calls `finish` when a program asks it to
+// end the run.
+//   `finish` is called from the core that wrote to the finisher, so it must
+// not wait for that core to do anything.
+func NewFinisher(finish func(pass bool, code uint32)) *Finisher {
+	return &Finisher{finish: finish}
+}
+
+// Read always reads 0.
+func (f *Finisher) Read(offset, width uint32) (bool, uint64) {
+	return width == 4 && offset == 0, 0
+}
+
+// Write ends the run if `v` asks for it.
+//   The finisher has a single 4 byte register.
+func (f *Finisher) Write(offset, width uint32, v uint64) bool {
+	if width != 4 || offset != 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return true
+	}
+
+	switch uint32(v) & 0xFFFF {
+	case FINISHER_PASS:
+		f.done = true
+		f.finish(true, 0)
+	case FINISHER_FAIL:
+		f.done = true
+		f.finish(false, uint32(v)>>16)
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+// This file contains a linear framebuffer.
+//   The framebuffer has a page of read-only registers describing it, followed
+// at FB_PIXELS by the pixels, row after row, with FB_STRIDE bytes per row.
+// Its resolution and pixel format are chosen by the host when it is created.
+//   There is no display; the host takes snapshots of the pixels and writes
+// them out as PPM or PNG images, so programs that draw can be checked without
+// anybody looking at a screen.
+
+package devices
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Framebuffer registers, given as offsets.
+//   All registers are 4 bytes and read-only.
+const (
+	FB_WIDTH  uint32 = 0x00 // pixels per row
+	FB_HEIGHT uint32 = 0x04 // rows
+	FB_FORMAT uint32 = 0x08 // PixelFormat of the pixels
+	FB_STRIDE uint32 = 0x0C // bytes per row
+
+	FB_PIXELS uint32 = 0x1000 // start of the pixels
+)
+
+// MaxFramebufferSide is the largest width or height of a framebuffer.
+const MaxFramebufferSide = 4096
+
+// PixelFormat is how the color of a pixel is stored.
+//   Pixels of more than one byte are little-endian.
+type PixelFormat uint32
+
+const (
+	FormatXRGB8888 PixelFormat = 0 // 4 bytes, 0x00RRGGBB
+	FormatRGB565   PixelFormat = 1 // 2 bytes, 5 bits red, 6 green, 5 blue
+	FormatGray8    PixelFormat = 2 // 1 byte of brightness
+)
+
+var formatNames = map[PixelFormat]string{
+	FormatXRGB8888: "xrgb8888",
+	FormatRGB565:   "rgb565",
+	FormatGray8:    "gray8",
+}
+
+// ErrBadFramebuffer is returned when a framebuffer is created with a
+// resolution or pixel format it can't have.
+var ErrBadFramebuffer = errors.New("bad framebuffer resolution or pixel format")
+
+// ParsePixelFormat returns the pixel format called `name`, as returned by
+// `PixelFormat.String`.
+func ParsePixelFormat(name string) (PixelFormat, error) {
+	for f, n := range formatNames {
+		if n == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown pixel format %q", name)
+}
+
+func (f PixelFormat) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("format %d", uint32(f))
+}
+
+// BytesPerPixel returns the size of a pixel, or 0 for unknown formats.
+func (f PixelFormat) BytesPerPixel() uint32 {
+	switch f {
+	case FormatXRGB8888:
+		return 4
+	case FormatRGB565:
+		return 2
+	case FormatGray8:
+		return 1
+	}
+	return 0
+}
+
+// Framebuffer is a linear framebuffer.
+type Framebuffer struct {
+	mu     sync.Mutex
+	width  uint32
+	height uint32
+	format PixelFormat
+	stride uint32
+	pixels []uint8
+}
+
+// NewFramebuffer creates a black framebuffer of `width` by `height` pixels
+// in the pixel format `format`.
+func NewFramebuffer(width, height int, format PixelFormat) (*Framebuffer, error) {
+	bpp := format.BytesPerPixel()
+	if width <= 0 || height <= 0 || width > MaxFramebufferSide || height > MaxFramebufferSide || bpp == 0 {
+		return nil, ErrBadFramebuffer
+	}
+
+	stride := uint32(width) * bpp
+	return &Framebuffer{
+		width:  uint32(width),
+		height: uint32(height),
+		format: format,
+		stride: stride,
+		pixels: make([]uint8, stride*uint32(height)),
+	}, nil
+}
+
+// Size returns the size of the range the framebuffer has to be mapped at,
+// which is a whole number of pages.
+func (fb *Framebuffer) Size() uint32 {
+	return (FB_PIXELS + uint32(len(fb.pixels)) + 0xFFF) &^ 0xFFF
+}
+
+// Read reads a register or pixels.
+func (fb *Framebuffer) Read(offset, width uint32) (bool, uint64) {
+	if offset < FB_PIXELS {
+		if width != 4 {
+			return false, 0
+		}
+		switch offset {
+		case FB_WIDTH:
+			return true, uint64(fb.width)
+		case FB_HEIGHT:
+			return true, uint64(fb.height)
+		case FB_FORMAT:
+			return true, uint64(fb.format)
+		case FB_STRIDE:
+			return true, uint64(fb.stride)
+		}
+		return true, 0
+	}
+
+	at := uint64(offset - FB_PIXELS)
+	if at+uint64(width) > uint64(len(fb.pixels)) {
+		return true, 0 // the rest of the last page
+	}
+
+	var bytes [8]uint8
+	fb.mu.Lock()
+	copy(bytes[:width], fb.pixels[at:])
+	fb.mu.Unlock()
+	return true, binary.LittleEndian.Uint64(bytes[:])
+}
+
+// Write writes pixels; writes to the registers and past the pixels are
+// ignored.
+func (fb *Framebuffer) Write(offset, width uint32, v uint64) bool {
+	if offset < FB_PIXELS {
+		return width == 4
+	}
+
+	at := uint64(offset - FB_PIXELS)
+	if at+uint64(width) > uint64(len(fb.pixels)) {
+		return true
+	}
+
+	var bytes [8]uint8
+	binary.LittleEndian.PutUint64(bytes[:], v)
+	fb.mu.Lock()
+	copy(fb.pixels[at:], bytes[:width])
+	fb.mu.Unlock()
+	return true
+}
+
+// Image returns a copy of what the framebuffer shows.
+func (fb *Framebuffer) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, int(fb.width), int(fb.height)))
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for y := uint32(0); y < fb.height; y++ {
+		row := fb.pixels[y*fb.stride:]
+		for x := uint32(0); x < fb.width; x++ {
+			img.SetRGBA(int(x), int(y), fb.pixel(row, x))
+		}
+	}
+	return img
+}
+
+// pixel returns the color of pixel `x` of `row`.
+//   The caller must hold `fb.mu`.
+func (fb *Framebuffer) pixel(row []uint8, x uint32) color.RGBA {
+	switch fb.format {
+	case FormatRGB565:
+		p := binary.LittleEndian.Uint16(row[x*2:])
+		r, g, b := uint8(p>>11), uint8(p>>5&0x3F), uint8(p&0x1F)
+		return color.RGBA{R: r<<3 | r>>2, G: g<<2 | g>>4, B: b<<3 | b>>2, A: 0xFF}
+	case FormatGray8:
+		return color.RGBA{R: row[x], G: row[x], B: row[x], A: 0xFF}
+	}
+	p := binary.LittleEndian.Uint32(row[x*4:])
+	return color.RGBA{R: uint8(p >> 16), G: uint8(p >> 8), B: uint8(p), A: 0xFF}
+}
+
+// WritePPM writes a snapshot of the framebuffer to `w` as a binary PPM image.
+func (fb *Framebuffer) WritePPM(w io.Writer) error {
+	img := fb.Image()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P6\n%d %d\n255\n", fb.width, fb.height)
+	for i := 0; i < len(img.Pix); i += 4 {
+		bw.Write(img.Pix[i : i+3])
+	}
+	return bw.Flush()
+}
+
+// WritePNG writes a snapshot of the framebuffer to `w` as a PNG image.
+func (fb *Framebuffer) WritePNG(w io.Writer) error {
+	return png.Encode(w, fb.Image())
+}
+
+// Snapshot writes a snapshot of the framebuffer to the file at `path`, as a
+// PNG image if the name ends in ".png" and as a PPM image otherwise.
+//   The image is written next to `path` first and then renamed, so whoever
+// reads the file never sees half an image.
+func (fb *Framebuffer) Snapshot(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	tmp.Chmod(0644) // CreateTemp makes it private
+	if strings.EqualFold(filepath.Ext(path), ".png") {
+		err = fb.WritePNG(tmp)
+	} else {
+		err = fb.WritePPM(tmp)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,373 @@
+// This file contains an input device that queues key presses and releases.
+//   Events come either from the host, as bytes read from a terminal, or from
+// a script of events that are each due at a given time of a clock, which
+// makes interactive programs repeatable: with a clock that counts cycles, a
+// program sees the same events at the same points of its run every time.
+//   The device interrupts while an event is waiting, and a driver takes the
+// events out one at a time through INPUT_EVENT.
+//   Once its sources have nothing more to give and the queue is empty, the
+// device says so with INPUT_STATUS_END, and interrupts if INPUT_IE_END is set,
+// so that a driver can report the end of the input.
+
+package devices
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// InputSize is the size of the register range of the input device.
+const InputSize = 0x1000
+
+// Input device registers, given as offsets.
+//   All registers are 4 bytes.
+const (
+	INPUT_STATUS uint32 = 0x00 // read-only
+	INPUT_EVENT  uint32 = 0x04 // reading takes the oldest event out of the queue
+	INPUT_IE     uint32 = 0x08 // interrupt enable
+	INPUT_DROPS  uint32 = 0x0C // events dropped because the queue was full, read-only
+)
+
+// Bits in INPUT_STATUS.
+const (
+	INPUT_STATUS_READY uint32 = 0x1 // an event is waiting
+	INPUT_STATUS_END   uint32 = 0x2 // no event is waiting and none will come
+)
+
+// Bits in INPUT_IE.
+const (
+	INPUT_IE_READY uint32 = 0x1 // interrupt while an event is waiting
+	INPUT_IE_END   uint32 = 0x2 // interrupt once the input has ended
+)
+
+// Bits of an event read from INPUT_EVENT.
+const (
+	INPUT_EVENT_CODE  uint32 = 0x0000FFFF // key code
+	INPUT_EVENT_PRESS uint32 = 0x00010000 // the key was pressed, not released
+	INPUT_EVENT_VALID uint32 = 0x80000000 // this is an event, the queue was not empty
+)
+
+// Key codes.
+//   Keys that produce a character have the code of that character in ASCII.
+const (
+	KEY_BACKSPACE uint16 = 0x08
+	KEY_TAB       uint16 = 0x09
+	KEY_ENTER     uint16 = 0x0A
+	KEY_ESCAPE    uint16 = 0x1B
+	KEY_SPACE     uint16 = 0x20
+	KEY_DELETE    uint16 = 0x7F
+	KEY_UP        uint16 = 0x100
+	KEY_DOWN      uint16 = 0x101
+	KEY_LEFT      uint16 = 0x102
+	KEY_RIGHT     uint16 = 0x103
+)
+
+// inputQueueSize is the number of events the device holds.
+const inputQueueSize = 64
+
+// inputPollInterval is how often the device looks at the clock to see whether
+// a scripted event is due.
+const inputPollInterval = 100 * time.Microsecond
+
+// InputEvent is a key being pressed or released.
+type InputEvent struct {
+	Time  uint64 // when a scripted event is due, on the clock of the script
+	Code  uint16 // key code
+	Press bool   // pressed, or released
+}
+
+// Input is an input device.
+type Input struct {
+	mu    sync.Mutex
+	irq   Line
+	level bool // level of `irq`
+
+	queue []uint32 // events as read from INPUT_EVENT
+	ie    uint32
+	drops uint32
+
+	clock   Clock
+	script  []InputEvent // scripted events that are not due yet, in order
+	feeds   []*inputFeed // readers given to `Feed`
+	feeding bool         // goroutines read the feeds, see `Start`
+	sources int          // sources that may still give events
+
+	stop chan struct{}  // closed to stop playing the script
+	done sync.WaitGroup // tracks the goroutine playing the script
+}
+
+// inputFeed is a reader given to `Feed`.
+type inputFeed struct {
+	r     io.Reader
+	ended bool // `r` has nothing more to give
+}
+
+// NewInput creates an input device without a source, which interrupts
+// through `irq`.
+//   `irq` may be nil if the device is not connected to an interrupt line.
+func NewInput(irq Line) *Input {
+	if irq == nil {
+		irq = noLine{}
+	}
+	return &Input{irq: irq}
+}
+
+// Read reads the register at `offset`.
+func (in *Input) Read(offset, width uint32) (bool, uint64) {
+	if width != 4 {
+		return false, 0
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	switch offset {
+	case INPUT_STATUS:
+		return true, uint64(in.status())
+	case INPUT_EVENT:
+		if len(in.queue) == 0 {
+			return true, 0
+		}
+		ev := in.queue[0]
+		in.queue = in.queue[1:]
+		in.update()
+		return true, uint64(ev)
+	case INPUT_IE:
+		return true, uint64(in.ie)
+	case INPUT_DROPS:
+		return true, uint64(in.drops)
+	}
+	return false, 0
+}
+
+// Write writes the register at `offset`; only INPUT_IE can be written.
+func (in *Input) Write(offset, width uint32, v uint64) bool {
+	if width != 4 {
+		return false
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	switch offset {
+	case INPUT_IE:
+		in.ie = uint32(v) & (INPUT_IE_READY | INPUT_IE_END)
+		in.update()
+		return true
+	case INPUT_STATUS, INPUT_EVENT, INPUT_DROPS:
+		return true
+	}
+	return false
+}
+
+// status returns the value of INPUT_STATUS.
+//   The caller must hold `in.mu`.
+func (in *Input) status() uint32 {
+	if len(in.queue) != 0 {
+		return INPUT_STATUS_READY
+	} else if in.sources == 0 {
+		return INPUT_STATUS_END
+	}
+	return 0
+}
+
+// update sets the interrupt line to match the status.
+//   The caller must hold `in.mu`.
+func (in *Input) update() {
+	level := in.ie&in.status() != 0
+	if level != in.level {
+		in.level = level
+		in.irq.Set(level)
+	}
+}
+
+// push adds `ev` to the queue, or drops it if the queue is full.
+//   The caller must hold `in.mu`.
+func (in *Input) push(ev InputEvent) {
+	if len(in.queue) >= inputQueueSize {
+		in.drops++
+		return
+	}
+
+	word := INPUT_EVENT_VALID | uint32(ev.Code)
+	if ev.Press {
+		word |= INPUT_EVENT_PRESS
+	}
+	in.queue = append(in.queue, word)
+	in.update()
+}
+
+// Push queues `ev` right away, ignoring its time.
+func (in *Input) Push(ev InputEvent) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.push(ev)
+}
+
+// Feed makes every byte read from `r`, such as a terminal, a press and a
+// release of the key with that code.
+//   Bytes are read by a goroutine that `Start` starts, or one at a time by
+// `Receive`.
+//   It must be called before the device is started.
+func (in *Input) Feed(r io.Reader) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.feeds = append(in.feeds, &inputFeed{r: r})
+	in.sources++
+}
+
+// key queues a press and a release of the key for the byte `b`.
+//   A carriage return counts as the enter key.
+//   The caller must hold `in.mu`.
+func (in *Input) key(b uint8) {
+	code := uint16(b)
+	if b == '\r' {
+		code = KEY_ENTER
+	}
+	in.push(InputEvent{Code: code, Press: true})
+	in.push(InputEvent{Code: code})
+}
+
+// feed reads from `f` until it ends, and queues a key for every byte.
+func (in *Input) feed(f *inputFeed) {
+	var buf [64]uint8
+	for {
+		n, err := f.r.Read(buf[:])
+		in.mu.Lock()
+		for _, b := range buf[:n] {
+			in.key(b)
+		}
+		if err != nil {
+			f.ended = true
+			in.sources--
+			in.update()
+		}
+		in.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Receive reads a single byte from every reader given to `Feed` and queues
+// its key, which the goroutines started by `Start` do as soon as the readers
+// have bytes.
+//   It is for a machine that runs without those goroutines, so that keys
+// arrive at points of its run that don't depend on the host. It waits until
+// the readers have a byte, and skips a reader that has no more, or all of
+// them if the queue has no room for a key.
+func (in *Input) Receive() {
+	in.mu.Lock()
+	feeds := in.feeds
+	skip := in.feeding || len(in.queue)+2 > inputQueueSize
+	in.mu.Unlock()
+	if skip {
+		return
+	}
+
+	for _, f := range feeds {
+		if f.ended {
+			continue
+		}
+
+		var b [1]uint8
+		n, err := f.r.Read(b[:])
+
+		in.mu.Lock()
+		if n == 1 {
+			in.key(b[0])
+		}
+		if err != nil {
+			f.ended = true
+			in.sources--
+			in.update()
+		}
+		in.mu.Unlock()
+	}
+}
+
+// Play makes the device queue the events of `script` once `clock` reaches
+// their times, while the device is running.
+//   The events must be in order of time, like `ParseInputScript` returns
+// them.
+//   It must be called before the device is started, and only once.
+func (in *Input) Play(clock Clock, script []InputEvent) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.clock = clock
+	in.script = script
+	if len(script) != 0 {
+		in.sources++
+	}
+}
+
+// Poll queues the scripted events that are due, which the goroutine started
+// by `Start` does every `inputPollInterval`.
+//   It is for a machine that runs without that goroutine, so that events are
+// queued at points of its run that don't depend on the host.
+func (in *Input) Poll() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.script) == 0 {
+		return
+	}
+
+	now := in.clock.Now()
+	for len(in.script) != 0 && in.script[0].Time <= now {
+		in.push(in.script[0])
+		in.script = in.script[1:]
+	}
+	if len(in.script) == 0 {
+		in.sources--
+		in.update()
+	}
+}
+
+// Start starts a goroutine that plays the script as the clock advances, and,
+// the first time, goroutines that read the readers given to `Feed` until they
+// end.
+//   Calling it while the device is already running does nothing.
+func (in *Input) Start() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !in.feeding {
+		in.feeding = true
+		for _, f := range in.feeds {
+			go in.feed(f)
+		}
+	}
+	if in.stop != nil {
+		return
+	}
+
+	in.stop = make(chan struct{})
+	in.done.Add(1)
+	go func(stop chan struct{}) {
+		defer in.done.Done()
+		ticker := time.NewTicker(inputPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				in.Poll()
+			case <-stop:
+				return
+			}
+		}
+	}(in.stop)
+}
+
+// Stop stops playing the script and waits for that to finish.
+func (in *Input) Stop() {
+	in.mu.Lock()
+	stop := in.stop
+	in.stop = nil
+	in.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		in.done.Wait()
+	}
+}
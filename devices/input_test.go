@@ -0,0 +1,35 @@
+package devices
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestInputReceive checks that without `Start`, keys are only read from a
+// feed by `Receive`, one at a time, and that the input ends with the feed.
+func TestInputReceive(t *testing.T) {
+	r := strings.NewReader("a\r")
+	in := NewInput(nil)
+	in.Feed(r)
+
+	for _, code := range []uint16{'a', KEY_ENTER} {
+		in.Receive()
+		for _, press := range []bool{true, false} {
+			want := INPUT_EVENT_VALID | uint32(code)
+			if press {
+				want |= INPUT_EVENT_PRESS
+			}
+			if _, ev := in.Read(INPUT_EVENT, 4); uint32(ev) != want {
+				t.Errorf("read event %#x, want %#x", ev, want)
+			}
+		}
+	}
+	if _, status := in.Read(INPUT_STATUS, 4); status != 0 {
+		t.Errorf("status %#x before the feed ended", status)
+	}
+
+	in.Receive()
+	if _, status := in.Read(INPUT_STATUS, 4); uint32(status) != INPUT_STATUS_END {
+		t.Errorf("status %#x after the feed ended, want %#x", status, INPUT_STATUS_END)
+	}
+}
@@ -0,0 +1,125 @@
+// This file contains the parser of the scripts an input device plays.
+//   A script has one event per line, made of the time it is due, an action,
+// and what the action applies to:
+//
+//   # comments and empty lines are ignored
+//   100000   press   a
+//   150000   release a
+//   200000   key     enter
+//   300000   type    ls -l
+//
+//   `press` and `release` press or release a single key, `key` does both, and
+// `type` does both for every character of the rest of the line, one after
+// the other.
+//   A key is a single character, a name such as `enter`, `space` or `up`, or
+// a key code like `0x41`.
+//   Times are ticks of the clock the script is played against, and may be
+// given in any base `strconv.ParseUint` understands.
+
+package devices
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keyNames gives the codes of keys that are known by name in scripts.
+var keyNames = map[string]uint16{
+	"backspace": KEY_BACKSPACE,
+	"tab":       KEY_TAB,
+	"enter":     KEY_ENTER,
+	"escape":    KEY_ESCAPE,
+	"space":     KEY_SPACE,
+	"delete":    KEY_DELETE,
+	"up":        KEY_UP,
+	"down":      KEY_DOWN,
+	"left":      KEY_LEFT,
+	"right":     KEY_RIGHT,
+}
+
+// ParseInputScript reads a script of input events from `r` and returns its
+// events in order of time.
+//   Events due at the same time keep the order of the script.
+func ParseInputScript(r io.Reader) ([]InputEvent, error) {
+	var events []InputEvent
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: want a time, an action and a key", line)
+		}
+		time, err := strconv.ParseUint(fields[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad time %q", line, fields[0])
+		}
+
+		if fields[1] == "type" {
+			// the text starts after the action, and may contain spaces
+			rest := strings.TrimSpace(text[len(fields[0]):])
+			rest = strings.TrimSpace(rest[len("type"):])
+			for _, c := range rest {
+				if c > 0x7F {
+					return nil, fmt.Errorf("line %d: can't type %q", line, c)
+				}
+				events = append(events,
+					InputEvent{Time: time, Code: uint16(c), Press: true},
+					InputEvent{Time: time, Code: uint16(c)})
+			}
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want a single key", line)
+		}
+		code, err := parseKey(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		switch fields[1] {
+		case "press":
+			events = append(events, InputEvent{Time: time, Code: code, Press: true})
+		case "release":
+			events = append(events, InputEvent{Time: time, Code: code})
+		case "key":
+			events = append(events,
+				InputEvent{Time: time, Code: code, Press: true},
+				InputEvent{Time: time, Code: code})
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", line, fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time < events[j].Time
+	})
+	return events, nil
+}
+
+// parseKey returns the code of the key `key` names in a script.
+func parseKey(key string) (uint16, error) {
+	if code, ok := keyNames[strings.ToLower(key)]; ok {
+		return code, nil
+	}
+	if len(key) == 1 {
+		return uint16(key[0]), nil
+	}
+	if strings.HasPrefix(key, "0x") {
+		if code, err := strconv.ParseUint(key, 0, 16); err == nil {
+			return uint16(code), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key %q", key)
+}
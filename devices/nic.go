@@ -0,0 +1,294 @@
+// This file contains a network interface card (NIC) that sends and receives
+// Ethernet frames through a `Switch`.
+//   Frames are exchanged through two rings of descriptors in RAM, one for
+// transmitting and one for receiving, which the NIC reads and writes on its
+// own, like a real NIC does with DMA.
+//   A ring is `size` descriptors long and has a head, owned by the NIC, and a
+// tail, owned by the driver. The NIC uses the descriptors from the head up to,
+// but not including, the tail, and moves the head past each one it is done
+// with; the driver hands it more by moving the tail. The ring is empty when
+// head and tail are equal, so at most `size - 1` descriptors are handed over.
+//   For transmitting, the driver fills in a descriptor and moves the tail,
+// and the NIC sends the frame right away. For receiving, the driver hands
+// over descriptors with empty buffers, and the NIC fills them as frames come
+// in, dropping frames when it has none.
+//   Since the NIC accesses RAM directly, the driver must make sure the caches
+// of the cores hold nothing it expects the NIC to see, or anything the NIC
+// wrote.
+//   The addresses of rings and buffers are 32 bits, so they must lie in RAM
+// below 4 GiB.
+
+package devices
+
+import (
+	"encoding/binary"
+	"gotos/cpu"
+	"sync"
+)
+
+// NICSize is the size of the register range of the NIC.
+const NICSize = 0x1000
+
+// NIC registers, given as offsets. All registers are 4 bytes wide.
+const (
+	NIC_CTRL    uint32 = 0x00 // control bits
+	NIC_STATUS  uint32 = 0x04 // status bits
+	NIC_MAC_LO  uint32 = 0x08 // first 4 bytes of the MAC address
+	NIC_MAC_HI  uint32 = 0x0C // last 2 bytes of the MAC address
+	NIC_IE      uint32 = 0x10 // interrupt enable bits
+	NIC_IS      uint32 = 0x14 // interrupt status bits, write 1 to clear
+	NIC_DROPS   uint32 = 0x18 // received frames dropped for lack of descriptors
+	NIC_TX_BASE uint32 = 0x20 // physical address of the transmit ring
+	NIC_TX_SIZE uint32 = 0x24 // descriptors in the transmit ring
+	NIC_TX_HEAD uint32 = 0x28 // transmit head, read-only
+	NIC_TX_TAIL uint32 = 0x2C // transmit tail
+	NIC_RX_BASE uint32 = 0x30 // physical address of the receive ring
+	NIC_RX_SIZE uint32 = 0x34 // descriptors in the receive ring
+	NIC_RX_HEAD uint32 = 0x38 // receive head, read-only
+	NIC_RX_TAIL uint32 = 0x3C // receive tail
+)
+
+// Bits in NIC_CTRL.
+const (
+	NIC_CTRL_ENABLE uint32 = 0x1 // the NIC sends and receives; clearing it resets the rings
+)
+
+// Bits in NIC_STATUS.
+const (
+	NIC_STATUS_LINK uint32 = 0x1 // connected to a switch
+)
+
+// Bits in NIC_IE and NIC_IS.
+const (
+	NIC_INT_RX uint32 = 0x1 // a frame was received
+	NIC_INT_TX uint32 = 0x2 // a frame was sent
+)
+
+// Layout of a descriptor.
+//   `len` is the length of the buffer when the driver hands the descriptor
+// to the NIC for receiving, and the length of the frame otherwise.
+const (
+	NICDescSize   = 8 // bytes per descriptor
+	NICDescAddr   = 0 // 4 bytes, physical address of the buffer
+	NICDescLen    = 4 // 2 bytes, length
+	NICDescStatus = 6 // 2 bytes, status bits
+)
+
+// Bits in the status of a descriptor.
+const (
+	NIC_DESC_DONE uint16 = 0x1 // the NIC is done with the descriptor
+)
+
+// MaxFrameSize is the size of the largest Ethernet frame a NIC sends, without
+// the checksum.
+const MaxFrameSize = 1514
+
+// nicRing is the state of a descriptor ring.
+type nicRing struct {
+	base, size, head, tail uint32
+}
+
+// NIC is a network interface card.
+type NIC struct {
+	mu     sync.Mutex
+	mem    *cpu.Memory
+	mac    [6]uint8
+	irq    Line
+	port   *Port // nil until connected to a switch
+	level  bool  // level of the interrupt line
+	ctrl   uint32
+	ie, is uint32
+	drops  uint32
+	tx, rx nicRing
+}
+
+// NewNIC creates a NIC with the MAC address `mac` that reads and writes its
+// rings in `mem`, and raises `irq` for interrupts.
+//   `irq` may be nil if the NIC is not connected to an interrupt controller.
+func NewNIC(mem *cpu.Memory, mac [6]uint8, irq Line) *NIC {
+	if irq == nil {
+		irq = noLine{}
+	}
+	return &NIC{mem: mem, mac: mac, irq: irq}
+}
+
+// MAC returns the MAC address of the NIC.
+func (nic *NIC) MAC() [6]uint8 {
+	return nic.mac
+}
+
+// Read reads the register at `offset`.
+func (nic *NIC) Read(offset, width uint32) (bool, uint64) {
+	if width != 4 || offset%4 != 0 {
+		return false, 0
+	}
+
+	nic.mu.Lock()
+	defer nic.mu.Unlock()
+
+	var v uint32
+	switch offset {
+	case NIC_CTRL:
+		v = nic.ctrl
+	case NIC_STATUS:
+		if nic.port != nil {
+			v = NIC_STATUS_LINK
+		}
+	case NIC_MAC_LO:
+		v = binary.LittleEndian.Uint32(nic.mac[0:4])
+	case NIC_MAC_HI:
+		v = uint32(binary.LittleEndian.Uint16(nic.mac[4:6]))
+	case NIC_IE:
+		v = nic.ie
+	case NIC_IS:
+		v = nic.is
+	case NIC_DROPS:
+		v = nic.drops
+	case NIC_TX_BASE:
+		v = nic.tx.base
+	case NIC_TX_SIZE:
+		v = nic.tx.size
+	case NIC_TX_HEAD:
+		v = nic.tx.head
+	case NIC_TX_TAIL:
+		v = nic.tx.tail
+	case NIC_RX_BASE:
+		v = nic.rx.base
+	case NIC_RX_SIZE:
+		v = nic.rx.size
+	case NIC_RX_HEAD:
+		v = nic.rx.head
+	case NIC_RX_TAIL:
+		v = nic.rx.tail
+	default:
+		return false, 0
+	}
+	return true, uint64(v)
+}
+
+// Write writes the register at `offset`.
+//   Writing the transmit tail sends the frames handed over right away.
+func (nic *NIC) Write(offset, width uint32, v uint64) bool {
+	if width != 4 || offset%4 != 0 {
+		return false
+	}
+
+	nic.mu.Lock()
+	defer nic.mu.Unlock()
+
+	w := uint32(v)
+	switch offset {
+	case NIC_CTRL:
+		nic.ctrl = w & NIC_CTRL_ENABLE
+		if nic.ctrl == 0 {
+			nic.tx.head, nic.tx.tail = 0, 0
+			nic.rx.head, nic.rx.tail = 0, 0
+		}
+	case NIC_IE:
+		nic.ie = w & (NIC_INT_RX | NIC_INT_TX)
+	case NIC_IS:
+		nic.is &^= w
+	case NIC_TX_BASE:
+		nic.tx.base = w
+	case NIC_TX_SIZE:
+		nic.tx.size = w
+	case NIC_TX_TAIL:
+		if w >= nic.tx.size {
+			return false
+		}
+		nic.tx.tail = w
+		nic.transmit()
+	case NIC_RX_BASE:
+		nic.rx.base = w
+	case NIC_RX_SIZE:
+		nic.rx.size = w
+	case NIC_RX_TAIL:
+		if w >= nic.rx.size {
+			return false
+		}
+		nic.rx.tail = w
+	case NIC_STATUS, NIC_MAC_LO, NIC_MAC_HI, NIC_DROPS, NIC_TX_HEAD, NIC_RX_HEAD:
+		// read-only
+	default:
+		return false
+	}
+
+	nic.update()
+	return true
+}
+
+// descriptor reads descriptor `i` of `ring`.
+func (nic *NIC) descriptor(ring *nicRing, i uint32) (addr uint32, length uint16, ok bool) {
+	err, desc := nic.mem.ReadRaw(uint64(ring.base+i*NICDescSize), NICDescSize)
+	if err != nil {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(desc[NICDescAddr:]), binary.LittleEndian.Uint16(desc[NICDescLen:]), true
+}
+
+// finish writes the length `length` into descriptor `i` of `ring`, marks it
+// done, and moves the head past it.
+func (nic *NIC) finish(ring *nicRing, i uint32, length uint16) {
+	var tail [NICDescSize - NICDescLen]uint8
+	binary.LittleEndian.PutUint16(tail[0:], length)
+	binary.LittleEndian.PutUint16(tail[2:], NIC_DESC_DONE)
+	nic.mem.WriteRaw(uint64(ring.base+i*NICDescSize+NICDescLen), tail[:])
+	ring.head = (ring.head + 1) % ring.size
+}
+
+// transmit sends the frames of all descriptors the driver handed over.
+//   The caller must hold `nic.mu`.
+func (nic *NIC) transmit() {
+	if nic.ctrl&NIC_CTRL_ENABLE == 0 {
+		return
+	}
+
+	for nic.tx.head != nic.tx.tail {
+		addr, length, ok := nic.descriptor(&nic.tx, nic.tx.head)
+		if ok && length <= MaxFrameSize {
+			if err, frame := nic.mem.ReadRaw(uint64(addr), uint32(length)); err == nil && nic.port != nil {
+				nic.port.send(frame)
+			}
+		}
+		nic.finish(&nic.tx, nic.tx.head, length)
+		nic.is |= NIC_INT_TX
+	}
+}
+
+// deliver places a frame that arrived from the switch into the next receive
+// descriptor, or drops it if there is none.
+func (nic *NIC) deliver(frame []uint8) {
+	nic.mu.Lock()
+	defer nic.mu.Unlock()
+
+	if nic.ctrl&NIC_CTRL_ENABLE == 0 || nic.rx.size == 0 || nic.rx.head == nic.rx.tail {
+		nic.drops++
+		return
+	}
+
+	addr, length, ok := nic.descriptor(&nic.rx, nic.rx.head)
+	if !ok || int(length) < len(frame) {
+		nic.drops++
+		length = 0
+	} else if err, _ := nic.mem.WriteRaw(uint64(addr), frame); err != nil {
+		nic.drops++
+		length = 0
+	} else {
+		length = uint16(len(frame))
+	}
+
+	// a frame that does not fit still uses up the descriptor, with length 0
+	nic.finish(&nic.rx, nic.rx.head, length)
+	nic.is |= NIC_INT_RX
+	nic.update()
+}
+
+// update sets the interrupt line to match the pending interrupts.
+//   The caller must hold `nic.mu`.
+func (nic *NIC) update() {
+	level := nic.is&nic.ie != 0
+	if level != nic.level {
+		nic.level = level
+		nic.irq.Set(level)
+	}
+}
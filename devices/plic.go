@@ -0,0 +1,248 @@
+// This file contains a platform-level interrupt controller (PLIC) like the
+// one described in the RISC-V PLIC specification.
+//   Devices raise interrupt sources, numbered from 1, and every source has a
+// priority. The PLIC has a context for every hart, with its own set of enabled
+// sources and a threshold; a context interrupts its hart when an enabled
+// source with a priority above the threshold is pending.
+//   The hart then claims the interrupt, which returns the highest priority
+// source and stops it from being pending, handles it, and completes it, after
+// which the source can become pending again.
+//   Sources are level-triggered: a source whose line is still raised when it
+// is completed becomes pending right away.
+
+package devices
+
+import "sync"
+
+// PLICSize is the size of the register range of the PLIC.
+const PLICSize = 0x4000000
+
+// PLICSources is the number of interrupt sources, including source 0, which
+// does not exist and is what a claim returns when nothing is pending.
+const PLICSources = 32
+
+// PLICMaxPriority is the highest priority a source can have.
+const PLICMaxPriority = 7
+
+// PLIC registers, given as offsets.
+const (
+	PLIC_PRIORITY  uint32 = 0x000000 // 4 bytes per source
+	PLIC_PENDING   uint32 = 0x001000 // 1 bit per source
+	PLIC_ENABLE    uint32 = 0x002000 // 1 bit per source, `PLIC_ENABLE_STRIDE` bytes per context
+	PLIC_THRESHOLD uint32 = 0x200000 // `PLIC_CONTEXT_STRIDE` bytes per context
+	PLIC_CLAIM     uint32 = 0x200004 // `PLIC_CONTEXT_STRIDE` bytes per context, also used to complete
+
+	PLIC_ENABLE_STRIDE  uint32 = 0x80
+	PLIC_CONTEXT_STRIDE uint32 = 0x1000
+)
+
+// PLIC is a platform-level interrupt controller.
+type PLIC struct {
+	mu       sync.Mutex
+	priority [PLICSources]uint32
+	levels   uint32 // levels of the source lines, 1 bit per source
+	pending  uint32 // 1 bit per source
+	claimed  uint32 // sources that have been claimed but not completed
+
+	enable    []uint32 // per context
+	threshold []uint32 // per context
+	outputs   []Line   // per context
+	outLevels []bool   // per context
+}
+
+// NewPLIC creates a PLIC with a context for every line in `outputs`, which are
+// the external interrupt lines of the harts.
+//   All sources start out with priority 0, which means they never interrupt.
+func NewPLIC(outputs []Line) *PLIC {
+	return &PLIC{
+		enable:    make([]uint32, len(outputs)),
+		threshold: make([]uint32, len(outputs)),
+		outputs:   outputs,
+		outLevels: make([]bool, len(outputs)),
+	}
+}
+
+// plicSource is the line a device raises to interrupt through the PLIC.
+type plicSource struct {
+	plic *PLIC
+	bit  uint32
+}
+
+// Source returns the line of source `id` to connect a device to.
+//   `id` must be between 1 and `PLICSources - 1`.
+func (plic *PLIC) Source(id uint32) Line {
+	if id == 0 || id >= PLICSources {
+		panic("invalid PLIC source")
+	}
+	return plicSource{plic: plic, bit: 1 << id}
+}
+
+func (src plicSource) Set(level bool) {
+	plic := src.plic
+	plic.mu.Lock()
+	defer plic.mu.Unlock()
+
+	if level {
+		plic.levels |= src.bit
+		if plic.claimed&src.bit == 0 {
+			plic.pending |= src.bit
+		}
+	} else {
+		plic.levels &^= src.bit
+		plic.pending &^= src.bit
+	}
+	plic.update()
+}
+
+// Read reads the register at `offset`.
+//   All registers are 4 bytes wide.
+func (plic *PLIC) Read(offset, width uint32) (bool, uint64) {
+	if width != 4 || offset%4 != 0 {
+		return false, 0
+	}
+
+	plic.mu.Lock()
+	defer plic.mu.Unlock()
+
+	switch {
+	case offset < PLIC_PENDING:
+		if id := offset / 4; id < PLICSources {
+			return true, uint64(plic.priority[id])
+		}
+	case offset < PLIC_ENABLE:
+		if offset != PLIC_PENDING {
+			return true, 0 // there are no sources past the first word
+		}
+		return true, uint64(plic.pending)
+	case offset >= PLIC_ENABLE && offset < PLIC_THRESHOLD:
+		if ctx, word, ok := plic.enableWord(offset); ok {
+			if word != 0 {
+				return true, 0 // there are no sources past the first word
+			}
+			return true, uint64(plic.enable[ctx])
+		}
+	case offset >= PLIC_THRESHOLD:
+		ctx, reg, ok := plic.contextRegister(offset)
+		if !ok {
+			break
+		}
+		if reg == PLIC_THRESHOLD {
+			return true, uint64(plic.threshold[ctx])
+		}
+		return true, uint64(plic.claim(ctx))
+	}
+
+	return false, 0
+}
+
+// Write writes the register at `offset`.
+//   All registers are 4 bytes wide. Writes to the pending bits are ignored.
+func (plic *PLIC) Write(offset, width uint32, v uint64) bool {
+	if width != 4 || offset%4 != 0 {
+		return false
+	}
+
+	plic.mu.Lock()
+	defer plic.mu.Unlock()
+
+	switch {
+	case offset < PLIC_PENDING:
+		if id := offset / 4; id < PLICSources {
+			if id != 0 {
+				plic.priority[id] = uint32(v) & PLICMaxPriority
+			}
+			plic.update()
+			return true
+		}
+	case offset < PLIC_ENABLE:
+		return true
+	case offset >= PLIC_ENABLE && offset < PLIC_THRESHOLD:
+		if ctx, word, ok := plic.enableWord(offset); ok {
+			if word == 0 {
+				plic.enable[ctx] = uint32(v) &^ 1 // source 0 does not exist
+			}
+			plic.update()
+			return true
+		}
+	case offset >= PLIC_THRESHOLD:
+		ctx, reg, ok := plic.contextRegister(offset)
+		if !ok {
+			break
+		}
+		if reg == PLIC_THRESHOLD {
+			plic.threshold[ctx] = uint32(v) & PLICMaxPriority
+		} else {
+			plic.complete(ctx, uint32(v))
+		}
+		plic.update()
+		return true
+	}
+
+	return false
+}
+
+// enableWord returns the context and the index of the word of enable bits at
+// `offset`.
+func (plic *PLIC) enableWord(offset uint32) (uint32, uint32, bool) {
+	ctx := (offset - PLIC_ENABLE) / PLIC_ENABLE_STRIDE
+	word := (offset - PLIC_ENABLE) % PLIC_ENABLE_STRIDE / 4
+	return ctx, word, ctx < uint32(len(plic.enable))
+}
+
+// contextRegister returns the context of the threshold or claim register at
+// `offset`, and which of the two it is.
+func (plic *PLIC) contextRegister(offset uint32) (uint32, uint32, bool) {
+	ctx := (offset - PLIC_THRESHOLD) / PLIC_CONTEXT_STRIDE
+	reg := PLIC_THRESHOLD + (offset-PLIC_THRESHOLD)%PLIC_CONTEXT_STRIDE
+	ok := ctx < uint32(len(plic.enable)) && (reg == PLIC_THRESHOLD || reg == PLIC_CLAIM)
+	return ctx, reg, ok
+}
+
+// best returns the pending source `ctx` should be interrupted for, or 0.
+//   Of the sources with the highest priority, the lowest id wins.
+func (plic *PLIC) best(ctx uint32) uint32 {
+	candidates := plic.pending & plic.enable[ctx]
+	best, bestPriority := uint32(0), plic.threshold[ctx]
+	for id := uint32(1); id < PLICSources; id++ {
+		if candidates&(1<<id) != 0 && plic.priority[id] > bestPriority {
+			best, bestPriority = id, plic.priority[id]
+		}
+	}
+	return best
+}
+
+// claim hands the best pending source of `ctx` to its hart, or 0 if there is
+// none.
+func (plic *PLIC) claim(ctx uint32) uint32 {
+	id := plic.best(ctx)
+	if id != 0 {
+		plic.pending &^= 1 << id
+		plic.claimed |= 1 << id
+	}
+	plic.update()
+	return id
+}
+
+// complete ends the handling of source `id` by `ctx`.
+//   Sources that are not enabled for `ctx`, or were not claimed, are ignored.
+func (plic *PLIC) complete(ctx, id uint32) {
+	if id == 0 || id >= PLICSources || plic.enable[ctx]&(1<<id) == 0 || plic.claimed&(1<<id) == 0 {
+		return
+	}
+	plic.claimed &^= 1 << id
+	if plic.levels&(1<<id) != 0 {
+		plic.pending |= 1 << id
+	}
+}
+
+// update sets the output lines to match the pending sources.
+//   The caller must hold `plic.mu`.
+func (plic *PLIC) update() {
+	for ctx := range plic.outputs {
+		level := plic.best(uint32(ctx)) != 0
+		if level != plic.outLevels[ctx] {
+			plic.outLevels[ctx] = level
+			plic.outputs[ctx].Set(level)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// This file contains a virtual Ethernet switch that connects the NICs of any
+// number of systems running in the same host process.
+//   The switch learns which MAC address is behind which port from the frames
+// it forwards, sends frames for known addresses only to their port, and
+// floods everything else, including broadcasts, to all other ports.
+//   Every port behaves like a link with the latency, loss, and bandwidth in
+// the `LinkConfig` of the switch: frames queue up behind each other according
+// to the bandwidth, arrive after the latency, and are lost at random. A port
+// whose queue is full drops frames, like a real switch does when it runs out
+// of buffers.
+//   The links follow the clock of the host, and every port delivers its
+// frames from a goroutine of its own, since the systems on a switch don't
+// share a clock that could be followed instead. The seed makes the losses
+// repeatable, but when frames arrive depends on the host.
+
+package devices
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// portQueueSize is how many frames can be on their way to a port.
+const portQueueSize = 256
+
+// broadcastMAC is the destination address of frames for every NIC.
+var broadcastMAC = [6]uint8{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// LinkConfig describes the links between the switch and the NICs.
+type LinkConfig struct {
+	Latency   time.Duration // time for a frame to reach the NIC once sent
+	Loss      float64       // probability of a frame being lost, from 0 to 1
+	Bandwidth uint64        // bytes per second, or 0 for no limit
+	Seed      int64         // seed for the random losses, so runs can be repeated
+}
+
+// Switch is a virtual Ethernet switch.
+type Switch struct {
+	mu     sync.Mutex
+	config LinkConfig
+	rng    *rand.Rand
+	ports  []*Port
+	macs   map[[6]uint8]*Port // where each known MAC address was last seen
+	closed bool
+
+	done sync.WaitGroup // tracks the goroutines of the ports
+}
+
+// Port is the port of a switch a NIC is connected to.
+type Port struct {
+	sw        *Switch
+	nic       *NIC
+	queue     chan queuedFrame
+	busyUntil time.Time // when the link is done with the frames queued so far
+}
+
+// queuedFrame is a frame on its way to a NIC.
+type queuedFrame struct {
+	frame  []uint8
+	arrive time.Time
+}
+
+// NewSwitch creates a switch whose links behave as described by `config`.
+func NewSwitch(config LinkConfig) *Switch {
+	return &Switch{
+		config: config,
+		rng:    rand.New(rand.NewSource(config.Seed)),
+		macs:   map[[6]uint8]*Port{},
+	}
+}
+
+// Connect connects `nic` to a new port of the switch.
+func (sw *Switch) Connect(nic *NIC) {
+	p := &Port{sw: sw, nic: nic, queue: make(chan queuedFrame, portQueueSize)}
+
+	sw.mu.Lock()
+	sw.ports = append(sw.ports, p)
+	sw.done.Add(1)
+	sw.mu.Unlock()
+	go p.run()
+
+	nic.mu.Lock()
+	nic.port = p
+	nic.mu.Unlock()
+}
+
+// Close disconnects all ports and waits until no more frames are delivered.
+func (sw *Switch) Close() {
+	sw.mu.Lock()
+	if !sw.closed {
+		sw.closed = true
+		for _, p := range sw.ports {
+			close(p.queue)
+		}
+	}
+	sw.mu.Unlock()
+	sw.done.Wait()
+}
+
+// send forwards a frame sent by the NIC on `p`.
+//   It never waits, so NICs can call it while locked.
+func (p *Port) send(frame []uint8) {
+	if len(frame) < 14 {
+		return // not even an Ethernet header
+	}
+	var dst, src [6]uint8
+	copy(dst[:], frame[0:6])
+	copy(src[:], frame[6:12])
+
+	sw := p.sw
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.closed {
+		return
+	}
+
+	sw.macs[src] = p
+	if out, ok := sw.macs[dst]; ok && dst != broadcastMAC {
+		if out != p {
+			sw.enqueue(out, frame)
+		}
+		return
+	}
+	for _, out := range sw.ports {
+		if out != p {
+			sw.enqueue(out, frame)
+		}
+	}
+}
+
+// enqueue puts a copy of `frame` on the link to `out`.
+//   The caller must hold `sw.mu`.
+func (sw *Switch) enqueue(out *Port, frame []uint8) {
+	if sw.config.Loss > 0 && sw.rng.Float64() < sw.config.Loss {
+		return
+	}
+
+	now := time.Now()
+	start := out.busyUntil
+	if start.Before(now) {
+		start = now
+	}
+	done := start
+	if sw.config.Bandwidth != 0 {
+		done = start.Add(time.Duration(uint64(len(frame)) * uint64(time.Second) / sw.config.Bandwidth))
+	}
+
+	select {
+	case out.queue <- queuedFrame{frame: append([]uint8(nil), frame...), arrive: done.Add(sw.config.Latency)}:
+		out.busyUntil = done
+	default:
+		// the queue is full, so the frame is dropped
+	}
+}
+
+// run delivers the frames on the link to the NIC of `p` as they arrive.
+func (p *Port) run() {
+	defer p.sw.done.Done()
+	for qf := range p.queue {
+		if wait := time.Until(qf.arrive); wait > 0 {
+			time.Sleep(wait)
+		}
+		p.nic.deliver(qf.frame)
+	}
+}
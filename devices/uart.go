@@ -0,0 +1,443 @@
+// This file contains a UART modelled after the 16550.
+//   The registers, their bits, and the receive and transmit FIFOs behave like
+// those of the 16550, as far as they make sense for a serial port that is
+// connected to the host instead of a wire: there is no baud rate, parity, or
+// modem, but the registers that control them can still be written and read
+// back.
+//   Bytes written to the transmit FIFO are sent to the host by a goroutine
+// started with `Start`, or whenever `Poll` is called. Bytes from the host are
+// received by another goroutine `Start` starts, or one at a time by `Receive`,
+// and wait in the receive FIFO until they are read; when the receive FIFO is
+// full, the host has to wait.
+
+package devices
+
+import (
+	"io"
+	"sync"
+)
+
+// UARTSize is the size of the register range of the UART.
+const UARTSize = 8
+
+// uartFIFOSize is the size of the receive and transmit FIFOs.
+const uartFIFOSize = 16
+
+// UART registers, given as offsets.
+//   Some offsets hold different registers depending on whether they are read
+// or written, and on the DLAB bit in LCR.
+const (
+	UART_RBR uint32 = 0 // receiver buffer, read
+	UART_THR uint32 = 0 // transmitter holding, write
+	UART_DLL uint32 = 0 // divisor latch low, with DLAB set
+	UART_IER uint32 = 1 // interrupt enable
+	UART_DLM uint32 = 1 // divisor latch high, with DLAB set
+	UART_IIR uint32 = 2 // interrupt identification, read
+	UART_FCR uint32 = 2 // FIFO control, write
+	UART_LCR uint32 = 3 // line control
+	UART_MCR uint32 = 4 // modem control
+	UART_LSR uint32 = 5 // line status
+	UART_MSR uint32 = 6 // modem status
+	UART_SCR uint32 = 7 // scratch
+)
+
+// Bits in IER.
+const (
+	UART_IER_RDI  uint8 = 0x01 // interrupt when received data is available
+	UART_IER_THRI uint8 = 0x02 // interrupt when the transmitter is empty
+)
+
+// Values of IIR.
+const (
+	UART_IIR_NO_INT uint8 = 0x01 // no interrupt pending
+	UART_IIR_THRI   uint8 = 0x02 // transmitter empty
+	UART_IIR_RDI    uint8 = 0x04 // received data available
+	UART_IIR_FIFO   uint8 = 0xC0 // FIFOs enabled
+)
+
+// Bits in FCR.
+const (
+	UART_FCR_ENABLE     uint8 = 0x01 // enable the FIFOs
+	UART_FCR_CLEAR_RCVR uint8 = 0x02 // empty the receive FIFO
+	UART_FCR_CLEAR_XMIT uint8 = 0x04 // empty the transmit FIFO
+)
+
+// Bits in LCR.
+const (
+	UART_LCR_WLEN8 uint8 = 0x03 // 8 bit words
+	UART_LCR_DLAB  uint8 = 0x80 // divisor latch access
+)
+
+// Bits in LSR.
+const (
+	UART_LSR_DR   uint8 = 0x01 // data ready
+	UART_LSR_OE   uint8 = 0x02 // overrun error
+	UART_LSR_THRE uint8 = 0x20 // transmit holding register empty
+	UART_LSR_TEMT uint8 = 0x40 // transmitter empty
+)
+
+// UART is a 16550-style serial port connected to the host.
+type UART struct {
+	mu   sync.Mutex
+	cond *sync.Cond // signalled whenever a FIFO changes
+	irq  Line
+	in   io.Reader
+	out  io.Writer
+
+	sending   sync.Mutex     // held while bytes are sent, so they stay in order
+	running   bool           // the goroutine started by `Start` is sending
+	stopping  bool           // that goroutine should stop once `tx` is empty
+	receiving bool           // the goroutine started by `Start` is receiving
+	ended     bool           // `in` has nothing more to receive
+	closed    bool           // the UART no longer receives
+	done      sync.WaitGroup // tracks the goroutine started by `Start`
+
+	rx           []uint8 // receive FIFO
+	tx           []uint8 // transmit FIFO
+	transmitting bool    // bytes taken from `tx` are being sent to the host
+	overrun      bool    // a byte was lost since LSR was last read
+	threPending  bool    // the transmitter empty interrupt is pending
+	level        bool    // level of the interrupt line
+
+	ier, lcr, mcr, scr, dll, dlm uint8
+	fifo                         bool // FIFOs enabled
+}
+
+// NewUART creates a UART that receives what is read from `in`, sends what is
+// transmitted to `out`, and raises `irq` for interrupts.
+//   `irq` may be nil if the UART is not connected to an interrupt controller.
+//   Nothing is received until `Start` or `Receive` is called, and nothing is
+// sent until `Start` or `Poll` is called.
+func NewUART(in io.Reader, out io.Writer, irq Line) *UART {
+	if irq == nil {
+		irq = noLine{}
+	}
+
+	u := &UART{irq: irq, in: in, out: out, lcr: UART_LCR_WLEN8}
+	u.cond = sync.NewCond(&u.mu)
+	return u
+}
+
+// Start starts a goroutine that sends the bytes written to the transmit FIFO
+// to the host as soon as they are written, and, the first time, one that
+// receives from the host until `Close`.
+//   Calling it while the goroutines are already running does nothing.
+func (u *UART) Start() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.receiving && !u.closed {
+		u.receiving = true
+		go u.receive()
+	}
+	if u.running {
+		return
+	}
+
+	u.running = true
+	u.stopping = false
+	u.done.Add(1)
+	go u.transmit()
+}
+
+// Stop stops the goroutine started by `Start` once it has sent what is in the
+// transmit FIFO, and waits for it to finish.
+func (u *UART) Stop() {
+	u.mu.Lock()
+	u.stopping = true
+	u.cond.Broadcast()
+	u.mu.Unlock()
+
+	u.done.Wait()
+}
+
+// Poll sends what is in the transmit FIFO to the host, which the goroutine
+// started by `Start` does as soon as it is written.
+//   It is for a machine that runs without that goroutine, so that the
+// transmitter empties at points of its run that don't depend on the host.
+func (u *UART) Poll() {
+	u.send()
+}
+
+// Receive reads a single byte from the host and puts it in the receive FIFO,
+// which the goroutine started by `Start` does as soon as the host has one.
+//   It is for a machine that runs without that goroutine, so that bytes arrive
+// at points of its run that don't depend on the host. It waits until the host
+// has a byte, and does nothing if the receive FIFO is full, or once the host
+// has no more bytes.
+func (u *UART) Receive() {
+	u.mu.Lock()
+	skip := u.receiving || u.ended || u.closed || len(u.rx) >= u.fifoSize()
+	u.mu.Unlock()
+	if skip {
+		return
+	}
+
+	var b [1]uint8
+	n, err := u.in.Read(b[:])
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if n == 1 && !u.closed {
+		u.rx = append(u.rx, b[0])
+		u.update()
+	}
+	if err != nil {
+		u.ended = true
+	}
+}
+
+// Close stops the UART: what is in the transmit FIFO is sent, and it no longer
+// sends or receives.
+//   If `in` is an `io.Closer`, it is closed so that a read waiting on it
+// returns; otherwise that read goes on waiting, and what it returns is
+// dropped.
+func (u *UART) Close() {
+	u.Stop()
+	u.send()
+
+	u.mu.Lock()
+	closed := u.closed
+	u.closed = true
+	u.cond.Broadcast()
+	u.mu.Unlock()
+
+	if c, ok := u.in.(io.Closer); ok && !closed {
+		c.Close()
+	}
+}
+
+// Read reads the register at `offset`.
+//   Registers are 1 byte wide, any other width causes an access fault.
+func (u *UART) Read(offset, width uint32) (bool, uint64) {
+	if width != 1 || offset >= UARTSize {
+		return false, 0
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	dlab := u.lcr&UART_LCR_DLAB != 0
+
+	var v uint8
+	switch offset {
+	case UART_RBR:
+		if dlab {
+			v = u.dll
+		} else if len(u.rx) > 0 {
+			v = u.rx[0]
+			u.rx = u.rx[1:]
+			u.cond.Broadcast()
+		}
+	case UART_IER:
+		if dlab {
+			v = u.dlm
+		} else {
+			v = u.ier
+		}
+	case UART_IIR:
+		v = u.iir()
+		if v&^UART_IIR_FIFO == UART_IIR_THRI {
+			u.threPending = false // reading IIR acknowledges it
+		}
+	case UART_LCR:
+		v = u.lcr
+	case UART_MCR:
+		v = u.mcr
+	case UART_LSR:
+		v = u.lsr()
+		u.overrun = false
+	case UART_MSR:
+		v = 0xB0 // clear to send, data set ready, carrier detect
+	case UART_SCR:
+		v = u.scr
+	}
+
+	u.update()
+	return true, uint64(v)
+}
+
+// Write writes the register at `offset`.
+//   Registers are 1 byte wide, any other width causes an access fault.
+func (u *UART) Write(offset, width uint32, v uint64) bool {
+	if width != 1 || offset >= UARTSize {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	dlab := u.lcr&UART_LCR_DLAB != 0
+	b := uint8(v)
+
+	switch offset {
+	case UART_THR:
+		if dlab {
+			u.dll = b
+		} else if len(u.tx) < u.fifoSize() {
+			u.tx = append(u.tx, b)
+			u.threPending = false
+			u.cond.Broadcast()
+		} else {
+			u.overrun = true // the byte is lost
+		}
+	case UART_IER:
+		if dlab {
+			u.dlm = b
+		} else {
+			// enabling the interrupt while the transmitter is empty raises it
+			if b&UART_IER_THRI != 0 && u.ier&UART_IER_THRI == 0 && u.empty() {
+				u.threPending = true
+			}
+			u.ier = b & 0x0F
+		}
+	case UART_FCR:
+		u.fifo = b&UART_FCR_ENABLE != 0
+		if b&UART_FCR_CLEAR_RCVR != 0 {
+			u.rx = nil
+		}
+		if b&UART_FCR_CLEAR_XMIT != 0 {
+			u.tx = nil
+		}
+		u.cond.Broadcast()
+	case UART_LCR:
+		u.lcr = b
+	case UART_MCR:
+		u.mcr = b & 0x1F
+	case UART_SCR:
+		u.scr = b
+	}
+
+	u.update()
+	return true
+}
+
+// fifoSize returns how many bytes the FIFOs hold; without FIFOs, a single
+// holding register is all there is.
+func (u *UART) fifoSize() int {
+	if u.fifo {
+		return uartFIFOSize
+	}
+	return 1
+}
+
+// empty reports whether the transmitter has nothing left to send.
+func (u *UART) empty() bool {
+	return len(u.tx) == 0 && !u.transmitting
+}
+
+// lsr computes the line status register.
+func (u *UART) lsr() uint8 {
+	var v uint8
+	if len(u.rx) > 0 {
+		v |= UART_LSR_DR
+	}
+	if u.overrun {
+		v |= UART_LSR_OE
+	}
+	if len(u.tx) == 0 {
+		v |= UART_LSR_THRE
+	}
+	if u.empty() {
+		v |= UART_LSR_TEMT
+	}
+	return v
+}
+
+// iir computes the interrupt identification register; received data takes
+// priority over the transmitter.
+func (u *UART) iir() uint8 {
+	var v uint8
+	if u.fifo {
+		v = UART_IIR_FIFO
+	}
+
+	switch {
+	case u.ier&UART_IER_RDI != 0 && len(u.rx) > 0:
+		return v | UART_IIR_RDI
+	case u.ier&UART_IER_THRI != 0 && u.threPending:
+		return v | UART_IIR_THRI
+	}
+	return v | UART_IIR_NO_INT
+}
+
+// update sets the interrupt line to match the pending interrupts.
+//   The caller must hold `u.mu`.
+func (u *UART) update() {
+	level := u.iir()&UART_IIR_NO_INT == 0
+	if level != u.level {
+		u.level = level
+		u.irq.Set(level)
+	}
+}
+
+// receive moves bytes from the host into the receive FIFO, waiting for room
+// when it is full, until the UART is closed.
+func (u *UART) receive() {
+	var buf [uartFIFOSize]uint8
+	for {
+		n, err := u.in.Read(buf[:])
+
+		u.mu.Lock()
+		for _, b := range buf[:n] {
+			for len(u.rx) >= u.fifoSize() && !u.closed {
+				u.cond.Wait()
+			}
+			if u.closed {
+				break
+			}
+			u.rx = append(u.rx, b)
+			u.update()
+		}
+		closed := u.closed
+		u.mu.Unlock()
+
+		if err != nil || closed {
+			return
+		}
+	}
+}
+
+// transmit sends the contents of the transmit FIFO to the host whenever there
+// are any, until `Stop` is called and the FIFO is empty.
+func (u *UART) transmit() {
+	defer u.done.Done()
+	for {
+		u.mu.Lock()
+		for len(u.tx) == 0 && !u.stopping {
+			u.cond.Wait()
+		}
+		if len(u.tx) == 0 {
+			u.running = false
+			u.mu.Unlock()
+			return
+		}
+		u.mu.Unlock()
+
+		u.send()
+	}
+}
+
+// send sends the contents of the transmit FIFO to the host.
+func (u *UART) send() {
+	u.sending.Lock()
+	defer u.sending.Unlock()
+
+	u.mu.Lock()
+	data := u.tx
+	if len(data) == 0 {
+		u.mu.Unlock()
+		return
+	}
+	u.tx = nil
+	u.transmitting = true
+	u.cond.Broadcast()
+	u.mu.Unlock()
+
+	u.out.Write(data)
+
+	u.mu.Lock()
+	u.transmitting = false
+	if u.empty() {
+		u.threPending = true
+	}
+	u.update()
+	u.mu.Unlock()
+}
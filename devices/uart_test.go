@@ -0,0 +1,123 @@
+package devices
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a `bytes.Buffer` that the goroutines of a UART can write to
+// while a test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []uint8) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// uartWrite writes `s` to the transmit FIFO of `u`.
+func uartWrite(t *testing.T, u *UART, s string) {
+	for _, b := range []uint8(s) {
+		if !u.Write(UART_THR, 1, uint64(b)) {
+			t.Fatal("writing THR failed")
+		}
+	}
+}
+
+// TestUARTPoll checks that without `Start`, the transmit FIFO is only sent
+// by `Poll`.
+func TestUARTPoll(t *testing.T) {
+	in, _ := io.Pipe()
+	out := &lockedBuffer{}
+	u := NewUART(in, out, nil)
+	defer u.Close()
+	u.Write(UART_FCR, 1, uint64(UART_FCR_ENABLE))
+
+	uartWrite(t, u, "hello")
+	if _, lsr := u.Read(UART_LSR, 1); uint8(lsr)&UART_LSR_THRE != 0 {
+		t.Error("THRE is set with bytes in the transmit FIFO")
+	}
+	if out.String() != "" {
+		t.Errorf("sent %q before Poll", out.String())
+	}
+
+	u.Poll()
+	if out.String() != "hello" {
+		t.Errorf("sent %q, want %q", out.String(), "hello")
+	}
+	if _, lsr := u.Read(UART_LSR, 1); uint8(lsr)&(UART_LSR_THRE|UART_LSR_TEMT) != UART_LSR_THRE|UART_LSR_TEMT {
+		t.Errorf("LSR is %#x after Poll", lsr)
+	}
+}
+
+// TestUARTReceive checks that without `Start`, bytes are only received by
+// `Receive`, one at a time, and not while the receive FIFO is full.
+func TestUARTReceive(t *testing.T) {
+	in := strings.NewReader("ab")
+	u := NewUART(in, io.Discard, nil)
+	defer u.Close()
+
+	for i, want := range []uint8{'a', 'b'} {
+		u.Receive()
+		u.Receive() // the holding register is full
+		if in.Len() != 1-i {
+			t.Fatalf("%d bytes left on the host after receiving %q", in.Len(), want)
+		}
+		if _, lsr := u.Read(UART_LSR, 1); uint8(lsr)&UART_LSR_DR == 0 {
+			t.Fatalf("no data ready after receiving %q", want)
+		}
+		if _, b := u.Read(UART_RBR, 1); uint8(b) != want {
+			t.Errorf("received %q, want %q", b, want)
+		}
+	}
+
+	u.Receive()
+	if _, lsr := u.Read(UART_LSR, 1); uint8(lsr)&UART_LSR_DR != 0 {
+		t.Error("data ready after the input ended")
+	}
+}
+
+// TestUARTClose checks that `Close` sends what is left in the transmit FIFO
+// and ends the goroutines of the UART.
+func TestUARTClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	in, host := io.Pipe()
+	out := &lockedBuffer{}
+	u := NewUART(in, out, nil)
+	u.Write(UART_FCR, 1, uint64(UART_FCR_ENABLE))
+	u.Start()
+
+	go host.Write([]uint8("typed"))
+	uartWrite(t, u, "bye")
+	u.Close()
+
+	if out.String() != "bye" {
+		t.Errorf("sent %q, want %q", out.String(), "bye")
+	}
+	if _, err := host.Write([]uint8("x")); err != io.ErrClosedPipe {
+		t.Errorf("writing to the closed input: %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines are left, %d before", n, before)
+	}
+}
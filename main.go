@@ -2,7 +2,12 @@ package main
 
 import (
 	"encoding/binary"
+	"flag"
+	"fmt"
+	"gotos/cpu"
+	"gotos/devices"
 	"gotos/system"
+	"os"
 )
 
 const (
@@ -16,14 +21,100 @@ const (
 	pageFlagDirty           = 0x80 // whether this page has been written to since the dirty bit was last cleared
 )
 
+var (
+	shell = flag.Bool("shell", false, "run the shell from c-programs/sh instead of the fib processes")
+	root  = flag.String("root", ".", "host directory the shell sees as /")
+	clock = flag.String("clock", "cycles", "what the timer follows: \"cycles\" of the cores or \"wall\" clock time of the host")
+
+	uartIn  = flag.String("uart-in", "", "file or pty the UART of the shell receives from, instead of stdin")
+	uartOut = flag.String("uart-out", "", "file or pty the UART of the shell transmits to, instead of stdout")
+
+	fb       = flag.String("fb", "", "attach a framebuffer with this resolution, like 640x480")
+	fbFormat = flag.String("fb-format", "xrgb8888", "pixel format of the framebuffer: xrgb8888, rgb565 or gray8")
+	fbOut    = flag.String("fb-out", "", "write the framebuffer to this .png or .ppm file when the run ends")
+	fbEvery  = flag.Duration("fb-every", 0, "also write the framebuffer to -fb-out this often while running")
+
+	input = flag.String("input", "", "attach an input device fed from this script of key events, or from the terminal with \"-\"; the shell reads its events on file descriptor 3")
+
+	fd        = flag.Bool("fd", false, "implement the F and D extensions")
+	fastFloat = flag.Bool("fast-float", false, "do the arithmetic of F and D with the floats of the host, which is faster but not IEEE 754 compliant")
+	cache     = flag.Bool("cache", true, "give the cores instruction and data caches")
+	blocks    = flag.Bool("block-cache", false, "decode basic blocks of instructions once and keep them, which is faster, but blocks bypass the instruction cache")
+	memory    = flag.Uint("memory", 4, "MiB of memory; what doesn't fit below the devices at 32 MiB goes above 4 GiB")
+	cores     = flag.Int("cores", 4, "number of cores")
+
+	deterministic = flag.Bool("deterministic", false, "run the cores in turns in a single goroutine, with the timers and devices following the cycles, so that a run can be repeated exactly")
+	quantum       = flag.Int("quantum", 1000, "instructions a core executes per turn with -deterministic")
+	seed          = flag.Int64("seed", 0, "with -deterministic, make every turn last a random number of instructions up to -quantum, drawn with this seed; 0 for turns of exactly -quantum")
+)
+
 func main() {
-	// create a system with 1 core
-	sys := system.NewSystem(4)
+	flag.Parse()
+
+	cfg := cpu.DefaultConfig()
+	cfg.F, cfg.D = *fd, *fd
+	cfg.SoftFloat = !*fastFloat
+	cfg.Cache = *cache
+	cfg.BlockCache = *blocks
+	cfg.MemorySize = uint64(*memory) * 1024 * 1024
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "bad configuration:", err)
+		os.Exit(2)
+	}
+	if *cores < 1 {
+		fmt.Fprintln(os.Stderr, "bad number of cores:", *cores)
+		os.Exit(2)
+	}
+
+	// create a system with 4 cores, unless asked for another number
+	sys := system.NewSystem(*cores, cfg)
 
 	// create a simple batch scheduler queue (FIFO)
 	fifo := &system.FIFO{}
 	sys.Scheduler = fifo
 
+	switch *clock {
+	case "cycles":
+	case "wall":
+		sys.UseWallClock()
+	default:
+		fmt.Fprintln(os.Stderr, "unknown clock:", *clock)
+		os.Exit(2)
+	}
+
+	if *deterministic {
+		if *clock != "cycles" {
+			fmt.Fprintln(os.Stderr, "-deterministic needs the clock to follow the cycles")
+			os.Exit(2)
+		}
+		if *quantum < 1 {
+			fmt.Fprintln(os.Stderr, "bad quantum:", *quantum)
+			os.Exit(2)
+		}
+		sys.UseDeterministicMode(*quantum, *seed)
+	}
+
+	if *fb != "" {
+		if err := attachFramebuffer(sys); err != nil {
+			fmt.Fprintln(os.Stderr, "could not attach the framebuffer:", err)
+			os.Exit(2)
+		}
+	}
+
+	var events system.File
+	if *input != "" {
+		var err error
+		if events, err = attachInput(sys); err != nil {
+			fmt.Fprintln(os.Stderr, "could not attach the input device:", err)
+			os.Exit(2)
+		}
+	}
+
+	if *shell {
+		runShell(sys, events)
+		return
+	}
+
 	scratchTable := [1024]uint32{}
 	page := tableToPage(scratchTable[:])
 
@@ -99,7 +190,133 @@ func main() {
 	sys.Load("c-programs/fib/main.text", 0x00004000, 0x00006000, 3, 0x00004000, 0x0000C000)
 
 	// run the system
-	sys.Run()
+	exit(sys.Run())
+}
+
+// runShell runs the shell on a UART connected to the console of the host, or
+// to what `-uart-in` and `-uart-out` name.
+//   The programs in c-programs are available in /bin, so `fib` runs
+// c-programs/fib/main.text.
+//   If `events` is not nil, the shell and the programs it runs read input
+// events from file descriptor 3.
+func runShell(sys *system.System, events system.File) {
+	rootFS, err := system.NewHostFS(*root, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binFS, err := system.NewHostFS("c-programs", false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sys.Mount("/", rootFS)
+	sys.Mount("/bin", binFS)
+
+	sh, err := sys.Spawn("/bin/sh/main.text", []string{"sh"}, []string{"PATH=/bin", "HOME=/"})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not start the shell:", err)
+		os.Exit(1)
+	}
+
+	in, out, err := uartFiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	console, err := sys.AttachUART(in, out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not attach the UART:", err)
+		os.Exit(1)
+	}
+	for fd := uint32(0); fd < 3; fd++ {
+		sh.SetFile(fd, console)
+	}
+	if events != nil {
+		sh.SetFile(3, events)
+	}
+
+	exit(sys.Run())
+}
+
+// exit ends the emulator with the result of a run, so that a program that
+// reports failure through the finisher fails the emulator as well.
+func exit(status system.ExitStatus) {
+	if status.Reason != system.ExitHalted {
+		fmt.Fprintln(os.Stderr, "finisher:", status)
+	}
+	os.Exit(status.ExitCode())
+}
+
+// attachFramebuffer attaches the framebuffer asked for with `-fb` and
+// `-fb-format`, and arranges for the snapshots asked for with `-fb-out` and
+// `-fb-every`.
+func attachFramebuffer(sys *system.System) error {
+	var width, height int
+	if _, err := fmt.Sscanf(*fb, "%dx%d", &width, &height); err != nil {
+		return fmt.Errorf("bad resolution %q", *fb)
+	}
+	format, err := devices.ParsePixelFormat(*fbFormat)
+	if err != nil {
+		return err
+	}
+	if _, err := sys.AttachFramebuffer(width, height, format); err != nil {
+		return err
+	}
+
+	if *fbOut != "" {
+		sys.SetFramebufferSnapshots(*fbOut, *fbEvery)
+	}
+	return nil
+}
+
+// attachInput attaches the input device asked for with `-input`, either to
+// the terminal or to a script.
+func attachInput(sys *system.System) (system.File, error) {
+	if *input == "-" {
+		if *shell && *uartIn == "" {
+			return nil, fmt.Errorf("the terminal already feeds the UART")
+		}
+		return sys.AttachInput(os.Stdin, nil)
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	script, err := devices.ParseInputScript(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", *input, err)
+	}
+	return sys.AttachInput(nil, script)
+}
+
+// uartFiles opens what the UART is connected to on the host.
+//   The same path may be given for both directions, as for a pty.
+func uartFiles() (*os.File, *os.File, error) {
+	in, out := os.Stdin, os.Stdout
+	var err error
+
+	if *uartIn != "" {
+		mode := os.O_RDONLY
+		if *uartIn == *uartOut {
+			mode = os.O_RDWR
+		}
+		if in, err = os.OpenFile(*uartIn, mode, 0); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if *uartOut != "" {
+		if *uartOut == *uartIn {
+			out = in
+		} else if out, err = os.Create(*uartOut); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return in, out, nil
 }
 
 func tableToPage(table []uint32) [4096]uint8 {
@@ -0,0 +1,394 @@
+// This file contains the kernel buffer cache.
+//   Reading and writing blocks directly from the device for every access is
+// slow, so recently used blocks are kept in a fixed number of buffers in
+// memory.
+//   Buffers are replaced in least-recently-used order, and modified buffers are
+// only written back to the device when they are replaced, when the periodic
+// write-back runs, or when somebody asks for it through `Sync`.
+//   Much like the `cache` type in the `cpu` package, the buffer cache keeps
+// track of hits and misses so its behaviour can be studied.
+
+package system
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoBuffers is returned when a block is requested but every buffer in the
+// cache is pinned.
+var ErrNoBuffers = errors.New("no unpinned buffers available")
+
+// Buffer holds the contents of a single block.
+//   A buffer returned from `BufferCache.Get` is locked and pinned, and must be
+// handed back with `BufferCache.Release` when the caller is done with it.
+type Buffer struct {
+	sync.Mutex // held by whoever is using the buffer
+
+	Data [BlockSize]uint8
+
+	dev    BlockDevice
+	number uint32
+
+	// protected by the `mu` of the cache, not by the buffer's own lock, since
+	// buffers are recycled, invalidated and discarded without being held
+	valid bool // Data holds the contents of the block
+	dirty bool // Data has been modified since it was last written
+	pins  int  // number of references that prevent the buffer from being replaced
+
+	// doubly linked LRU list, most recently used at the front
+	prev *Buffer
+	next *Buffer
+}
+
+// Number returns the block number the buffer holds.
+func (b *Buffer) Number() uint32 {
+	return b.number
+}
+
+// Device returns the device the buffer belongs to.
+func (b *Buffer) Device() BlockDevice {
+	return b.dev
+}
+
+// BufferCacheStats contains counters from the buffer cache.
+type BufferCacheStats struct {
+	Hits       uint64 // requested block was already in the cache
+	Misses     uint64 // requested block had to be read from the device
+	Evictions  uint64 // a valid buffer was replaced to make room
+	Writebacks uint64 // a dirty buffer was written to the device
+}
+
+// HitRate returns the fraction of requests that were hits.
+func (s BufferCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// BufferCache is a fixed-size cache of block buffers with LRU replacement.
+type BufferCache struct {
+	mu      sync.Mutex // protects the list, pins, valid and dirty flags, and stats
+	buffers []Buffer
+	head    Buffer // sentinel for the LRU list
+	stats   BufferCacheStats
+
+	stop chan struct{}  // closed to stop the periodic write-back
+	done sync.WaitGroup // tracks the periodic write-back goroutine
+}
+
+// NewBufferCache creates a buffer cache with `n` buffers.
+func NewBufferCache(n int) *BufferCache {
+	bc := &BufferCache{
+		buffers: make([]Buffer, n),
+	}
+
+	bc.head.prev = &bc.head
+	bc.head.next = &bc.head
+	for i := range bc.buffers {
+		bc.pushFront(&bc.buffers[i])
+	}
+
+	return bc
+}
+
+// unlink removes `b` from the LRU list.
+func (bc *BufferCache) unlink(b *Buffer) {
+	b.prev.next = b.next
+	b.next.prev = b.prev
+}
+
+// pushFront places `b` at the most recently used end of the LRU list.
+func (bc *BufferCache) pushFront(b *Buffer) {
+	b.next = bc.head.next
+	b.prev = &bc.head
+	bc.head.next.prev = b
+	bc.head.next = b
+}
+
+// Get returns a locked and pinned buffer holding block `n` of `dev`.
+//   The block is only read from the device if it was not already cached.
+func (bc *BufferCache) Get(dev BlockDevice, n uint32) (*Buffer, error) {
+	b, err := bc.lookup(dev, n)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Lock()
+	bc.mu.Lock()
+	valid := b.valid
+	bc.mu.Unlock()
+	if !valid {
+		if err := dev.ReadBlock(n, b.Data[:]); err != nil {
+			b.Unlock()
+			bc.Unpin(b)
+			return nil, err
+		}
+		bc.mu.Lock()
+		b.valid = true
+		bc.mu.Unlock()
+	}
+
+	return b, nil
+}
+
+// lookup finds the buffer for block `n` of `dev`, or recycles the least
+// recently used unpinned buffer for it.
+//   The returned buffer is pinned but not locked.
+func (bc *BufferCache) lookup(dev BlockDevice, n uint32) (*Buffer, error) {
+	bc.mu.Lock()
+
+	for b := bc.head.next; b != &bc.head; b = b.next {
+		if b.dev == dev && b.number == n {
+			b.pins++
+			bc.stats.Hits++
+			bc.mu.Unlock()
+			return b, nil
+		}
+	}
+
+	bc.stats.Misses++
+
+	// not cached, recycle the least recently used unpinned buffer
+	for b := bc.head.prev; b != &bc.head; b = b.prev {
+		if b.pins != 0 {
+			continue
+		}
+
+		if b.dirty {
+			// write back before reuse; pin it so nobody grabs it meanwhile
+			b.pins++
+			bc.mu.Unlock()
+
+			b.Lock()
+			err := bc.writeback(b)
+			b.Unlock()
+
+			bc.mu.Lock()
+			b.pins--
+			if err != nil {
+				bc.mu.Unlock()
+				return nil, err
+			}
+
+			// the buffer might have been picked up while the lock was released
+			bc.mu.Unlock()
+			return bc.lookup(dev, n)
+		}
+
+		if b.dev != nil {
+			bc.stats.Evictions++
+		}
+
+		b.dev = dev
+		b.number = n
+		b.valid = false
+		b.pins = 1
+		bc.mu.Unlock()
+		return b, nil
+	}
+
+	bc.mu.Unlock()
+	return nil, ErrNoBuffers
+}
+
+// Release unlocks and unpins a buffer returned by `Get`.
+//   When the last pin goes away the buffer becomes the most recently used.
+func (bc *BufferCache) Release(b *Buffer) {
+	b.Unlock()
+	bc.Unpin(b)
+}
+
+// Pin adds a reference to `b` which keeps it from being replaced even after it
+// is released.
+//   This is used by code that must know a block stays in memory, such as a
+// journal that has not yet committed.
+func (bc *BufferCache) Pin(b *Buffer) {
+	bc.mu.Lock()
+	b.pins++
+	bc.mu.Unlock()
+}
+
+// Unpin removes a reference added by `Pin` or `Get`.
+func (bc *BufferCache) Unpin(b *Buffer) {
+	bc.mu.Lock()
+	b.pins--
+	if b.pins == 0 {
+		bc.unlink(b)
+		bc.pushFront(b)
+	}
+	bc.mu.Unlock()
+}
+
+// MarkDirty marks `b` as modified so it will be written back later.
+//   The caller must hold the buffer.
+func (bc *BufferCache) MarkDirty(b *Buffer) {
+	bc.mu.Lock()
+	b.dirty = true
+	bc.mu.Unlock()
+}
+
+// Write writes `b` to its device immediately.
+//   The caller must hold the buffer.
+func (bc *BufferCache) Write(b *Buffer) error {
+	bc.MarkDirty(b)
+	return bc.writeback(b)
+}
+
+// writeback writes a dirty buffer to its device and clears the dirty flag.
+//   The caller must hold the buffer, but not `bc.mu`.
+func (bc *BufferCache) writeback(b *Buffer) error {
+	bc.mu.Lock()
+	dirty := b.dirty
+	b.dirty = false
+	bc.mu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	if err := b.dev.WriteBlock(b.number, b.Data[:]); err != nil {
+		bc.mu.Lock()
+		b.dirty = true
+		bc.mu.Unlock()
+		return err
+	}
+
+	bc.mu.Lock()
+	bc.stats.Writebacks++
+	bc.mu.Unlock()
+	return nil
+}
+
+// SyncDevice writes every dirty buffer belonging to `dev` back to it and
+// flushes the device.
+//   If `dev` is nil, buffers of all devices are written back.
+func (bc *BufferCache) SyncDevice(dev BlockDevice) error {
+	// pin everything that needs writing so it can't be replaced while the
+	// cache lock is released
+	var dirty []*Buffer
+	bc.mu.Lock()
+	for i := range bc.buffers {
+		b := &bc.buffers[i]
+		if b.dirty && (dev == nil || b.dev == dev) {
+			b.pins++
+			dirty = append(dirty, b)
+		}
+	}
+	bc.mu.Unlock()
+
+	var firstErr error
+	devices := map[BlockDevice]bool{}
+	for _, b := range dirty {
+		b.Lock()
+		if err := bc.writeback(b); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		devices[b.dev] = true
+		b.Unlock()
+		bc.Unpin(b)
+	}
+
+	if dev != nil {
+		devices[dev] = true
+	}
+
+	for d := range devices {
+		if err := d.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Sync writes all dirty buffers back to their devices.
+func (bc *BufferCache) Sync() error {
+	return bc.SyncDevice(nil)
+}
+
+// Invalidate drops every cached block of `dev` so that the next access reads
+// it from the device again.
+//   Dirty buffers are dropped without being written back.
+//   Pinned buffers can not be dropped and make this function fail with
+// `false`.
+func (bc *BufferCache) Invalidate(dev BlockDevice) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	ok := true
+	for i := range bc.buffers {
+		b := &bc.buffers[i]
+		if b.dev != dev {
+			continue
+		}
+		if b.pins != 0 {
+			ok = false
+			continue
+		}
+		b.dev = nil
+		b.valid = false
+		b.dirty = false
+	}
+	return ok
+}
+
+// discard drops the contents of `b` so that the next `Get` reads the block from
+// the device again.
+//   The buffer stays pinned by whoever pinned it.
+func (bc *BufferCache) discard(b *Buffer) {
+	bc.mu.Lock()
+	b.valid = false
+	b.dirty = false
+	bc.mu.Unlock()
+}
+
+// Stats returns a snapshot of the cache counters.
+func (bc *BufferCache) Stats() BufferCacheStats {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.stats
+}
+
+// StartWriteback starts a goroutine that writes all dirty buffers back every
+// `interval`.
+//   Calling it while the write-back is already running does nothing.
+func (bc *BufferCache) StartWriteback(interval time.Duration) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.stop != nil {
+		return
+	}
+
+	bc.stop = make(chan struct{})
+	bc.done.Add(1)
+	go func(stop chan struct{}) {
+		defer bc.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bc.Sync()
+			case <-stop:
+				return
+			}
+		}
+	}(bc.stop)
+}
+
+// StopWriteback stops the periodic write-back and waits for it to finish.
+//   Dirty buffers are not written; call `Sync` for that.
+func (bc *BufferCache) StopWriteback() {
+	bc.mu.Lock()
+	stop := bc.stop
+	bc.stop = nil
+	bc.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		bc.done.Wait()
+	}
+}
@@ -0,0 +1,54 @@
+package system
+
+import (
+	"gotos/cpu"
+	"testing"
+)
+
+// BenchmarkFib33 runs c-programs/fib, which computes fib(33), as a single
+// process on a single core, with and without the block cache.
+func BenchmarkFib33(b *testing.B) {
+	benchmarkFib33(b, 1, 1)
+}
+
+// BenchmarkFib33x4 runs c-programs/fib as 4 processes on 4 cores, with and
+// without the block cache.
+//   The cores only run in parallel if the host has as many CPUs to give them.
+func BenchmarkFib33x4(b *testing.B) {
+	benchmarkFib33(b, 4, 4)
+}
+
+// benchmarkFib33 runs `processes` processes of c-programs/fib on a system of
+// `cores` cores, with and without the block cache.
+func benchmarkFib33(b *testing.B, cores, processes int) {
+	for _, bc := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"interpreter", false},
+		{"block-cache", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cfg := cpu.DefaultConfig()
+			cfg.BlockCache = bc.enabled
+			fs, err := NewHostFS("../c-programs/fib", false)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for i := 0; i < b.N; i++ {
+				s := NewSystem(cores, cfg)
+				s.Scheduler = &FIFO{}
+				s.Mount("/", fs)
+				for p := 0; p < processes; p++ {
+					if _, err := s.Spawn("/main.text", []string{"fib"}, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if status := s.Run(); status.Reason != ExitHalted {
+					b.Fatal(status)
+				}
+			}
+		})
+	}
+}
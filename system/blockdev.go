@@ -0,0 +1,163 @@
+// This file contains the `BlockDevice` interface along with two simple
+// implementations; one that lives in host memory and one that is backed by an
+// image file on the host.
+
+package system
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	// BlockSize is the size of a single block in bytes.
+	//   All block devices in gotos use the same block size.
+	BlockSize = 1024
+)
+
+// BlockDevice is the interface a storage device must implement so that it can
+// be used through the buffer cache.
+//   Blocks are always read and written whole, and `p` is always exactly
+// `BlockSize` bytes long.
+type BlockDevice interface {
+	// ReadBlock reads block number `n` into `p`.
+	ReadBlock(n uint32, p []uint8) error
+	// WriteBlock writes `p` to block number `n`.
+	WriteBlock(n uint32, p []uint8) error
+	// BlockCount returns the number of blocks on the device.
+	BlockCount() uint32
+	// Flush should make sure all previously written blocks have reached
+	// stable storage.
+	Flush() error
+}
+
+// MemDisk is a block device that lives entirely in host memory.
+//   It is mostly useful for experiments and for tests where nothing should
+// touch the host file system.
+type MemDisk struct {
+	sync.Mutex
+	data []uint8
+
+	// Reads and Writes count the number of blocks transferred, so that the
+	// effect of the buffer cache can be observed.
+	Reads  uint64
+	Writes uint64
+}
+
+// NewMemDisk creates a new, zeroed, in-memory disk with `blocks` blocks.
+func NewMemDisk(blocks uint32) *MemDisk {
+	return &MemDisk{
+		data: make([]uint8, int(blocks)*BlockSize),
+	}
+}
+
+// ReadBlock reads block number `n` into `p`.
+func (d *MemDisk) ReadBlock(n uint32, p []uint8) error {
+	d.Lock()
+	defer d.Unlock()
+	if n >= d.BlockCount() {
+		return fmt.Errorf("block %d out of range", n)
+	}
+	copy(p[:BlockSize], d.data[n*BlockSize:])
+	d.Reads++
+	return nil
+}
+
+// WriteBlock writes `p` to block number `n`.
+func (d *MemDisk) WriteBlock(n uint32, p []uint8) error {
+	d.Lock()
+	defer d.Unlock()
+	if n >= d.BlockCount() {
+		return fmt.Errorf("block %d out of range", n)
+	}
+	copy(d.data[n*BlockSize:], p[:BlockSize])
+	d.Writes++
+	return nil
+}
+
+// BlockCount returns the number of blocks on the disk.
+func (d *MemDisk) BlockCount() uint32 {
+	return uint32(len(d.data) / BlockSize)
+}
+
+// Flush does nothing as host memory is as stable as it gets.
+func (d *MemDisk) Flush() error {
+	return nil
+}
+
+// ImageDisk is a block device backed by an image file on the host.
+type ImageDisk struct {
+	sync.Mutex
+	f      *os.File
+	blocks uint32
+}
+
+// OpenImageDisk opens the image file `fname`.
+//   If the file does not exist it is created with `blocks` zeroed blocks,
+// otherwise `blocks` is ignored and the size of the file decides the number of
+// blocks.
+func OpenImageDisk(fname string, blocks uint32) (*ImageDisk, error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if stats.Size() == 0 {
+		if err := f.Truncate(int64(blocks) * BlockSize); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else {
+		blocks = uint32(stats.Size() / BlockSize)
+	}
+
+	return &ImageDisk{f: f, blocks: blocks}, nil
+}
+
+// ReadBlock reads block number `n` into `p`.
+func (d *ImageDisk) ReadBlock(n uint32, p []uint8) error {
+	d.Lock()
+	defer d.Unlock()
+	if n >= d.blocks {
+		return fmt.Errorf("block %d out of range", n)
+	}
+	_, err := d.f.ReadAt(p[:BlockSize], int64(n)*BlockSize)
+	return err
+}
+
+// WriteBlock writes `p` to block number `n`.
+func (d *ImageDisk) WriteBlock(n uint32, p []uint8) error {
+	d.Lock()
+	defer d.Unlock()
+	if n >= d.blocks {
+		return fmt.Errorf("block %d out of range", n)
+	}
+	_, err := d.f.WriteAt(p[:BlockSize], int64(n)*BlockSize)
+	return err
+}
+
+// BlockCount returns the number of blocks in the image.
+func (d *ImageDisk) BlockCount() uint32 {
+	return d.blocks
+}
+
+// Flush asks the host to commit the image file to stable storage.
+func (d *ImageDisk) Flush() error {
+	d.Lock()
+	defer d.Unlock()
+	return d.f.Sync()
+}
+
+// Close closes the image file.
+func (d *ImageDisk) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	return d.f.Close()
+}
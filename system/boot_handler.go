@@ -6,12 +6,10 @@ package system
 import "gotos/cpu"
 
 // HandleBoot handles the boot-up process of a core.
+//   Cores come up with interrupts disabled; the system takes software, timer,
+// and external interrupts.
 func (s *System) HandleBoot(c *cpu.Core) {
-	next := s.Scheduler.Pop()
-	if next != nil {
-		s.swtch(c, nil, next)
-		c.SetCounter(timeSlice)
-	} else {
-		c.Halt()
-	}
+	c.SetCSR(cpu.Csr_MIE, cpu.MIE_MSIE|cpu.MIE_MTIE|cpu.MIE_MEIE)
+	c.SetCSR(cpu.Csr_MSTATUS, c.GetCSR(cpu.Csr_MSTATUS)|cpu.MSTATUS_MIE)
+	s.runNext(c)
 }
@@ -0,0 +1,84 @@
+// This file contains the driver for the CLINT from the `devices` package,
+// which gives every core a timer and lets cores interrupt each other.
+//   The timer of a core is armed whenever a process starts running on it, so
+// that the process is preempted after `timeSlice` ticks of `mtime`, and
+// disarmed when the core has nothing to run.
+//   Idle cores are woken up with a software interrupt.
+
+package system
+
+import (
+	"gotos/cpu"
+	"gotos/devices"
+)
+
+// clintBase is the physical address the CLINT is mapped at.
+const clintBase = 0x02000000
+
+// wallClockFrequency is the frequency of `mtime` when it follows the wall
+// clock of the host; at this frequency, a time slice is 10 ms.
+const wallClockFrequency = 10000000
+
+// timerDisarmed is a value of `mtimecmp` that `mtime` never reaches.
+const timerDisarmed = ^uint64(0)
+
+// pendingLine is an interrupt line connected to a core.
+type pendingLine struct {
+	core *cpu.Core
+	bit  uint32
+}
+
+func (l pendingLine) Set(level bool) {
+	l.core.SetPending(l.bit, level)
+}
+
+// attachCLINT creates the CLINT for the cores of the system, with `mtime`
+// counting the cycles of the cores, and maps it.
+func (s *System) attachCLINT() {
+	var timer, soft []devices.Line
+	var counters []devices.CycleCounter
+	for i := range s.cores {
+		timer = append(timer, pendingLine{&s.cores[i], cpu.MIP_MTIP})
+		soft = append(soft, pendingLine{&s.cores[i], cpu.MIP_MSIP})
+		counters = append(counters, &s.cores[i])
+	}
+
+	s.clint = devices.NewCLINT(devices.NewCycleClock(counters...), timer, soft)
+	if err := s.memory.Map(clintBase, devices.CLINTSize, s.clint); err != nil {
+		panic(err) // nothing else has been mapped yet
+	}
+}
+
+// UseWallClock makes `mtime` follow the wall clock of the host instead of the
+// cycles of the cores.
+//   Time slices then take the same time no matter how fast the host is, but
+// runs are less repeatable.
+func (s *System) UseWallClock() {
+	s.clint.SetClock(devices.NewWallClock(wallClockFrequency))
+}
+
+// startTimer arms the timer of `c` to go off after a time slice.
+func (s *System) startTimer(c *cpu.Core) {
+	_, mtime := s.memory.ReadIO(clintBase+uint64(devices.CLINT_MTIME), 8)
+	s.setTimer(c.GetCSR(cpu.Csr_MHARTID), mtime+timeSlice)
+}
+
+// stopTimer disarms the timer of `c`.
+func (s *System) stopTimer(c *cpu.Core) {
+	s.setTimer(c.GetCSR(cpu.Csr_MHARTID), timerDisarmed)
+}
+
+// setTimer sets `mtimecmp` of the core with the id `coreID`.
+func (s *System) setTimer(coreID uint32, mtimecmp uint64) {
+	s.memory.WriteIO(clintBase+uint64(devices.CLINT_MTIMECMP+coreID*8), 8, mtimecmp)
+}
+
+// sendIPI raises a software interrupt on the core with the id `coreID`.
+func (s *System) sendIPI(coreID uint32) {
+	s.memory.WriteIO(clintBase+uint64(devices.CLINT_MSIP+coreID*4), 4, 1)
+}
+
+// clearIPI acknowledges a software interrupt on `c`.
+func (s *System) clearIPI(c *cpu.Core) {
+	s.memory.WriteIO(clintBase+uint64(devices.CLINT_MSIP+c.GetCSR(cpu.Csr_MHARTID)*4), 4, 0)
+}
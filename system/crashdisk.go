@@ -0,0 +1,109 @@
+// This file contains `CrashDisk`, a block device wrapper that can cut the
+// power at a chosen block write.
+//   It is used to check that the journal really does restore a consistent
+// state: run a workload once to count its writes, then run it again crashing
+// at every one of those writes, reopen the journal, and check the result.
+
+package system
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrPowerLoss is returned by every operation on a `CrashDisk` after the power
+// has been cut.
+var ErrPowerLoss = errors.New("power lost")
+
+// CrashDisk wraps a block device and drops every write from a chosen point
+// onwards, as if the machine lost power.
+type CrashDisk struct {
+	BlockDevice // the device that survives the crash
+
+	mu      sync.Mutex
+	writes  uint64 // number of writes that reached the device
+	crashAt uint64 // writes reaching this count cut the power; 0 disables
+	crashed bool
+}
+
+// NewCrashDisk wraps `dev`.
+//   No crash is armed until `CrashAt` is called.
+func NewCrashDisk(dev BlockDevice) *CrashDisk {
+	return &CrashDisk{BlockDevice: dev}
+}
+
+// CrashAt arms the disk so that the power is cut when the `n`th write from now
+// is attempted; that write and every following write is lost.
+//   `n` = 1 loses the very next write.
+//   `n` = 0 disarms the disk.
+func (d *CrashDisk) CrashAt(n uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n == 0 {
+		d.crashAt = 0
+	} else {
+		d.crashAt = d.writes + n
+	}
+}
+
+// Writes returns the number of writes that have reached the device.
+func (d *CrashDisk) Writes() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.writes
+}
+
+// Crashed tells whether the power has been cut.
+func (d *CrashDisk) Crashed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.crashed
+}
+
+// Restore turns the power back on and disarms the disk.
+//   Anything that was cached in memory above the disk, such as the buffer
+// cache, must be thrown away before the disk is used again.
+func (d *CrashDisk) Restore() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.crashed = false
+	d.crashAt = 0
+}
+
+// ReadBlock reads block number `n` into `p` unless the power is out.
+func (d *CrashDisk) ReadBlock(n uint32, p []uint8) error {
+	d.mu.Lock()
+	crashed := d.crashed
+	d.mu.Unlock()
+	if crashed {
+		return ErrPowerLoss
+	}
+	return d.BlockDevice.ReadBlock(n, p)
+}
+
+// WriteBlock writes `p` to block number `n` unless the power is out, or is cut
+// by this write.
+func (d *CrashDisk) WriteBlock(n uint32, p []uint8) error {
+	d.mu.Lock()
+	if !d.crashed && d.crashAt != 0 && d.writes+1 >= d.crashAt {
+		d.crashed = true
+	}
+	if d.crashed {
+		d.mu.Unlock()
+		return ErrPowerLoss
+	}
+	d.writes++
+	d.mu.Unlock()
+	return d.BlockDevice.WriteBlock(n, p)
+}
+
+// Flush flushes the underlying device unless the power is out.
+func (d *CrashDisk) Flush() error {
+	d.mu.Lock()
+	crashed := d.crashed
+	d.mu.Unlock()
+	if crashed {
+		return ErrPowerLoss
+	}
+	return d.BlockDevice.Flush()
+}
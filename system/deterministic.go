@@ -0,0 +1,171 @@
+// This file contains the deterministic mode of the system, in which a single
+// goroutine runs all of the cores in turn, rather than every core running in
+// a goroutine of its own.
+//   The cores take turns round-robin, each executing a quantum of
+// instructions. After every turn, the devices are brought up to date: the
+// timers of the CLINT, the script of the input device, the transmitter of the
+// UART, the periodic write-back of the buffer cache, and the snapshots of the
+// framebuffer. The timed ones follow `mtime`, which counts the cycles of the
+// cores, so nothing depends on how fast the host is or how it schedules
+// goroutines, and a run goes the same way every time.
+//   Input from the host follows `mtime` as well: the UART receives a byte
+// every `uartByteTime`, and the input device a key from the terminal every
+// `inputKeyTime`. Both wait for the host to have one, so the run stands still
+// while a terminal has nothing typed, but the bytes arrive at the same points
+// of the run however fast they come from the host.
+//   With a seed other than 0, every turn instead lasts a random number of
+// instructions, up to the quantum, drawn from a generator seeded with it.
+// Different seeds make the cores interleave differently, which shakes out
+// races, and a run with a given seed can be repeated exactly.
+//   A system with a NIC can't use the mode. The switch it is connected to is
+// shared with other systems, each with an `mtime` of its own, so the switch
+// times frames by the clock of the host.
+
+package system
+
+import (
+	"math/rand"
+	"time"
+)
+
+// deterministic is the state of the deterministic mode.
+type deterministic struct {
+	quantum int
+	rng     *rand.Rand // draws the lengths of turns, nil for turns of `quantum`
+
+	nextWriteback uint64 // `mtime` of the next write-back of the buffer cache
+	nextSnapshot  uint64 // `mtime` of the next snapshot of the framebuffer
+	nextByte      uint64 // `mtime` at which the UART receives its next byte
+	nextKey       uint64 // `mtime` at which the input device reads its next key
+}
+
+// UseDeterministicMode makes `Run` run the cores in turns of `quantum`
+// instructions in a single goroutine, so that a run can be repeated exactly.
+//   With a `seed` other than 0, turns last a random number of instructions up
+// to `quantum`, and the same seed gives the same run.
+//   `mtime` must count the cycles of the cores, so it can't be used with
+// `UseWallClock`.
+//   Panics if `quantum` is less than 1, or if a NIC is attached.
+func (s *System) UseDeterministicMode(quantum int, seed int64) {
+	if quantum < 1 {
+		panic("a turn needs at least one instruction")
+	}
+	if s.nic != nil {
+		panic(ErrDeterministicNIC)
+	}
+	s.det = &deterministic{quantum: quantum}
+	if seed != 0 {
+		s.det.rng = rand.New(rand.NewSource(seed))
+	}
+}
+
+// durationTicks converts `d` into ticks of `mtime`, at the frequency it has
+// when it follows the wall clock.
+func durationTicks(d time.Duration) uint64 {
+	return uint64(d / (time.Second / wallClockFrequency))
+}
+
+// runDeterministic is `Run` for the deterministic mode.
+//   The cores are stopped the same way as by `Stop`, only by letting them take
+// turns until they have taken the interrupt to stop.
+func (s *System) runDeterministic() ExitStatus {
+	for i := range s.cores {
+		s.cores[i].StartTurns()
+	}
+
+	for s.anyRunning() && !s.finished() {
+		s.round()
+	}
+	status := ExitStatus{Reason: ExitHalted}
+	if s.finished() {
+		status = s.finisher.status
+	}
+
+	for i := range s.cores {
+		s.RaiseInterrupt(uint32(i), interruptStop)
+	}
+	for s.round() {
+	}
+
+	if s.uart != nil {
+		s.uart.close()
+	}
+	s.stopSnapshots()
+	s.bcache.Sync()
+	return status
+}
+
+// anyRunning returns whether any core is running.
+func (s *System) anyRunning() bool {
+	for i := range s.cores {
+		if s.cores[i].Running() {
+			return true
+		}
+	}
+	return false
+}
+
+// finished returns whether a program has ended the run through the finisher.
+func (s *System) finished() bool {
+	select {
+	case <-s.finisher.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// round gives every core a turn, and brings the devices up to date after
+// each.
+//   Returns false once every core has stopped.
+func (s *System) round() bool {
+	awake := false
+	for i := range s.cores {
+		n := s.det.quantum
+		if s.det.rng != nil {
+			n = 1 + s.det.rng.Intn(n)
+		}
+		if s.cores[i].Turn(n) {
+			awake = true
+		}
+		s.poll()
+	}
+	return awake
+}
+
+// poll brings the devices that follow time up to date with `mtime`, as their
+// goroutines do when the cores run in goroutines of their own.
+func (s *System) poll() {
+	d := s.det
+	s.clint.Poll()
+	if s.input != nil {
+		s.input.dev.Poll()
+	}
+	if s.uart != nil {
+		s.uart.dev.Poll()
+	}
+
+	now := s.clint.Now()
+	if s.uart != nil && now >= d.nextByte {
+		s.uart.dev.Receive()
+		d.nextByte = now + durationTicks(uartByteTime)
+	}
+	if s.input != nil && now >= d.nextKey {
+		s.input.dev.Receive()
+		d.nextKey = now + durationTicks(inputKeyTime)
+	}
+	if now >= d.nextWriteback {
+		if d.nextWriteback != 0 {
+			s.bcache.Sync()
+		}
+		d.nextWriteback = now + durationTicks(writebackInterval)
+	}
+
+	sn := &s.snapshots
+	if s.fb != nil && sn.path != "" && sn.interval > 0 && now >= d.nextSnapshot {
+		if d.nextSnapshot != 0 {
+			s.fb.Snapshot(sn.path)
+		}
+		d.nextSnapshot = now + durationTicks(sn.interval)
+	}
+}
@@ -0,0 +1,113 @@
+// This file contains error numbers returned by syscalls.
+//   Syscalls that fail return the negated error number in a0, the same way
+// Linux does.
+//   Errno also implements the `error` interface, so that file systems and
+// other kernel code can return the exact error a syscall should fail with.
+
+package system
+
+import (
+	"errors"
+	"fmt"
+	"gotos/cpu"
+)
+
+// Errno is a syscall error number.
+type Errno uint32
+
+const (
+	ENOENT          Errno = 2   // no such file or directory
+	EIO             Errno = 5   // input/output error
+	E2BIG           Errno = 7   // argument list too long
+	ENOEXEC         Errno = 8   // exec format error
+	EBADF           Errno = 9   // bad file descriptor
+	ECHILD          Errno = 10  // no child processes
+	EAGAIN          Errno = 11  // resource temporarily unavailable
+	ENOMEM          Errno = 12  // out of memory
+	EACCES          Errno = 13  // permission denied
+	EFAULT          Errno = 14  // bad address
+	EEXIST          Errno = 17  // file exists
+	ENODEV          Errno = 19  // no such device
+	ENOTDIR         Errno = 20  // not a directory
+	EISDIR          Errno = 21  // is a directory
+	EINVAL          Errno = 22  // invalid argument
+	EMFILE          Errno = 24  // too many open files
+	EROFS           Errno = 30  // read-only file system
+	EPIPE           Errno = 32  // broken pipe
+	ENAMETOOLONG    Errno = 36  // file name too long
+	ENOTSOCK        Errno = 88  // socket operation on non-socket
+	EDESTADDRREQ    Errno = 89  // destination address required
+	EMSGSIZE        Errno = 90  // message too long
+	EPROTONOSUPPORT Errno = 93  // protocol not supported
+	EAFNOSUPPORT    Errno = 97  // address family not supported by protocol
+	EADDRINUSE      Errno = 98  // address already in use
+	EADDRNOTAVAIL   Errno = 99  // cannot assign requested address
+	ENETDOWN        Errno = 100 // network is down
+	ENOBUFS         Errno = 105 // no buffer space available
+	ETIMEDOUT       Errno = 110 // connection timed out
+)
+
+var errnoNames = map[Errno]string{
+	ENOENT:          "no such file or directory",
+	EIO:             "input/output error",
+	E2BIG:           "argument list too long",
+	ENOEXEC:         "exec format error",
+	EBADF:           "bad file descriptor",
+	ECHILD:          "no child processes",
+	EAGAIN:          "resource temporarily unavailable",
+	ENOMEM:          "out of memory",
+	EACCES:          "permission denied",
+	EFAULT:          "bad address",
+	EEXIST:          "file exists",
+	ENODEV:          "no such device",
+	ENOTDIR:         "not a directory",
+	EISDIR:          "is a directory",
+	EINVAL:          "invalid argument",
+	EMFILE:          "too many open files",
+	EROFS:           "read-only file system",
+	EPIPE:           "broken pipe",
+	ENAMETOOLONG:    "file name too long",
+	ENOTSOCK:        "socket operation on non-socket",
+	EDESTADDRREQ:    "destination address required",
+	EMSGSIZE:        "message too long",
+	EPROTONOSUPPORT: "protocol not supported",
+	EAFNOSUPPORT:    "address family not supported by protocol",
+	EADDRINUSE:      "address already in use",
+	EADDRNOTAVAIL:   "cannot assign requested address",
+	ENETDOWN:        "network is down",
+	ENOBUFS:         "no buffer space available",
+	ETIMEDOUT:       "connection timed out",
+}
+
+// Error returns a description of the error.
+func (e Errno) Error() string {
+	if name, ok := errnoNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("errno %d", uint32(e))
+}
+
+// ret gives the value placed in a0 when a syscall fails with `e`.
+func (e Errno) ret() uint32 {
+	return -uint32(e)
+}
+
+// errnoOf turns any error into the Errno a syscall should fail with.
+//   Faults from accessing user memory become EFAULT, and other errors that are
+// not an Errno become EIO.
+func errnoOf(err error) Errno {
+	var e Errno
+	if errors.As(err, &e) {
+		return e
+	}
+
+	var fault *cpu.FaultError
+	if errors.As(err, &fault) {
+		return EFAULT
+	}
+	if errors.Is(err, cpu.ErrStringTooLong) {
+		return ENAMETOOLONG
+	}
+
+	return EIO
+}
@@ -0,0 +1,143 @@
+// This file contains the `File` interface and the per-process table of file
+// descriptors.
+
+package system
+
+import "sync/atomic"
+
+// maxFiles is the number of file descriptors a process can have open.
+const maxFiles = 16
+
+// File is anything a file descriptor can refer to.
+//   Operations that can not complete yet, like reading from an empty pipe,
+// return an error from `WaitQueue.wouldBlock`, which puts the process to sleep
+// until the operation can be retried.
+type File interface {
+	// Read reads up to len(p) bytes into p.
+	Read(p []uint8) (int, error)
+	// Write writes len(p) bytes from p.
+	Write(p []uint8) (int, error)
+	// Sync commits the contents of the file to stable storage.
+	Sync() error
+	// Close releases the file.
+	Close() error
+}
+
+// openFile is an open file shared by every file descriptor that refers to it.
+//   The file is closed when the last of those descriptors is closed.
+type openFile struct {
+	File
+	refs int32
+}
+
+// release drops a reference to the open file and closes it if it was the
+// last one.
+func (of *openFile) release() error {
+	if atomic.AddInt32(&of.refs, -1) == 0 {
+		return of.Close()
+	}
+	return nil
+}
+
+// file returns the file referred to by `fd` in the process `pcb`, or nil if
+// `fd` is not an open file descriptor.
+func (pcb *PCB) file(fd uint32) File {
+	if fd >= maxFiles || pcb.files[fd] == nil {
+		return nil
+	}
+	return pcb.files[fd].File
+}
+
+// allocFD places `f` in the lowest free file descriptor of `pcb` and returns
+// that descriptor.
+func (pcb *PCB) allocFD(f File) (uint32, bool) {
+	return pcb.install(&openFile{File: f, refs: 1})
+}
+
+// install places the open file `of` in the lowest free file descriptor of
+// `pcb` and returns that descriptor.
+//   The caller must already hold the reference the descriptor takes.
+func (pcb *PCB) install(of *openFile) (uint32, bool) {
+	for fd := range pcb.files {
+		if pcb.files[fd] == nil {
+			pcb.files[fd] = of
+			return uint32(fd), true
+		}
+	}
+	return 0, false
+}
+
+// dup makes the lowest free file descriptor of `pcb` refer to the same open
+// file as `fd`, and returns that descriptor.
+func (pcb *PCB) dup(fd uint32) (uint32, error) {
+	if fd >= maxFiles || pcb.files[fd] == nil {
+		return 0, EBADF
+	}
+	of := pcb.files[fd]
+	atomic.AddInt32(&of.refs, 1)
+	newFD, ok := pcb.install(of)
+	if !ok {
+		of.release()
+		return 0, EMFILE
+	}
+	return newFD, nil
+}
+
+// dup2 makes `newFD` refer to the same open file as `oldFD`, closing whatever
+// `newFD` referred to before.
+func (pcb *PCB) dup2(oldFD, newFD uint32) error {
+	if oldFD >= maxFiles || newFD >= maxFiles || pcb.files[oldFD] == nil {
+		return EBADF
+	}
+	if oldFD == newFD {
+		return nil
+	}
+	of := pcb.files[oldFD]
+	atomic.AddInt32(&of.refs, 1)
+	pcb.closeFD(newFD)
+	pcb.files[newFD] = of
+	return nil
+}
+
+// inheritFiles gives `pcb` every file descriptor of `parent`, referring to the
+// same open files.
+func (pcb *PCB) inheritFiles(parent *PCB) {
+	for fd, of := range parent.files {
+		if of != nil {
+			atomic.AddInt32(&of.refs, 1)
+			pcb.files[fd] = of
+		}
+	}
+}
+
+// SetFile makes the file descriptor `fd` of `pcb` refer to `f`, closing
+// whatever it referred to before.
+//   This lets the host hand files, such as the ends of a pipe, to a process
+// before it starts.
+func (pcb *PCB) SetFile(fd uint32, f File) error {
+	if fd >= maxFiles {
+		return EBADF
+	}
+	pcb.closeFD(fd)
+	pcb.files[fd] = &openFile{File: f, refs: 1}
+	return nil
+}
+
+// closeFD closes the file descriptor `fd` of `pcb`.
+func (pcb *PCB) closeFD(fd uint32) error {
+	if fd >= maxFiles || pcb.files[fd] == nil {
+		return EBADF
+	}
+	of := pcb.files[fd]
+	pcb.files[fd] = nil
+	return of.release()
+}
+
+// closeAll closes every file descriptor of `pcb`.
+func (pcb *PCB) closeAll() {
+	for fd := range pcb.files {
+		if pcb.files[fd] != nil {
+			pcb.closeFD(uint32(fd))
+		}
+	}
+}
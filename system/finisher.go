@@ -0,0 +1,97 @@
+// This file contains how a run of the system ends, either because every core
+// halted or because a program asked the finisher from the `devices` package to
+// end it.
+//   Bare-metal programs that map `FinisherBase` into their address space can
+// end the run with a result, which `Run` returns, so that a test harness can
+// tell passing and failing programs apart.
+
+package system
+
+import (
+	"fmt"
+	"gotos/devices"
+	"sync"
+)
+
+// FinisherBase is the physical address the finisher is mapped at.
+const FinisherBase = 0x11100000
+
+// ExitReason says why a run ended.
+type ExitReason int
+
+const (
+	ExitHalted ExitReason = 0 // every core halted
+	ExitPass   ExitReason = 1 // a program reported success to the finisher
+	ExitFail   ExitReason = 2 // a program reported failure to the finisher
+)
+
+// ExitStatus is the result of a run.
+type ExitStatus struct {
+	Reason ExitReason
+	Code   uint32 // exit code reported with `ExitFail`
+}
+
+// ExitCode returns the exit code for the host process: 0 unless a program
+// reported failure, and never 0 if it did.
+//   Hosts only keep the low 8 bits of an exit code, so a code whose low 8 bits
+// are 0 becomes 1.
+func (e ExitStatus) ExitCode() int {
+	if e.Reason != ExitFail {
+		return 0
+	}
+	if e.Code&0xFF == 0 {
+		return 1
+	}
+	return int(e.Code & 0xFF)
+}
+
+func (e ExitStatus) String() string {
+	switch e.Reason {
+	case ExitPass:
+		return "passed"
+	case ExitFail:
+		return fmt.Sprintf("failed with code %d", e.Code)
+	}
+	return "all cores halted"
+}
+
+// finisher keeps track of whether a program has ended the run.
+type finisher struct {
+	once   sync.Once
+	done   chan struct{} // closed when a program ends the run
+	status ExitStatus
+}
+
+// attachFinisher creates the finisher and maps it.
+func (s *System) attachFinisher() {
+	s.finisher.done = make(chan struct{})
+	dev := devices.NewFinisher(func(pass bool, code uint32) {
+		s.finisher.once.Do(func() {
+			s.finisher.status = ExitStatus{Reason: ExitFail, Code: code}
+			if pass {
+				s.finisher.status = ExitStatus{Reason: ExitPass}
+			}
+			close(s.finisher.done)
+		})
+	})
+	if err := s.memory.Map(FinisherBase, devices.FinisherSize, dev); err != nil {
+		panic(err)
+	}
+}
+
+// waitFinish waits until every core has halted or a program has ended the
+// run, and returns the result.
+func (s *System) waitFinish() ExitStatus {
+	halted := make(chan struct{})
+	go func() {
+		s.WaitHalt()
+		close(halted)
+	}()
+
+	select {
+	case <-halted:
+		return ExitStatus{Reason: ExitHalted}
+	case <-s.finisher.done:
+		return s.finisher.status
+	}
+}
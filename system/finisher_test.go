@@ -0,0 +1,23 @@
+package system
+
+import "testing"
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		status ExitStatus
+		want   int
+	}{
+		{ExitStatus{Reason: ExitHalted}, 0},
+		{ExitStatus{Reason: ExitPass}, 0},
+		{ExitStatus{Reason: ExitFail}, 1},
+		{ExitStatus{Reason: ExitFail, Code: 3}, 3},
+		{ExitStatus{Reason: ExitFail, Code: 255}, 255},
+		{ExitStatus{Reason: ExitFail, Code: 256}, 1},
+		{ExitStatus{Reason: ExitFail, Code: 512}, 1},
+		{ExitStatus{Reason: ExitFail, Code: 0x1234}, 0x34},
+	} {
+		if got := tc.status.ExitCode(); got != tc.want {
+			t.Errorf("%v: exit code %d, want %d", tc.status, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// This file contains the framebuffer of the system and the snapshots taken of
+// it.
+//   Programs draw by mapping `FramebufferBase` into their address space and
+// storing pixels to it; the host gets to see the result as images, which are
+// written on demand with `SnapshotFramebuffer`, every so often while the
+// system runs, and once more when it stops.
+
+package system
+
+import (
+	"gotos/devices"
+	"sync"
+	"time"
+)
+
+// FramebufferBase is the physical address the framebuffer is mapped at.
+const FramebufferBase = 0x20000000
+
+// snapshots writes images of the framebuffer to a file while the system runs.
+type snapshots struct {
+	path     string        // where the images go, "" for nowhere
+	interval time.Duration // time between images, 0 for only at the end
+
+	stop chan struct{}  // closed to stop taking images
+	done sync.WaitGroup // tracks the goroutine taking images
+}
+
+// AttachFramebuffer creates a framebuffer of `width` by `height` pixels in
+// the pixel format `format` and maps it.
+//   It must be called before the system is started.
+func (s *System) AttachFramebuffer(width, height int, format devices.PixelFormat) (*devices.Framebuffer, error) {
+	fb, err := devices.NewFramebuffer(width, height, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.memory.Map(FramebufferBase, fb.Size(), fb); err != nil {
+		return nil, err
+	}
+	s.fb = fb
+	return fb, nil
+}
+
+// SnapshotFramebuffer writes what the framebuffer shows to the file at `path`,
+// as PNG if the name ends in ".png" and as PPM otherwise.
+func (s *System) SnapshotFramebuffer(path string) error {
+	if s.fb == nil {
+		return ENODEV
+	}
+	return s.fb.Snapshot(path)
+}
+
+// SetFramebufferSnapshots makes the system write what the framebuffer shows to
+// the file at `path` every `interval` while it runs, and once more when it is
+// stopped.
+//   With an `interval` of 0 the image is only written when the system stops.
+//   It must be called before the system is started.
+func (s *System) SetFramebufferSnapshots(path string, interval time.Duration) {
+	s.snapshots.path = path
+	s.snapshots.interval = interval
+}
+
+// startSnapshots starts taking images of the framebuffer periodically, if
+// that was asked for.
+func (s *System) startSnapshots() {
+	sn := &s.snapshots
+	if s.fb == nil || sn.path == "" || sn.interval <= 0 {
+		return
+	}
+
+	sn.stop = make(chan struct{})
+	sn.done.Add(1)
+	go func() {
+		defer sn.done.Done()
+		ticker := time.NewTicker(sn.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.fb.Snapshot(sn.path)
+			case <-sn.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopSnapshots stops taking images periodically and takes the last one.
+func (s *System) stopSnapshots() error {
+	sn := &s.snapshots
+	if sn.stop != nil {
+		close(sn.stop)
+		sn.done.Wait()
+		sn.stop = nil
+	}
+
+	if s.fb == nil || sn.path == "" {
+		return nil
+	}
+	return s.fb.Snapshot(sn.path)
+}
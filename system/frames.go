@@ -0,0 +1,122 @@
+// This file contains the allocator for physical page frames.
+//   Processes created by the system get their page tables, program, and stack
+// from frames handed out here, and give them back when they exit.
+//   Memory below `frameBase` is left alone, so that the host can keep placing
+// processes there by hand with `Load`.
+//   Frames below 4 GiB are kept apart from those above, and only handed out
+// for processes when there are no others left, since devices such as the NIC
+// can only reach RAM below 4 GiB.
+
+package system
+
+import (
+	"gotos/cpu"
+	"sync"
+)
+
+// frameBase is the physical address of the first frame the allocator hands
+// out.
+const frameBase = 0x00100000
+
+// framePool is a range of frames, some of which have been handed out.
+//   Frames are handed out from the bottom of the range, so that a large
+// memory costs nothing until it is used, and frames that are given back
+// are handed out again first.
+type framePool struct {
+	base uint64   // the first frame of the pool
+	next uint64   // the lowest frame that has never been handed out
+	end  uint64   // the first address above the pool
+	free []uint64 // physical addresses of frames that were given back
+}
+
+// take takes a frame from the pool.
+func (p *framePool) take() (uint64, bool) {
+	if len(p.free) > 0 {
+		frame := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		return frame, true
+	}
+	if p.next < p.end {
+		frame := p.next
+		p.next += pageSize
+		return frame, true
+	}
+	return 0, false
+}
+
+// frameAllocator keeps the free physical frames below and above 4 GiB.
+type frameAllocator struct {
+	sync.Mutex
+	low  []framePool // below 4 GiB
+	high []framePool // above 4 GiB
+}
+
+// init gives the allocator every frame of RAM from `base`, as laid out by
+// `regions`.
+func (fa *frameAllocator) init(base uint64, regions []cpu.Region) {
+	for _, r := range regions {
+		start, end := r.Base, r.Base+r.Size
+		if r.Kind != cpu.RegionRAM || end <= base {
+			continue
+		}
+		if start < base {
+			start = base
+		}
+		pool := framePool{base: start, next: start, end: end}
+		if start < 1<<32 {
+			fa.low = append(fa.low, pool)
+		} else {
+			fa.high = append(fa.high, pool)
+		}
+	}
+}
+
+// alloc takes a free frame, fills it with zeros, and returns its physical
+// address.
+func (fa *frameAllocator) alloc(m *cpu.Memory) (uint64, bool) {
+	return fa.allocFrom(m, fa.high, fa.low)
+}
+
+// allocLow is like `alloc`, but only takes frames below 4 GiB, for devices.
+func (fa *frameAllocator) allocLow(m *cpu.Memory) (uint64, bool) {
+	return fa.allocFrom(m, fa.low)
+}
+
+// allocFrom takes a frame from the first of `pools` that has one.
+func (fa *frameAllocator) allocFrom(m *cpu.Memory, pools ...[]framePool) (uint64, bool) {
+	fa.Lock()
+	frame, ok := uint64(0), false
+	for _, pool := range pools {
+		for i := range pool {
+			if frame, ok = pool[i].take(); ok {
+				break
+			}
+		}
+		if ok {
+			break
+		}
+	}
+	fa.Unlock()
+	if !ok {
+		return 0, false
+	}
+
+	var zero [pageSize]uint8
+	m.WriteRaw(frame, zero[:])
+	return frame, true
+}
+
+// release gives frames back to the allocator.
+func (fa *frameAllocator) release(frames []uint64) {
+	fa.Lock()
+	for _, frame := range frames {
+		for _, pools := range [][]framePool{fa.low, fa.high} {
+			for i := range pools {
+				if frame >= pools[i].base && frame < pools[i].end {
+					pools[i].free = append(pools[i].free, frame)
+				}
+			}
+		}
+	}
+	fa.Unlock()
+}
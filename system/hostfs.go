@@ -0,0 +1,230 @@
+// This file contains a file system driver that passes a directory on the host
+// through to the guest.
+//   It makes it easy to hand input to guest programs and to inspect what they
+// wrote afterwards, without building a disk image.
+//   Guest paths can never reach outside the directory; ".." is resolved before
+// the driver sees the path, and symbolic links that point out of the
+// directory are refused, as are links that point nowhere, since creating the
+// file would follow them.
+
+package system
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HostFS is a file system that exposes a directory of the host.
+//   It is read-only unless it was created with writing explicitly allowed.
+type HostFS struct {
+	root     string // absolute path on the host, symbolic links resolved
+	writable bool
+}
+
+// NewHostFS creates a file system for the host directory `dir`.
+//   Guest programs can only modify files if `writable` is set.
+func NewHostFS(dir string, writable bool) (*HostFS, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !stats.IsDir() {
+		return nil, ENOTDIR
+	}
+
+	return &HostFS{root: root, writable: writable}, nil
+}
+
+// hostPath turns a path in the file system into a path on the host and checks
+// that it does not escape the root through a symbolic link.
+//   The last element of the path does not need to exist, but it may not be a
+// symbolic link whose target doesn't.
+func (h *HostFS) hostPath(p string) (string, error) {
+	full := filepath.Join(h.root, filepath.FromSlash(p))
+	if !h.inside(full) {
+		return "", EACCES
+	}
+
+	// resolve links in the longest prefix that exists
+	existing := full
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !h.inside(resolved) {
+				return "", EACCES
+			}
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", hostErrno(err)
+		}
+
+		// `existing` is missing, unless it is a link to something that is;
+		// such a link would be followed out of the root by creating what it
+		// points to
+		if _, err := os.Lstat(existing); err == nil {
+			return "", EACCES
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", hostErrno(err)
+		}
+		if existing == h.root {
+			return "", ENOENT
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+}
+
+// inside tells whether the host path `p` is the root or below it.
+func (h *HostFS) inside(p string) bool {
+	return p == h.root || strings.HasPrefix(p, h.root+string(filepath.Separator))
+}
+
+// Open opens a file on the host.
+func (h *HostFS) Open(p string, flags, mode uint32) (File, error) {
+	if !h.writable && (flags&O_ACCMODE != O_RDONLY || flags&(O_CREAT|O_TRUNC|O_APPEND) != 0) {
+		return nil, EROFS
+	}
+
+	hp, err := h.hostPath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var hostFlags int
+	switch flags & O_ACCMODE {
+	case O_RDONLY:
+		hostFlags = os.O_RDONLY
+	case O_WRONLY:
+		hostFlags = os.O_WRONLY
+	case O_RDWR:
+		hostFlags = os.O_RDWR
+	default:
+		return nil, EINVAL
+	}
+	if flags&O_CREAT != 0 {
+		hostFlags |= os.O_CREATE
+	}
+	if flags&O_EXCL != 0 {
+		hostFlags |= os.O_EXCL
+	}
+	if flags&O_TRUNC != 0 {
+		hostFlags |= os.O_TRUNC
+	}
+	if flags&O_APPEND != 0 {
+		hostFlags |= os.O_APPEND
+	}
+
+	f, err := os.OpenFile(hp, hostFlags, fs.FileMode(mode&0777))
+	if err != nil {
+		return nil, hostErrno(err)
+	}
+
+	stats, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, hostErrno(err)
+	}
+	if stats.IsDir() && flags&O_ACCMODE != O_RDONLY {
+		f.Close()
+		return nil, EISDIR
+	}
+	if !stats.IsDir() && flags&O_DIRECTORY != 0 {
+		f.Close()
+		return nil, ENOTDIR
+	}
+
+	return &hostFile{f: f}, nil
+}
+
+// Mkdir creates a directory on the host.
+func (h *HostFS) Mkdir(p string, mode uint32) error {
+	if !h.writable {
+		return EROFS
+	}
+	hp, err := h.hostPath(p)
+	if err != nil {
+		return err
+	}
+	return hostErrno(os.Mkdir(hp, fs.FileMode(mode&0777)))
+}
+
+// Remove removes a file or an empty directory on the host.
+func (h *HostFS) Remove(p string) error {
+	if !h.writable {
+		return EROFS
+	}
+	if p == "." {
+		return EACCES // the root is not ours to remove
+	}
+	hp, err := h.hostPath(p)
+	if err != nil {
+		return err
+	}
+	return hostErrno(os.Remove(hp))
+}
+
+// hostErrno converts errors from the host into the Errno the guest sees.
+func hostErrno(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return EACCES
+	}
+
+	var e Errno
+	if errors.As(err, &e) {
+		return e
+	}
+	return EIO
+}
+
+// hostFile is a file opened through a `HostFS`.
+type hostFile struct {
+	f *os.File
+}
+
+// Read reads from the host file.
+//   End of file is a read of 0 bytes, not an error.
+func (h *hostFile) Read(p []uint8) (int, error) {
+	n, err := h.f.Read(p)
+	if n == 0 && err != nil && !errors.Is(err, io.EOF) {
+		return 0, hostErrno(err)
+	}
+	return n, nil
+}
+
+// Write writes to the host file.
+func (h *hostFile) Write(p []uint8) (int, error) {
+	n, err := h.f.Write(p)
+	return n, hostErrno(err)
+}
+
+// Sync commits the host file to stable storage.
+func (h *hostFile) Sync() error {
+	return hostErrno(h.f.Sync())
+}
+
+// Close closes the host file.
+func (h *hostFile) Close() error {
+	return hostErrno(h.f.Close())
+}
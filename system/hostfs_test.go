@@ -0,0 +1,53 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHostFSDanglingLink checks that a link inside the root whose target
+// outside it doesn't exist can't be used to create that target.
+func TestHostFSDanglingLink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	target := filepath.Join(outside, "escaped")
+	if err := os.Symlink(target, filepath.Join(root, "link")); err != nil {
+		t.Skip("symbolic links unavailable:", err)
+	}
+
+	h, err := NewHostFS(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err := h.Open("link", O_WRONLY|O_CREAT, 0644); err == nil {
+		f.Close()
+		t.Error("Open created a file through the link")
+	} else if err != EACCES {
+		t.Errorf("Open: %v, want %v", err, EACCES)
+	}
+	if err := h.Mkdir("link", 0755); err != EACCES {
+		t.Errorf("Mkdir: %v, want %v", err, EACCES)
+	}
+	if _, err := h.Open("link/file", O_WRONLY|O_CREAT, 0644); err != EACCES {
+		t.Errorf("Open below the link: %v, want %v", err, EACCES)
+	}
+	if err := h.Remove("link"); err != EACCES {
+		t.Errorf("Remove: %v, want %v", err, EACCES)
+	}
+
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Errorf("%s exists", target)
+	}
+
+	// files that don't exist yet can still be created
+	f, err := h.Open("file", O_WRONLY|O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := h.Remove("file"); err != nil {
+		t.Error(err)
+	}
+}
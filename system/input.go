@@ -0,0 +1,157 @@
+// This file contains the driver for the input device from the `devices`
+// package.
+//   Events are collected by the interrupt handler into a buffer, from which
+// processes read them through a file. Every event is read as a little-endian
+// word laid out like INPUT_EVENT, so a read returns as many whole events as
+// fit, and end of file once the input has ended.
+//   Scripted events are timed by `mtime`, so with the default clock that
+// counts cycles, a script is replayed the same way on every run.
+
+package system
+
+import (
+	"encoding/binary"
+	"gotos/devices"
+	"io"
+	"sync"
+	"time"
+)
+
+// inputBase is the physical address the input device is mapped at.
+const inputBase = 0x10002000
+
+// inputBufferSize is how many events the driver keeps before it stops taking
+// events out of the device.
+const inputBufferSize = 256
+
+// inputEventSize is the size of an event read from the file.
+const inputEventSize = 4
+
+// inputKeyTime is how often the device reads a key from the terminal in the
+// deterministic mode.
+const inputKeyTime = 10 * time.Millisecond
+
+type inputFile struct {
+	s    *System
+	base uint64
+	dev  *devices.Input
+
+	mu       sync.Mutex
+	buf      []uint32  // events that have not been read yet
+	end      bool      // the device has no more events
+	stalled  bool      // the ready interrupt is disabled because `buf` is full
+	readWait WaitQueue // readers waiting for events
+}
+
+// AttachInput creates an input device, maps it, and returns a file that reads
+// its events.
+//   The events come from `in`, read like a terminal where every byte is a key
+// that is pressed and released, and from `script`, whose events are due at
+// times of `mtime`. Either may be nil.
+//   It must be called before the system is started.
+func (s *System) AttachInput(in io.Reader, script []devices.InputEvent) (File, error) {
+	dev := devices.NewInput(s.plic.Source(irqInput))
+	if err := s.memory.Map(inputBase, devices.InputSize, dev); err != nil {
+		return nil, err
+	}
+	if in != nil {
+		dev.Feed(in)
+	}
+	if script != nil {
+		dev.Play(s.clint, script)
+	}
+
+	f := &inputFile{s: s, base: inputBase, dev: dev}
+	f.set(devices.INPUT_IE, devices.INPUT_IE_READY|devices.INPUT_IE_END)
+	s.handleIRQ(irqInput, f.interrupt)
+
+	s.input = f
+	return f, nil
+}
+
+// get reads the register `reg` of the device.
+func (f *inputFile) get(reg uint32) uint32 {
+	_, v := f.s.memory.ReadIO(f.base+uint64(reg), 4)
+	return uint32(v)
+}
+
+// set writes `v` to the register `reg` of the device.
+func (f *inputFile) set(reg, v uint32) {
+	f.s.memory.WriteIO(f.base+uint64(reg), 4, uint64(v))
+}
+
+// interrupt handles the interrupts of the device by moving events into the
+// buffer and waking readers.
+func (f *inputFile) interrupt() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for !f.stalled {
+		if len(f.buf) >= inputBufferSize {
+			// leave the rest in the device until a reader makes room
+			f.stalled = true
+			f.set(devices.INPUT_IE, devices.INPUT_IE_END)
+			break
+		}
+
+		ev := f.get(devices.INPUT_EVENT)
+		if ev&devices.INPUT_EVENT_VALID == 0 {
+			break
+		}
+		f.buf = append(f.buf, ev)
+	}
+
+	if f.get(devices.INPUT_STATUS)&devices.INPUT_STATUS_END != 0 {
+		f.end = true
+		f.set(devices.INPUT_IE, 0) // there is nothing more to tell
+	}
+
+	f.s.wake(&f.readWait)
+}
+
+// Read reads as many whole events as fit in `b`, or sleeps until one
+// arrives.
+func (f *inputFile) Read(b []uint8) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(b) < inputEventSize {
+		return 0, EINVAL
+	}
+
+	if len(f.buf) == 0 {
+		if f.end {
+			return 0, nil
+		}
+		return 0, f.readWait.wouldBlock()
+	}
+
+	n := 0
+	for len(f.buf) != 0 && n+inputEventSize <= len(b) {
+		binary.LittleEndian.PutUint32(b[n:], f.buf[0])
+		f.buf = f.buf[1:]
+		n += inputEventSize
+	}
+
+	if f.stalled {
+		// there is room again, so the device may interrupt again
+		f.stalled = false
+		f.set(devices.INPUT_IE, devices.INPUT_IE_READY|devices.INPUT_IE_END)
+	}
+	return n, nil
+}
+
+// Write can not be used on an input device.
+func (f *inputFile) Write(b []uint8) (int, error) {
+	return 0, EBADF
+}
+
+// Sync is not supported by the input device.
+func (f *inputFile) Sync() error {
+	return EINVAL
+}
+
+// Close does nothing, the device outlives its file descriptors.
+func (f *inputFile) Close() error {
+	return nil
+}
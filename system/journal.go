@@ -0,0 +1,442 @@
+// This file contains a write-ahead journal that file systems can use to make
+// updates that span several blocks crash-consistent.
+//   Blocks modified in a transaction are first written to a log area on the
+// device, followed by a commit block.
+//   Only once the commit block is on the device are the blocks allowed to
+// reach their home locations, so after a crash the device either contains
+// none of the changes of a transaction or, after replaying the log, all of
+// them.
+//
+//   The log area looks like this:
+//
+//   | superblock | descriptor | block | ... | block | commit | descriptor | ...
+//
+//   The superblock tells at which sequence number replay should start.
+//   A descriptor lists the home locations of the blocks that follow it and
+// the commit block closes the transaction with a checksum over those blocks.
+//   A transaction is only replayed if its commit block is present and the
+// checksum matches.
+
+package system
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync"
+)
+
+// JournalMode selects which blocks go through the log.
+type JournalMode int
+
+const (
+	// JournalMetadata only logs metadata blocks.
+	//   Data blocks are written to their home locations before the
+	// transaction commits, so metadata never points at garbage, but a crash
+	// may leave data from an uncommitted transaction on the device.
+	JournalMetadata JournalMode = 0
+	// JournalData logs every block, data included.
+	//   This writes all data twice, but a crash never exposes any part of an
+	// uncommitted transaction.
+	JournalData JournalMode = 1
+)
+
+const (
+	journalMagicSuper      uint32 = 0x4A534230 // "JSB0"
+	journalMagicDescriptor        = 0x4A444230 // "JDB0"
+	journalMagicCommit            = 0x4A434230 // "JCB0"
+
+	// how many home locations fit in a descriptor block after the header
+	journalDescriptorEntries = (BlockSize - 12) / 4
+)
+
+var (
+	// ErrTransactionTooLarge is returned when a transaction modifies more
+	// blocks than fit in the log.
+	ErrTransactionTooLarge = errors.New("transaction does not fit in the journal")
+	// ErrTransactionDone is returned when a finished transaction is used.
+	ErrTransactionDone = errors.New("transaction already committed or aborted")
+)
+
+// Journal is a write-ahead log that lives in `size` blocks starting at block
+// `start` of a device.
+//   Only one transaction can be running at a time.
+type Journal struct {
+	mu sync.Mutex // held by the running transaction
+
+	bc    *BufferCache
+	dev   BlockDevice
+	mode  JournalMode
+	start uint32 // block number of the journal superblock
+	size  uint32 // number of blocks in the log area, superblock included
+
+	sequence uint32 // sequence number of the next transaction
+	tail     uint32 // sequence number of the oldest transaction in the log
+	head     uint32 // offset of the next free block in the log area
+}
+
+// JournalReplay describes what was found in the log when a journal was opened.
+type JournalReplay struct {
+	Transactions int // number of committed transactions that were replayed
+	Blocks       int // number of blocks written to their home locations
+}
+
+// OpenJournal opens the journal in the log area of `dev` and replays all
+// committed transactions it contains.
+//   This should happen when the file system is mounted, before any other block
+// of the device is read.
+//   A log area that has never been used is formatted.
+func OpenJournal(bc *BufferCache, dev BlockDevice, start, size uint32, mode JournalMode) (*Journal, JournalReplay, error) {
+	j := &Journal{
+		bc:    bc,
+		dev:   dev,
+		mode:  mode,
+		start: start,
+		size:  size,
+	}
+
+	var replay JournalReplay
+	var block [BlockSize]uint8
+	if err := dev.ReadBlock(start, block[:]); err != nil {
+		return nil, replay, err
+	}
+
+	if binary.LittleEndian.Uint32(block[0:]) != journalMagicSuper {
+		// fresh log area
+		j.sequence = 1
+		j.tail = 1
+		j.head = 1
+		return j, replay, j.writeSuper()
+	}
+
+	j.sequence = binary.LittleEndian.Uint32(block[4:])
+	j.head = 1
+
+	replay, err := j.replay()
+	if err != nil {
+		return nil, replay, err
+	}
+
+	// everything in the log is now at its home location, so the log is empty
+	j.tail = j.sequence
+	j.head = 1
+	if err := j.writeSuper(); err != nil {
+		return nil, replay, err
+	}
+
+	// cached copies of replayed blocks are stale
+	bc.Invalidate(dev)
+
+	return j, replay, nil
+}
+
+// replay walks the log from the superblock and installs every transaction
+// that has a valid commit block.
+//   It stops at the first transaction that is incomplete.
+func (j *Journal) replay() (JournalReplay, error) {
+	var replay JournalReplay
+	var descriptor, commit [BlockSize]uint8
+
+	for {
+		if j.head+2 > j.size {
+			break
+		}
+
+		if err := j.dev.ReadBlock(j.start+j.head, descriptor[:]); err != nil {
+			return replay, err
+		}
+		if binary.LittleEndian.Uint32(descriptor[0:]) != journalMagicDescriptor ||
+			binary.LittleEndian.Uint32(descriptor[4:]) != j.sequence {
+			break
+		}
+
+		count := binary.LittleEndian.Uint32(descriptor[8:])
+		if count > journalDescriptorEntries || j.head+count+2 > j.size {
+			break
+		}
+
+		if err := j.dev.ReadBlock(j.start+j.head+1+count, commit[:]); err != nil {
+			return replay, err
+		}
+		if binary.LittleEndian.Uint32(commit[0:]) != journalMagicCommit ||
+			binary.LittleEndian.Uint32(commit[4:]) != j.sequence {
+			break
+		}
+
+		// read the logged blocks and verify them against the checksum
+		blocks := make([][BlockSize]uint8, count)
+		sum := crc32.NewIEEE()
+		sum.Write(descriptor[:])
+		for i := uint32(0); i < count; i++ {
+			if err := j.dev.ReadBlock(j.start+j.head+1+i, blocks[i][:]); err != nil {
+				return replay, err
+			}
+			sum.Write(blocks[i][:])
+		}
+		if sum.Sum32() != binary.LittleEndian.Uint32(commit[8:]) {
+			break
+		}
+
+		// install
+		for i := uint32(0); i < count; i++ {
+			home := binary.LittleEndian.Uint32(descriptor[12+4*i:])
+			if err := j.dev.WriteBlock(home, blocks[i][:]); err != nil {
+				return replay, err
+			}
+		}
+
+		replay.Transactions++
+		replay.Blocks += int(count)
+		j.head += count + 2
+		j.sequence++
+	}
+
+	return replay, j.dev.Flush()
+}
+
+// writeSuper writes the journal superblock and flushes the device.
+func (j *Journal) writeSuper() error {
+	var block [BlockSize]uint8
+	binary.LittleEndian.PutUint32(block[0:], journalMagicSuper)
+	binary.LittleEndian.PutUint32(block[4:], j.tail)
+	if err := j.dev.WriteBlock(j.start, block[:]); err != nil {
+		return err
+	}
+	return j.dev.Flush()
+}
+
+// MaxTransactionBlocks returns the largest number of logged blocks a single
+// transaction can contain.
+func (j *Journal) MaxTransactionBlocks() int {
+	max := int(j.size) - 3 // superblock, descriptor, and commit
+	if max > journalDescriptorEntries {
+		max = journalDescriptorEntries
+	}
+	return max
+}
+
+// Checkpoint makes sure every committed transaction has reached its home
+// locations, after which the log space they used can be reused.
+func (j *Journal) Checkpoint() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.checkpoint()
+}
+
+// checkpoint is `Checkpoint` without locking.
+func (j *Journal) checkpoint() error {
+	if j.tail == j.sequence {
+		return nil // log is empty
+	}
+
+	// committed blocks are dirty in the buffer cache, write them home
+	if err := j.bc.SyncDevice(j.dev); err != nil {
+		return err
+	}
+
+	j.tail = j.sequence
+	j.head = 1
+	return j.writeSuper()
+}
+
+// Transaction groups block updates that must reach the device atomically.
+type Transaction struct {
+	j        *Journal
+	done     bool
+	logged   []*Buffer // blocks that go through the log
+	inPlace  []*Buffer // data blocks written in place (metadata mode only)
+	included map[uint32]bool
+}
+
+// Begin starts a new transaction.
+//   It waits for the running transaction, if any, to finish.
+func (j *Journal) Begin() *Transaction {
+	j.mu.Lock()
+	return &Transaction{
+		j:        j,
+		included: map[uint32]bool{},
+	}
+}
+
+// Get returns block `n` of the journalled device, locked, so that it can be
+// modified as part of the transaction.
+//   `data` tells whether the block holds file data rather than file system
+// metadata; it decides whether the block is logged in `JournalMetadata` mode.
+//   The buffer must be handed back with `BufferCache.Release` after it has been
+// modified, and must not be marked dirty by the caller; the journal decides
+// when it may reach its home location.
+func (tx *Transaction) Get(n uint32, data bool) (*Buffer, error) {
+	if tx.done {
+		return nil, ErrTransactionDone
+	}
+
+	j := tx.j
+	logged := !data || j.mode == JournalData
+
+	if !tx.included[n] && logged && len(tx.logged) >= j.MaxTransactionBlocks() {
+		return nil, ErrTransactionTooLarge
+	}
+
+	b, err := j.bc.Get(j.dev, n)
+	if err != nil {
+		return nil, err
+	}
+
+	if tx.included[n] {
+		return b, nil
+	}
+
+	// If an earlier transaction left the block dirty, its committed contents
+	// go home now, before this transaction starts modifying it.
+	if err := j.bc.writeback(b); err != nil {
+		j.bc.Release(b)
+		return nil, err
+	}
+
+	// keep the block in memory until the transaction is done
+	j.bc.Pin(b)
+	tx.included[n] = true
+	if logged {
+		tx.logged = append(tx.logged, b)
+	} else {
+		tx.inPlace = append(tx.inPlace, b)
+	}
+
+	return b, nil
+}
+
+// Commit writes the transaction to the log.
+//   When Commit returns without an error the transaction is durable; the
+// modified blocks reach their home locations at the next checkpoint or when
+// the buffer cache writes them back.
+//   If Commit fails, the transaction is aborted.
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.done = true
+
+	err := tx.commit()
+	if err != nil {
+		tx.discardAll()
+	}
+
+	tx.unpinAll()
+	tx.j.mu.Unlock()
+	return err
+}
+
+// commit does the actual work of `Commit`.
+func (tx *Transaction) commit() error {
+	j := tx.j
+
+	// ordered mode: data reaches the device before the metadata referring to it
+	for _, b := range tx.inPlace {
+		b.Lock()
+		err := j.bc.Write(b)
+		b.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if len(tx.inPlace) != 0 {
+		if err := j.dev.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(tx.logged) == 0 {
+		return nil
+	}
+
+	count := uint32(len(tx.logged))
+	if j.head+count+2 > j.size {
+		if err := j.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	// descriptor
+	var descriptor [BlockSize]uint8
+	binary.LittleEndian.PutUint32(descriptor[0:], journalMagicDescriptor)
+	binary.LittleEndian.PutUint32(descriptor[4:], j.sequence)
+	binary.LittleEndian.PutUint32(descriptor[8:], count)
+	for i, b := range tx.logged {
+		binary.LittleEndian.PutUint32(descriptor[12+4*i:], b.number)
+	}
+	if err := j.dev.WriteBlock(j.start+j.head, descriptor[:]); err != nil {
+		return err
+	}
+
+	// logged copies of the blocks
+	sum := crc32.NewIEEE()
+	sum.Write(descriptor[:])
+	for i, b := range tx.logged {
+		b.Lock()
+		sum.Write(b.Data[:])
+		err := j.dev.WriteBlock(j.start+j.head+1+uint32(i), b.Data[:])
+		b.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// everything must be on the device before the commit block is
+	if err := j.dev.Flush(); err != nil {
+		return err
+	}
+
+	var commit [BlockSize]uint8
+	binary.LittleEndian.PutUint32(commit[0:], journalMagicCommit)
+	binary.LittleEndian.PutUint32(commit[4:], j.sequence)
+	binary.LittleEndian.PutUint32(commit[8:], sum.Sum32())
+	if err := j.dev.WriteBlock(j.start+j.head+1+count, commit[:]); err != nil {
+		return err
+	}
+	if err := j.dev.Flush(); err != nil {
+		return err
+	}
+
+	// committed, the blocks may now go home whenever
+	for _, b := range tx.logged {
+		j.bc.MarkDirty(b)
+	}
+
+	j.head += count + 2
+	j.sequence++
+	return nil
+}
+
+// Abort throws away every modification made in the transaction.
+func (tx *Transaction) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+
+	tx.discardAll()
+	tx.unpinAll()
+	tx.j.mu.Unlock()
+}
+
+// discardAll drops the cached copies of every block in the transaction.
+//   The device holds the last committed contents, so they are read again the
+// next time they are needed.
+func (tx *Transaction) discardAll() {
+	for _, b := range tx.logged {
+		tx.j.bc.discard(b)
+	}
+	for _, b := range tx.inPlace {
+		tx.j.bc.discard(b)
+	}
+}
+
+// unpinAll releases the pins the transaction holds.
+func (tx *Transaction) unpinAll() {
+	for _, b := range tx.logged {
+		tx.j.bc.Unpin(b)
+	}
+	for _, b := range tx.inPlace {
+		tx.j.bc.Unpin(b)
+	}
+}
@@ -0,0 +1,134 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+const (
+	journalTestStart = 1  // first block of the log area
+	journalTestSize  = 16 // blocks in the log area
+	journalTestHome  = 64 // first home location the workload writes
+	journalTestCount = 4  // blocks the workload writes
+)
+
+// journalTestWrite fills blocks `journalTestHome` onwards with `fill` in a
+// single transaction, and checkpoints it if `checkpoint` is set.
+func journalTestWrite(j *Journal, fill uint8, data, checkpoint bool) error {
+	tx := j.Begin()
+	for i := uint32(0); i < journalTestCount; i++ {
+		b, err := tx.Get(journalTestHome+i, data)
+		if err != nil {
+			tx.Abort()
+			return err
+		}
+		for k := range b.Data {
+			b.Data[k] = fill
+		}
+		j.bc.Release(b)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if checkpoint {
+		return j.Checkpoint()
+	}
+	return nil
+}
+
+// journalTestState returns the byte every home block of the workload is
+// filled with, or an error if they are not all filled with the same one.
+func journalTestState(dev BlockDevice) (uint8, error) {
+	var block [BlockSize]uint8
+	fill := -1
+	for i := uint32(0); i < journalTestCount; i++ {
+		if err := dev.ReadBlock(journalTestHome+i, block[:]); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(block[:], bytes.Repeat(block[:1], BlockSize)) {
+			return 0, fmt.Errorf("block %d is torn", journalTestHome+i)
+		}
+		if fill == -1 {
+			fill = int(block[0])
+		} else if int(block[0]) != fill {
+			return 0, fmt.Errorf("block %d holds %#x, block %d %#x",
+				journalTestHome, fill, journalTestHome+i, block[0])
+		}
+	}
+	return uint8(fill), nil
+}
+
+// TestJournalCrash cuts the power at every write a transaction makes, and
+// checks that replaying the journal gives either the state before the
+// transaction or the state after it.
+func TestJournalCrash(t *testing.T) {
+	const old, new = 0xAA, 0x55
+
+	for _, tc := range []struct {
+		name string
+		mode JournalMode
+		data bool
+	}{
+		{"metadata", JournalMetadata, false},
+		{"data", JournalData, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// setup returns a disk holding the old state, its journal
+			// checkpointed
+			setup := func() (*CrashDisk, *Journal) {
+				disk := NewCrashDisk(NewMemDisk(128))
+				j, _, err := OpenJournal(NewBufferCache(32), disk, journalTestStart, journalTestSize, tc.mode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := journalTestWrite(j, old, tc.data, true); err != nil {
+					t.Fatal(err)
+				}
+				return disk, j
+			}
+
+			// count the writes of the workload
+			disk, j := setup()
+			before := disk.Writes()
+			if err := journalTestWrite(j, new, tc.data, true); err != nil {
+				t.Fatal(err)
+			}
+			writes := disk.Writes() - before
+			if writes == 0 {
+				t.Fatal("the workload did not write")
+			}
+
+			sawOld, sawNew := false, false
+			for n := uint64(1); n <= writes+1; n++ {
+				disk, j := setup()
+				disk.CrashAt(n)
+				err := journalTestWrite(j, new, tc.data, true)
+				if n <= writes && (err == nil || !disk.Crashed()) {
+					t.Fatalf("crash at write %d: power not cut (%v)", n, err)
+				}
+
+				disk.Restore()
+				if _, _, err := OpenJournal(NewBufferCache(32), disk, journalTestStart, journalTestSize, tc.mode); err != nil {
+					t.Fatalf("crash at write %d: replay: %v", n, err)
+				}
+				fill, err := journalTestState(disk)
+				if err != nil {
+					t.Fatalf("crash at write %d: %v", n, err)
+				}
+				switch fill {
+				case old:
+					sawOld = true
+				case new:
+					sawNew = true
+				default:
+					t.Fatalf("crash at write %d: blocks hold %#x", n, fill)
+				}
+			}
+
+			if !sawOld || !sawNew {
+				t.Errorf("the crashes never gave the old state (%v) or the new state (%v)", sawOld, sawNew)
+			}
+		})
+	}
+}
@@ -2,15 +2,18 @@ package system
 
 import (
 	"encoding/binary"
-	"gotos/cpu"
 	"os"
 )
 
 // Load loads a raw binary from file `fname` and places it at `addr` in system
 // memory, and creates a process with `pc`, `sp`, `pid`, and a pointer to a page
 // table `ptableAddr`.
+//   The stack below `sp` is set up like the one of a spawned process, with the
+// file name as the only argument and an empty environment.
+//   The new process is returned so that the caller can set up its files before
+// the system is started.
 //   `addr` has to be aligned on an INSTRUCTION_WIDTH byte boundary (4 bytes).
-func (s *System) Load(fname string, pc, sp, pid, addr, ptableAddr uint32) {
+func (s *System) Load(fname string, pc, sp, pid, addr, ptableAddr uint32) *PCB {
 	f, err := os.Open(fname)
 	if err != nil {
 		panic(err)
@@ -21,12 +24,18 @@ func (s *System) Load(fname string, pc, sp, pid, addr, ptableAddr uint32) {
 	binary.Read(f, binary.BigEndian, &program)
 	f.Close()
 
-	err, _ = s.memory.WriteRaw(addr, program)
+	err, _ = s.memory.WriteRaw(uint64(addr), program)
 	pcb := PCB{
 		PC:     pc,
 		PID:    pid,
-		PTable: ptableAddr,
+		PTable: uint64(ptableAddr),
+		cwd:    "/",
+	}
+	s.reservePID(pid)
+
+	if err := s.initStack(&pcb, sp, []string{fname}, nil); err != nil {
+		panic(err)
 	}
-	pcb.IReg[cpu.Reg_SP] = sp
 	s.Scheduler.Push(&pcb)
+	return &pcb
 }
@@ -0,0 +1,36 @@
+// This file contains the memory map of the system.
+//   RAM starts at 0 and goes up to the devices, which are mapped in an MMIO
+// region from `clintBase`. RAM that doesn't fit below the devices continues
+// at 4 GiB, where only page tables can reach it, through the high bits of
+// PPN[1]; the rest of the 16 GiB physical address space is a hole.
+
+package system
+
+import "gotos/cpu"
+
+const (
+	mmioBase    = clintBase   // the first address of the MMIO region, below which RAM may be
+	mmioEnd     = 0x40000000  // the first address above the MMIO region
+	highRAMBase = 0x100000000 // where RAM that doesn't fit below the devices goes
+)
+
+// maxMemorySize is the most RAM the memory map has room for.
+const maxMemorySize = mmioBase + cpu.PhysicalAddressLimit - highRAMBase
+
+// memoryMap returns the memory map of a system with `size` bytes of RAM.
+func memoryMap(size uint64) []cpu.Region {
+	low := size
+	if low > mmioBase {
+		low = mmioBase
+	}
+
+	regions := []cpu.Region{
+		{Base: 0, Size: low, Kind: cpu.RegionRAM},
+		{Base: mmioBase, Size: mmioEnd - mmioBase, Kind: cpu.RegionMMIO},
+		{Base: mmioEnd, Size: highRAMBase - mmioEnd, Kind: cpu.RegionHole},
+	}
+	if high := size - low; high > 0 {
+		regions = append(regions, cpu.Region{Base: highRAMBase, Size: high, Kind: cpu.RegionRAM})
+	}
+	return regions
+}
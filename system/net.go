@@ -0,0 +1,405 @@
+// This file contains a minimal IPv4 stack on top of the NIC driver.
+//   It speaks just enough of Ethernet, ARP, IPv4 and ICMP to exchange UDP
+// datagrams with other systems on the same switch and to answer pings.
+//   There is no routing: every address is expected to be on the local link,
+// and is resolved with ARP. Packets waiting for an answer are kept in a small
+// queue per address and sent once the answer arrives.
+//   Fragments are dropped, and packets are always sent with the "don't
+// fragment" flag, so a datagram has to fit in a single frame.
+//   Packets to the address of the system itself, or to 127.0.0.0/8, never
+// reach the NIC and are handed straight back to the stack.
+
+package system
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// ipAddr is an IPv4 address in network order.
+type ipAddr [4]uint8
+
+// macAddr is an Ethernet address.
+type macAddr [6]uint8
+
+var (
+	broadcastIP  = ipAddr{255, 255, 255, 255}
+	broadcastMAC = macAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	loopbackIP   = ipAddr{127, 0, 0, 1}
+)
+
+// Ethernet types of the frames the stack understands.
+const (
+	etherTypeIPv4 uint16 = 0x0800
+	etherTypeARP  uint16 = 0x0806
+)
+
+// IP protocol numbers of the protocols the stack understands.
+const (
+	ipProtoICMP uint8 = 1
+	ipProtoUDP  uint8 = 17
+)
+
+// Sizes of the headers, without options.
+const (
+	etherHeaderSize = 14
+	arpPacketSize   = 28
+	ipHeaderSize    = 20
+	icmpHeaderSize  = 8
+	udpHeaderSize   = 8
+)
+
+// Fields of the headers.
+const (
+	ipTTL        = 64     // time to live of sent packets
+	ipFlagDF     = 0x4000 // don't fragment
+	ipFlagMF     = 0x2000 // more fragments
+	ipFragOffset = 0x1FFF // offset of a fragment
+
+	arpRequest = 1
+	arpReply   = 2
+
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+)
+
+const (
+	arpQueueSize = 8 // packets kept per address while it is being resolved
+
+	// maxIPPayload is the most an IP packet can carry in a single frame.
+	maxIPPayload = 1500 - ipHeaderSize
+)
+
+type netStack struct {
+	s *System
+
+	mu       sync.Mutex
+	ip       ipAddr                   // address of the system
+	arp      map[ipAddr]macAddr       // resolved addresses
+	waiting  map[ipAddr][][]uint8     // IP packets waiting for their address to be resolved
+	ipID     uint16                   // identification of the next packet
+	ports    map[uint16]*udpSocket    // bound sockets by port
+	nextPort uint16                   // next ephemeral port to try
+	pings    map[uint16]chan struct{} // echo requests sent by `Ping`, by identifier
+	pingID   uint16                   // identifier of the next one
+}
+
+// init prepares the stack of `s`, without an address.
+func (n *netStack) init(s *System) {
+	n.s = s
+	n.arp = map[ipAddr]macAddr{}
+	n.waiting = map[ipAddr][][]uint8{}
+	n.ports = map[uint16]*udpSocket{}
+	n.pings = map[uint16]chan struct{}{}
+	n.nextPort = ephemeralFirst
+}
+
+// SetIPAddress gives the system the IPv4 address `ip`.
+//
+//	It should be called before the system is started.
+func (s *System) SetIPAddress(ip [4]uint8) {
+	s.net.mu.Lock()
+	s.net.ip = ip
+	s.net.mu.Unlock()
+}
+
+// address returns the address of the system.
+func (n *netStack) address() ipAddr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ip
+}
+
+// isLocal reports whether packets to `ip` stay inside the system.
+func (n *netStack) isLocal(ip ipAddr) bool {
+	return ip[0] == 127 || ip != (ipAddr{}) && ip == n.address()
+}
+
+// checksum computes the Internet checksum of `parts` taken as one sequence of
+// bytes.
+func checksum(parts ...[]uint8) uint16 {
+	var data []uint8
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+	if len(data)%2 != 0 {
+		data = append(data, 0)
+	}
+
+	var sum uint32
+	for i := 0; i < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+//
+// Ethernet
+//
+
+// input handles the Ethernet frame `frame` received by the NIC.
+func (n *netStack) input(frame []uint8) {
+	if len(frame) < etherHeaderSize || n.s.nic == nil {
+		return
+	}
+
+	var dst macAddr
+	copy(dst[:], frame[0:6])
+	if dst != n.s.nic.mac && dst != broadcastMAC {
+		return
+	}
+
+	payload := frame[etherHeaderSize:]
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case etherTypeARP:
+		n.arpInput(payload)
+	case etherTypeIPv4:
+		n.ipInput(payload)
+	}
+}
+
+// output sends `payload` of the Ethernet type `etherType` to `dst`.
+func (n *netStack) output(dst macAddr, etherType uint16, payload []uint8) error {
+	dev := n.s.nic
+	if dev == nil {
+		return ENETDOWN
+	}
+
+	frame := make([]uint8, etherHeaderSize+len(payload))
+	copy(frame[0:6], dst[:])
+	copy(frame[6:12], dev.mac[:])
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	copy(frame[etherHeaderSize:], payload)
+	return dev.transmit(frame)
+}
+
+//
+// ARP
+//
+
+// arpInput handles the ARP packet `p`.
+//
+//	The address of the sender of any packet meant for the system is learned,
+//
+// and requests are answered.
+func (n *netStack) arpInput(p []uint8) {
+	if len(p) < arpPacketSize {
+		return
+	}
+	if binary.BigEndian.Uint16(p[0:]) != 1 || binary.BigEndian.Uint16(p[2:]) != etherTypeIPv4 || p[4] != 6 || p[5] != 4 {
+		return
+	}
+
+	var sha macAddr
+	var spa, tpa ipAddr
+	copy(sha[:], p[8:14])
+	copy(spa[:], p[14:18])
+	copy(tpa[:], p[24:28])
+
+	n.mu.Lock()
+	if tpa != n.ip || n.ip == (ipAddr{}) {
+		n.mu.Unlock()
+		return
+	}
+	n.arp[spa] = sha
+	waiting := n.waiting[spa]
+	delete(n.waiting, spa)
+	n.mu.Unlock()
+
+	if binary.BigEndian.Uint16(p[6:]) == arpRequest {
+		n.arpSend(arpReply, sha, spa)
+	}
+	for _, packet := range waiting {
+		n.output(sha, etherTypeIPv4, packet)
+	}
+}
+
+// arpSend sends an ARP packet with the operation `op` to `tha` and `tpa`.
+func (n *netStack) arpSend(op uint16, tha macAddr, tpa ipAddr) error {
+	if n.s.nic == nil {
+		return ENETDOWN
+	}
+	spa := n.address()
+
+	p := make([]uint8, arpPacketSize)
+	binary.BigEndian.PutUint16(p[0:], 1) // Ethernet
+	binary.BigEndian.PutUint16(p[2:], etherTypeIPv4)
+	p[4], p[5] = 6, 4
+	binary.BigEndian.PutUint16(p[6:], op)
+	copy(p[8:14], n.s.nic.mac[:])
+	copy(p[14:18], spa[:])
+	copy(p[18:24], tha[:])
+	copy(p[24:28], tpa[:])
+
+	dst := tha
+	if op == arpRequest {
+		dst = broadcastMAC
+	}
+	return n.output(dst, etherTypeARP, p)
+}
+
+//
+// IPv4
+//
+
+// ipInput handles the IP packet `p`.
+func (n *netStack) ipInput(p []uint8) {
+	if len(p) < ipHeaderSize || p[0]>>4 != 4 {
+		return
+	}
+	hdrLen := int(p[0]&0xF) * 4
+	total := int(binary.BigEndian.Uint16(p[2:]))
+	if hdrLen < ipHeaderSize || total < hdrLen || total > len(p) || checksum(p[:hdrLen]) != 0 {
+		return
+	}
+	if binary.BigEndian.Uint16(p[6:])&(ipFlagMF|ipFragOffset) != 0 {
+		return // fragments are not reassembled
+	}
+
+	var src, dst ipAddr
+	copy(src[:], p[12:16])
+	copy(dst[:], p[16:20])
+	if dst != broadcastIP && !n.isLocal(dst) {
+		return
+	}
+
+	payload := p[hdrLen:total]
+	switch p[9] {
+	case ipProtoICMP:
+		n.icmpInput(src, payload)
+	case ipProtoUDP:
+		n.udpInput(src, dst, payload)
+	}
+}
+
+// ipOutput sends `payload` of the protocol `proto` from `src` to `dst`.
+//
+//	A packet to an address that has not been resolved yet waits for the
+//
+// answer to an ARP request, and is dropped if too many are waiting already.
+func (n *netStack) ipOutput(src, dst ipAddr, proto uint8, payload []uint8) error {
+	if len(payload) > maxIPPayload {
+		return EMSGSIZE
+	}
+
+	n.mu.Lock()
+	id := n.ipID
+	n.ipID++
+	n.mu.Unlock()
+
+	p := make([]uint8, ipHeaderSize+len(payload))
+	p[0] = 4<<4 | ipHeaderSize/4
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	binary.BigEndian.PutUint16(p[4:], id)
+	binary.BigEndian.PutUint16(p[6:], ipFlagDF)
+	p[8] = ipTTL
+	p[9] = proto
+	copy(p[12:16], src[:])
+	copy(p[16:20], dst[:])
+	binary.BigEndian.PutUint16(p[10:], checksum(p[:ipHeaderSize]))
+	copy(p[ipHeaderSize:], payload)
+
+	if n.isLocal(dst) {
+		n.ipInput(p)
+		return nil
+	}
+	if dst == broadcastIP {
+		return n.output(broadcastMAC, etherTypeIPv4, p)
+	}
+
+	n.mu.Lock()
+	mac, ok := n.arp[dst]
+	if !ok {
+		if len(n.waiting[dst]) >= arpQueueSize {
+			n.mu.Unlock()
+			return ENOBUFS
+		}
+		n.waiting[dst] = append(n.waiting[dst], p)
+	}
+	n.mu.Unlock()
+
+	if !ok {
+		return n.arpSend(arpRequest, macAddr{}, dst)
+	}
+	return n.output(mac, etherTypeIPv4, p)
+}
+
+//
+// ICMP
+//
+
+// icmpInput handles the ICMP message `p` from `src` by answering echo
+// requests, and by passing echo replies on to `Ping`.
+func (n *netStack) icmpInput(src ipAddr, p []uint8) {
+	if len(p) < icmpHeaderSize || checksum(p) != 0 {
+		return
+	}
+	if p[0] == icmpEchoReply {
+		n.mu.Lock()
+		if reply, ok := n.pings[binary.BigEndian.Uint16(p[4:])]; ok {
+			close(reply)
+			delete(n.pings, binary.BigEndian.Uint16(p[4:]))
+		}
+		n.mu.Unlock()
+		return
+	}
+	if p[0] != icmpEchoRequest {
+		return
+	}
+
+	reply := append([]uint8(nil), p...)
+	reply[0] = icmpEchoReply
+	binary.BigEndian.PutUint16(reply[2:], 0)
+	binary.BigEndian.PutUint16(reply[2:], checksum(reply))
+
+	from := n.address()
+	if src[0] == 127 {
+		from = loopbackIP
+	}
+	n.ipOutput(from, src, ipProtoICMP, reply)
+}
+
+// Ping sends an echo request to `ip` and waits up to `timeout` for the reply.
+//
+//	It is for the host, to check that a system can be reached; the interrupt
+//
+// handler of the NIC only passes the reply on while the system is running.
+func (s *System) Ping(ip [4]uint8, timeout time.Duration) error {
+	n := &s.net
+	reply := make(chan struct{})
+	n.mu.Lock()
+	id := n.pingID
+	n.pingID++
+	n.pings[id] = reply
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pings, id)
+		n.mu.Unlock()
+	}()
+
+	req := make([]uint8, icmpHeaderSize)
+	req[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(req[4:], id)
+	binary.BigEndian.PutUint16(req[2:], checksum(req))
+
+	from := n.address()
+	if ip[0] == 127 {
+		from = loopbackIP
+	}
+	if err := n.ipOutput(from, ip, ipProtoICMP, req); err != nil {
+		return err
+	}
+
+	select {
+	case <-reply:
+		return nil
+	case <-time.After(timeout):
+		return ETIMEDOUT
+	}
+}
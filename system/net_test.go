@@ -0,0 +1,247 @@
+package system
+
+import (
+	"encoding/binary"
+	"gotos/cpu"
+	"gotos/devices"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// netTestTimeout is how long the tests wait for an answer from the other
+// system.
+const netTestTimeout = 5 * time.Second
+
+// Registers used by the echo server.
+const (
+	rZero = 0
+	rSP   = 2
+	rT0   = 5
+	rS0   = 8
+	rA0   = 10
+	rA1   = 11
+	rA2   = 12
+	rA3   = 13
+	rA4   = 14
+	rA5   = 15
+	rA6   = 16
+)
+
+// rvI encodes an I-type instruction.
+func rvI(opcode, funct3, rd, rs1 uint32, imm int32) uint32 {
+	return uint32(imm)<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+// rvS encodes an S-type instruction.
+func rvS(funct3, rs1, rs2 uint32, imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>5&0x7F)<<25 | rs2<<20 | rs1<<15 | funct3<<12 | (u&0x1F)<<7 | 0x23
+}
+
+// rvB encodes a B-type instruction.
+func rvB(funct3, rs1, rs2 uint32, imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>12&1)<<31 | (u>>5&0x3F)<<25 | rs2<<20 | rs1<<15 | funct3<<12 |
+		(u>>1&0xF)<<8 | (u>>11&1)<<7 | 0x63
+}
+
+// rvJ encodes a JAL.
+func rvJ(rd uint32, imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>20&1)<<31 | (u>>1&0x3FF)<<21 | (u>>11&1)<<20 | (u>>12&0xFF)<<12 | rd<<7 | 0x6F
+}
+
+func addi(rd, rs1 uint32, imm int32) uint32 { return rvI(0x13, 0, rd, rs1, imm) }
+func sh(rs2, rs1 uint32, imm int32) uint32  { return rvS(1, rs1, rs2, imm) }
+func sw(rs2, rs1 uint32, imm int32) uint32  { return rvS(2, rs1, rs2, imm) }
+
+const ecall = 0x00000073
+
+// Numbers of the socket syscalls, see syscall.go.
+const (
+	testSysSocket   = 26
+	testSysBind     = 27
+	testSysSendto   = 28
+	testSysRecvfrom = 29
+)
+
+// echoServer returns a program that binds a UDP socket to `port` and sends
+// every datagram it receives back to where it came from, forever. The socket
+// address is kept at sp, the length of the sender's address at sp+16, the
+// datagram at sp+32, and the sender's address at sp+96.
+func echoServer(port uint16) []uint8 {
+	var sockPort [2]uint8
+	binary.BigEndian.PutUint16(sockPort[:], port)
+
+	code := []uint32{
+		addi(rSP, rSP, -128),
+
+		addi(rA0, rZero, testSysSocket),
+		addi(rA1, rZero, int32(AF_INET)),
+		addi(rA2, rZero, int32(SOCK_DGRAM)),
+		addi(rA3, rZero, 0),
+		ecall,
+		addi(rS0, rA0, 0),
+
+		addi(rT0, rZero, int32(AF_INET)),
+		sh(rT0, rSP, 0),
+		addi(rT0, rZero, int32(binary.LittleEndian.Uint16(sockPort[:]))),
+		sh(rT0, rSP, 2),
+		sw(rZero, rSP, 4),
+		sw(rZero, rSP, 8),
+		sw(rZero, rSP, 12),
+		addi(rA0, rZero, testSysBind),
+		addi(rA1, rS0, 0),
+		addi(rA2, rSP, 0),
+		addi(rA3, rZero, sockaddrSize),
+		ecall,
+
+		// loop:
+		addi(rT0, rZero, sockaddrSize),
+		sw(rT0, rSP, 16),
+		addi(rA0, rZero, testSysRecvfrom),
+		addi(rA1, rS0, 0),
+		addi(rA2, rSP, 32),
+		addi(rA3, rZero, 64),
+		addi(rA4, rZero, 0),
+		addi(rA5, rSP, 96),
+		addi(rA6, rSP, 16),
+		ecall,
+		rvB(4, rA0, rZero, -40), // blt a0, zero, loop
+
+		addi(rA3, rA0, 0),
+		addi(rA0, rZero, testSysSendto),
+		addi(rA1, rS0, 0),
+		addi(rA2, rSP, 32),
+		addi(rA4, rZero, 0),
+		addi(rA5, rSP, 96),
+		addi(rA6, rZero, sockaddrSize),
+		ecall,
+		rvJ(rZero, -76), // j loop
+	}
+
+	program := make([]uint8, 4*len(code))
+	for i, inst := range code {
+		binary.LittleEndian.PutUint32(program[4*i:], inst)
+	}
+	return program
+}
+
+// netTestSystem creates a system with the address `ip` on `sw` that runs an
+// echo server on port 7.
+func netTestSystem(t *testing.T, sw *devices.Switch, ip [4]uint8) *System {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "echo"), echoServer(7), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewHostFS(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSystem(1, cpu.DefaultConfig())
+	s.Scheduler = &FIFO{}
+	s.Mount("/", fs)
+	if err := s.AttachNIC(sw, [6]uint8{0x02, 0, 0, 0, 0, ip[3]}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetIPAddress(ip)
+	if _, err := s.Spawn("/echo", []string{"echo"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// netTestEcho sends `data` from a socket of `s` to port 7 of `to`, and checks
+// that the echo server there sends it back.
+func netTestEcho(t *testing.T, s *System, to [4]uint8, data string) {
+	u := s.newUDPSocket()
+	defer u.Close()
+	if err := u.sendTo(sockAddr{ip: to, port: 7}, []uint8(data)); err != nil {
+		t.Fatalf("sending to %v: %v", to, err)
+	}
+
+	deadline := time.Now().Add(netTestTimeout)
+	for {
+		d, err := u.recvFrom()
+		if err == nil {
+			if string(d.data) != data || d.from != (sockAddr{ip: to, port: 7}) {
+				t.Errorf("got %q from %v, want %q from %v:7", d.data, d.from, data, to)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no echo from %v", to)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestNetTwoSystems connects two systems to one switch and checks that
+// datagrams go both ways and that they answer pings.
+func TestNetTwoSystems(t *testing.T) {
+	sw := devices.NewSwitch(devices.LinkConfig{})
+	defer sw.Close()
+
+	ipA := [4]uint8{10, 0, 0, 1}
+	ipB := [4]uint8{10, 0, 0, 2}
+	a := netTestSystem(t, sw, ipA)
+	b := netTestSystem(t, sw, ipB)
+	a.Start()
+	defer a.Stop()
+	b.Start()
+	defer b.Stop()
+
+	netTestEcho(t, a, ipB, "from a to b")
+	netTestEcho(t, b, ipA, "from b to a")
+
+	if err := a.Ping(ipB, netTestTimeout); err != nil {
+		t.Errorf("pinging b from a: %v", err)
+	}
+	if err := b.Ping(ipA, netTestTimeout); err != nil {
+		t.Errorf("pinging a from b: %v", err)
+	}
+	if err := a.Ping([4]uint8{10, 0, 0, 3}, 100*time.Millisecond); err != ETIMEDOUT {
+		t.Errorf("pinging nobody: %v, want %v", err, ETIMEDOUT)
+	}
+}
+
+// TestNICDeterministicMode checks that a NIC can't be attached in the
+// deterministic mode.
+func TestNICDeterministicMode(t *testing.T) {
+	sw := devices.NewSwitch(devices.LinkConfig{})
+	defer sw.Close()
+
+	s := NewSystem(1, cpu.DefaultConfig())
+	s.UseDeterministicMode(1000, 0)
+	if err := s.AttachNIC(sw, [6]uint8{0x02, 0, 0, 0, 0, 1}); err != ErrDeterministicNIC {
+		t.Errorf("attaching a NIC: %v, want %v", err, ErrDeterministicNIC)
+	}
+}
+
+// TestUDPRequeue checks that a datagram put back after a failed receive is
+// the next one received.
+func TestUDPRequeue(t *testing.T) {
+	s := NewSystem(1, cpu.DefaultConfig())
+	u := s.newUDPSocket()
+	if err := u.bind(7); err != nil {
+		t.Fatal(err)
+	}
+	u.deliver(datagram{data: []uint8("first")})
+	u.deliver(datagram{data: []uint8("second")})
+
+	d, err := u.recvFrom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.requeue(d)
+
+	for _, want := range []string{"first", "second"} {
+		d, err := u.recvFrom()
+		if err != nil || string(d.data) != want {
+			t.Errorf("got %q, %v, want %q", d.data, err, want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// This file contains the driver for the NIC from the `devices` package.
+//   The driver keeps the rings and the frame buffers in frames of its own,
+// with a fixed buffer for every descriptor. Frames are sent by copying them
+// into the buffer of the next transmit descriptor; received frames are
+// collected by the interrupt handler and passed on to the network stack.
+
+package system
+
+import (
+	"encoding/binary"
+	"errors"
+	"gotos/devices"
+	"sync"
+)
+
+// ErrDeterministicNIC is returned when a NIC is attached in the deterministic
+// mode, see deterministic.go.
+var ErrDeterministicNIC = errors.New("a system with a NIC can't run in the deterministic mode")
+
+// nicBase is the physical address the NIC is mapped at.
+const nicBase = 0x10001000
+
+// Sizes of the rings and buffers of the driver.
+//   Two buffers fit in a page, and both rings fit in a single page.
+const (
+	nicRingSize   = 16   // descriptors per ring
+	nicBufferSize = 2048 // bytes per buffer, enough for any frame
+)
+
+type netDevice struct {
+	s    *System
+	base uint64
+	mac  [6]uint8
+
+	txLock sync.Mutex // serializes senders
+	txRing uint32     // physical address of the transmit ring
+	txBufs []uint32   // physical address of the buffer of each transmit descriptor
+	txTail uint32
+
+	mu     sync.Mutex
+	rxRing uint32   // physical address of the receive ring
+	rxBufs []uint32 // physical address of the buffer of each receive descriptor
+	rxNext uint32   // next descriptor the NIC fills
+	rxTail uint32
+}
+
+// AttachNIC creates a NIC with the MAC address `mac`, maps it, and connects it
+// to `sw`.
+//   It must be called before the system is started.
+//   Frames arrive by the clock of the host, so it returns
+// `ErrDeterministicNIC` in the deterministic mode.
+func (s *System) AttachNIC(sw *devices.Switch, mac [6]uint8) error {
+	if s.det != nil {
+		return ErrDeterministicNIC
+	}
+	nic := devices.NewNIC(&s.memory, mac, s.plic.Source(irqNIC))
+	if err := s.memory.Map(nicBase, devices.NICSize, nic); err != nil {
+		return err
+	}
+
+	dev := &netDevice{s: s, base: nicBase, mac: mac}
+	if err := dev.allocate(); err != nil {
+		s.memory.Unmap(nicBase)
+		return err
+	}
+
+	dev.set(devices.NIC_CTRL, 0)
+	dev.set(devices.NIC_TX_BASE, dev.txRing)
+	dev.set(devices.NIC_TX_SIZE, nicRingSize)
+	dev.set(devices.NIC_RX_BASE, dev.rxRing)
+	dev.set(devices.NIC_RX_SIZE, nicRingSize)
+
+	// hand every receive descriptor but one to the NIC
+	for dev.rxTail = 0; dev.rxTail < nicRingSize-1; dev.rxTail++ {
+		dev.arm(dev.rxTail)
+	}
+	dev.set(devices.NIC_RX_TAIL, dev.rxTail)
+
+	dev.set(devices.NIC_IE, devices.NIC_INT_RX)
+	dev.set(devices.NIC_CTRL, devices.NIC_CTRL_ENABLE)
+	s.handleIRQ(irqNIC, dev.interrupt)
+
+	sw.Connect(nic)
+	s.nic = dev
+	return nil
+}
+
+// allocate takes the frames for the rings and buffers, below 4 GiB where the
+// NIC can reach them.
+func (dev *netDevice) allocate() error {
+	var frames []uint64
+	alloc := func() (uint32, error) {
+		frame, ok := dev.s.frames.allocLow(&dev.s.memory)
+		if !ok {
+			dev.s.frames.release(frames)
+			return 0, ENOMEM
+		}
+		frames = append(frames, frame)
+		return uint32(frame), nil
+	}
+
+	rings, err := alloc()
+	if err != nil {
+		return err
+	}
+	dev.txRing = rings
+	dev.rxRing = rings + nicRingSize*devices.NICDescSize
+
+	for _, bufs := range []*[]uint32{&dev.txBufs, &dev.rxBufs} {
+		for len(*bufs) < nicRingSize {
+			frame, err := alloc()
+			if err != nil {
+				return err
+			}
+			for at := frame; at < frame+pageSize; at += nicBufferSize {
+				*bufs = append(*bufs, at)
+			}
+		}
+	}
+	return nil
+}
+
+// get reads the NIC register `reg`.
+func (dev *netDevice) get(reg uint32) uint32 {
+	_, v := dev.s.memory.ReadIO(dev.base+uint64(reg), 4)
+	return uint32(v)
+}
+
+// set writes `v` to the NIC register `reg`.
+func (dev *netDevice) set(reg, v uint32) {
+	dev.s.memory.WriteIO(dev.base+uint64(reg), 4, uint64(v))
+}
+
+// writeDescriptor fills in descriptor `i` of the ring at `ring`.
+func (dev *netDevice) writeDescriptor(ring, i, addr uint32, length uint16) {
+	var desc [devices.NICDescSize]uint8
+	binary.LittleEndian.PutUint32(desc[devices.NICDescAddr:], addr)
+	binary.LittleEndian.PutUint16(desc[devices.NICDescLen:], length)
+	dev.s.memory.WriteRaw(uint64(ring+i*devices.NICDescSize), desc[:])
+}
+
+// arm prepares receive descriptor `i` to be handed to the NIC.
+func (dev *netDevice) arm(i uint32) {
+	dev.writeDescriptor(dev.rxRing, i, dev.rxBufs[i], nicBufferSize)
+}
+
+// transmit sends the Ethernet frame `frame`.
+//   Fails with ENOBUFS if every transmit descriptor is in use.
+func (dev *netDevice) transmit(frame []uint8) error {
+	if len(frame) > devices.MaxFrameSize {
+		return EMSGSIZE
+	}
+
+	dev.txLock.Lock()
+	defer dev.txLock.Unlock()
+
+	next := (dev.txTail + 1) % nicRingSize
+	if next == dev.get(devices.NIC_TX_HEAD) {
+		return ENOBUFS
+	}
+
+	dev.s.memory.WriteRaw(uint64(dev.txBufs[dev.txTail]), frame)
+	dev.writeDescriptor(dev.txRing, dev.txTail, dev.txBufs[dev.txTail], uint16(len(frame)))
+	dev.txTail = next
+	dev.set(devices.NIC_TX_TAIL, dev.txTail)
+	return nil
+}
+
+// interrupt handles the interrupts of the NIC by handing the descriptors of
+// received frames back, and the frames to the network stack.
+func (dev *netDevice) interrupt() {
+	dev.set(devices.NIC_IS, dev.get(devices.NIC_IS))
+
+	var frames [][]uint8
+	dev.mu.Lock()
+	for {
+		_, desc := dev.s.memory.ReadRaw(uint64(dev.rxRing+dev.rxNext*devices.NICDescSize), devices.NICDescSize)
+		if binary.LittleEndian.Uint16(desc[devices.NICDescStatus:])&devices.NIC_DESC_DONE == 0 {
+			break
+		}
+
+		length := uint32(binary.LittleEndian.Uint16(desc[devices.NICDescLen:]))
+		if length > 0 {
+			_, frame := dev.s.memory.ReadRaw(uint64(dev.rxBufs[dev.rxNext]), length)
+			frames = append(frames, frame)
+		}
+		dev.rxNext = (dev.rxNext + 1) % nicRingSize
+
+		// the buffer just emptied makes room to hand over one more
+		dev.arm(dev.rxTail)
+		dev.rxTail = (dev.rxTail + 1) % nicRingSize
+	}
+	dev.set(devices.NIC_RX_TAIL, dev.rxTail)
+	dev.mu.Unlock()
+
+	// the stack may answer right away, which needs the transmit side
+	for _, frame := range frames {
+		dev.s.net.input(frame)
+	}
+}
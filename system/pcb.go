@@ -1,9 +1,38 @@
 package system
 
+import "path"
+
 type PCB struct {
 	IReg   [32]uint32
 	FReg   [32]uint64
 	PC     uint32
 	PID    uint32
-	PTable uint32
+	PTable uint64
+
+	files   [maxFiles]*openFile // open files, indexed by file descriptor
+	ignored uint32              // bit n set if signal n is ignored
+	cwd     string              // absolute working directory
+	frames  []uint64            // physical frames owned by the process
+
+	// protected by System.procLock
+	parent    *PCB      // process that spawned this one, nil if none
+	children  []*PCB    // spawned processes that have not been waited for
+	exited    bool      // the process is gone, but its parent has not waited for it
+	status    uint32    // exit status, once exited
+	childExit WaitQueue // woken whenever a child exits
+}
+
+// satp returns the value of the satp CSR that selects the address space of
+// `pcb`.
+func (pcb *PCB) satp() uint32 {
+	return 0x80000000 | uint32(pcb.PTable>>12) | pcb.PID<<22
+}
+
+// abs turns `p` into an absolute path by joining it to the working directory
+// of `pcb`.
+func (pcb *PCB) abs(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join("/", pcb.cwd, p)
 }
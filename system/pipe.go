@@ -0,0 +1,148 @@
+// This file contains pipes, a one-way channel of bytes between processes.
+//   A pipe is a bounded ring buffer with a read end and a write end.
+//   Readers sleep while it is empty and writers sleep while it is full.
+//   When every write end is closed, reading an empty pipe gives end of file,
+// and when every read end is closed, writing gives EPIPE and SIGPIPE.
+
+package system
+
+import "sync"
+
+// pipeSize is the number of bytes a pipe can hold.
+const pipeSize = 4096
+
+type pipe struct {
+	sync.Mutex
+	s *System
+
+	buf   [pipeSize]uint8
+	head  int // index of the first unread byte
+	count int // number of unread bytes
+
+	readers int // number of open read ends
+	writers int // number of open write ends
+
+	readWait  WaitQueue // readers waiting for data
+	writeWait WaitQueue // writers waiting for space
+}
+
+// pipeReader is the read end of a pipe.
+type pipeReader struct {
+	p *pipe
+}
+
+// pipeWriter is the write end of a pipe.
+type pipeWriter struct {
+	p *pipe
+}
+
+// Pipe creates a new pipe and returns its read and write ends.
+func (s *System) Pipe() (File, File) {
+	p := &pipe{s: s, readers: 1, writers: 1}
+	return &pipeReader{p}, &pipeWriter{p}
+}
+
+// Read reads up to len(b) bytes from the pipe.
+//   If the pipe is empty, it either returns end of file or blocks, depending
+// on whether any write end is still open.
+func (r *pipeReader) Read(b []uint8) (int, error) {
+	p := r.p
+	p.Lock()
+	defer p.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if p.count == 0 {
+		if p.writers == 0 {
+			return 0, nil // end of file
+		}
+		return 0, p.readWait.wouldBlock()
+	}
+
+	n := 0
+	for n < len(b) && p.count > 0 {
+		b[n] = p.buf[p.head]
+		p.head = (p.head + 1) % pipeSize
+		p.count--
+		n++
+	}
+
+	p.s.wake(&p.writeWait)
+	return n, nil
+}
+
+// Write can not be used on the read end.
+func (r *pipeReader) Write(b []uint8) (int, error) {
+	return 0, EBADF
+}
+
+// Sync is not supported by pipes.
+func (r *pipeReader) Sync() error {
+	return EINVAL
+}
+
+// Close closes the read end.
+func (r *pipeReader) Close() error {
+	p := r.p
+	p.Lock()
+	defer p.Unlock()
+	p.readers--
+	if p.readers == 0 {
+		p.s.wake(&p.writeWait) // writers must learn that nobody is reading
+	}
+	return nil
+}
+
+// Read can not be used on the write end.
+func (w *pipeWriter) Read(b []uint8) (int, error) {
+	return 0, EBADF
+}
+
+// Write writes as much of `b` as there is room for in the pipe.
+//   If the pipe is full it blocks, and if nobody can read it fails with EPIPE.
+func (w *pipeWriter) Write(b []uint8) (int, error) {
+	p := w.p
+	p.Lock()
+	defer p.Unlock()
+
+	if p.readers == 0 {
+		return 0, EPIPE
+	}
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if p.count == pipeSize {
+		return 0, p.writeWait.wouldBlock()
+	}
+
+	n := 0
+	for n < len(b) && p.count < pipeSize {
+		p.buf[(p.head+p.count)%pipeSize] = b[n]
+		p.count++
+		n++
+	}
+
+	p.s.wake(&p.readWait)
+	return n, nil
+}
+
+// Sync is not supported by pipes.
+func (w *pipeWriter) Sync() error {
+	return EINVAL
+}
+
+// Close closes the write end.
+func (w *pipeWriter) Close() error {
+	p := w.p
+	p.Lock()
+	defer p.Unlock()
+	p.writers--
+	if p.writers == 0 {
+		p.s.wake(&p.readWait) // readers must see end of file
+	}
+	return nil
+}
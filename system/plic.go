@@ -0,0 +1,63 @@
+// This file contains the driver for the PLIC from the `devices` package,
+// through which devices interrupt the cores.
+//   Every core may take any device interrupt: the first core to claim it
+// runs the handler registered for the device, and the others find nothing
+// when they claim.
+
+package system
+
+import (
+	"gotos/cpu"
+	"gotos/devices"
+)
+
+// plicBase is the physical address the PLIC is mapped at.
+const plicBase = 0x0C000000
+
+// Interrupt sources of the devices of the system.
+const (
+	irqUART  uint32 = 10
+	irqNIC   uint32 = 11
+	irqInput uint32 = 12
+)
+
+// attachPLIC creates the PLIC for the cores of the system and maps it.
+func (s *System) attachPLIC() {
+	var outputs []devices.Line
+	for i := range s.cores {
+		outputs = append(outputs, pendingLine{&s.cores[i], cpu.MIP_MEIP})
+	}
+
+	s.plic = devices.NewPLIC(outputs)
+	if err := s.memory.Map(plicBase, devices.PLICSize, s.plic); err != nil {
+		panic(err) // only the CLINT has been mapped, far from here
+	}
+}
+
+// handleIRQ makes `handler` handle the interrupts of source `irq`, and
+// enables the source on every core.
+//   It must be called before the system is started.
+func (s *System) handleIRQ(irq uint32, handler func()) {
+	s.irqHandlers[irq] = handler
+	s.memory.WriteIO(plicBase+uint64(devices.PLIC_PRIORITY+irq*4), 4, 1)
+	for i := range s.cores {
+		addr := plicBase + uint64(devices.PLIC_ENABLE+uint32(i)*devices.PLIC_ENABLE_STRIDE)
+		_, enabled := s.memory.ReadIO(addr, 4)
+		s.memory.WriteIO(addr, 4, enabled|1<<irq)
+	}
+}
+
+// handleDeviceInterrupt claims the interrupt that made the PLIC interrupt
+// `c`, runs its handler, and completes it.
+func (s *System) handleDeviceInterrupt(c *cpu.Core) {
+	claim := plicBase + uint64(devices.PLIC_CLAIM+c.GetCSR(cpu.Csr_MHARTID)*devices.PLIC_CONTEXT_STRIDE)
+	_, irq := s.memory.ReadIO(claim, 4)
+	if irq == 0 {
+		return // another core got to it first
+	}
+
+	if handler := s.irqHandlers[uint32(irq)]; handler != nil {
+		handler()
+	}
+	s.memory.WriteIO(claim, 4, irq)
+}
@@ -0,0 +1,291 @@
+// This file contains the creation and the end of processes.
+//   A process is created from a raw binary in the file system, linked at
+// `userText` like the programs in `c-programs`, and gets its page tables,
+// program, and stack from the frame allocator.
+//   Its stack starts out the way the RISC-V System V ABI describes it, so a
+// program finds its arguments and environment at `sp`:
+//
+//   sp      argc
+//   sp+4    argv[0] ... argv[argc-1], NULL
+//           envp[0] ... NULL
+//           auxv pairs, ending with AT_NULL
+//           the strings argv and envp point to
+//
+//   A process that exits stays around until the process that spawned it waits
+// for it, so that the exit status can be collected.
+
+package system
+
+import (
+	"encoding/binary"
+	"gotos/cpu"
+	"sync/atomic"
+)
+
+// Layout of the address space of a process created by `Spawn`.
+//   Everything lives in the first 4 MiB, so a single second level page table
+// is enough.
+const (
+	userText   = 0x00004000 // where programs are linked
+	stackTop   = 0x00400000 // the stack grows down from here
+	stackPages = 4          // pages of stack
+	heapPages  = 8          // pages after the program, for .bss and the heap
+
+	// maxProgram is the size of the largest program that fits.
+	maxProgram = stackTop - stackPages*pageSize - heapPages*pageSize - userText
+)
+
+// Limits on the arguments and environment of a new process.
+const (
+	maxArgs     = 64       // strings in argv or envp
+	maxArgBytes = pageSize // bytes taken by argc, the vectors, and the strings
+)
+
+// Types of entries in the auxiliary vector.
+const (
+	AT_NULL   uint32 = 0 // end of the vector
+	AT_PAGESZ uint32 = 6 // page size
+	AT_ENTRY  uint32 = 9 // entry point of the program
+)
+
+// newPID returns a process id that has not been used before.
+func (s *System) newPID() uint32 {
+	return atomic.AddUint32(&s.nextPID, 1) - 1
+}
+
+// reservePID makes sure `newPID` never hands out `pid`.
+func (s *System) reservePID(pid uint32) {
+	for {
+		next := atomic.LoadUint32(&s.nextPID)
+		if next > pid || atomic.CompareAndSwapUint32(&s.nextPID, next, pid+1) {
+			return
+		}
+	}
+}
+
+// Spawn creates a process running the program at the absolute path `p` with
+// the arguments `argv` and the environment `envp`, and makes it ready.
+//   The process starts without any open files; the host can hand it some
+// with `PCB.SetFile` before the system is started.
+func (s *System) Spawn(p string, argv, envp []string) (*PCB, error) {
+	return s.spawn(nil, p, argv, envp)
+}
+
+// spawn creates a process as a child of `parent`, which may be nil.
+//   A child starts in the working directory of its parent with copies of all
+// of its file descriptors.
+func (s *System) spawn(parent *PCB, p string, argv, envp []string) (*PCB, error) {
+	program, err := s.readProgram(p)
+	if err != nil {
+		return nil, err
+	}
+
+	pcb := &PCB{
+		PC:  userText,
+		PID: s.newPID(),
+		cwd: "/",
+	}
+
+	if err := s.mapProcess(pcb, program); err != nil {
+		s.frames.release(pcb.frames)
+		return nil, err
+	}
+	if err := s.initStack(pcb, stackTop, argv, envp); err != nil {
+		s.frames.release(pcb.frames)
+		return nil, err
+	}
+
+	if parent != nil {
+		pcb.cwd = parent.cwd
+		pcb.inheritFiles(parent)
+
+		s.procLock.Lock()
+		pcb.parent = parent
+		parent.children = append(parent.children, pcb)
+		s.procLock.Unlock()
+	}
+
+	s.ready(pcb)
+	return pcb, nil
+}
+
+// readProgram reads the whole program at `p`.
+func (s *System) readProgram(p string) ([]uint8, error) {
+	f, err := s.vfs.Open(p, O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var program []uint8
+	buf := make([]uint8, pageSize)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		program = append(program, buf[:n]...)
+		if len(program) > maxProgram {
+			return nil, ENOEXEC
+		}
+	}
+
+	if len(program) == 0 {
+		return nil, ENOEXEC
+	}
+	return program, nil
+}
+
+// mapProcess builds the page tables of `pcb` and fills its memory with
+// `program`.
+//   Every frame taken is recorded in `pcb.frames`, also when it fails.
+func (s *System) mapProcess(pcb *PCB, program []uint8) error {
+	alloc := func() (uint64, error) {
+		frame, ok := s.frames.alloc(&s.memory)
+		if !ok {
+			return 0, ENOMEM
+		}
+		pcb.frames = append(pcb.frames, frame)
+		return frame, nil
+	}
+
+	root, err := alloc()
+	if err != nil {
+		return err
+	}
+	table, err := alloc()
+	if err != nil {
+		return err
+	}
+	pcb.PTable = root
+
+	setPTE := func(at uint64, pte uint32) {
+		var bytes [4]uint8
+		binary.LittleEndian.PutUint32(bytes[:], pte)
+		s.memory.WriteRaw(at, bytes[:])
+	}
+	setPTE(root, ppn(table)<<10|pageFlagValid)
+
+	// the program is a flat binary, so text and data can't be told apart
+	const programFlags = pageFlagUser | pageFlagValid | pageFlagAccessed | pageFlagDirty | pageFlagRead | pageFlagWrite | pageFlagExec
+	const stackFlags = pageFlagUser | pageFlagValid | pageFlagAccessed | pageFlagDirty | pageFlagRead | pageFlagWrite
+
+	pages := (uint32(len(program))+pageSize-1)/pageSize + heapPages
+	for i := uint32(0); i < pages; i++ {
+		frame, err := alloc()
+		if err != nil {
+			return err
+		}
+		if start := i * pageSize; start < uint32(len(program)) {
+			end := start + pageSize
+			if end > uint32(len(program)) {
+				end = uint32(len(program))
+			}
+			s.memory.WriteRaw(frame, program[start:end])
+		}
+		setPTE(table+uint64(userText/pageSize+i)*4, ppn(frame)<<10|programFlags)
+	}
+
+	for i := uint32(1); i <= stackPages; i++ {
+		frame, err := alloc()
+		if err != nil {
+			return err
+		}
+		setPTE(table+uint64(stackTop/pageSize-i)*4, ppn(frame)<<10|stackFlags)
+	}
+
+	return nil
+}
+
+// initStack places `argv` and `envp` on the stack of `pcb`, which must already
+// be mapped, below `top`, and points the stack pointer of `pcb` at `argc`.
+func (s *System) initStack(pcb *PCB, top uint32, argv, envp []string) error {
+	sp, stack, err := buildStack(top, pcb.PC, argv, envp)
+	if err != nil {
+		return err
+	}
+	if !s.writeUser(pcb.satp(), sp, stack) {
+		return EFAULT
+	}
+	pcb.IReg[cpu.Reg_SP] = sp
+	return nil
+}
+
+// buildStack lays out the initial stack of a process whose stack ends at `top`
+// and whose program starts at `entry`.
+//   Returns the stack pointer and everything between it and `top`.
+func buildStack(top, entry uint32, argv, envp []string) (uint32, []uint8, error) {
+	if len(argv) > maxArgs || len(envp) > maxArgs {
+		return 0, nil, E2BIG
+	}
+
+	// the strings go right below the top
+	var strs []uint8
+	for _, str := range argv {
+		strs = append(strs, str...)
+		strs = append(strs, 0)
+	}
+	for _, str := range envp {
+		strs = append(strs, str...)
+		strs = append(strs, 0)
+	}
+	strAddr := top - uint32(len(strs))
+
+	// argc, argv and NULL, envp and NULL, and three auxv pairs
+	vector := make([]uint32, 0, 1+len(argv)+1+len(envp)+1+6)
+	vector = append(vector, uint32(len(argv)))
+	a := strAddr
+	for _, list := range [][]string{argv, envp} {
+		for _, str := range list {
+			vector = append(vector, a)
+			a += uint32(len(str)) + 1
+		}
+		vector = append(vector, 0)
+	}
+	vector = append(vector, AT_PAGESZ, pageSize, AT_ENTRY, entry, AT_NULL, 0)
+
+	// the ABI wants sp aligned on 16 bytes
+	sp := (strAddr - uint32(len(vector))*4) &^ 15
+	if top-sp > maxArgBytes {
+		return 0, nil, E2BIG
+	}
+
+	stack := make([]uint8, top-sp)
+	for i, w := range vector {
+		binary.LittleEndian.PutUint32(stack[i*4:], w)
+	}
+	copy(stack[strAddr-sp:], strs)
+
+	return sp, stack, nil
+}
+
+// terminate ends the process running on `c` with the exit status `status`,
+// releases its resources, and moves on to the next process.
+func (s *System) terminate(c *cpu.Core, status uint32) {
+	pcb := s.current(c)
+	pcb.closeAll()
+	s.running[c.GetCSR(cpu.Csr_MHARTID)] = nil
+
+	// the cache may still hold lines of frames that are about to be reused
+	c.FENCE()
+	s.frames.release(pcb.frames)
+	pcb.frames = nil
+
+	s.procLock.Lock()
+	for _, child := range pcb.children {
+		child.parent = nil // nobody will wait for it
+	}
+	pcb.children = nil
+	pcb.exited = true
+	pcb.status = status
+	if pcb.parent != nil {
+		s.wake(&pcb.parent.childExit)
+	}
+	s.procLock.Unlock()
+
+	// run the next process if available
+	s.runNext(c)
+}
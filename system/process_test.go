@@ -0,0 +1,105 @@
+package system
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gotos/cpu"
+	"strings"
+	"testing"
+)
+
+// TestSpawnStack spawns the shell with arguments and an environment, checks
+// the initial stack `Spawn` builds for it against the layout described in
+// process.go, and then runs it to see that it finds its environment there.
+func TestSpawnStack(t *testing.T) {
+	fs, err := NewHostFS("../c-programs", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSystem(1, cpu.DefaultConfig())
+	s.Scheduler = &FIFO{}
+	s.Mount("/", fs)
+
+	argv := []string{"sh", "-x", "an argument"}
+	envp := []string{"PATH=/bin", "HOME=/nowhere"}
+	pcb, err := s.Spawn("/sh/main.text", argv, envp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	word := func(addr uint32) uint32 {
+		ok, pAddr := walk(&s.memory, pcb.satp(), addr, false)
+		if !ok {
+			t.Fatalf("%#x is not mapped", addr)
+		}
+		err, b := s.memory.ReadRaw(pAddr, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return binary.LittleEndian.Uint32(b)
+	}
+	str := func(addr uint32) string {
+		var b []uint8
+		for ; ; addr++ {
+			ok, pAddr := walk(&s.memory, pcb.satp(), addr, false)
+			if !ok {
+				t.Fatalf("%#x is not mapped", addr)
+			}
+			err, c := s.memory.ReadRaw(pAddr, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c[0] == 0 {
+				return string(b)
+			}
+			b = append(b, c[0])
+		}
+	}
+
+	sp := pcb.IReg[cpu.Reg_SP]
+	if sp%16 != 0 {
+		t.Errorf("sp %#x is not aligned on 16 bytes", sp)
+	}
+	if argc := word(sp); argc != uint32(len(argv)) {
+		t.Errorf("argc is %d, want %d", argc, len(argv))
+	}
+
+	a := sp + 4
+	for _, list := range [][]string{argv, envp} {
+		for _, want := range list {
+			if got := str(word(a)); got != want {
+				t.Errorf("string at %#x is %q, want %q", a, got, want)
+			}
+			a += 4
+		}
+		if p := word(a); p != 0 {
+			t.Errorf("vector ends in %#x at %#x, want NULL", p, a)
+		}
+		a += 4
+	}
+
+	for _, want := range [][2]uint32{{AT_PAGESZ, pageSize}, {AT_ENTRY, userText}, {AT_NULL, 0}} {
+		if got := [2]uint32{word(a), word(a + 4)}; got != want {
+			t.Errorf("auxv pair at %#x is %v, want %v", a, got, want)
+		}
+		a += 8
+	}
+
+	// `cd` goes to HOME, which only the environment on the stack tells
+	var out bytes.Buffer
+	console, err := s.AttachUART(strings.NewReader("cd\nexit 7\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fd := uint32(0); fd < 3; fd++ {
+		pcb.SetFile(fd, console)
+	}
+	s.Run()
+
+	if !strings.Contains(out.String(), "sh: /nowhere: no such file or directory") {
+		t.Errorf("the shell wrote %q, want it to fail to go to HOME", out.String())
+	}
+	if !pcb.exited || pcb.status != 7 {
+		t.Errorf("the shell exited %v with %d, want with 7", pcb.exited, pcb.status)
+	}
+}
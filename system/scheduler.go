@@ -1,6 +1,11 @@
 package system
 
-import "gotos/cpu"
+import (
+	"fmt"
+	"gotos/cpu"
+	"math/bits"
+	"sync"
+)
 
 type Scheduler interface {
 	// should put a PCB into the scheduler queue
@@ -11,40 +16,148 @@ type Scheduler interface {
 }
 
 const (
-	timeSlice uint64 = 100000
+	timeSlice uint64 = 100000 // ticks of mtime a process runs before it is preempted
 )
 
-// TODO, don't just restore PCB from current state
-// instead, hold a pointer to the PCB of the currently running thread on each core
-// restore state to that PCB instead
+// Interrupt codes the system raises on its own cores.
+//   Any other code halts the core.
+const (
+	interruptStop uint32 = 1 // stop the core
+)
+
+// idleCores keeps track of cores that have nothing to run, but that should be
+// woken up when a process becomes ready.
+//   The cores are a bitmap rather than a map, so that they are always woken
+// in the same order, lowest id first, which the deterministic mode relies on.
+type idleCores struct {
+	sync.Mutex
+	cores   []uint64 // bit id%64 of cores[id/64] is set if core `id` is idle
+	blocked int      // number of processes sleeping on a wait queue
+}
 
+// add marks the core `id` as idle.
+func (ic *idleCores) add(id uint32) { ic.cores[id/64] |= 1 << (id % 64) }
+
+// remove marks the core `id` as not idle.
+func (ic *idleCores) remove(id uint32) { ic.cores[id/64] &^= 1 << (id % 64) }
+
+// takeLowest removes the idle core with the lowest id and returns it.
+//   Returns false if no core is idle.
+func (ic *idleCores) takeLowest() (uint32, bool) {
+	for i, w := range ic.cores {
+		if w != 0 {
+			id := uint32(i*64 + bits.TrailingZeros64(w))
+			ic.remove(id)
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// swtch saves the state of the core into `oldPCB` (if not nil) and restores
+// the state of `newPCB`, which becomes the process running on the core.
+//   `oldPCB` is normally the PCB of the process currently running on the core,
+// see `System.current`.
 func (s *System) swtch(c *cpu.Core, oldPCB *PCB, newPCB *PCB) {
 	// Have to invalidate cache on context switches so work can be resumed on a different core
 	c.FENCE()
 	c.FENCE_I()
 
-	coreId := c.GetCSR(cpu.Csr_MHARTID)
-
 	if oldPCB != nil {
-		ireg := c.GetIRegisters()
-		copy(oldPCB.IReg[:], ireg[:])
+		s.save(c, oldPCB)
+	}
+
+	s.restore(c, newPCB)
+}
 
-		freg := c.GetFRegisters()
-		copy(oldPCB.FReg[:], freg[:])
+// save copies the state of the process running on `c` into `pcb`.
+func (s *System) save(c *cpu.Core, pcb *PCB) {
+	ireg := c.GetIRegisters()
+	copy(pcb.IReg[:], ireg[:])
 
-		pc := c.GetCSR(cpu.Csr_MEPC)
-		oldPCB.PC = pc
+	freg := c.GetFRegisters()
+	copy(pcb.FReg[:], freg[:])
 
-		oldPCB.PID = s.running[coreId]
-		oldPCB.PTable = (c.GetCSR(cpu.Csr_SATP) & 0x003FFFFF) << 12
-	}
+	pc := c.GetCSR(cpu.Csr_MEPC)
+	pcb.PC = pc
+
+	pcb.PTable = uint64(c.GetCSR(cpu.Csr_SATP)&0x003FFFFF) << 12
+}
 
-	c.SetIRegisters(newPCB.IReg)
-	c.SetFRegisters(newPCB.FReg)
-	c.SetCSR(cpu.Csr_SATP, 0x80000000|(newPCB.PTable>>12)|newPCB.PID<<22)
-	c.SetCSR(cpu.Csr_MEPC, newPCB.PC)
+// restore loads the state in `pcb` into `c`, which makes it the process
+// running on the core.
+func (s *System) restore(c *cpu.Core, pcb *PCB) {
+	c.SetIRegisters(pcb.IReg)
+	c.SetFRegisters(pcb.FReg)
+	c.SetCSR(cpu.Csr_SATP, pcb.satp())
+	c.SetCSR(cpu.Csr_MEPC, pcb.PC)
 
 	c.SFENCE_VMA(0, 0, 0)
 
-	s.running[coreId] = newPCB.PID
+	s.running[c.GetCSR(cpu.Csr_MHARTID)] = pcb
+}
+
+// current returns the PCB of the process running on `c`.
+func (s *System) current(c *cpu.Core) *PCB {
+	return s.running[c.GetCSR(cpu.Csr_MHARTID)]
+}
+
+// runNext runs the next ready process on `c`.
+//   The process that was running must already have been saved, or be gone.
+//   If no process is ready, the core waits for one if some process is
+// sleeping, or halts otherwise.
+func (s *System) runNext(c *cpu.Core) {
+	coreID := c.GetCSR(cpu.Csr_MHARTID)
+
+	// Register as idle before looking at the queue, so that a process that
+	// becomes ready right after the queue turned out empty is guaranteed to
+	// wake this core.
+	s.idle.Lock()
+	next := s.Scheduler.Pop()
+	if next != nil {
+		s.idle.remove(coreID)
+		s.idle.Unlock()
+
+		// data in the cache belongs to whatever ran here before
+		c.FENCE()
+		c.FENCE_I()
+		s.restore(c, next)
+		s.startTimer(c)
+		return
+	}
+
+	s.running[coreID] = nil
+	s.stopTimer(c)
+
+	if s.idle.blocked == 0 {
+		// nothing will ever become ready again, so take down every idle core
+		// along with this one
+		for id, ok := s.idle.takeLowest(); ok; id, ok = s.idle.takeLowest() {
+			s.sendIPI(id)
+		}
+		s.idle.Unlock()
+		fmt.Printf("[core %d]: No more pcb's in queue!\n", coreID)
+		c.Halt()
+		return
+	}
+
+	s.idle.add(coreID)
+	s.idle.Unlock()
+	c.WaitForInterrupt()
+}
+
+// ready makes `pcb` runnable and wakes an idle core to run it, if there is
+// one.
+func (s *System) ready(pcb *PCB) {
+	s.idle.Lock()
+	s.readyLocked(pcb)
+	s.idle.Unlock()
+}
+
+// readyLocked is `ready` for callers that already hold `s.idle`.
+func (s *System) readyLocked(pcb *PCB) {
+	s.Scheduler.Push(pcb)
+	if id, ok := s.idle.takeLowest(); ok {
+		s.sendIPI(id)
+	}
 }
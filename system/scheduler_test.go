@@ -0,0 +1,22 @@
+package system
+
+import "testing"
+
+// TestIdleCoresLowestFirst checks that idle cores are taken lowest id first,
+// whatever the order they became idle in.
+func TestIdleCoresLowestFirst(t *testing.T) {
+	ic := idleCores{cores: make([]uint64, 2)}
+	for _, id := range []uint32{70, 3, 64, 9, 3} {
+		ic.add(id)
+	}
+	ic.remove(9)
+
+	for _, want := range []uint32{3, 64, 70} {
+		if id, ok := ic.takeLowest(); !ok || id != want {
+			t.Fatalf("took %d, %v, want %d", id, ok, want)
+		}
+	}
+	if id, ok := ic.takeLowest(); ok {
+		t.Fatalf("took %d from no idle cores", id)
+	}
+}
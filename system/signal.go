@@ -0,0 +1,64 @@
+// This file contains a minimal notion of signals.
+//   Gotos has no way to run signal handlers in user mode, so a signal can
+// either be ignored or take its default action, which is to terminate the
+// process.
+
+package system
+
+import (
+	"fmt"
+	"gotos/cpu"
+)
+
+// Signal numbers, the same as on Linux.
+const (
+	SIGPIPE uint32 = 13
+)
+
+// Signal dispositions accepted by the signal syscall.
+const (
+	SIG_DFL uint32 = 0 // take the default action
+	SIG_IGN uint32 = 1 // ignore the signal
+)
+
+// maxSignal is the highest signal number.
+const maxSignal = 31
+
+// signal delivers `sig` to the process running on `c`.
+//   Returns true if the process was terminated.
+func (s *System) signal(c *cpu.Core, sig uint32) bool {
+	pcb := s.current(c)
+	if pcb.ignored&(1<<sig) != 0 {
+		return false
+	}
+
+	fmt.Printf("[core %d]: Process %d terminated by signal %d\n", c.GetCSR(cpu.Csr_MHARTID), pcb.PID, sig)
+	s.terminate(c, 128+sig) // the status a shell reports for a killed process
+	return true
+}
+
+// sysSignal sets the disposition of the signal in a1 to the one in a2, and
+// returns the previous disposition.
+func (s *System) sysSignal(c *cpu.Core) {
+	sig := c.GetIRegister(cpu.Reg_A1)
+	disposition := c.GetIRegister(cpu.Reg_A2)
+	c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+
+	if sig == 0 || sig > maxSignal || (disposition != SIG_DFL && disposition != SIG_IGN) {
+		returnValue(c, EINVAL.ret())
+		return
+	}
+
+	pcb := s.current(c)
+	old := SIG_DFL
+	if pcb.ignored&(1<<sig) != 0 {
+		old = SIG_IGN
+	}
+
+	if disposition == SIG_IGN {
+		pcb.ignored |= 1 << sig
+	} else {
+		pcb.ignored &^= 1 << sig
+	}
+	returnValue(c, old)
+}
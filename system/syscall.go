@@ -16,6 +16,26 @@ func (s *System) syscall(c *cpu.Core, number uint32) {
 		sys_getpid = 6
 		sys_putint = 8
 		sys_yield  = 10
+		sys_sync   = 11
+		sys_fsync  = 12
+		sys_open   = 13
+		sys_close  = 14
+		sys_read   = 15
+		sys_write  = 16
+		sys_mkdir  = 17
+		sys_unlink = 18
+		sys_pipe   = 19
+		sys_signal = 20
+		sys_spawn  = 21
+		sys_wait   = 22
+		sys_chdir  = 23
+		sys_dup    = 24
+		sys_dup2   = 25
+
+		sys_socket   = 26
+		sys_bind     = 27
+		sys_sendto   = 28
+		sys_recvfrom = 29
 	)
 
 	switch number {
@@ -29,6 +49,44 @@ func (s *System) syscall(c *cpu.Core, number uint32) {
 		s.sysPutInt(c)
 	case sys_yield:
 		s.sysYield(c)
+	case sys_sync:
+		s.sysSync(c)
+	case sys_fsync:
+		s.sysFsync(c)
+	case sys_open:
+		s.sysOpen(c)
+	case sys_close:
+		s.sysClose(c)
+	case sys_read:
+		s.sysRead(c)
+	case sys_write:
+		s.sysWrite(c)
+	case sys_mkdir:
+		s.sysMkdir(c)
+	case sys_unlink:
+		s.sysUnlink(c)
+	case sys_pipe:
+		s.sysPipe(c)
+	case sys_signal:
+		s.sysSignal(c)
+	case sys_spawn:
+		s.sysSpawn(c)
+	case sys_wait:
+		s.sysWait(c)
+	case sys_chdir:
+		s.sysChdir(c)
+	case sys_dup:
+		s.sysDup(c)
+	case sys_dup2:
+		s.sysDup2(c)
+	case sys_socket:
+		s.sysSocket(c)
+	case sys_bind:
+		s.sysBind(c)
+	case sys_sendto:
+		s.sysSendto(c)
+	case sys_recvfrom:
+		s.sysRecvfrom(c)
 	}
 }
 
@@ -48,25 +106,21 @@ func returnValue(c *cpu.Core, v uint32) {
 	c.SetIRegister(cpu.Reg_A0, v)
 }
 
-func (s *System) syscall_exit(c *cpu.Core) {
-	// TODO sys_exit just halts the core
-	// Instead, extract return value and store somewhere safe.
-	// Start the next process in the queue
-	// Halt if the queue is empty
+// sysReturn returns from a syscall with the value `v`.
+//   `ecall` has no compressed form, so the instruction after it is always 4
+// bytes further, even in code built for the C extension.
+func (s *System) sysReturn(c *cpu.Core, v uint32) {
+	returnValue(c, v)
+	c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+}
 
+func (s *System) syscall_exit(c *cpu.Core) {
 	value := c.GetIRegister(cpu.Reg_A1)
 	coreId := c.GetCSR(cpu.Csr_MHARTID)
-	fmt.Printf("[core %d]: Process %d exited with value 0x%08X = %d\n", coreId, s.running[coreId], value, value)
+	fmt.Printf("[core %d]: Process %d exited with value 0x%08X = %d\n", coreId, s.current(c).PID, value, value)
 
-	// run the next process if available
-	next := s.Scheduler.Pop()
-	if next != nil {
-		s.swtch(c, nil, next)
-		c.SetCounter(timeSlice)
-	} else {
-		fmt.Printf("[core %d]: No more pcb's in queue!\n", c.GetCSR(cpu.Csr_MHARTID))
-		c.Halt()
-	}
+	// the value is kept as the exit status until the parent waits for it
+	s.terminate(c, value)
 }
 
 func (s *System) sysYield(c *cpu.Core) {
@@ -77,10 +131,10 @@ func (s *System) sysYield(c *cpu.Core) {
 
 	next := s.Scheduler.Pop()
 	if next != nil {
-		old := &PCB{}
+		old := s.current(c)
 		s.swtch(c, old, next)
-		s.Scheduler.Push(old)
-		c.SetCounter(timeSlice)
+		s.ready(old)
+		s.startTimer(c)
 	} // else do nothing
 }
 
@@ -97,7 +151,41 @@ func (s *System) sysGetPID(c *cpu.Core) {
 	c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
 }
 
+// sysPutInt prints the value of a1 in decimal on a line of its own, on the UART
+// if one is attached.
 func (s *System) sysPutInt(c *cpu.Core) {
-	fmt.Println(c.GetIRegister(cpu.Reg_A1))
+	if s.uart != nil {
+		_, err := s.uart.Write([]uint8(fmt.Sprintln(c.GetIRegister(cpu.Reg_A1))))
+		if s.sleep(c, err) {
+			return
+		}
+	} else {
+		fmt.Println(c.GetIRegister(cpu.Reg_A1))
+	}
+	c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+}
+
+// sysSync writes all modified blocks in the buffer cache back to their
+// devices.
+func (s *System) sysSync(c *cpu.Core) {
+	if err := s.bcache.Sync(); err != nil {
+		returnValue(c, EIO.ret())
+	} else {
+		returnValue(c, 0)
+	}
+	c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+}
+
+// sysFsync commits the file referred to by the file descriptor in a1 to stable
+// storage.
+func (s *System) sysFsync(c *cpu.Core) {
+	fd := c.GetIRegister(cpu.Reg_A1)
+	if f := s.current(c).file(fd); f == nil {
+		returnValue(c, EBADF.ret())
+	} else if err := f.Sync(); err != nil {
+		returnValue(c, EIO.ret())
+	} else {
+		returnValue(c, 0)
+	}
 	c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
 }
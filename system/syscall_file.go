@@ -0,0 +1,214 @@
+// This file contains the syscalls that work on files.
+//   Relative paths are taken relative to the working directory of the process.
+
+package system
+
+import (
+	"encoding/binary"
+	"gotos/cpu"
+)
+
+// maxIO is the largest number of bytes a single read or write transfers.
+//   Larger requests are cut short, which programs must handle anyway.
+const maxIO = 64 * 1024
+
+// sysOpen opens the file at the path pointed to by a1 with the flags in a2 and
+// the mode in a3, and returns a new file descriptor.
+func (s *System) sysOpen(c *cpu.Core) {
+	args := getArgs(c)
+	defer c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+
+	err, p := c.CopyInString(args[0], maxPath)
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+
+	f, err := s.vfs.Open(s.current(c).abs(p), args[1], args[2])
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+
+	fd, ok := s.current(c).allocFD(f)
+	if !ok {
+		f.Close()
+		returnValue(c, EMFILE.ret())
+		return
+	}
+
+	returnValue(c, fd)
+}
+
+// sysClose closes the file descriptor in a1.
+func (s *System) sysClose(c *cpu.Core) {
+	fd := c.GetIRegister(cpu.Reg_A1)
+	defer c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+
+	if err := s.current(c).closeFD(fd); err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+	returnValue(c, 0)
+}
+
+// sysRead reads up to a3 bytes from the file descriptor in a1 into the buffer
+// pointed to by a2, and returns the number of bytes read.
+//   The process sleeps if the file has nothing to read yet.
+func (s *System) sysRead(c *cpu.Core) {
+	args := getArgs(c)
+
+	f := s.current(c).file(args[0])
+	if f == nil {
+		s.sysReturn(c, EBADF.ret())
+		return
+	}
+
+	n := args[2]
+	if n > maxIO {
+		n = maxIO
+	}
+
+	buf := make([]uint8, n)
+	read, err := f.Read(buf)
+	if s.sleep(c, err) {
+		return
+	}
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+
+	if err := c.CopyOut(args[1], buf[:read]); err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	s.sysReturn(c, uint32(read))
+}
+
+// sysWrite writes a3 bytes from the buffer pointed to by a2 to the file
+// descriptor in a1, and returns the number of bytes written.
+//   The process sleeps if the file can't take any bytes yet.
+func (s *System) sysWrite(c *cpu.Core) {
+	args := getArgs(c)
+
+	f := s.current(c).file(args[0])
+	if f == nil {
+		s.sysReturn(c, EBADF.ret())
+		return
+	}
+
+	n := args[2]
+	if n > maxIO {
+		n = maxIO
+	}
+
+	err, buf := c.Read(args[1], n)
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+
+	written, err := f.Write(buf)
+	if s.sleep(c, err) {
+		return
+	}
+	if err != nil && written == 0 {
+		if errnoOf(err) == EPIPE && s.signal(c, SIGPIPE) {
+			return
+		}
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	s.sysReturn(c, uint32(written))
+}
+
+// sysPipe creates a pipe and stores the file descriptors of its read and write
+// ends in the array of two words pointed to by a1.
+func (s *System) sysPipe(c *cpu.Core) {
+	addr := c.GetIRegister(cpu.Reg_A1)
+	pcb := s.current(c)
+
+	r, w := s.Pipe()
+	rfd, ok := pcb.allocFD(r)
+	if !ok {
+		s.sysReturn(c, EMFILE.ret())
+		return
+	}
+	wfd, ok := pcb.allocFD(w)
+	if !ok {
+		pcb.closeFD(rfd)
+		w.Close()
+		s.sysReturn(c, EMFILE.ret())
+		return
+	}
+
+	var fds [8]uint8
+	binary.LittleEndian.PutUint32(fds[0:], rfd)
+	binary.LittleEndian.PutUint32(fds[4:], wfd)
+	if err := c.CopyOut(addr, fds[:]); err != nil {
+		pcb.closeFD(rfd)
+		pcb.closeFD(wfd)
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	s.sysReturn(c, 0)
+}
+
+// sysMkdir creates a directory at the path pointed to by a1 with the mode in
+// a2.
+func (s *System) sysMkdir(c *cpu.Core) {
+	args := getArgs(c)
+	defer c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+
+	err, p := c.CopyInString(args[0], maxPath)
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+
+	if err := s.vfs.Mkdir(s.current(c).abs(p), args[1]); err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+	returnValue(c, 0)
+}
+
+// sysUnlink removes the file or empty directory at the path pointed to by a1.
+func (s *System) sysUnlink(c *cpu.Core) {
+	defer c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+
+	err, p := c.CopyInString(c.GetIRegister(cpu.Reg_A1), maxPath)
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+
+	if err := s.vfs.Remove(s.current(c).abs(p)); err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+	returnValue(c, 0)
+}
+
+// sysDup returns a new file descriptor that refers to the same open file as
+// the one in a1.
+func (s *System) sysDup(c *cpu.Core) {
+	fd, err := s.current(c).dup(c.GetIRegister(cpu.Reg_A1))
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	s.sysReturn(c, fd)
+}
+
+// sysDup2 makes the file descriptor in a2 refer to the same open file as the
+// one in a1, and returns it.
+func (s *System) sysDup2(c *cpu.Core) {
+	args := getArgs(c)
+	if err := s.current(c).dup2(args[0], args[1]); err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	s.sysReturn(c, args[1])
+}
@@ -0,0 +1,221 @@
+// This file contains the syscalls that work on sockets.
+//   Addresses are passed as a `struct sockaddr_in` the way Linux lays it out:
+//
+//   0   family, AF_INET, in host order
+//   2   port, in network order
+//   4   address, in network order
+//   8   8 bytes of padding
+
+package system
+
+import (
+	"encoding/binary"
+	"gotos/cpu"
+)
+
+// Families, types and flags of sockets.
+const (
+	AF_INET      uint32 = 2    // IPv4
+	SOCK_DGRAM   uint32 = 2    // datagrams
+	IPPROTO_UDP  uint32 = 17   // UDP, the only protocol for SOCK_DGRAM
+	MSG_DONTWAIT uint32 = 0x40 // fail with EAGAIN instead of sleeping
+)
+
+// sockaddrSize is the size of a `struct sockaddr_in`.
+const sockaddrSize = 16
+
+// socket returns the socket referred to by `fd` in the process running on
+// `c`.
+func (s *System) socket(c *cpu.Core, fd uint32) (*udpSocket, error) {
+	f := s.current(c).file(fd)
+	if f == nil {
+		return nil, EBADF
+	}
+	u, ok := f.(*udpSocket)
+	if !ok {
+		return nil, ENOTSOCK
+	}
+	return u, nil
+}
+
+// copyInSockaddr reads the `struct sockaddr_in` of `size` bytes at the virtual
+// address `addr` of the process running on `c`.
+func copyInSockaddr(c *cpu.Core, addr, size uint32) (sockAddr, error) {
+	if size < sockaddrSize {
+		return sockAddr{}, EINVAL
+	}
+	err, raw := c.Read(addr, sockaddrSize)
+	if err != nil {
+		return sockAddr{}, err
+	}
+	if uint32(binary.LittleEndian.Uint16(raw[0:])) != AF_INET {
+		return sockAddr{}, EAFNOSUPPORT
+	}
+
+	var sa sockAddr
+	sa.port = binary.BigEndian.Uint16(raw[2:])
+	copy(sa.ip[:], raw[4:8])
+	return sa, nil
+}
+
+// sysSocket creates a socket of the family in a1 and the type in a2, with the
+// protocol in a3, and returns its file descriptor.
+//   Only UDP sockets, AF_INET and SOCK_DGRAM with protocol 0 or IPPROTO_UDP,
+// exist.
+func (s *System) sysSocket(c *cpu.Core) {
+	args := getArgs(c)
+	if args[0] != AF_INET {
+		s.sysReturn(c, EAFNOSUPPORT.ret())
+		return
+	}
+	if args[1] != SOCK_DGRAM || args[2] != 0 && args[2] != IPPROTO_UDP {
+		s.sysReturn(c, EPROTONOSUPPORT.ret())
+		return
+	}
+
+	fd, ok := s.current(c).allocFD(s.newUDPSocket())
+	if !ok {
+		s.sysReturn(c, EMFILE.ret())
+		return
+	}
+	s.sysReturn(c, fd)
+}
+
+// sysBind binds the socket in a1 to the address pointed to by a2, which is a3
+// bytes long.
+//   The address must be INADDR_ANY, a loopback address, or the address of the
+// system. Port 0 picks a free port.
+func (s *System) sysBind(c *cpu.Core) {
+	args := getArgs(c)
+	u, err := s.socket(c, args[0])
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	sa, err := copyInSockaddr(c, args[1], args[2])
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	if sa.ip != (ipAddr{}) && !s.net.isLocal(sa.ip) {
+		s.sysReturn(c, EADDRNOTAVAIL.ret())
+		return
+	}
+
+	if err := u.bind(sa.port); err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	s.sysReturn(c, 0)
+}
+
+// sysSendto sends a3 bytes from the buffer pointed to by a2 as a datagram on
+// the socket in a1, to the address pointed to by a5, which is a6 bytes long,
+// and returns the number of bytes sent.
+//   The flags in a4 are ignored. A socket that is not bound yet is bound to a
+// free port first.
+func (s *System) sysSendto(c *cpu.Core) {
+	args := getArgs(c)
+	u, err := s.socket(c, args[0])
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	if args[4] == 0 {
+		s.sysReturn(c, EDESTADDRREQ.ret())
+		return
+	}
+	to, err := copyInSockaddr(c, args[4], args[5])
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	if args[2] > maxUDPPayload {
+		s.sysReturn(c, EMSGSIZE.ret())
+		return
+	}
+
+	err, data := c.Read(args[1], args[2])
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	if err := u.sendTo(to, data); err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+	s.sysReturn(c, args[2])
+}
+
+// sysRecvfrom receives a datagram on the socket in a1 into the buffer pointed
+// to by a2, which is a3 bytes long, and returns the number of bytes received.
+//   Whatever does not fit in the buffer is dropped. If the datagram can't be
+// stored, the call fails and the datagram stays queued for the next one.
+//   Unless a5 is NULL, the address of the sender is stored at a5, and the word
+// pointed to by a6 is replaced by the size of the address, the way Linux does.
+//   The process sleeps until a datagram arrives, unless the flags in a4
+// include MSG_DONTWAIT.
+func (s *System) sysRecvfrom(c *cpu.Core) {
+	args := getArgs(c)
+	u, err := s.socket(c, args[0])
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+
+	var addrLen uint32
+	if args[4] != 0 {
+		err, raw := c.Read(args[5], 4)
+		if err != nil {
+			s.sysReturn(c, errnoOf(err).ret())
+			return
+		}
+		addrLen = binary.LittleEndian.Uint32(raw)
+	}
+
+	d, err := u.recvFrom()
+	if _, ok := err.(wouldBlock); ok && args[3]&MSG_DONTWAIT != 0 {
+		err = EAGAIN
+	}
+	if s.sleep(c, err) {
+		return
+	}
+	if err != nil {
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+
+	n := uint32(len(d.data))
+	if n > args[2] {
+		n = args[2]
+	}
+	if err := c.CopyOut(args[1], d.data[:n]); err != nil {
+		u.requeue(d)
+		s.sysReturn(c, errnoOf(err).ret())
+		return
+	}
+
+	if args[4] != 0 {
+		var raw [sockaddrSize]uint8
+		binary.LittleEndian.PutUint16(raw[0:], uint16(AF_INET))
+		binary.BigEndian.PutUint16(raw[2:], d.from.port)
+		copy(raw[4:8], d.from.ip[:])
+		if addrLen > sockaddrSize {
+			addrLen = sockaddrSize
+		}
+
+		var size [4]uint8
+		binary.LittleEndian.PutUint32(size[:], sockaddrSize)
+		if err := c.CopyOut(args[4], raw[:addrLen]); err != nil {
+			u.requeue(d)
+			s.sysReturn(c, errnoOf(err).ret())
+			return
+		}
+		if err := c.CopyOut(args[5], size[:]); err != nil {
+			u.requeue(d)
+			s.sysReturn(c, errnoOf(err).ret())
+			return
+		}
+	}
+	s.sysReturn(c, n)
+}
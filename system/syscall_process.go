@@ -0,0 +1,163 @@
+// This file contains the syscalls that create processes and wait for them.
+
+package system
+
+import (
+	"encoding/binary"
+	"errors"
+	"gotos/cpu"
+)
+
+// Options for the wait syscall.
+const (
+	WNOHANG uint32 = 1 // return 0 instead of sleeping if no child has exited
+)
+
+// waitAny is the pid that makes the wait syscall wait for any child.
+const waitAny = 0xFFFFFFFF
+
+// copyInStrings reads a NULL-terminated array of pointers to strings from the
+// virtual address `addr` of the process running on `c`.
+//   A NULL `addr` is an empty array.
+func (s *System) copyInStrings(c *cpu.Core, addr uint32) ([]string, error) {
+	var strs []string
+	if addr == 0 {
+		return strs, nil
+	}
+
+	for {
+		if len(strs) > maxArgs {
+			return nil, E2BIG
+		}
+
+		err, ptr := c.Read(addr, 4)
+		if err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(ptr) == 0 {
+			return strs, nil
+		}
+
+		err, str := c.CopyInString(binary.LittleEndian.Uint32(ptr), maxArgBytes)
+		if errors.Is(err, cpu.ErrStringTooLong) {
+			return nil, E2BIG
+		} else if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+		addr += 4
+	}
+}
+
+// sysSpawn creates a child process running the program at the path pointed to
+// by a1, with the argument vector pointed to by a2 and the environment pointed
+// to by a3, and returns its pid.
+//   The child gets copies of all file descriptors, so the caller can redirect
+// the input and output of the child by rearranging its own descriptors with
+// dup2 around the call.
+func (s *System) sysSpawn(c *cpu.Core) {
+	args := getArgs(c)
+	defer c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+
+	err, p := c.CopyInString(args[0], maxPath)
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+	argv, err := s.copyInStrings(c, args[1])
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+	envp, err := s.copyInStrings(c, args[2])
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+
+	parent := s.current(c)
+	child, err := s.spawn(parent, parent.abs(p), argv, envp)
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+
+	returnValue(c, child.PID)
+}
+
+// sysWait waits for the child with the pid in a1, or any child if a1 is -1, to
+// exit, stores its exit status in the word pointed to by a2 unless it is NULL,
+// and returns its pid.
+//   With WNOHANG in a3 it returns 0 right away if no such child has exited.
+func (s *System) sysWait(c *cpu.Core) {
+	args := getArgs(c)
+	pid, statusAddr, options := args[0], args[1], args[2]
+	pcb := s.current(c)
+
+	s.procLock.Lock()
+	found := false
+	for i, child := range pcb.children {
+		if pid != waitAny && child.PID != pid {
+			continue
+		}
+		found = true
+		if !child.exited {
+			continue
+		}
+
+		if statusAddr != 0 {
+			var status [4]uint8
+			binary.LittleEndian.PutUint32(status[:], child.status)
+			if err := c.CopyOut(statusAddr, status[:]); err != nil {
+				s.procLock.Unlock()
+				s.sysReturn(c, errnoOf(err).ret())
+				return
+			}
+		}
+
+		pcb.children = append(pcb.children[:i], pcb.children[i+1:]...)
+		s.procLock.Unlock()
+		s.sysReturn(c, child.PID)
+		return
+	}
+
+	if !found {
+		s.procLock.Unlock()
+		s.sysReturn(c, ECHILD.ret())
+		return
+	}
+	if options&WNOHANG != 0 {
+		s.procLock.Unlock()
+		s.sysReturn(c, 0)
+		return
+	}
+
+	err := pcb.childExit.wouldBlock()
+	s.procLock.Unlock()
+	s.sleep(c, err)
+}
+
+// sysChdir changes the working directory to the directory at the path pointed
+// to by a1.
+func (s *System) sysChdir(c *cpu.Core) {
+	addr := c.GetIRegister(cpu.Reg_A1)
+	defer c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4)
+
+	err, p := c.CopyInString(addr, maxPath)
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+
+	pcb := s.current(c)
+	dir := pcb.abs(p)
+	f, err := s.vfs.Open(dir, O_RDONLY|O_DIRECTORY, 0)
+	if err != nil {
+		returnValue(c, errnoOf(err).ret())
+		return
+	}
+	f.Close()
+
+	pcb.cwd = dir
+	returnValue(c, 0)
+}
@@ -2,8 +2,14 @@ package system
 
 import (
 	"gotos/cpu"
+	"gotos/devices"
 	"sync"
-	"sync/atomic"
+	"time"
+)
+
+const (
+	bufferCount       = 64                     // number of buffers in the buffer cache
+	writebackInterval = 500 * time.Millisecond // how often dirty buffers are written back
 )
 
 // System implements the `System` interface from the `cpu` package.
@@ -19,8 +25,26 @@ type System struct {
 	wgRunning  sync.WaitGroup
 
 	// --- other fields ---
-	running   []uint32  // keeps track of which PID is running on which core
-	Scheduler Scheduler // acts as the system scheduler
+	running   []*PCB               // keeps track of which process is running on which core
+	Scheduler Scheduler            // acts as the system scheduler
+	bcache    *BufferCache         // caches blocks of all block devices
+	vfs       VFS                  // tree of mounted file systems
+	idle      idleCores            // cores waiting for a process to become ready
+	frames    frameAllocator       // physical frames for processes
+	nextPID   uint32               // next process id to hand out
+	procLock  sync.Mutex           // protects the parent/child relations of processes
+	uart      *uartConsole         // console on the UART, if one is attached
+	clint     *devices.CLINT       // timers and software interrupts of the cores
+	plic      *devices.PLIC        // interrupts from devices
+	finisher  finisher             // lets programs end the run
+	nic       *netDevice           // network interface, if one is attached
+	net       netStack             // IPv4 and UDP on top of the network interface
+	fb        *devices.Framebuffer // framebuffer, if one is attached
+	input     *inputFile           // input device, if one is attached
+	snapshots snapshots            // images taken of the framebuffer
+	det       *deterministic       // state of the deterministic mode, nil unless it is used
+	// handlers of device interrupts by source, see `handleIRQ`
+	irqHandlers [devices.PLICSources]func()
 }
 
 // Memory returns a pointer to the system Memory and is part of the cpu.System
@@ -41,6 +65,27 @@ func (s *System) InterruptMatrix() *cpu.InterruptMatrix {
 	return &s.interrupts
 }
 
+// BufferCache returns the buffer cache of the system.
+func (s *System) BufferCache() *BufferCache {
+	return s.bcache
+}
+
+// Mount mounts the file system `fs` at the absolute directory `dir`.
+func (s *System) Mount(dir string, fs FileSystem) error {
+	return s.vfs.Mount(dir, fs)
+}
+
+// Unmount removes the file system mounted at `dir`.
+func (s *System) Unmount(dir string) error {
+	return s.vfs.Unmount(dir)
+}
+
+// Time returns the value of `mtime` of the CLINT and is part of the
+// cpu.System interface
+func (s *System) Time() uint64 {
+	return s.clint.Now()
+}
+
 func (s *System) WgAwake() *sync.WaitGroup {
 	return &s.wgAwake
 }
@@ -49,37 +94,67 @@ func (s *System) WgRunning() *sync.WaitGroup {
 	return &s.wgRunning
 }
 
+// RaiseInterrupt raises an interrupt with `code` on a core through the
+// InterruptMatrix.
+//   The system only uses this to stop cores; devices interrupt through the
+// PLIC instead.
 func (s *System) RaiseInterrupt(coreID, code uint32) {
-	for !atomic.CompareAndSwapUint32(&s.interrupts[coreID][cpu.CoresMax], 0, code) {
-	}
+	s.interrupts.RaiseSystemInterrupt(coreID, code)
 }
 
-// creates a new system with `n` cores
-func NewSystem(n int) *System {
+// creates a new system with `n` cores, configured by `cfg`
+//   Panics if `cfg` is not valid, if `n` is less than 1, or if the memory of
+// `cfg` doesn't fit in the memory map of the system, see memmap.go.
+func NewSystem(n int, cfg cpu.Config) *System {
+	if err := cfg.Validate(); err != nil {
+		panic(err)
+	}
+	if n < 1 {
+		panic("a system needs at least one core")
+	}
+	if cfg.MemorySize <= frameBase || cfg.MemorySize > maxMemorySize {
+		panic("memory size out of range for the system")
+	}
+
 	sys := &System{
 		// necessary
-		cores:  make([]cpu.Core, n),
-		memory: cpu.NewMemory(),
-		rsets:  cpu.NewReservationSets(),
+		cores:      make([]cpu.Core, n),
+		memory:     cpu.NewMemory(memoryMap(cfg.MemorySize)),
+		rsets:      cpu.NewReservationSets(n),
+		interrupts: cpu.NewInterruptMatrix(n),
 
 		// other
-		running: make([]uint32, n),
+		running: make([]*PCB, n),
+		bcache:  NewBufferCache(bufferCount),
+		idle:    idleCores{cores: make([]uint64, (n+63)/64)},
 	}
+	sys.frames.init(frameBase, sys.memory.Regions())
+	sys.net.init(sys)
 
 	for i := range sys.cores {
-		sys.cores[i] = cpu.NewCore(uint32(i), sys)
+		sys.cores[i] = cpu.NewCore(uint32(i), sys, cfg)
 	}
+	sys.attachCLINT()
+	sys.attachPLIC()
+	sys.attachFinisher()
 
 	return sys
 }
 
-// Run will start all cores and run them until they halt, then send a signal to
-// all cores that they should stop, then wait for all cores to stop before
-// finally returning with no value.
-func (s *System) Run() {
+// Run will start all cores and run them until they halt or a program ends the
+// run through the finisher, then send a signal to all cores that they should
+// stop, then wait for all cores to stop before finally returning how the run
+// ended.
+//   In the deterministic mode, the cores run in the calling goroutine, see
+// deterministic.go.
+func (s *System) Run() ExitStatus {
+	if s.det != nil {
+		return s.runDeterministic()
+	}
 	s.Start()
-	s.WaitHalt()
+	status := s.waitFinish()
 	s.Stop()
+	return status
 }
 
 // Boot will cause all cores on the system to run the boot routine
@@ -106,22 +181,48 @@ func (s *System) StepAndDump() {
 	s.Dump()
 }
 
-// Start will start all cores in the system
+// Start will start all cores in the system along with the timers, the
+// script of the input device, the transmitter of the UART, the periodic
+// write-back of the buffer cache, and the periodic snapshots of the
+// framebuffer.
 func (s *System) Start() {
+	s.clint.Start()
+	s.bcache.StartWriteback(writebackInterval)
+	s.startSnapshots()
+	if s.input != nil {
+		s.input.dev.Start()
+	}
+	if s.uart != nil {
+		s.uart.dev.Start()
+	}
 	for i := range s.cores {
 		s.cores[i].Start()
 	}
 }
 
-// Stop will raise an interrupt on each core with code 1 which should cause the
+// Stop will raise a stop interrupt on each core which should cause the
 // core to eventually stop.
-//   Stop then waits for all cores to finish stopping before finally returning.
+//   Stop then waits for all cores to finish stopping before sending the output
+// that is left for the UART and closing it, taking the last snapshot of the
+// framebuffer, stopping the periodic write-back, and writing all dirty
+// buffers back to their devices.
 func (s *System) Stop() {
 	for i := range s.cores {
-		s.RaiseInterrupt(uint32(i), 1)
+		s.RaiseInterrupt(uint32(i), interruptStop)
 	}
 
 	s.WaitStop()
+
+	s.clint.Stop()
+	if s.input != nil {
+		s.input.dev.Stop()
+	}
+	if s.uart != nil {
+		s.uart.close()
+	}
+	s.stopSnapshots()
+	s.bcache.StopWriteback()
+	s.bcache.Sync()
 }
 
 // WaitHalt will wait for all cores on the system to enter the halted state.
@@ -20,6 +20,7 @@ import (
 // TrapLoadPageFault
 // TrapStorePageFault
 //
+// TrapMachineSoftwareInterrupt
 // TrapMachineTimerInterrupt
 // TrapMachineExternalInterrupt
 
@@ -54,6 +55,8 @@ func (s *System) HandleTrap(c *cpu.Core) {
 		s.handleLoadPageFault(c)
 	case cpu.TrapStorePageFault:
 		s.handleStorePageFault(c)
+	case cpu.TrapMachineSoftwareInterrupt:
+		s.handleMachineSoftwareInterrupt(c)
 	case cpu.TrapMachineTimerInterrupt:
 		s.handleMachineTimerInterrupt(c)
 	case cpu.TrapMachineExternalInterrupt:
@@ -102,26 +105,53 @@ func (s *System) handleStoreAccessFault(c *cpu.Core) {
 
 func (s *System) handleBreakpoint(c *cpu.Core) {
 	fmt.Printf("[core %d]: Breakpoint.\n", c.GetCSR(cpu.Csr_MHARTID))
-	c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+4) // return to the instruction after the breakpoint
+	c.SetCSR(cpu.Csr_MEPC, c.GetCSR(cpu.Csr_MEPC)+c.InstructionLength()) // return to the instruction after the breakpoint, which may be c.ebreak
 }
 
 func (s *System) handleMachineTimerInterrupt(c *cpu.Core) {
 	// switch to the next process if available
-	old := &PCB{}
+	old := s.current(c)
+	if old == nil {
+		// nothing to preempt, but the core may have found work meanwhile
+		s.runNext(c)
+		return
+	}
 	next := s.Scheduler.Pop()
 
 	if next != nil {
 		s.swtch(c, old, next)
-		s.Scheduler.Push(old)
+		s.ready(old)
 	}
 
-	c.SetCounter(timeSlice)
+	s.startTimer(c)
+}
+
+// handleMachineSoftwareInterrupt runs a process on an idle core that was woken
+// because one became ready.
+func (s *System) handleMachineSoftwareInterrupt(c *cpu.Core) {
+	s.clearIPI(c)
+
+	// the core may have found work on its own since it was woken
+	if s.current(c) == nil {
+		s.runNext(c)
+	}
 }
 
 func (s *System) handleMachineExternalInterrupt(c *cpu.Core) {
 	by, code := c.InterruptInfo()
+	if code == 0 {
+		s.handleDeviceInterrupt(c)
+
+		// an idle core goes back to waiting, unless the handler made a
+		// process ready
+		if s.current(c) == nil {
+			s.runNext(c)
+		}
+		return
+	}
+
 	fmt.Printf("[core %d]: Machine External Interrupt - code %d, by %d\n", c.GetCSR(cpu.Csr_MHARTID), code, by)
-	if code == 1 {
+	if code == interruptStop {
 		c.Stop()
 		return
 	}
@@ -0,0 +1,122 @@
+// This file contains functions that access the address space of a process
+// that is not running on any core, such as one that is being created.
+//   Syscalls use `cpu.Core.Read` and `cpu.Core.Write` instead, which go
+// through the caches of the core the process is running on.
+//   The page table of the process is walked in software, the same way the
+// hardware would walk it, and every page is checked for the permissions a
+// user mode access would need.
+
+package system
+
+import (
+	"encoding/binary"
+	"gotos/cpu"
+)
+
+const (
+	pageFlagValid    uint32 = 0x01
+	pageFlagRead     uint32 = 0x02
+	pageFlagWrite    uint32 = 0x04
+	pageFlagExec     uint32 = 0x08
+	pageFlagUser     uint32 = 0x10
+	pageFlagAccessed uint32 = 0x40
+	pageFlagDirty    uint32 = 0x80
+)
+
+const (
+	pageSize = 4096
+
+	// maxPath is the longest path, terminator included, a syscall accepts.
+	maxPath = 256
+)
+
+// ppn returns the physical page number of the physical address `pAddr`, as
+// a page table entry or satp holds it.
+func ppn(pAddr uint64) uint32 {
+	return uint32(pAddr / pageSize)
+}
+
+// walk translates the virtual address `vAddr` using the Sv32 page table
+// described by `satp`.
+//   If `write` is set, the page must be writable, otherwise readable.
+//   Returns `false, 0` if a user mode access of that kind would fault.
+//   Like the hardware, it produces a 34-bit physical address.
+func walk(m *cpu.Memory, satp, vAddr uint32, write bool) (bool, uint64) {
+	if satp&0x80000000 == 0 { // bare mode
+		return true, uint64(vAddr)
+	}
+
+	a := uint64(satp&0x003FFFFF) * pageSize
+	for i := 1; i >= 0; i-- {
+		vpni := (vAddr >> (12 + 10*i)) & 0x3FF
+		err, bytes := m.ReadRaw(a+uint64(vpni)*4, 4)
+		if err != nil {
+			return false, 0
+		}
+		pte := binary.LittleEndian.Uint32(bytes)
+
+		if pte&pageFlagValid == 0 || (pte&pageFlagRead == 0 && pte&pageFlagWrite != 0) {
+			return false, 0
+		}
+
+		if pte&(pageFlagRead|pageFlagExec) == 0 { // pointer to next level
+			a = uint64(pte>>10) * pageSize
+			continue
+		}
+
+		// leaf
+		if pte&pageFlagUser == 0 || pte&pageFlagAccessed == 0 {
+			return false, 0
+		}
+		if write && (pte&pageFlagWrite == 0 || pte&pageFlagDirty == 0) {
+			return false, 0
+		}
+		if !write && pte&pageFlagRead == 0 {
+			return false, 0
+		}
+
+		if i == 1 {
+			if pte&0x000FFC00 != 0 { // misaligned superpage
+				return false, 0
+			}
+			return true, uint64(pte&0xFFF00000)<<2 | uint64(vAddr&0x003FFFFF)
+		}
+		return true, uint64(pte&0xFFFFFC00)<<2 | uint64(vAddr&0x00000FFF)
+	}
+
+	return false, 0
+}
+
+// writeUser writes `data` to the virtual address `addr` of the address space
+// described by `satp`, which does not have to be running anywhere.
+//   Either all of `data` is written, or nothing is.
+func (s *System) writeUser(satp, addr uint32, data []uint8) bool {
+	// translate everything first so a bad page halfway leaves memory untouched
+	var pAddrs []uint64
+	for a, left := addr, uint32(len(data)); left > 0; {
+		chunk := pageSize - a%pageSize
+		if chunk > left {
+			chunk = left
+		}
+		ok, pAddr := walk(&s.memory, satp, a, true)
+		if !ok {
+			return false
+		}
+		pAddrs = append(pAddrs, pAddr)
+		a += chunk
+		left -= chunk
+	}
+
+	for _, pAddr := range pAddrs {
+		chunk := uint64(pageSize - pAddr%pageSize)
+		if chunk > uint64(len(data)) {
+			chunk = uint64(len(data))
+		}
+		if err, _ := s.memory.WriteRaw(pAddr, data[:chunk]); err != nil {
+			return false
+		}
+		data = data[chunk:]
+	}
+
+	return true
+}
@@ -0,0 +1,246 @@
+// This file contains the driver for the UART from the `devices` package, which
+// connects processes to the host through a serial port.
+//   The driver only touches the UART through its registers on the bus.
+// Received bytes are collected by the interrupt handler into a buffer, so
+// processes reading the console sleep until input arrives. Output goes into
+// another buffer, which the interrupt handler moves into the transmit FIFO
+// whenever the UART says it is empty, so processes writing only sleep when
+// there is no room in that buffer.
+
+package system
+
+import (
+	"bytes"
+	"gotos/devices"
+	"io"
+	"sync"
+	"time"
+)
+
+// uartBase is the physical address the UART is mapped at.
+const uartBase = 0x10000000
+
+// uartBufferSize is how much received input the driver keeps before it stops
+// taking bytes out of the UART, and how much output it keeps before writers
+// have to wait.
+const uartBufferSize = 4096
+
+// uartFIFOSize is how many bytes the transmit FIFO takes when it is empty.
+const uartFIFOSize = 16
+
+// uartByteTime is how long a byte takes on a line at 115200 baud, with a start
+// bit, 8 data bits and a stop bit.
+//   In the deterministic mode, the UART receives a byte this often.
+const uartByteTime = 10 * time.Second / 115200
+
+// Special input characters.
+const (
+	asciiEOT uint8 = 0x04 // ^D, ends the input
+	asciiCR  uint8 = 0x0D // sent by the return key of a terminal in raw mode
+	asciiNL  uint8 = 0x0A
+)
+
+type uartConsole struct {
+	s    *System
+	dev  *devices.UART
+	base uint64
+
+	mu        sync.Mutex
+	buf       []uint8   // input that has not been read yet
+	eof       bool      // ^D has been received
+	stalled   bool      // the receive interrupt is disabled because `buf` is full
+	readWait  WaitQueue // readers waiting for input
+	out       []uint8   // output that has not been written to the UART yet
+	writeWait WaitQueue // writers waiting for room in `out`
+}
+
+// AttachUART creates a UART that receives from `in` and transmits to `out`,
+// maps it into the physical address space, and returns a console file that
+// uses it.
+//   When `in` ends, the UART receives a ^D, which the console reads as the
+// end of the input. When the system stops, `in` is closed if it is an
+// `io.Closer`.
+//   It must be called before the system is started.
+//   Once a UART is attached, the putint syscall writes through it as well.
+func (s *System) AttachUART(in io.Reader, out io.Writer) (File, error) {
+	eot := io.MultiReader(in, bytes.NewReader([]uint8{asciiEOT}))
+	if c, ok := in.(io.Closer); ok {
+		eot = struct {
+			io.Reader
+			io.Closer
+		}{eot, c}
+	}
+	uart := devices.NewUART(eot, out, s.plic.Source(irqUART))
+	if err := s.memory.Map(uartBase, devices.UARTSize, uart); err != nil {
+		return nil, err
+	}
+
+	con := &uartConsole{s: s, dev: uart, base: uartBase}
+	con.set(devices.UART_FCR, devices.UART_FCR_ENABLE|devices.UART_FCR_CLEAR_RCVR|devices.UART_FCR_CLEAR_XMIT)
+	con.set(devices.UART_LCR, devices.UART_LCR_WLEN8)
+	con.set(devices.UART_IER, devices.UART_IER_RDI)
+	s.handleIRQ(irqUART, con.interrupt)
+
+	s.uart = con
+	return con, nil
+}
+
+// get reads the UART register `reg`.
+func (con *uartConsole) get(reg uint32) uint8 {
+	_, v := con.s.memory.ReadIO(con.base+uint64(reg), 1)
+	return uint8(v)
+}
+
+// set writes `v` to the UART register `reg`.
+func (con *uartConsole) set(reg uint32, v uint8) {
+	con.s.memory.WriteIO(con.base+uint64(reg), 1, uint64(v))
+}
+
+// interrupt handles the interrupts of the UART by moving received bytes into
+// the console buffer and waking readers, and by moving output into the
+// transmit FIFO and waking writers.
+func (con *uartConsole) interrupt() {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+
+	for con.get(devices.UART_IIR)&devices.UART_IIR_NO_INT == 0 {
+		for !con.stalled && con.get(devices.UART_LSR)&devices.UART_LSR_DR != 0 {
+			if len(con.buf) >= uartBufferSize {
+				// leave the rest in the UART until a reader makes room
+				con.stalled = true
+				con.enable()
+				break
+			}
+
+			b := con.get(devices.UART_RBR)
+			switch {
+			case con.eof:
+				// nothing is read after the end of the input
+			case b == asciiEOT:
+				con.eof = true
+			case b == asciiCR:
+				con.buf = append(con.buf, asciiNL)
+			default:
+				con.buf = append(con.buf, b)
+			}
+		}
+	}
+
+	con.s.wake(&con.readWait)
+
+	if len(con.out) != 0 && con.transmit() {
+		con.s.wake(&con.writeWait)
+	}
+}
+
+// enable enables the interrupts the console waits for: received data, unless
+// the console buffer is full, and an empty transmitter, if there is output
+// left.
+//   The caller must hold `con.mu`.
+func (con *uartConsole) enable() {
+	var ier uint8
+	if !con.stalled {
+		ier |= devices.UART_IER_RDI
+	}
+	if len(con.out) != 0 {
+		ier |= devices.UART_IER_THRI
+	}
+	con.set(devices.UART_IER, ier)
+}
+
+// transmit moves output into the transmit FIFO if it is empty, and returns
+// whether it did.
+//   The caller must hold `con.mu`.
+func (con *uartConsole) transmit() bool {
+	moved := false
+	if con.get(devices.UART_LSR)&devices.UART_LSR_THRE != 0 {
+		n := len(con.out)
+		if n > uartFIFOSize {
+			n = uartFIFOSize
+		}
+		for _, b := range con.out[:n] {
+			con.set(devices.UART_THR, b)
+		}
+		con.out = con.out[n:]
+		moved = n != 0
+	}
+	con.enable()
+	return moved
+}
+
+// Read reads input that has already arrived, or sleeps until some does.
+func (con *uartConsole) Read(b []uint8) (int, error) {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if len(con.buf) == 0 {
+		if con.eof {
+			return 0, nil
+		}
+		return 0, con.readWait.wouldBlock()
+	}
+
+	n := copy(b, con.buf)
+	con.buf = con.buf[n:]
+
+	if con.stalled {
+		// there is room again, so the UART may interrupt again
+		con.stalled = false
+		con.enable()
+	}
+	return n, nil
+}
+
+// Write puts `b` in the output buffer, from where it goes to the UART, and
+// sleeps until there is room for it.
+//   Only writes larger than the whole buffer are split, so that the output of
+// a write isn't mixed with that of others.
+func (con *uartConsole) Write(b []uint8) (int, error) {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	n := len(b)
+	if n > uartBufferSize {
+		n = uartBufferSize
+	}
+	if uartBufferSize-len(con.out) < n {
+		return 0, con.writeWait.wouldBlock()
+	}
+
+	con.out = append(con.out, b[:n]...)
+	con.transmit()
+	return n, nil
+}
+
+// close writes the output that is left in the buffer to the UART, and closes
+// it.
+//   The cores must have stopped, as the interrupts that would move the output
+// along are no longer handled.
+func (con *uartConsole) close() {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+
+	for len(con.out) != 0 {
+		con.transmit()
+		con.dev.Poll()
+	}
+	con.dev.Close()
+}
+
+// Sync does nothing, the output in the buffer is sent on its own.
+func (con *uartConsole) Sync() error {
+	return nil
+}
+
+// Close does nothing, the console outlives its file descriptors.
+func (con *uartConsole) Close() error {
+	return nil
+}
@@ -0,0 +1,253 @@
+// This file contains UDP and the sockets processes use it through.
+//   A socket is a `File`, so it lives in the file descriptor table and is
+// closed like any other file, but datagrams can only be sent with the sendto
+// syscall, since a socket has no peer that writes could go to.
+//   Every socket is bound to a port, at the latest when it first sends
+// something, and receives the datagrams sent to that port on any address of
+// the system. Datagrams that arrive while the queue of a socket is full are
+// dropped.
+
+package system
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Range of the ports given to sockets that send without being bound.
+const (
+	ephemeralFirst = 49152
+	ephemeralLast  = 65535
+)
+
+const (
+	udpQueueSize = 64 // datagrams a socket holds before it drops more
+
+	// maxUDPPayload is the most a datagram can carry.
+	maxUDPPayload = maxIPPayload - udpHeaderSize
+)
+
+// sockAddr is the address and port of one end of a datagram.
+type sockAddr struct {
+	ip   ipAddr
+	port uint16
+}
+
+// datagram is a received datagram and where it came from.
+type datagram struct {
+	from sockAddr
+	data []uint8
+}
+
+type udpSocket struct {
+	s *System
+
+	mu       sync.Mutex
+	port     uint16 // 0 while unbound
+	queue    []datagram
+	readWait WaitQueue // waiting for a datagram to arrive
+}
+
+// newUDPSocket creates an unbound UDP socket.
+func (s *System) newUDPSocket() *udpSocket {
+	return &udpSocket{s: s}
+}
+
+// bind binds the socket to `port`, or to a free ephemeral port if `port` is
+// 0.
+func (u *udpSocket) bind(port uint16) error {
+	n := &u.s.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.port != 0 {
+		return EINVAL
+	}
+
+	if port == 0 {
+		for tries := 0; tries <= ephemeralLast-ephemeralFirst; tries++ {
+			candidate := n.nextPort
+			n.nextPort++
+			if n.nextPort == 0 {
+				n.nextPort = ephemeralFirst
+			}
+			if n.ports[candidate] == nil {
+				port = candidate
+				break
+			}
+		}
+		if port == 0 {
+			return EADDRINUSE
+		}
+	} else if n.ports[port] != nil {
+		return EADDRINUSE
+	}
+
+	n.ports[port] = u
+	u.port = port
+	return nil
+}
+
+// localPort returns the port the socket is bound to, binding it first if it
+// is not.
+func (u *udpSocket) localPort() (uint16, error) {
+	u.mu.Lock()
+	port := u.port
+	u.mu.Unlock()
+	if port != 0 {
+		return port, nil
+	}
+
+	if err := u.bind(0); err != nil && err != EINVAL {
+		return 0, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.port, nil
+}
+
+// sendTo sends `data` as a single datagram to `to`.
+func (u *udpSocket) sendTo(to sockAddr, data []uint8) error {
+	if len(data) > maxUDPPayload {
+		return EMSGSIZE
+	}
+	port, err := u.localPort()
+	if err != nil {
+		return err
+	}
+
+	n := &u.s.net
+	src := n.address()
+	if to.ip[0] == 127 {
+		src = loopbackIP
+	}
+
+	p := make([]uint8, udpHeaderSize+len(data))
+	binary.BigEndian.PutUint16(p[0:], port)
+	binary.BigEndian.PutUint16(p[2:], to.port)
+	binary.BigEndian.PutUint16(p[4:], uint16(len(p)))
+	copy(p[udpHeaderSize:], data)
+
+	sum := checksum(pseudoHeader(src, to.ip, len(p)), p)
+	if sum == 0 {
+		sum = 0xFFFF // 0 means there is no checksum
+	}
+	binary.BigEndian.PutUint16(p[6:], sum)
+
+	return n.ipOutput(src, to.ip, ipProtoUDP, p)
+}
+
+// recvFrom takes the oldest datagram from the queue of the socket, or returns
+// a `wouldBlock` if there is none.
+func (u *udpSocket) recvFrom() (datagram, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.queue) == 0 {
+		return datagram{}, u.readWait.wouldBlock()
+	}
+	d := u.queue[0]
+	u.queue = u.queue[1:]
+	return d, nil
+}
+
+// requeue puts `d`, which `recvFrom` has just taken, back at the head of the
+// queue, so that a receive that could not hand it to the process doesn't lose
+// it.
+func (u *udpSocket) requeue(d datagram) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.port == 0 {
+		return // closed in the meantime
+	}
+	u.queue = append([]datagram{d}, u.queue...)
+}
+
+// deliver adds the datagram `d` to the queue of the socket.
+func (u *udpSocket) deliver(d datagram) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.queue) >= udpQueueSize {
+		return
+	}
+	u.queue = append(u.queue, d)
+	u.s.wake(&u.readWait)
+}
+
+// Read receives a datagram into `p`, dropping whatever does not fit.
+func (u *udpSocket) Read(p []uint8) (int, error) {
+	d, err := u.recvFrom()
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, d.data), nil
+}
+
+// Write can not be used, since the socket has no peer.
+func (u *udpSocket) Write(p []uint8) (int, error) {
+	return 0, EDESTADDRREQ
+}
+
+// Sync is not supported by sockets.
+func (u *udpSocket) Sync() error {
+	return EINVAL
+}
+
+// Close unbinds the socket and drops the datagrams in its queue.
+func (u *udpSocket) Close() error {
+	n := &u.s.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.port != 0 && n.ports[u.port] == u {
+		delete(n.ports, u.port)
+	}
+	u.port = 0
+	u.queue = nil
+	return nil
+}
+
+// pseudoHeader returns the part of the IP header that the UDP checksum
+// covers for a datagram of `length` bytes from `src` to `dst`.
+func pseudoHeader(src, dst ipAddr, length int) []uint8 {
+	h := make([]uint8, 12)
+	copy(h[0:4], src[:])
+	copy(h[4:8], dst[:])
+	h[9] = ipProtoUDP
+	binary.BigEndian.PutUint16(h[10:], uint16(length))
+	return h
+}
+
+// udpInput handles the datagram `p` from `src` to `dst` by passing it on to
+// the socket bound to its port.
+func (n *netStack) udpInput(src, dst ipAddr, p []uint8) {
+	if len(p) < udpHeaderSize {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(p[4:]))
+	if length < udpHeaderSize || length > len(p) {
+		return
+	}
+	p = p[:length]
+	if binary.BigEndian.Uint16(p[6:]) != 0 && checksum(pseudoHeader(src, dst, length), p) != 0 {
+		return
+	}
+
+	n.mu.Lock()
+	u := n.ports[binary.BigEndian.Uint16(p[2:])]
+	n.mu.Unlock()
+	if u == nil {
+		return
+	}
+
+	u.deliver(datagram{
+		from: sockAddr{ip: src, port: binary.BigEndian.Uint16(p[0:])},
+		data: append([]uint8(nil), p[udpHeaderSize:]...),
+	})
+}
@@ -0,0 +1,152 @@
+// This file contains the virtual file system layer.
+//   File system drivers implement the `FileSystem` interface and are mounted
+// at a directory in a single tree.
+//   Paths are resolved by finding the mount with the longest matching
+// directory and handing the rest of the path to its driver.
+
+package system
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// Flags for opening files.
+//   The values are the same as on Linux.
+const (
+	O_RDONLY  uint32 = 0x000
+	O_WRONLY  uint32 = 0x001
+	O_RDWR    uint32 = 0x002
+	O_ACCMODE uint32 = 0x003
+	O_CREAT   uint32 = 0x040
+	O_EXCL    uint32 = 0x080
+	O_TRUNC   uint32 = 0x200
+	O_APPEND  uint32 = 0x400
+
+	O_DIRECTORY uint32 = 0x10000 // fail unless the path is a directory
+)
+
+// FileSystem is the interface a file system driver must implement to be
+// mounted.
+//   Paths handed to a driver are always clean, relative to the root of the
+// mount, and never contain "..", e.g. "data/input.txt", or "." for the root
+// itself.
+type FileSystem interface {
+	// Open opens the file at `path` with the O_* `flags`.
+	//   `mode` gives the permissions of a file created with O_CREAT.
+	Open(path string, flags, mode uint32) (File, error)
+	// Mkdir creates a directory.
+	Mkdir(path string, mode uint32) error
+	// Remove removes a file or an empty directory.
+	Remove(path string) error
+}
+
+// mount is a file system mounted at a directory.
+type mount struct {
+	dir string // absolute and clean
+	fs  FileSystem
+}
+
+// VFS is the tree of mounted file systems.
+type VFS struct {
+	sync.RWMutex
+	mounts []mount
+}
+
+// Mount mounts `fs` at the absolute directory `dir`, hiding whatever was
+// mounted there before.
+func (v *VFS) Mount(dir string, fs FileSystem) error {
+	if !path.IsAbs(dir) {
+		return EINVAL
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	dir = path.Clean(dir)
+	for i := range v.mounts {
+		if v.mounts[i].dir == dir {
+			v.mounts[i].fs = fs
+			return nil
+		}
+	}
+	v.mounts = append(v.mounts, mount{dir: dir, fs: fs})
+	return nil
+}
+
+// Unmount removes the file system mounted at `dir`.
+//   Files that are already open stay usable.
+func (v *VFS) Unmount(dir string) error {
+	v.Lock()
+	defer v.Unlock()
+	dir = path.Clean(dir)
+	for i := range v.mounts {
+		if v.mounts[i].dir == dir {
+			v.mounts = append(v.mounts[:i], v.mounts[i+1:]...)
+			return nil
+		}
+	}
+	return EINVAL
+}
+
+// resolve finds the file system that holds the absolute path `p`, and the path
+// relative to the root of that file system.
+func (v *VFS) resolve(p string) (FileSystem, string, error) {
+	if !path.IsAbs(p) {
+		return nil, "", EINVAL
+	}
+	// Clean removes every ".." that would climb above the root, so drivers
+	// never see a path that leaves their tree
+	p = path.Clean(p)
+
+	v.RLock()
+	defer v.RUnlock()
+
+	var best *mount
+	for i := range v.mounts {
+		m := &v.mounts[i]
+		if p != m.dir && m.dir != "/" && !strings.HasPrefix(p, m.dir+"/") {
+			continue
+		}
+		if best == nil || len(m.dir) > len(best.dir) {
+			best = m
+		}
+	}
+
+	if best == nil {
+		return nil, "", ENOENT
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, best.dir), "/")
+	if rel == "" {
+		rel = "."
+	}
+	return best.fs, rel, nil
+}
+
+// Open opens the file at the absolute path `p`.
+func (v *VFS) Open(p string, flags, mode uint32) (File, error) {
+	fs, rel, err := v.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Open(rel, flags, mode)
+}
+
+// Mkdir creates a directory at the absolute path `p`.
+func (v *VFS) Mkdir(p string, mode uint32) error {
+	fs, rel, err := v.resolve(p)
+	if err != nil {
+		return err
+	}
+	return fs.Mkdir(rel, mode)
+}
+
+// Remove removes the file or empty directory at the absolute path `p`.
+func (v *VFS) Remove(p string) error {
+	fs, rel, err := v.resolve(p)
+	if err != nil {
+		return err
+	}
+	return fs.Remove(rel)
+}
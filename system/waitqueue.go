@@ -0,0 +1,94 @@
+// This file contains wait queues, which is how processes wait for something
+// to happen without keeping a core busy.
+//   A process that has to wait is put to sleep on a queue and the core moves
+// on to another process.
+//   Whoever makes the awaited thing happen wakes the queue, which makes the
+// sleeping processes ready again.
+//   A woken process retries the syscall it was sleeping in, so syscalls that
+// sleep must not have had any side-effects before they decide to.
+
+package system
+
+import (
+	"gotos/cpu"
+	"sync"
+)
+
+// WaitQueue is a queue of sleeping processes.
+//   The zero value is an empty queue.
+type WaitQueue struct {
+	mu         sync.Mutex
+	generation uint64 // incremented by every wake-up
+	sleepers   []*PCB
+}
+
+// wouldBlock is the error returned by a file operation that can not complete
+// until `queue` is woken.
+//   `generation` is the generation of the queue when the file decided to
+// block; if the queue has been woken since, sleeping is pointless.
+type wouldBlock struct {
+	queue      *WaitQueue
+	generation uint64
+}
+
+func (w wouldBlock) Error() string {
+	return "operation would block"
+}
+
+// wouldBlock returns the error a file operation returns when it has to wait
+// for the queue.
+//   It must be called while holding whatever lock protects the condition
+// being waited for, and that lock must also be held when the queue is woken.
+func (q *WaitQueue) wouldBlock() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return wouldBlock{queue: q, generation: q.generation}
+}
+
+// sleep puts the process running on `c` to sleep on the queue given by `err`,
+// and moves the core on to another process.
+//   The process is left so that it repeats the syscall once it is woken.
+//   Returns false if `err` is not a `wouldBlock`.
+func (s *System) sleep(c *cpu.Core, err error) bool {
+	w, ok := err.(wouldBlock)
+	if !ok {
+		return false
+	}
+
+	q := w.queue
+	q.mu.Lock()
+	if q.generation != w.generation {
+		// woken after the file gave up; just retry the syscall
+		q.mu.Unlock()
+		return true
+	}
+
+	pcb := s.current(c)
+	c.FENCE() // other cores must see what the process wrote
+	s.save(c, pcb)
+	q.sleepers = append(q.sleepers, pcb)
+
+	s.idle.Lock()
+	s.idle.blocked++
+	s.idle.Unlock()
+	q.mu.Unlock()
+
+	s.runNext(c)
+	return true
+}
+
+// wake makes every process sleeping on `q` ready.
+func (s *System) wake(q *WaitQueue) {
+	q.mu.Lock()
+	q.generation++
+	sleepers := q.sleepers
+	q.sleepers = nil
+	q.mu.Unlock()
+
+	s.idle.Lock()
+	for _, pcb := range sleepers {
+		s.idle.blocked--
+		s.readyLocked(pcb)
+	}
+	s.idle.Unlock()
+}